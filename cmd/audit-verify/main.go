@@ -0,0 +1,60 @@
+// Command audit-verify checks the hash chain of a proxy audit log and
+// prints a JSON report. It exits 1 if any record was altered, removed or
+// reordered, or if an earlier head given with -head is no longer present.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+
+	"github.com/fdo-server-wrapper/internal/audit"
+)
+
+func main() {
+	var (
+		logPath string
+		keyPath string
+		head    string
+	)
+	flag.StringVar(&logPath, "log", "", "Audit log to verify (the proxy's -audit-log)")
+	flag.StringVar(&keyPath, "key", "", "File holding the HMAC key the log was written with (the proxy's -audit-key)")
+	flag.StringVar(&head, "head", "", "Head hash reported by an earlier verification, to detect records removed from the end")
+	flag.Parse()
+
+	if logPath == "" {
+		slog.Error("-log is required")
+		os.Exit(2)
+	}
+
+	opts := audit.VerifyOptions{Head: head}
+	if keyPath != "" {
+		key, err := audit.ReadKey(keyPath)
+		if err != nil {
+			slog.Error("Failed to read audit key", "error", err)
+			os.Exit(1)
+		}
+		opts.Key = key
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		slog.Error("Failed to open audit log", "error", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	report, err := audit.Verify(f, opts)
+	if err != nil {
+		slog.Error("Audit log verification failed", "error", err)
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.Valid() {
+		os.Exit(1)
+	}
+}
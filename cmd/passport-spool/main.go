@@ -0,0 +1,92 @@
+// Command passport-spool uploads the commissioning passports an offline
+// proxy spooled with the "file" passport backend, once the spool has been
+// carried to a machine that can reach the passport service.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+func main() {
+	var (
+		spoolDir            string
+		ledgerBackend       string
+		ledgerBackendConfig string
+		commissioningURL    string
+		timeout             time.Duration
+		dryRun              bool
+		debug               bool
+	)
+	flag.StringVar(&spoolDir, "spool", "", "Spool directory to export (the file backend's commissioning_dir)")
+	flag.StringVar(&ledgerBackend, "ledger-backend", "rest", "Passport backend to upload to: "+strings.Join(ledger.Backends(), ", "))
+	flag.StringVar(&ledgerBackendConfig, "ledger-backend-config", "", "JSON file configuring the passport backend (rest defaults to -commissioning-url)")
+	flag.StringVar(&commissioningURL, "commissioning-url", "", "URL for commissioning passport creation, for the rest backend without a config file")
+	flag.DurationVar(&timeout, "timeout", 0, "Give up on the export after this long (default: no limit)")
+	flag.BoolVar(&dryRun, "dry-run", false, "List what would be uploaded without sending or moving anything")
+	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
+	flag.Parse()
+
+	if debug {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+	if spoolDir == "" {
+		slog.Error("-spool is required")
+		os.Exit(2)
+	}
+
+	var sender ledger.CommissioningSender
+	switch {
+	case dryRun:
+	case ledgerBackendConfig != "":
+		config, err := os.ReadFile(ledgerBackendConfig)
+		if err != nil {
+			slog.Error("Failed to read passport backend config", "error", err)
+			os.Exit(1)
+		}
+		if sender, err = ledger.OpenBackend(ledgerBackend, config); err != nil {
+			slog.Error("Passport backend init failed", "error", err)
+			os.Exit(1)
+		}
+	case ledgerBackend == "rest" && commissioningURL != "":
+		c, err := ledger.RESTConfig{CommissioningURL: commissioningURL}.Open()
+		if err != nil {
+			slog.Error("Passport client init failed", "error", err)
+			os.Exit(1)
+		}
+		sender = c
+	default:
+		slog.Error("Need -commissioning-url or -ledger-backend-config to upload to")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	report, err := ledger.ExportSpool(ctx, spoolDir, sender, dryRun)
+	if err != nil {
+		slog.Error("Spool export failed", "error", err)
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/config"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/middleware"
+	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/trace"
+)
+
+// proxyConfig is the proxy's configuration, from the command line, the
+// environment and the configuration file.
+type proxyConfig struct {
+	fs   *flag.FlagSet
+	path string // configuration file, "" if none
+
+	serverSettings
+	pipelineSettings
+}
+
+// serverSettings need a restart to change: the listeners and their TLS,
+// the backend, tracing, the audit log and the commissioning outbox.
+type serverSettings struct {
+	// Proxy server flags
+	listenAddr      string
+	adminAddr       string
+	shutdownTimeout time.Duration
+
+	// Listener TLS flags
+	tlsCertPath     string
+	tlsKeyPath      string
+	tlsMinVersion   string
+	tlsCipherSuites string
+	tlsClientAuth   string
+	tlsClientCAPath string
+
+	// Backend flags
+	backendURL          string
+	backendCACertPath   string
+	backendProbePath    string
+	backendReadyTimeout time.Duration
+	backendHealthEvery  time.Duration
+	backendMaxBackoff   time.Duration
+	backendStopTimeout  time.Duration
+	fdoPath             string
+	fdoSubcommand       string
+	fdoWorkDir          string
+	fdoDBPath           string
+	fdoListenAddr       string
+	fdoEnv              envList
+	fdoLogPath          string
+
+	// Commissioning outbox flags
+	commissioningOutbox   string
+	commissioningAttempts int
+
+	// Tracing flags
+	traceExporter    string
+	traceFile        string
+	traceEndpoint    string
+	traceServiceName string
+
+	// Audit flags
+	auditLogPath string
+	auditKeyPath string
+
+	// Debug flag
+	debug bool
+}
+
+// pipelineSettings are applied by a reload: the passport client and the
+// middleware using it.
+type pipelineSettings struct {
+	// Passport service flags
+	ledgerBackend          string
+	ledgerBackendConfig    string
+	productPassportBaseURL string
+	commissioningCreateURL string
+	caCertPath             string
+	clientCertPath         string
+	clientKeyPath          string
+	certCheckInterval      time.Duration
+	certExpiryWarning      time.Duration
+	enableProductPassport  bool
+	productIDField         string
+	ownerID                string
+	deployedLocation       string
+	deployedLocationMap    string
+	deployedLocationHeader string
+
+	// Ledger resilience flags
+	ledgerRetryAttempts   int
+	productTimeout        time.Duration
+	commissioningTimeout  time.Duration
+	ledgerBreakerFailures int
+	ledgerBreakerCooldown time.Duration
+
+	// Passport cache flags
+	passportCacheTTL         time.Duration
+	passportCacheNegativeTTL time.Duration
+	passportCacheSize        int
+
+	// Passport policy flags
+	requireProductPassport bool
+	passportSchemaVersions string
+	passportDescriptor     string
+	passportMatchBoardSN   bool
+	passportTrustStore     string
+}
+
+// envList is a repeatable KEY=VALUE flag
+type envList []string
+
+func (l *envList) String() string { return strings.Join(*l, ",") }
+
+func (l *envList) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("expected KEY=VALUE, got %q", v)
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// loadConfig reads the configuration from args, the environment and the
+// file named by -config or FDO_PROXY_CONFIG.
+func loadConfig(args []string, errorHandling flag.ErrorHandling) (*proxyConfig, error) {
+	c := &proxyConfig{fs: flag.NewFlagSet(os.Args[0], errorHandling)}
+	c.fs.StringVar(&c.path, "config", "", "JSON configuration file keyed by flag name; also read from "+config.EnvName("config"))
+	c.serverSettings.register(c.fs)
+	c.pipelineSettings.register(c.fs)
+
+	path, err := config.Load(c.fs, args, "config")
+	if err != nil {
+		return nil, err
+	}
+	c.path = path
+	return c, nil
+}
+
+func (s *serverSettings) register(fs *flag.FlagSet) {
+	// Proxy server flags
+	fs.StringVar(&s.listenAddr, "listen", "localhost:8080", "Address to listen on")
+	fs.DurationVar(&s.shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for active FDO sessions to finish on shutdown")
+	fs.StringVar(&s.adminAddr, "admin-listen", "", "Address for the admin API, kept off the device-facing port (e.g. 127.0.0.1:9090; default: disabled)")
+
+	// Listener TLS flags
+	fs.StringVar(&s.tlsCertPath, "tls-cert", "", "Path to the certificate chain PEM served to devices; with -tls-key the listener uses TLS (default: plain HTTP)")
+	fs.StringVar(&s.tlsKeyPath, "tls-key", "", "Path to the private key PEM for -tls-cert")
+	fs.StringVar(&s.tlsMinVersion, "tls-min-version", "1.2", "Minimum TLS version accepted from devices: 1.2 or 1.3")
+	fs.StringVar(&s.tlsCipherSuites, "tls-cipher-suites", "", "Comma-separated TLS 1.2 cipher suites, by Go name (e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256; default: Go's secure defaults)")
+	fs.StringVar(&s.tlsClientAuth, "tls-client-auth", proxy.ClientAuthNone, "Device client certificates: none, request (verified if presented) or require")
+	fs.StringVar(&s.tlsClientCAPath, "tls-client-ca", "", "Path to CA cert PEM device client certificates are verified against")
+
+	// Backend connection and health flags
+	fs.StringVar(&s.backendURL, "backend-url", "", "URL of an already running go-fdo server; when set no backend process is started")
+	fs.StringVar(&s.backendCACertPath, "backend-ca-cert", "", "Path to CA cert PEM for an https backend URL")
+	fs.StringVar(&s.backendProbePath, "backend-probe-path", "/", "Path requested to check the backend is ready and healthy")
+	fs.DurationVar(&s.backendReadyTimeout, "backend-ready-timeout", proxy.DefaultBackendReadyTimeout, "How long to wait for the backend to answer at startup and after each restart")
+	fs.DurationVar(&s.backendHealthEvery, "backend-health-interval", proxy.DefaultBackendHealthInterval, "How often the ready backend is health checked")
+	fs.DurationVar(&s.backendMaxBackoff, "backend-max-backoff", proxy.DefaultBackendMaxBackoff, "Upper bound on the delay between backend restarts")
+	fs.DurationVar(&s.backendStopTimeout, "backend-stop-timeout", proxy.DefaultBackendStopTimeout, "How long the backend has to exit after SIGTERM before it is killed")
+
+	// Backend flags; arguments after the flags (or after --) are passed to the backend
+	fs.StringVar(&s.fdoPath, "fdo-path", "../go-fdo", "Path to the fdo-server binary, or to a go-fdo checkout containing it")
+	fs.StringVar(&s.fdoSubcommand, "fdo-subcommand", proxy.DefaultBackendSubcommand, "Subcommand passed to the backend binary (empty for none)")
+	fs.StringVar(&s.fdoWorkDir, "fdo-workdir", "", "Working directory for the backend process (default: current directory)")
+	fs.StringVar(&s.fdoDBPath, "fdo-db", proxy.DefaultBackendDB, "Backend database path, passed as -db")
+	fs.StringVar(&s.fdoListenAddr, "fdo-listen", proxy.DefaultBackendListenAddr, "Address the backend listens on, passed as -http")
+	fs.Var(&s.fdoEnv, "fdo-env", "KEY=VALUE environment variable for the backend (repeatable)")
+	fs.StringVar(&s.fdoLogPath, "fdo-log", "", "File receiving backend stdout/stderr (default: proxy stdout/stderr)")
+
+	// Commissioning outbox flags
+	fs.StringVar(&s.commissioningOutbox, "commissioning-outbox", "", "Directory for a durable outbox of commissioning passports, delivered in the background with retries (default: create inline)")
+	fs.IntVar(&s.commissioningAttempts, "commissioning-max-attempts", ledger.DefaultOutboxMaxAttempts, "Delivery attempts before an outbox item is moved to failed/")
+
+	// Tracing flags
+	fs.StringVar(&s.traceExporter, "trace-exporter", "none", "Where spans are exported: none, stdout, file (OTLP/JSON lines) or otlp (OTLP/HTTP collector)")
+	fs.StringVar(&s.traceFile, "trace-file", "fdo-proxy-traces.jsonl", "File appended to with -trace-exporter file")
+	fs.StringVar(&s.traceEndpoint, "trace-endpoint", trace.DefaultOTLPEndpoint, "Collector OTLP/HTTP traces URL for -trace-exporter otlp")
+	fs.StringVar(&s.traceServiceName, "trace-service-name", "fdo-proxy", "service.name reported with exported spans")
+
+	// Audit flags
+	fs.StringVar(&s.auditLogPath, "audit-log", "", "JSON-lines file recording onboarding events in a hash chain (default: disabled)")
+	fs.StringVar(&s.auditKeyPath, "audit-key", "", "File holding a secret key; audit records are chained with HMAC-SHA256 under it instead of SHA-256")
+
+	// Debug flag
+	fs.BoolVar(&s.debug, "debug", false, "Enable debug logging")
+}
+
+func (s *pipelineSettings) register(fs *flag.FlagSet) {
+	// Passport service flags
+	fs.StringVar(&s.ledgerBackend, "ledger-backend", "rest", "Passport backend: "+strings.Join(ledger.Backends(), ", "))
+	fs.StringVar(&s.ledgerBackendConfig, "ledger-backend-config", "", "JSON file configuring the passport backend (rest defaults to -product-base-url, -commissioning-url and the mTLS flags)")
+	fs.StringVar(&s.productPassportBaseURL, "product-base-url", "", "Base URL for product item passport service (e.g., https://cmulk1.cymanii.org:8443)")
+	fs.StringVar(&s.commissioningCreateURL, "commissioning-url", "", "URL for commissioning passport creation (e.g., http://cmulk1.cymanii.org:8000/create-commissioning-passport)")
+	fs.StringVar(&s.caCertPath, "ca-cert", "", "Path to CA cert PEM for product passport mTLS")
+	fs.StringVar(&s.clientCertPath, "client-cert", "", "Path to client cert PEM for product passport mTLS")
+	fs.StringVar(&s.clientKeyPath, "client-key", "", "Path to client key PEM for product passport mTLS")
+	fs.DurationVar(&s.certCheckInterval, "client-cert-check-interval", ledger.DefaultCertCheckInterval, "How often the mTLS files are checked for rotated certificates while lookups are made")
+	fs.DurationVar(&s.certExpiryWarning, "client-cert-expiry-warning", ledger.DefaultCertExpiryWarning, "How long before the mTLS client or CA certificate expires that warnings are logged")
+	fs.BoolVar(&s.enableProductPassport, "enable-product-passport", false, "Enable product item passport lookup during DI")
+	fs.StringVar(&s.productIDField, "product-id-field", string(fdo.MfgInfoSerialNumber), "DeviceMfgInfo field used as the product passport UUID (serial, device-info, csr-cn)")
+	fs.StringVar(&s.ownerID, "owner-id", "", "Owner ID for commissioning passports")
+	fs.StringVar(&s.deployedLocation, "deployed-location", "", "Deployment location recorded in commissioning passports when no other source has one")
+	fs.StringVar(&s.deployedLocationMap, "deployed-location-map", "", "JSON file mapping owner key SHA-256 fingerprints or owner IDs to deployment locations")
+	fs.StringVar(&s.deployedLocationHeader, "deployed-location-header", "", "Request header a site gateway sets to the deployment location (e.g. "+middleware.DefaultLocationHeader+"; default: ignored)")
+
+	// Ledger resilience flags
+	fs.IntVar(&s.ledgerRetryAttempts, "ledger-retry-attempts", ledger.DefaultRetryAttempts, "Attempts per passport service call, retrying 429/502/503/504 and transient network errors")
+	fs.DurationVar(&s.productTimeout, "product-timeout", ledger.DefaultProductTimeout, "Timeout for each product passport lookup attempt")
+	fs.DurationVar(&s.commissioningTimeout, "commissioning-timeout", ledger.DefaultCommissioningTimeout, "Timeout for each commissioning passport attempt")
+	fs.IntVar(&s.ledgerBreakerFailures, "ledger-breaker-failures", ledger.DefaultBreakerFailures, "Consecutive failed attempts that open an endpoint's circuit breaker")
+	fs.DurationVar(&s.ledgerBreakerCooldown, "ledger-breaker-cooldown", ledger.DefaultBreakerCooldown, "How long an open circuit breaker fails calls before probing the service again")
+
+	// Passport cache flags
+	fs.DurationVar(&s.passportCacheTTL, "passport-cache-ttl", ledger.DefaultCacheTTL, "How long fetched product passports are cached (0 disables the cache)")
+	fs.DurationVar(&s.passportCacheNegativeTTL, "passport-cache-negative-ttl", ledger.DefaultCacheNegativeTTL, "How long a product UUID without a passport (404) is cached")
+	fs.IntVar(&s.passportCacheSize, "passport-cache-size", ledger.DefaultCacheMaxEntries, "Maximum number of cached product passport lookups")
+
+	// Passport policy flags
+	fs.BoolVar(&s.requireProductPassport, "require-product-passport", false, "Reject DI.AppStart unless the device has a signed product passport passing the checks below")
+	fs.StringVar(&s.passportSchemaVersions, "passport-schema-versions", "", "Comma-separated passport schema_version values accepted with -require-product-passport (default: any)")
+	fs.StringVar(&s.passportDescriptor, "passport-descriptor", middleware.DefaultPassportDescriptor, "Record descriptor a passport must contain with -require-product-passport (empty to skip)")
+	fs.BoolVar(&s.passportMatchBoardSN, "passport-match-board-sn", false, "With -require-product-passport, require metadata.board_sn to match the device serial number")
+	fs.StringVar(&s.passportTrustStore, "passport-trust-store", "", "Directory of issuer and agent public keys used to verify passport signatures (issuers/*.pem, agents/<agent-uuid>.pem); enforced with -require-product-passport")
+}
+
+// keepServerSettings carries the settings that need a restart over from
+// the running configuration, warning about those the new one changes.
+func (c *proxyConfig) keepServerSettings(running *proxyConfig) {
+	var changed []string
+	names := flag.NewFlagSet("", flag.ContinueOnError)
+	new(serverSettings).register(names)
+	names.VisitAll(func(f *flag.Flag) {
+		if c.fs.Lookup(f.Name).Value.String() != running.fs.Lookup(f.Name).Value.String() {
+			changed = append(changed, f.Name)
+		}
+	})
+	if len(changed) > 0 {
+		slog.Warn("Settings changed that need a restart, keeping the running values", "settings", changed)
+	}
+	c.serverSettings = running.serverSettings
+}
@@ -2,94 +2,130 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/fdo-server-wrapper/internal/admin"
+	"github.com/fdo-server-wrapper/internal/audit"
 	"github.com/fdo-server-wrapper/internal/ledger"
-	"github.com/fdo-server-wrapper/internal/middleware"
+	"github.com/fdo-server-wrapper/internal/metrics"
 	"github.com/fdo-server-wrapper/internal/proxy"
+	"github.com/fdo-server-wrapper/internal/trace"
 )
 
-var (
-	// Proxy server flags
-	listenAddr string
-	fdoPath    string
-
-	// Passport service flags
-	productPassportBaseURL string
-	commissioningCreateURL string
-	caCertPath             string
-	clientCertPath         string
-	clientKeyPath          string
-	enableProductPassport  bool
-	ownerID                string
-
-	// Debug flag
-	debug bool
-)
-
-func init() {
-	// Proxy server flags
-	flag.StringVar(&listenAddr, "listen", "localhost:8080", "Address to listen on")
-	flag.StringVar(&fdoPath, "fdo-path", "../go-fdo", "Path to go-fdo repository")
-
-	// Passport service flags
-	flag.StringVar(&productPassportBaseURL, "product-base-url", "", "Base URL for product item passport service (e.g., https://cmulk1.cymanii.org:8443)")
-	flag.StringVar(&commissioningCreateURL, "commissioning-url", "", "URL for commissioning passport creation (e.g., http://cmulk1.cymanii.org:8000/create-commissioning-passport)")
-	flag.StringVar(&caCertPath, "ca-cert", "", "Path to CA cert PEM for product passport mTLS")
-	flag.StringVar(&clientCertPath, "client-cert", "", "Path to client cert PEM for product passport mTLS")
-	flag.StringVar(&clientKeyPath, "client-key", "", "Path to client key PEM for product passport mTLS")
-	flag.BoolVar(&enableProductPassport, "enable-product-passport", false, "Enable product item passport lookup during DI")
-	flag.StringVar(&ownerID, "owner-id", "", "Owner ID for commissioning passports")
-
-	// Debug flag
-	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
-}
+// version is set at link time with -ldflags "-X main.version=...".
+var version string
 
 func main() {
-	flag.Parse()
+	cfg, err := loadConfig(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	// Setup logging
-	if debug {
+	if cfg.debug {
 		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
 	}
+	if cfg.path != "" {
+		slog.Info("Configuration file loaded", "path", cfg.path)
+	}
 
-	// Initialize passport client if configured
-	var ledgerClient proxy.LedgerClient
-	if productPassportBaseURL != "" || commissioningCreateURL != "" {
-		c, err := ledger.NewClient(productPassportBaseURL, commissioningCreateURL, caCertPath, clientCertPath, clientKeyPath)
-		if err != nil {
-			slog.Warn("Passport client init failed", "error", err)
-		} else {
-			ledgerClient = c
-			slog.Info("Passport client initialized", "product_base", productPassportBaseURL, "commissioning_url", commissioningCreateURL)
-		}
-	} else {
-		slog.Warn("Passport client not configured - functionality will be disabled")
+	// Setup tracing
+	tracer, traceOut, err := openTracer(cfg)
+	if err != nil {
+		slog.Error("Tracing init failed", "error", err)
+		os.Exit(1)
+	}
+	if tracer != nil {
+		trace.SetDefault(tracer)
+		slog.Info("Tracing enabled", "exporter", cfg.traceExporter)
 	}
 
-	// Create middleware
-	var middlewareList []proxy.Middleware
+	// Open the audit log
+	auditLog, err := openAuditLog(cfg)
+	if err != nil {
+		slog.Error("Audit log init failed", "error", err)
+		os.Exit(1)
+	}
+	if auditLog != nil {
+		seq, head := auditLog.Head()
+		slog.Info("Audit log opened", "path", cfg.auditLogPath, "keyed", cfg.auditKeyPath != "", "seq", seq, "head", head)
+	}
 
-	// Add DI middleware if product passport is enabled
-	if enableProductPassport {
-		diMiddleware := middleware.NewDIMiddleware(ledgerClient, enableProductPassport)
-		middlewareList = append(middlewareList, diMiddleware)
-		slog.Info("DI middleware enabled for product passport")
+	// Open the commissioning outbox; it delivers through the passport
+	// client of the current pipeline, set below and on every reload
+	var outbox *ledger.Outbox
+	if cfg.commissioningOutbox != "" {
+		outbox, err = ledger.NewOutbox(nil, ledger.OutboxConfig{
+			Dir:         cfg.commissioningOutbox,
+			MaxAttempts: cfg.commissioningAttempts,
+			Audit:       auditLog,
+		})
+		if err != nil {
+			slog.Error("Failed to open commissioning outbox", "error", err)
+			os.Exit(1)
+		}
 	}
 
-	// Add TO2 middleware if owner ID is provided
-	if ownerID != "" {
-		to2Middleware := middleware.NewTO2Middleware(ledgerClient, ownerID)
-		middlewareList = append(middlewareList, to2Middleware)
-		slog.Info("TO2 middleware enabled for commissioning passport", "owner_id", ownerID)
+	// Create the passport client and middleware
+	pipe, err := buildPipeline(cfg, auditLog, outbox, nil)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	if outbox != nil {
+		outbox.SetSender(pipe.ledgerClient)
+		slog.Info("Commissioning outbox opened",
+			"dir", cfg.commissioningOutbox,
+			"pending", len(outbox.Pending()),
+			"failed", len(outbox.Failed()))
 	}
 
 	// Create and start proxy
-	proxy := proxy.NewFDOProxy(fdoPath, nil, listenAddr, ledgerClient, middlewareList)
+	backend := proxy.BackendConfig{
+		URL:            cfg.backendURL,
+		CACertPath:     cfg.backendCACertPath,
+		ProbePath:      cfg.backendProbePath,
+		ReadyTimeout:   cfg.backendReadyTimeout,
+		HealthInterval: cfg.backendHealthEvery,
+		MaxBackoff:     cfg.backendMaxBackoff,
+		StopTimeout:    cfg.backendStopTimeout,
+		BinaryPath:     cfg.fdoPath,
+		Subcommand:     cfg.fdoSubcommand,
+		WorkDir:        cfg.fdoWorkDir,
+		DBPath:         cfg.fdoDBPath,
+		ListenAddr:     cfg.fdoListenAddr,
+		Args:           cfg.fs.Args(),
+		Env:            cfg.fdoEnv,
+		LogPath:        cfg.fdoLogPath,
+	}
+	if backend.External() && cfg.fs.NArg() > 0 {
+		slog.Warn("Backend arguments ignored with -backend-url", "args", cfg.fs.Args())
+	}
+	var proxyOptions []proxy.Option
+	tlsConfig, err := listenerTLS(cfg)
+	if err != nil {
+		slog.Error("Listener TLS init failed", "error", err)
+		os.Exit(1)
+	}
+	if tlsConfig != nil {
+		proxyOptions = append(proxyOptions, proxy.WithTLS(tlsConfig))
+		slog.Info("Listener TLS enabled",
+			"min_version", cfg.tlsMinVersion,
+			"client_auth", cfg.tlsClientAuth)
+	}
+	proxy := proxy.NewFDOProxy(backend, cfg.listenAddr, pipe.ledgerClient, pipe.middleware, proxyOptions...)
+	reloader := &reloader{args: os.Args[1:], auditLog: auditLog, outbox: outbox, proxy: proxy}
+	reloader.config.Store(cfg)
+	reloader.pipeline.Store(pipe)
 
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -99,16 +135,162 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// Reload the configuration on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 	go func() {
-		<-sigChan
-		slog.Info("Shutdown signal received, stopping proxy...")
-		cancel()
+		for range hupChan {
+			slog.Info("Reload signal received, reloading configuration...")
+			if err := reloader.reload(); err != nil {
+				slog.Error("Configuration rejected, keeping the running one", "error", err)
+				continue
+			}
+			slog.Info("Configuration reloaded")
+		}
 	}()
 
+	// Deliver queued commissioning passports in the background
+	if outbox != nil {
+		go outbox.Run(ctx)
+	}
+
 	// Start the proxy
-	slog.Info("Starting FDO proxy server", "listen_addr", listenAddr)
-	if err := proxy.Start(ctx, listenAddr); err != nil {
+	slog.Info("Starting FDO proxy server", "listen_addr", cfg.listenAddr)
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- proxy.Start(ctx, cfg.listenAddr)
+	}()
+
+	// Start the admin API
+	var adminServer *admin.Server
+	if cfg.adminAddr != "" {
+		adminServer = admin.NewServer(cfg.adminAddr)
+		adminServer.Handle("/livez", admin.LivenessHandler())
+		adminServer.Handle("/readyz", admin.ReadinessHandler(admin.BackendCheck(proxy), admin.LedgerCheck(proxy)))
+		adminServer.Handle("/buildinfo", admin.BuildInfoHandler(admin.ReadBuildInfo(version)))
+		adminServer.Handle("/config", admin.ConfigHandler(reloader.flags, "fdo-env"))
+		adminServer.Handle("/sessions", admin.SessionsHandler(proxy.Sessions()))
+		adminServer.Handle("/middleware", admin.MiddlewareHandler(proxy))
+		adminServer.Handle("/metrics", metrics.Default.Handler())
+		if outbox != nil {
+			adminServer.Handle("/outbox", admin.OutboxHandler(outbox))
+			adminServer.Handle("/outbox/", admin.OutboxHandler(outbox))
+		}
+		adminServer.Handle("/cache/passports", admin.CurrentCache(reloader.cache, admin.PassportCacheHandler))
+		adminServer.Handle("/cache/passports/prefetch", admin.CurrentCache(reloader.cache, admin.PrefetchHandler))
+		go func() {
+			if err := adminServer.Start(); err != nil {
+				errChan <- fmt.Errorf("admin server: %w", err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-errChan:
 		slog.Error("Proxy server error", "error", err)
+		if stopErr := proxy.Stop(context.Background()); stopErr != nil {
+			slog.Error("Shutdown incomplete", "error", stopErr)
+		}
 		os.Exit(1)
+	case sig := <-sigChan:
+		slog.Info("Shutdown signal received, draining proxy...", "signal", sig.String(), "timeout", cfg.shutdownTimeout)
+	}
+	signal.Stop(hupChan)
+
+	// A second signal abandons the drain
+	go func() {
+		<-sigChan
+		slog.Warn("Second shutdown signal received, exiting immediately")
+		os.Exit(1)
+	}()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer shutdownCancel()
+	stopErr := proxy.Stop(shutdownCtx)
+
+	// The rest gets its own budget so a drain that timed out does not cut it short
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer closeCancel()
+	if adminServer != nil {
+		if err := adminServer.Shutdown(closeCtx); err != nil {
+			stopErr = errors.Join(stopErr, fmt.Errorf("admin server: %w", err))
+		}
+	}
+	if tracer != nil {
+		if err := tracer.Shutdown(closeCtx); err != nil {
+			stopErr = errors.Join(stopErr, fmt.Errorf("tracing: %w", err))
+		}
+		if traceOut != nil {
+			traceOut.Close()
+		}
+	}
+	if err := auditLog.Close(); err != nil {
+		stopErr = errors.Join(stopErr, fmt.Errorf("audit log: %w", err))
+	}
+	if stopErr != nil {
+		slog.Error("Shutdown incomplete", "error", stopErr)
+		os.Exit(1)
+	}
+	slog.Info("Proxy stopped cleanly")
+}
+
+// openTracer builds the tracer selected by the tracing flags, returning the
+// trace file to close after shutdown if one was opened. It returns a nil
+// tracer when tracing is off.
+func openTracer(cfg *proxyConfig) (*trace.Tracer, io.Closer, error) {
+	switch cfg.traceExporter {
+	case "", "none":
+		return nil, nil, nil
+	case "stdout":
+		return trace.NewTracer(trace.NewWriterExporter(os.Stdout, cfg.traceServiceName)), nil, nil
+	case "file":
+		f, err := os.OpenFile(cfg.traceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open trace file: %w", err)
+		}
+		return trace.NewTracer(trace.NewWriterExporter(f, cfg.traceServiceName)), f, nil
+	case "otlp":
+		return trace.NewTracer(trace.NewOTLPExporter(cfg.traceEndpoint, cfg.traceServiceName)), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown -trace-exporter %q", cfg.traceExporter)
+	}
+}
+
+// listenerTLS builds the device listener's TLS configuration from the
+// listener TLS flags. It returns nil when the listener serves plain HTTP.
+func listenerTLS(cfg *proxyConfig) (*tls.Config, error) {
+	if cfg.tlsCertPath == "" && cfg.tlsKeyPath == "" {
+		if cfg.tlsClientAuth != proxy.ClientAuthNone || cfg.tlsClientCAPath != "" {
+			return nil, errors.New("-tls-client-auth and -tls-client-ca need -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	return proxy.ListenerTLS{
+		CertPath:     cfg.tlsCertPath,
+		KeyPath:      cfg.tlsKeyPath,
+		MinVersion:   cfg.tlsMinVersion,
+		CipherSuites: cfg.tlsCipherSuites,
+		ClientAuth:   cfg.tlsClientAuth,
+		ClientCAPath: cfg.tlsClientCAPath,
+	}.Config()
+}
+
+// openAuditLog opens the log named by -audit-log, keyed with the contents
+// of -audit-key if set. It returns nil when auditing is off.
+func openAuditLog(cfg *proxyConfig) (*audit.Log, error) {
+	if cfg.auditLogPath == "" {
+		if cfg.auditKeyPath != "" {
+			return nil, errors.New("-audit-key needs -audit-log")
+		}
+		return nil, nil
+	}
+	var opts []audit.Option
+	if cfg.auditKeyPath != "" {
+		key, err := audit.ReadKey(cfg.auditKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, audit.WithKey(key))
 	}
+	return audit.Open(cfg.auditLogPath, opts...)
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fdo-server-wrapper/internal/audit"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/middleware"
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// pipeline is the part of the proxy a configuration reload replaces: the
+// passport client, its cache and the middleware using them.
+type pipeline struct {
+	ledgerClient proxy.LedgerClient
+	cache        *ledger.PassportCache
+	middleware   []proxy.Middleware
+
+	// source identifies where product passports come from. A reload keeps
+	// the cached passports while it and cacheConfig are unchanged.
+	source      string
+	cacheConfig ledger.CacheConfig
+}
+
+// buildPipeline builds the passport client and middleware cfg describes.
+// outbox is the commissioning outbox opened at startup, nil if there is
+// none. running is the pipeline being replaced, nil at startup; its cached
+// passports carry over when the passport source and cache settings are
+// unchanged. Nothing is installed, so an error leaves the running proxy as
+// it was.
+func buildPipeline(cfg *proxyConfig, auditLog *audit.Log, outbox *ledger.Outbox, running *pipeline) (*pipeline, error) {
+	p := &pipeline{}
+
+	// Initialize passport client if configured
+	switch {
+	case cfg.ledgerBackendConfig != "":
+		config, err := os.ReadFile(cfg.ledgerBackendConfig)
+		if err != nil {
+			return nil, fmt.Errorf("read passport backend config: %w", err)
+		}
+		api, err := ledger.OpenBackend(cfg.ledgerBackend, config)
+		if err != nil {
+			return nil, fmt.Errorf("passport backend: %w", err)
+		}
+		p.ledgerClient = api
+		p.source = cfg.ledgerBackend + "\x00" + string(config)
+		slog.Info("Passport backend initialized", "backend", cfg.ledgerBackend, "config", cfg.ledgerBackendConfig)
+	case cfg.ledgerBackend != "rest":
+		return nil, fmt.Errorf("-ledger-backend %s needs -ledger-backend-config", cfg.ledgerBackend)
+	case cfg.productPassportBaseURL != "" || cfg.commissioningCreateURL != "":
+		c, err := ledger.RESTConfig{
+			ProductBaseURL:       cfg.productPassportBaseURL,
+			CommissioningURL:     cfg.commissioningCreateURL,
+			CACert:               cfg.caCertPath,
+			ClientCert:           cfg.clientCertPath,
+			ClientKey:            cfg.clientKeyPath,
+			RetryAttempts:        cfg.ledgerRetryAttempts,
+			ProductTimeout:       ledger.Duration(cfg.productTimeout),
+			CommissioningTimeout: ledger.Duration(cfg.commissioningTimeout),
+			BreakerFailures:      cfg.ledgerBreakerFailures,
+			BreakerCooldown:      ledger.Duration(cfg.ledgerBreakerCooldown),
+			CertCheckInterval:    ledger.Duration(cfg.certCheckInterval),
+			CertExpiryWarning:    ledger.Duration(cfg.certExpiryWarning),
+		}.Open()
+		if err != nil {
+			return nil, fmt.Errorf("passport client: %w", err)
+		}
+		p.ledgerClient = c
+		p.source = "rest\x00" + cfg.productPassportBaseURL
+		slog.Info("Passport client initialized", "product_base", cfg.productPassportBaseURL, "commissioning_url", cfg.commissioningCreateURL)
+	default:
+		slog.Warn("Passport client not configured - functionality will be disabled")
+	}
+	if outbox != nil && p.ledgerClient == nil {
+		return nil, errors.New("-commissioning-outbox needs a passport backend (-commissioning-url or -ledger-backend-config)")
+	}
+
+	// Cache product passport lookups
+	if p.ledgerClient != nil && cfg.passportCacheTTL > 0 {
+		p.cacheConfig = ledger.CacheConfig{
+			TTL:         cfg.passportCacheTTL,
+			NegativeTTL: cfg.passportCacheNegativeTTL,
+			MaxEntries:  cfg.passportCacheSize,
+		}
+		if running != nil && running.cache != nil && running.source == p.source && running.cacheConfig == p.cacheConfig {
+			p.cache = running.cache.WithBackend(p.ledgerClient)
+			slog.Info("Product passport cache kept", "entries", p.cache.Stats().Entries)
+		} else {
+			p.cache = ledger.NewPassportCache(p.ledgerClient, p.cacheConfig)
+			slog.Info("Product passport cache enabled",
+				"ttl", cfg.passportCacheTTL,
+				"negative_ttl", cfg.passportCacheNegativeTTL,
+				"max_entries", cfg.passportCacheSize)
+		}
+		p.ledgerClient = p.cache
+	}
+
+	// Audit first, so it sees messages other middleware reject
+	if auditLog != nil {
+		p.middleware = append(p.middleware, middleware.NewAuditMiddleware(auditLog))
+	}
+
+	// Add DI middleware if product passport is enabled
+	if cfg.enableProductPassport || cfg.requireProductPassport {
+		field, err := fdo.ParseMfgInfoField(cfg.productIDField)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -product-id-field: %w", err)
+		}
+		diOptions := []middleware.DIOption{middleware.WithProductIDField(field), middleware.WithPassportAudit(auditLog)}
+		if cfg.passportTrustStore != "" {
+			trust, err := ledger.LoadTrustStore(cfg.passportTrustStore)
+			if err != nil {
+				return nil, fmt.Errorf("load passport trust store: %w", err)
+			}
+			diOptions = append(diOptions, middleware.WithPassportVerifier(ledger.NewVerifier(trust)))
+			slog.Info("Passport signature verification enabled",
+				"issuers", len(trust.Issuers),
+				"agents", len(trust.Agents),
+				"enforced", cfg.requireProductPassport)
+		}
+		if cfg.requireProductPassport {
+			if cfg.productPassportBaseURL == "" && cfg.ledgerBackendConfig == "" {
+				return nil, errors.New("-require-product-passport needs a passport backend (-product-base-url or -ledger-backend-config)")
+			}
+			policy, err := passportPolicy(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid passport policy: %w", err)
+			}
+			diOptions = append(diOptions, middleware.WithPassportPolicy(policy))
+			slog.Info("Product passport required for DI",
+				"schema_versions", policy.SchemaVersions,
+				"descriptor", policy.Descriptor,
+				"match_board_sn", policy.MatchBoardSerial)
+		}
+		diMiddleware := middleware.NewDIMiddleware(p.ledgerClient, cfg.enableProductPassport, diOptions...)
+		p.middleware = append(p.middleware, diMiddleware)
+		slog.Info("DI middleware enabled for product passport", "product_id_field", field)
+	}
+
+	// Add TO2 middleware if owner ID is provided
+	if cfg.ownerID != "" {
+		to2Options := []middleware.TO2Option{middleware.WithCommissioningAudit(auditLog)}
+		if outbox != nil {
+			to2Options = append(to2Options, middleware.WithCommissioningOutbox(outbox))
+		}
+		if cfg.deployedLocation != "" || cfg.deployedLocationMap != "" || cfg.deployedLocationHeader != "" {
+			src := middleware.LocationSource{Header: cfg.deployedLocationHeader, Static: cfg.deployedLocation}
+			if cfg.deployedLocationMap != "" {
+				m, err := middleware.LoadLocationMap(cfg.deployedLocationMap)
+				if err != nil {
+					return nil, fmt.Errorf("load deployment location map: %w", err)
+				}
+				src.ByOwner = m
+			}
+			to2Options = append(to2Options, middleware.WithDeployedLocation(src))
+			slog.Info("Commissioning passports record deployment location",
+				"header", cfg.deployedLocationHeader,
+				"owners_mapped", len(src.ByOwner),
+				"static", cfg.deployedLocation)
+		}
+		to2Middleware := middleware.NewTO2Middleware(p.ledgerClient, cfg.ownerID, to2Options...)
+		p.middleware = append(p.middleware, to2Middleware)
+		slog.Info("TO2 middleware enabled for commissioning passport", "owner_id", cfg.ownerID)
+	}
+
+	return p, nil
+}
+
+// passportPolicy builds the DI passport policy from the policy flags.
+func passportPolicy(cfg *proxyConfig) (middleware.PassportPolicy, error) {
+	policy := middleware.PassportPolicy{
+		Descriptor:       cfg.passportDescriptor,
+		MatchBoardSerial: cfg.passportMatchBoardSN,
+	}
+	for _, v := range strings.Split(cfg.passportSchemaVersions, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return policy, fmt.Errorf("invalid schema version %q: %w", v, err)
+		}
+		policy.SchemaVersions = append(policy.SchemaVersions, f)
+	}
+	return policy, nil
+}
+
+// reloader rebuilds the pipeline from the configuration on SIGHUP.
+type reloader struct {
+	args     []string
+	auditLog *audit.Log
+	outbox   *ledger.Outbox
+	proxy    *proxy.FDOProxy
+
+	config   atomic.Pointer[proxyConfig]
+	pipeline atomic.Pointer[pipeline]
+}
+
+// reload reads the configuration again and installs the pipeline it
+// describes. An invalid configuration is rejected with the running
+// pipeline left in place. Settings that need a restart keep their running
+// values.
+func (r *reloader) reload() error {
+	cfg, err := loadConfig(r.args, flag.ContinueOnError)
+	if err != nil {
+		return err
+	}
+	cfg.keepServerSettings(r.config.Load())
+	p, err := buildPipeline(cfg, r.auditLog, r.outbox, r.pipeline.Load())
+	if err != nil {
+		return err
+	}
+
+	r.proxy.Reload(p.ledgerClient, p.middleware)
+	if r.outbox != nil {
+		r.outbox.SetSender(p.ledgerClient)
+	}
+	r.pipeline.Store(p)
+	r.config.Store(cfg)
+	return nil
+}
+
+// flags returns the flags of the configuration in effect.
+func (r *reloader) flags() *flag.FlagSet {
+	return r.config.Load().fs
+}
+
+// cache returns the passport cache of the pipeline in effect, nil if
+// caching is off.
+func (r *reloader) cache() *ledger.PassportCache {
+	return r.pipeline.Load().cache
+}
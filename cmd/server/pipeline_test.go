@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// fileBackendArgs configures the file passport backend with one passport.
+func fileBackendArgs(t *testing.T) []string {
+	t.Helper()
+	dir := t.TempDir()
+	passports := filepath.Join(dir, "passports")
+	if err := os.Mkdir(passports, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(passports, "SN-0001.json"), []byte(`{"uuid": "SN-0001"}`), 0o644); err != nil {
+		t.Fatalf("write passport: %v", err)
+	}
+	config := filepath.Join(dir, "backend.json")
+	if err := os.WriteFile(config, []byte(`{"dir": "`+passports+`"}`), 0o644); err != nil {
+		t.Fatalf("write backend config: %v", err)
+	}
+	return []string{"-ledger-backend=file", "-ledger-backend-config=" + config}
+}
+
+func TestReloader_KeepsPassportCache(t *testing.T) {
+	args := fileBackendArgs(t)
+	cfg, err := loadConfig(args, flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	pipe, err := buildPipeline(cfg, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("build pipeline: %v", err)
+	}
+	r := &reloader{args: args, proxy: proxy.NewFDOProxy(proxy.BackendConfig{}, "", pipe.ledgerClient, pipe.middleware)}
+	r.config.Store(cfg)
+	r.pipeline.Store(pipe)
+
+	if _, err := r.cache().GetProductItemPassport(context.Background(), "SN-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Reloading the same passport source keeps what was fetched
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if r.cache() == pipe.cache {
+		t.Error("expected the cache to front the reloaded client")
+	}
+	before := r.cache().Stats()
+	if _, err := r.cache().GetProductItemPassport(context.Background(), "SN-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if after := r.cache().Stats(); after.Hits != before.Hits+1 {
+		t.Errorf("expected the passport to be served from the cache, got %+v", after)
+	}
+
+	// Changed cache settings start an empty cache
+	r.args = append(args, "-passport-cache-ttl=1m")
+	if err := r.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if n := r.cache().Stats().Entries; n != 0 {
+		t.Errorf("expected an empty cache, got %d entries", n)
+	}
+}
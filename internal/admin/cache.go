@@ -0,0 +1,105 @@
+package admin
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// PassportCacheHandler serves the product passport cache:
+//
+//	GET    /cache/passports             cache statistics
+//	DELETE /cache/passports?uuid={uuid} invalidate one product UUID
+//	DELETE /cache/passports             purge every entry
+func PassportCacheHandler(cache *ledger.PassportCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, cache.Stats())
+
+		case http.MethodDelete:
+			if uuid := r.URL.Query().Get("uuid"); uuid != "" {
+				found := cache.Invalidate(uuid)
+				slog.Info("Invalidated cached product passport", "uuid", uuid, "found", found)
+				writeJSON(w, http.StatusOK, map[string]any{"uuid": uuid, "invalidated": found})
+				return
+			}
+			n := cache.Purge()
+			slog.Info("Purged product passport cache", "entries", n)
+			writeJSON(w, http.StatusOK, map[string]any{"purged": n})
+
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+	})
+}
+
+// CurrentCache serves each request with the handler h builds for the cache
+// current returns, so the cache endpoints follow a cache replaced by a
+// configuration reload. It answers 404 while caching is off.
+func CurrentCache(current func() *ledger.PassportCache, h func(*ledger.PassportCache) http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cache := current()
+		if cache == nil {
+			writeError(w, http.StatusNotFound, "passport cache disabled")
+			return
+		}
+		h(cache).ServeHTTP(w, r)
+	})
+}
+
+// maxManifestSize bounds a prefetch manifest upload.
+const maxManifestSize = 10 << 20
+
+// PrefetchHandler warms the passport cache from a manufacturing manifest:
+//
+//	POST /cache/passports/prefetch[?concurrency=N][&ttl=8h]
+//
+// The body is a CSV or JSON manifest of product UUIDs (see
+// ledger.ParseManifest). The response is the ledger.PrefetchReport listing
+// UUIDs without a passport and lookups that failed.
+func PrefetchHandler(cache *ledger.PassportCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+
+		opts, err := prefetchOptions(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		uuids, err := ledger.ParseManifest(http.MaxBytesReader(w, r.Body, maxManifestSize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, cache.Prefetch(r.Context(), uuids, opts))
+	})
+}
+
+func prefetchOptions(r *http.Request) (ledger.PrefetchOptions, error) {
+	var opts ledger.PrefetchOptions
+	q := r.URL.Query()
+	if v := q.Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("invalid concurrency %q", v)
+		}
+		opts.Concurrency = n
+	}
+	if v := q.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid ttl %q", v)
+		}
+		opts.TTL = d
+	}
+	return opts, nil
+}
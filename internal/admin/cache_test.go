@@ -0,0 +1,155 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// stubAPI returns a passport for every UUID except those starting with "missing".
+type stubAPI struct{}
+
+func (s *stubAPI) GetProductItemPassport(ctx context.Context, uuid string) (*ledger.ProductItemPassport, error) {
+	if strings.HasPrefix(uuid, "missing") {
+		return nil, &ledger.StatusError{Op: "passport GET", StatusCode: http.StatusNotFound}
+	}
+	return &ledger.ProductItemPassport{UUID: uuid}, nil
+}
+
+func (s *stubAPI) CreateCommissioningPassport(ctx context.Context, body *ledger.CommissioningCreateRequest) error {
+	return nil
+}
+
+func TestPassportCacheHandler(t *testing.T) {
+	cache := ledger.NewPassportCache(&stubAPI{}, ledger.CacheConfig{})
+	for _, uuid := range []string{"SN-0001", "SN-0002", "SN-0003"} {
+		cache.GetProductItemPassport(context.Background(), uuid)
+	}
+	handler := PassportCacheHandler(cache)
+
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		expectStatus  int
+		expectField   string
+		expectValue   any
+		expectEntries int
+	}{
+		{name: "stats", method: http.MethodGet, target: "/cache/passports", expectStatus: 200, expectField: "entries", expectValue: 3.0, expectEntries: 3},
+		{name: "invalidate one", method: http.MethodDelete, target: "/cache/passports?uuid=SN-0002", expectStatus: 200, expectField: "invalidated", expectValue: true, expectEntries: 2},
+		{name: "invalidate missing", method: http.MethodDelete, target: "/cache/passports?uuid=SN-0002", expectStatus: 200, expectField: "invalidated", expectValue: false, expectEntries: 2},
+		{name: "purge", method: http.MethodDelete, target: "/cache/passports", expectStatus: 200, expectField: "purged", expectValue: 2.0, expectEntries: 0},
+		{name: "wrong method", method: http.MethodPost, target: "/cache/passports", expectStatus: 405, expectField: "error", expectValue: "method not allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+
+			if rec.Code != tt.expectStatus {
+				t.Errorf("expected status %d, got %d", tt.expectStatus, rec.Code)
+			}
+			var body map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if body[tt.expectField] != tt.expectValue {
+				t.Errorf("expected %s=%v, got %v", tt.expectField, tt.expectValue, body[tt.expectField])
+			}
+			if got := cache.Stats().Entries; tt.expectStatus == 200 && got != tt.expectEntries {
+				t.Errorf("expected %d entries, got %d", tt.expectEntries, got)
+			}
+		})
+	}
+}
+
+func TestCurrentCache(t *testing.T) {
+	var current *ledger.PassportCache
+	handler := CurrentCache(func() *ledger.PassportCache { return current }, PassportCacheHandler)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache/passports", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 without a cache, got %d", rec.Code)
+	}
+
+	current = ledger.NewPassportCache(&stubAPI{}, ledger.CacheConfig{})
+	current.GetProductItemPassport(context.Background(), "SN-0001")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache/passports", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"entries": 1`) {
+		t.Errorf("expected the stats of the current cache, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPrefetchHandler(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		body          string
+		expectStatus  int
+		expectLoaded  int
+		expectMissing []any
+	}{
+		{
+			name:          "CSV manifest",
+			method:        http.MethodPost,
+			target:        "/cache/passports/prefetch?concurrency=2&ttl=8h",
+			body:          "uuid\nSN-0001\nSN-0002\nmissing-1\n",
+			expectStatus:  200,
+			expectLoaded:  2,
+			expectMissing: []any{"missing-1"},
+		},
+		{
+			name:          "JSON manifest",
+			method:        http.MethodPost,
+			target:        "/cache/passports/prefetch",
+			body:          `["SN-0001"]`,
+			expectStatus:  200,
+			expectLoaded:  1,
+			expectMissing: []any{},
+		},
+		{name: "empty manifest", method: http.MethodPost, target: "/cache/passports/prefetch", expectStatus: 400},
+		{name: "bad ttl", method: http.MethodPost, target: "/cache/passports/prefetch?ttl=soon", body: "SN-0001", expectStatus: 400},
+		{name: "wrong method", method: http.MethodGet, target: "/cache/passports/prefetch", expectStatus: 405},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := ledger.NewPassportCache(&stubAPI{}, ledger.CacheConfig{})
+			rec := httptest.NewRecorder()
+			PrefetchHandler(cache).ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			if rec.Code != tt.expectStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectStatus, rec.Code, rec.Body.String())
+			}
+			if tt.expectStatus != 200 {
+				return
+			}
+			var report struct {
+				Loaded  int   `json:"loaded"`
+				Missing []any `json:"missing"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if report.Loaded != tt.expectLoaded {
+				t.Errorf("expected %d loaded, got %d", tt.expectLoaded, report.Loaded)
+			}
+			if len(report.Missing) != len(tt.expectMissing) || (len(tt.expectMissing) > 0 && report.Missing[0] != tt.expectMissing[0]) {
+				t.Errorf("expected missing %v, got %v", tt.expectMissing, report.Missing)
+			}
+			if got := cache.Stats().Entries; got != tt.expectLoaded+len(tt.expectMissing) {
+				t.Errorf("expected %d cache entries, got %d", tt.expectLoaded+len(tt.expectMissing), got)
+			}
+		})
+	}
+}
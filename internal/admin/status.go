@@ -0,0 +1,311 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// Redacted replaces secret configuration values.
+const Redacted = "REDACTED"
+
+// readyTimeout bounds the readiness checks of one request.
+const readyTimeout = 5 * time.Second
+
+// LivenessHandler answers 200 while the process is serving the admin API:
+//
+//	GET /livez
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, "GET, HEAD")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+// Check is one readiness condition; Func returns nil when it holds.
+type Check struct {
+	Name string
+	Func func(ctx context.Context) error
+}
+
+// BackendCheck holds while the go-fdo backend is ready and the proxy is
+// not draining.
+func BackendCheck(p *proxy.FDOProxy) Check {
+	return Check{Name: "backend", Func: func(ctx context.Context) error {
+		if p.Draining() {
+			return errors.New("proxy is draining")
+		}
+		if state := p.BackendState(); state != proxy.BackendReady {
+			return fmt.Errorf("backend %s", state)
+		}
+		return nil
+	}}
+}
+
+// ledgerProbeTTL is how long the outcome of a ledger reachability probe is
+// reused, so frequent readiness polls do not each reach the service.
+const ledgerProbeTTL = 5 * time.Second
+
+// LedgerCheck holds while the passport service can be reached and no
+// circuit breaker in front of it is open, meaning recent calls failed.
+// Reachability is probed with the client's Ping, if it has one, at most
+// every few seconds. Backends without breakers or Ping, such as the file
+// backend, always pass. The check follows the ledger client installed by
+// the latest reload.
+func LedgerCheck(p *proxy.FDOProxy) Check {
+	probe := &ledgerProbe{now: time.Now}
+	return Check{Name: "ledger", Func: func(ctx context.Context) error {
+		client := p.LedgerClient()
+		if b, ok := client.(interface {
+			BreakerStates() map[string]ledger.BreakerState
+		}); ok {
+			var open []string
+			for endpoint, state := range b.BreakerStates() {
+				if state == ledger.BreakerOpen {
+					open = append(open, endpoint)
+				}
+			}
+			if len(open) > 0 {
+				sort.Strings(open)
+				return fmt.Errorf("circuit breaker open for %s", strings.Join(open, ", "))
+			}
+		}
+		return probe.check(ctx, client)
+	}}
+}
+
+// ledgerProbe caches the latest Ping of a ledger client.
+type ledgerProbe struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	client proxy.LedgerClient
+	at     time.Time
+	err    error
+}
+
+func (p *ledgerProbe) check(ctx context.Context, client proxy.LedgerClient) error {
+	pinger, ok := client.(interface{ Ping(context.Context) error })
+	if !ok {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	if p.client == client && now.Sub(p.at) < ledgerProbeTTL {
+		return p.err
+	}
+	// The outcome is shared, so a caller giving up must not decide it
+	pctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readyTimeout)
+	defer cancel()
+	p.err = pinger.Ping(pctx)
+	if p.err != nil {
+		p.err = fmt.Errorf("passport service unreachable: %w", p.err)
+	}
+	p.client, p.at = client, now
+	return p.err
+}
+
+// ReadinessHandler answers 200 if every check holds and 503 otherwise,
+// with the outcome of each check:
+//
+//	GET /readyz
+func ReadinessHandler(checks ...Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, "GET, HEAD")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		ready := true
+		results := make(map[string]string, len(checks))
+		for _, c := range checks {
+			if err := c.Func(ctx); err != nil {
+				ready = false
+				results[c.Name] = err.Error()
+				continue
+			}
+			results[c.Name] = "ok"
+		}
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+			slog.Debug("Readiness check failed", "checks", results)
+		}
+		writeJSON(w, status, map[string]any{"ready": ready, "checks": results})
+	})
+}
+
+// BuildInfo identifies the running binary.
+type BuildInfo struct {
+	Version      string `json:"version"`
+	GoVersion    string `json:"go_version"`
+	Module       string `json:"module"`
+	Revision     string `json:"revision,omitempty"`
+	RevisionTime string `json:"revision_time,omitempty"`
+	Modified     bool   `json:"modified,omitempty"`
+}
+
+// ReadBuildInfo returns the build information embedded by the Go
+// toolchain, with version as set at link time.
+func ReadBuildInfo(version string) BuildInfo {
+	info := BuildInfo{Version: version}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.GoVersion = bi.GoVersion
+	info.Module = bi.Main.Path
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.RevisionTime = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// BuildInfoHandler serves info:
+//
+//	GET /buildinfo
+func BuildInfoHandler(info BuildInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+}
+
+// ConfigHandler serves the value of every flag in the FlagSet flags
+// returns, which is the configuration in effect after the latest reload:
+//
+//	GET /config
+//
+// The flags named in secret are shown as REDACTED when set, and passwords
+// in URL values are masked.
+func ConfigHandler(flags func() *flag.FlagSet, secret ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, redactedFlags(flags(), secret))
+	})
+}
+
+func redactedFlags(fs *flag.FlagSet, secret []string) map[string]string {
+	config := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch {
+		case v == "":
+		case slices.Contains(secret, f.Name):
+			v = Redacted
+		case strings.Contains(v, "://"):
+			if u, err := url.Parse(v); err == nil && u.User != nil {
+				u.User = url.User(Redacted)
+				v = u.String()
+			}
+		}
+		config[f.Name] = v
+	})
+	return config
+}
+
+// SessionsHandler lists the FDO sessions under way:
+//
+//	GET /sessions
+func SessionsHandler(sessions *proxy.SessionTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		infos := sessions.Snapshot()
+		writeJSON(w, http.StatusOK, map[string]any{"count": len(infos), "sessions": infos})
+	})
+}
+
+// OutboxHandler serves the commissioning passport outbox:
+//
+//	GET  /outbox                 pending and failed items
+//	POST /outbox/retry?uuid={id} move a failed item back to pending
+func OutboxHandler(outbox *ledger.Outbox) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/outbox" && r.Method == http.MethodGet:
+			pending, failed := outbox.Pending(), outbox.Failed()
+			writeJSON(w, http.StatusOK, map[string]any{
+				"pending_count": len(pending),
+				"failed_count":  len(failed),
+				"pending":       pending,
+				"failed":        failed,
+			})
+
+		case r.URL.Path == "/outbox/retry" && r.Method == http.MethodPost:
+			uuid := r.URL.Query().Get("uuid")
+			if uuid == "" {
+				writeError(w, http.StatusBadRequest, "uuid is required")
+				return
+			}
+			if err := outbox.Retry(uuid); errors.Is(err, ledger.ErrNotInOutbox) {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			} else if err != nil {
+				slog.Error("Failed to retry commissioning passport", "controller_uuid", uuid, "error", err)
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			slog.Info("Retrying failed commissioning passport", "controller_uuid", uuid)
+			writeJSON(w, http.StatusOK, map[string]any{"uuid": uuid, "retrying": true})
+
+		case r.URL.Path == "/outbox/retry":
+			methodNotAllowed(w, "POST")
+		case r.URL.Path == "/outbox":
+			methodNotAllowed(w, "GET")
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	})
+}
+
+// MiddlewareHandler lists the installed middleware in the order they run,
+// with the message types each subscribes to:
+//
+//	GET /middleware
+func MiddlewareHandler(p *proxy.FDOProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, p.Middleware())
+	})
+}
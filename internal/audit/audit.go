@@ -0,0 +1,328 @@
+// Package audit keeps a tamper-evident record of onboarding events: one
+// JSON object per line, each carrying the hash of the line before it, so a
+// record that is edited, removed or reordered breaks the chain at that point
+// when the log is checked with Verify.
+//
+// A plain SHA-256 chain shows accidental damage and casual edits; anyone who
+// can rewrite the file can also recompute the hashes after their edit. With
+// a key, each link is an HMAC-SHA256 only key holders can produce. Removing
+// records from the end leaves a valid chain, so auditors should keep the
+// Head reported by Verify and check later logs still contain it.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/trace"
+)
+
+// Event types recorded by the proxy.
+const (
+	// EventOpened starts every run of the proxy.
+	EventOpened = "audit.opened"
+
+	// FDO protocol progress, recorded by the audit middleware.
+	EventDIStarted     = "di.started"
+	EventVoucherIssued = "di.voucher_issued"
+	EventDICompleted   = "di.completed"
+	EventTO2Started    = "to2.started"
+	EventTO2Completed  = "to2.completed"
+	EventProtocolError = "fdo.error"
+
+	// Product passport checks at DI.AppStart.
+	EventPassportFetched      = "passport.fetched"
+	EventPassportLookupFailed = "passport.lookup_failed"
+	EventPassportVerified     = "passport.verified"
+	EventPassportInvalid      = "passport.verification_failed"
+	EventDIRejected           = "di.rejected"
+
+	// Commissioning passports at TO2.Done2 and from the outbox.
+	EventCommissioningCreated   = "commissioning.created"
+	EventCommissioningQueued    = "commissioning.queued"
+	EventCommissioningFailed    = "commissioning.failed"
+	EventCommissioningDelivered = "commissioning.delivered"
+	EventCommissioningAbandoned = "commissioning.abandoned"
+)
+
+// GenesisHash is the prev of the first record in a log.
+const GenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Record is one line of the audit log.
+type Record struct {
+	Seq     uint64         `json:"seq"`
+	Time    time.Time      `json:"time"`
+	Event   string         `json:"event"`
+	GUID    string         `json:"guid,omitempty"`
+	TraceID string         `json:"trace_id,omitempty"`
+	Fields  map[string]any `json:"fields,omitempty"`
+	// Prev is the Hash of the previous record, GenesisHash for the first.
+	Prev string `json:"prev"`
+	// Hash covers the line up to, but excluding, the hash member itself.
+	Hash string `json:"hash"`
+}
+
+// body is a Record as hashed: every member but Hash, in the same order.
+type body struct {
+	Seq     uint64         `json:"seq"`
+	Time    time.Time      `json:"time"`
+	Event   string         `json:"event"`
+	GUID    string         `json:"guid,omitempty"`
+	TraceID string         `json:"trace_id,omitempty"`
+	Fields  map[string]any `json:"fields,omitempty"`
+	Prev    string         `json:"prev"`
+}
+
+// hashSuffixLen is the length of what ends every line: ,"hash":"<64 hex>"}
+const hashSuffixLen = len(`,"hash":""}`) + sha256.Size*2
+
+// Log appends records to an audit file. All methods are safe for
+// concurrent use, and Record is a no-op on a nil Log.
+type Log struct {
+	key []byte
+
+	mu   sync.Mutex
+	f    *os.File
+	seq  uint64
+	head string
+}
+
+// Option customizes a Log.
+type Option func(*Log)
+
+// WithKey chains records with HMAC-SHA256 under key instead of SHA-256.
+// Verify must be given the same key.
+func WithKey(key []byte) Option {
+	return func(l *Log) {
+		l.key = key
+	}
+}
+
+// ReadKey reads an HMAC key from a file, ignoring surrounding whitespace so
+// the file can be written with echo.
+func ReadKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read audit key: %w", err)
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("audit key %s is empty", path)
+	}
+	return key, nil
+}
+
+// Open opens the audit log at path for appending, creating it if needed,
+// and continues the chain from its last record. A log whose last line is
+// damaged is refused rather than extended.
+func Open(path string, opts ...Option) (*Log, error) {
+	l := &Log{head: GenesisHash}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	last, err := lastLine(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read audit log %s: %w", path, err)
+	}
+	if last != nil {
+		rec, err := l.check(last)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("audit log %s ends with a damaged record, verify it before appending: %w", path, err)
+		}
+		l.seq, l.head = rec.Seq, rec.Hash
+	}
+	l.f = f
+
+	l.Record(context.Background(), EventOpened, "", "keyed", l.key != nil)
+	return l, nil
+}
+
+// Record appends an event. guid is the device GUID if known, and kv are
+// further fields given as alternating keys and values, as with slog. A
+// span in ctx links the record to its trace. Write failures are logged
+// rather than returned: the FDO exchange being audited has already
+// happened.
+func (l *Log) Record(ctx context.Context, event, guid string, kv ...any) {
+	if l == nil {
+		return
+	}
+	b := body{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		GUID:    guid,
+		TraceID: traceID(ctx),
+		Fields:  fields(kv),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		slog.Error("Audit log closed, event not recorded", "event", event, "guid", guid)
+		return
+	}
+	b.Seq, b.Prev = l.seq+1, l.head
+	line, hash, err := l.encode(b)
+	if err == nil {
+		if _, err = l.f.Write(line); err == nil {
+			err = l.f.Sync()
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to write audit record", "event", event, "guid", guid, "error", err)
+		return
+	}
+	l.seq, l.head = b.Seq, hash
+}
+
+// Head returns the sequence number and hash of the last record written.
+func (l *Log) Head() (uint64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.head
+}
+
+// Close closes the file. Later records are dropped with an error logged.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// encode returns the line for b, newline included, and its hash.
+func (l *Log) encode(b body) ([]byte, string, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, "", fmt.Errorf("encode audit record: %w", err)
+	}
+	hash := l.sum(data)
+	line := make([]byte, 0, len(data)+hashSuffixLen+1)
+	line = append(line, data[:len(data)-1]...)
+	line = append(line, `,"hash":"`...)
+	line = append(line, hash...)
+	line = append(line, "\"}\n"...)
+	return line, hash, nil
+}
+
+// check parses line and confirms its hash matches its body.
+func (l *Log) check(line []byte) (*Record, error) {
+	var rec Record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return nil, fmt.Errorf("not a JSON record: %w", err)
+	}
+	if len(line) < hashSuffixLen || !bytes.HasPrefix(line[len(line)-hashSuffixLen:], []byte(`,"hash":"`)) {
+		return nil, errors.New("hash is not the last member")
+	}
+	data := append(append([]byte(nil), line[:len(line)-hashSuffixLen]...), '}')
+	if want := l.sum(data); !hmac.Equal([]byte(want), []byte(rec.Hash)) {
+		return &rec, errors.New("hash does not match the record")
+	}
+	return &rec, nil
+}
+
+func (l *Log) sum(data []byte) string {
+	var h hash.Hash
+	if l.key != nil {
+		h = hmac.New(sha256.New, l.key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lastLine returns the last line of f without its newline, or nil for an
+// empty file. A final line without a newline is an error: it was cut short.
+func lastLine(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, nil
+	}
+
+	const chunk = 64 << 10
+	var tail []byte
+	for off := size; off > 0; {
+		n := int64(chunk)
+		if off < n {
+			n = off
+		}
+		off -= n
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, off); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		tail = append(buf, tail...)
+		if len(tail) > 0 && tail[len(tail)-1] != '\n' {
+			return nil, errors.New("last record is incomplete")
+		}
+		if i := bytes.LastIndexByte(tail[:len(tail)-1], '\n'); i >= 0 || off == 0 {
+			return tail[i+1 : len(tail)-1], nil
+		}
+	}
+	return nil, nil
+}
+
+func traceID(ctx context.Context) string {
+	if sc := trace.SpanFromContext(ctx).Context(); sc.IsValid() {
+		return sc.TraceID.String()
+	}
+	return ""
+}
+
+// fields turns alternating keys and values into a map, formatting values
+// that do not marshal usefully.
+func fields(kv []any) map[string]any {
+	if len(kv) < 2 {
+		return nil
+	}
+	m := make(map[string]any, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		switch v := kv[i+1].(type) {
+		case error:
+			m[key] = v.Error()
+		case time.Duration:
+			m[key] = v.String()
+		case time.Time:
+			m[key] = v
+		case fmt.Stringer:
+			m[key] = v.String()
+		default:
+			m[key] = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,220 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLog records three events in a fresh log and returns its lines.
+func writeLog(t *testing.T, opts ...Option) (string, []string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path, opts...)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	l.Record(context.Background(), EventDIStarted, "", "serial_number", "SN-0001")
+	l.Record(context.Background(), EventVoucherIssued, "191e886b-dfff-4f39-9618-d7a364ec0c90", "device_info", "board")
+	l.Record(context.Background(), EventTO2Completed, "191e886b-dfff-4f39-9618-d7a364ec0c90", "error", errors.New("none"))
+	if err := l.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	return path, lines[:len(lines)-1]
+}
+
+func verify(t *testing.T, lines []string, opts VerifyOptions) *VerifyReport {
+	t.Helper()
+	report, err := Verify(strings.NewReader(strings.Join(lines, "")), opts)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	return report
+}
+
+func TestLog_Record(t *testing.T) {
+	_, lines := writeLog(t)
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(lines))
+	}
+
+	var recs []Record
+	for _, line := range lines {
+		var rec Record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("unmarshal %q: %v", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	if recs[0].Event != EventOpened || recs[0].Prev != GenesisHash {
+		t.Errorf("expected the log to start with %s after genesis, got %s after %s", EventOpened, recs[0].Event, recs[0].Prev)
+	}
+	for i, rec := range recs {
+		if rec.Seq != uint64(i+1) {
+			t.Errorf("expected seq %d, got %d", i+1, rec.Seq)
+		}
+		if i > 0 && rec.Prev != recs[i-1].Hash {
+			t.Errorf("record %d does not link to record %d", i+1, i)
+		}
+	}
+	if recs[2].GUID != "191e886b-dfff-4f39-9618-d7a364ec0c90" || recs[2].Fields["device_info"] != "board" {
+		t.Errorf("unexpected record %+v", recs[2])
+	}
+	if recs[3].Fields["error"] != "none" {
+		t.Errorf("expected error field as a string, got %v", recs[3].Fields["error"])
+	}
+}
+
+func TestLog_Reopen(t *testing.T) {
+	path, lines := writeLog(t)
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	l.Record(context.Background(), EventDIStarted, "")
+	seq, head := l.Head()
+	l.Close()
+	if seq != 6 {
+		t.Errorf("expected the chain to continue to seq 6, got %d", seq)
+	}
+
+	b, _ := os.ReadFile(path)
+	report, err := Verify(bytes.NewReader(b), VerifyOptions{})
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if !report.Valid() || report.Records != len(lines)+2 || report.Head != head {
+		t.Errorf("expected a valid chain of %d ending at %s, got %+v", len(lines)+2, head, report)
+	}
+}
+
+func TestOpen_DamagedTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(string) string
+	}{
+		{name: "cut short", damage: func(s string) string { return s[:len(s)-10] }},
+		{name: "edited", damage: func(s string) string { return strings.Replace(s, EventTO2Completed, EventTO2Started, 1) }},
+		{name: "not JSON", damage: func(s string) string { return s + "garbage\n" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := writeLog(t)
+			b, _ := os.ReadFile(path)
+			os.WriteFile(path, []byte(tt.damage(string(b))), 0o640)
+			if _, err := Open(path); err == nil {
+				t.Error("expected a damaged log to be refused")
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	_, lines := writeLog(t, WithKey([]byte("secret")))
+	head := verify(t, lines, VerifyOptions{Key: []byte("secret")}).Head
+
+	tests := []struct {
+		name         string
+		lines        func() []string
+		opts         VerifyOptions
+		expectLines  []int
+		expectRecord int
+	}{
+		{
+			name:         "intact",
+			lines:        func() []string { return lines },
+			opts:         VerifyOptions{Key: []byte("secret"), Head: head},
+			expectRecord: 4,
+		},
+		{
+			name: "edited field",
+			lines: func() []string {
+				out := append([]string(nil), lines...)
+				out[1] = strings.Replace(out[1], "SN-0001", "SN-0002", 1)
+				return out
+			},
+			opts:         VerifyOptions{Key: []byte("secret")},
+			expectLines:  []int{2},
+			expectRecord: 4,
+		},
+		{
+			name:         "deleted record",
+			lines:        func() []string { return []string{lines[0], lines[2], lines[3]} },
+			opts:         VerifyOptions{Key: []byte("secret")},
+			expectLines:  []int{2},
+			expectRecord: 3,
+		},
+		{
+			name:         "reordered records",
+			lines:        func() []string { return []string{lines[0], lines[2], lines[1], lines[3]} },
+			opts:         VerifyOptions{Key: []byte("secret")},
+			expectLines:  []int{2, 3, 4},
+			expectRecord: 4,
+		},
+		{
+			name:         "truncated after head",
+			lines:        func() []string { return lines[:3] },
+			opts:         VerifyOptions{Key: []byte("secret"), Head: head},
+			expectLines:  []int{0},
+			expectRecord: 3,
+		},
+		{
+			name:         "wrong key",
+			lines:        func() []string { return lines },
+			opts:         VerifyOptions{Key: []byte("guess")},
+			expectLines:  []int{1, 2, 3, 4},
+			expectRecord: 4,
+		},
+		{
+			name:         "incomplete last record",
+			lines:        func() []string { return []string{lines[0], lines[1][:20]} },
+			opts:         VerifyOptions{Key: []byte("secret")},
+			expectLines:  []int{2},
+			expectRecord: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := verify(t, tt.lines(), tt.opts)
+			var got []int
+			for _, p := range report.Problems {
+				got = append(got, p.Line)
+			}
+			if len(got) != len(tt.expectLines) {
+				t.Fatalf("expected problems on lines %v, got %+v", tt.expectLines, report.Problems)
+			}
+			for i := range got {
+				if got[i] != tt.expectLines[i] {
+					t.Errorf("expected problems on lines %v, got %+v", tt.expectLines, report.Problems)
+					break
+				}
+			}
+			if report.Records != tt.expectRecord {
+				t.Errorf("expected %d records, got %d", tt.expectRecord, report.Records)
+			}
+			if report.Valid() != (len(tt.expectLines) == 0) {
+				t.Errorf("expected valid %v", len(tt.expectLines) == 0)
+			}
+		})
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.Record(context.Background(), EventDIStarted, "")
+	if err := l.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VerifyOptions configures Verify.
+type VerifyOptions struct {
+	// Key is the HMAC key the log was written with, nil for SHA-256.
+	Key []byte
+	// Head is the hash of a record seen in an earlier verification. If no
+	// record has it, the log was cut short since.
+	Head string
+}
+
+// VerifyReport is the outcome of Verify.
+type VerifyReport struct {
+	Records  int    `json:"records"`
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+	// Head is the hash of the last record, to keep for the next Verify.
+	Head     string    `json:"head"`
+	Problems []Problem `json:"problems"`
+}
+
+// Problem is a point where the chain is broken.
+type Problem struct {
+	Line   int    `json:"line"`
+	Seq    uint64 `json:"seq,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Valid reports whether the whole chain checked out.
+func (r *VerifyReport) Valid() bool { return len(r.Problems) == 0 }
+
+// Verify reads an audit log from r and checks that each record's hash
+// matches its contents and that each record follows the one before it in
+// sequence and hash. Every break is reported, the check carrying on from
+// the record after it. The error is for failures reading r.
+func Verify(r io.Reader, opts VerifyOptions) (*VerifyReport, error) {
+	l := &Log{key: opts.Key}
+	report := &VerifyReport{Problems: []Problem{}}
+	prevSeq, prevHash := uint64(0), GenesisHash
+	headSeen := opts.Head == ""
+
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 && errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("read audit log: %w", err)
+		}
+		problem := func(seq uint64, format string, args ...any) {
+			report.Problems = append(report.Problems, Problem{Line: n, Seq: seq, Reason: fmt.Sprintf(format, args...)})
+		}
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			problem(0, "last record is incomplete")
+			break
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+
+		rec, err := l.check(line)
+		if rec == nil {
+			problem(0, "%v", err)
+			continue
+		}
+		if err != nil {
+			problem(rec.Seq, "record was altered: %v", err)
+		}
+		if rec.Seq != prevSeq+1 {
+			problem(rec.Seq, "expected seq %d: records missing or out of order", prevSeq+1)
+		} else if rec.Prev != prevHash {
+			problem(rec.Seq, "prev does not match the hash of record %d", prevSeq)
+		}
+
+		if report.Records == 0 {
+			report.FirstSeq = rec.Seq
+		}
+		report.Records++
+		report.LastSeq = rec.Seq
+		report.Head = rec.Hash
+		if rec.Hash == opts.Head {
+			headSeen = true
+		}
+		prevSeq, prevHash = rec.Seq, rec.Hash
+	}
+
+	if !headSeen {
+		report.Problems = append(report.Problems, Problem{Reason: fmt.Sprintf("earlier head %s not found, records were removed", opts.Head)})
+	}
+	return report, nil
+}
@@ -0,0 +1,185 @@
+// Package config fills a flag.FlagSet from a JSON configuration file and
+// from environment variables, so every setting has one name whether it is
+// given on the command line, in the file or in the environment.
+//
+// A configuration file is a JSON object keyed by flag name:
+//
+//	{
+//	  "listen": ":8080",
+//	  "product-base-url": "https://passports.example.com",
+//	  "enable-product-passport": true,
+//	  "ledger-retry-attempts": 5,
+//	  "fdo-env": ["FDO_LOG=debug", "TZ=UTC"]
+//	}
+//
+// Strings, numbers and booleans are set as if given on the command line,
+// and an array sets a repeatable flag once per element. The environment
+// variable for a flag is its name in upper case with dashes turned into
+// underscores behind EnvPrefix, so -owner-id is FDO_PROXY_OWNER_ID.
+//
+// The command line wins over the environment, which wins over the file,
+// which wins over the flag defaults. Values for a repeatable flag given in
+// both the file and the environment add up.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// EnvPrefix starts the name of every environment variable read by Load.
+const EnvPrefix = "FDO_PROXY_"
+
+// EnvName returns the environment variable that sets the flag name.
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Load parses args into fs, then sets every flag not given in args from the
+// environment and from the configuration file named by the flag fileFlag
+// (or its environment variable). It returns the path of the file read, or
+// "" if there was none.
+//
+// fs must not have been parsed before; Load may be called again on a fresh
+// FlagSet to reload the same settings. Unknown keys in the file and values
+// a flag rejects are errors.
+func Load(fs *flag.FlagSet, args []string, fileFlag string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	path := ""
+	if f := fs.Lookup(fileFlag); f != nil {
+		path = f.Value.String()
+		if !explicit[fileFlag] {
+			if v, ok := os.LookupEnv(EnvName(fileFlag)); ok {
+				path = v
+			}
+		}
+	}
+	if path != "" {
+		if err := applyFile(fs, path, fileFlag, explicit); err != nil {
+			return "", err
+		}
+	}
+	if err := applyEnv(fs, fileFlag, explicit); err != nil {
+		return "", err
+	}
+	if path != "" && !explicit[fileFlag] {
+		// Show the file in use alongside the other settings.
+		if err := fs.Set(fileFlag, path); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// applyFile sets the flags not in explicit from the JSON object in path.
+func applyFile(fs *flag.FlagSet, path, fileFlag string, explicit map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var settings map[string]any
+	if err := dec.Decode(&settings); err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	if settings == nil {
+		return fmt.Errorf("parse config %s: expected a JSON object", path)
+	}
+
+	// Sorted so the first error reported does not change between runs.
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if name == fileFlag || fs.Lookup(name) == nil {
+			errs = append(errs, fmt.Errorf("unknown setting %q", name))
+			continue
+		}
+		if explicit[name] {
+			continue
+		}
+		values, err := flagValues(settings[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				break
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv sets the flags not in explicit from their environment variables.
+func applyEnv(fs *flag.FlagSet, fileFlag string, explicit map[string]bool) error {
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == fileFlag || explicit[f.Name] {
+			return
+		}
+		env := EnvName(f.Name)
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", env, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// flagValues converts a JSON value into the flag values it stands for.
+func flagValues(v any) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case bool:
+		if v {
+			return []string{"true"}, nil
+		}
+		return []string{"false"}, nil
+	case json.Number:
+		return []string{v.String()}, nil
+	case []any:
+		var values []string
+		for _, e := range v {
+			switch e.(type) {
+			case []any, map[string]any:
+				return nil, errors.New("arrays may only hold strings, numbers and booleans")
+			}
+			ev, err := flagValues(e)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, ev...)
+		}
+		return values, nil
+	default:
+		return nil, errors.New("expected a string, number, boolean or array")
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listFlag is a repeatable flag, as -fdo-env is.
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, ",") }
+func (l *listFlag) Set(v string) error { *l = append(*l, v); return nil }
+
+type settings struct {
+	config  string
+	listen  string
+	owner   string
+	enabled bool
+	retries int
+	timeout time.Duration
+	env     listFlag
+}
+
+func newFlagSet(s *settings) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	fs.StringVar(&s.config, "config", "", "")
+	fs.StringVar(&s.listen, "listen", "localhost:8080", "")
+	fs.StringVar(&s.owner, "owner-id", "", "")
+	fs.BoolVar(&s.enabled, "enable-product-passport", false, "")
+	fs.IntVar(&s.retries, "ledger-retry-attempts", 3, "")
+	fs.DurationVar(&s.timeout, "product-timeout", 10*time.Second, "")
+	fs.Var(&s.env, "fdo-env", "")
+	return fs
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("owner-id"); got != "FDO_PROXY_OWNER_ID" {
+		t.Errorf("expected FDO_PROXY_OWNER_ID, got %s", got)
+	}
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeConfig(t, `{
+		"listen": ":9000",
+		"owner-id": "file-owner",
+		"enable-product-passport": true,
+		"ledger-retry-attempts": 5,
+		"product-timeout": "2s",
+		"fdo-env": ["A=1", "B=2"]
+	}`)
+	t.Setenv("FDO_PROXY_OWNER_ID", "env-owner")
+	t.Setenv("FDO_PROXY_LEDGER_RETRY_ATTEMPTS", "7")
+
+	var s settings
+	got, err := Load(newFlagSet(&s), []string{"-config", path, "-ledger-retry-attempts", "9"}, "config")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got != path {
+		t.Errorf("expected path %s, got %s", path, got)
+	}
+	if s.listen != ":9000" {
+		t.Errorf("expected listen from the file, got %s", s.listen)
+	}
+	if s.owner != "env-owner" {
+		t.Errorf("expected owner-id from the environment, got %s", s.owner)
+	}
+	if s.retries != 9 {
+		t.Errorf("expected ledger-retry-attempts from the command line, got %d", s.retries)
+	}
+	if !s.enabled || s.timeout != 2*time.Second {
+		t.Errorf("expected bool and duration from the file, got %v and %s", s.enabled, s.timeout)
+	}
+	if s.env.String() != "A=1,B=2" {
+		t.Errorf("expected one fdo-env per array element, got %v", s.env)
+	}
+}
+
+func TestLoad_FileFromEnvironment(t *testing.T) {
+	path := writeConfig(t, `{"owner-id": "file-owner"}`)
+	t.Setenv("FDO_PROXY_CONFIG", path)
+
+	var s settings
+	fs := newFlagSet(&s)
+	if _, err := Load(fs, nil, "config"); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if s.owner != "file-owner" {
+		t.Errorf("expected owner-id from the file, got %s", s.owner)
+	}
+	if s.config != path {
+		t.Errorf("expected -config to show %s, got %s", path, s.config)
+	}
+}
+
+func TestLoad_NoFile(t *testing.T) {
+	var s settings
+	got, err := Load(newFlagSet(&s), []string{"-owner-id", "cli"}, "config")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got != "" || s.owner != "cli" || s.listen != "localhost:8080" {
+		t.Errorf("expected command line and defaults only, got path %q, %+v", got, s)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		expect  string
+	}{
+		{name: "not JSON", content: `listen: ":9000"`, expect: "parse config"},
+		{name: "not an object", content: `[]`, expect: "parse config"},
+		{name: "unknown setting", content: `{"listen-addr": ":9000"}`, expect: `unknown setting "listen-addr"`},
+		{name: "nested config", content: `{"config": "other.json"}`, expect: `unknown setting "config"`},
+		{name: "bad value", content: `{"ledger-retry-attempts": "many"}`, expect: "ledger-retry-attempts"},
+		{name: "object value", content: `{"listen": {"port": 9000}}`, expect: "expected a string"},
+		{name: "bad environment", content: `{}`, env: map[string]string{"FDO_PROXY_PRODUCT_TIMEOUT": "soon"}, expect: "FDO_PROXY_PRODUCT_TIMEOUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := writeConfig(t, tt.content)
+			var s settings
+			_, err := Load(newFlagSet(&s), []string{"-config", path}, "config")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.expect) {
+				t.Errorf("expected error mentioning %q, got %v", tt.expect, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+// Package fdo contains the small amount of FDO protocol knowledge the proxy
+// needs to inspect messages flowing to and from the go-fdo backend.
+package fdo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Tag is a CBOR tagged data item (major type 6).
+type Tag struct {
+	Number  uint64
+	Content any
+}
+
+// maxDepth bounds nesting so a hostile body cannot exhaust the stack.
+const maxDepth = 32
+
+// ErrTrailingData is returned by Decode when bytes remain after the first item.
+var ErrTrailingData = errors.New("cbor: trailing data after item")
+
+// Decode parses exactly one CBOR data item from b.
+//
+// Items are mapped to Go values as follows:
+//
+//	unsigned int  -> uint64
+//	negative int  -> int64
+//	byte string   -> []byte
+//	text string   -> string
+//	array         -> []any
+//	map           -> map[any]any (keys must be comparable)
+//	tag           -> Tag
+//	false/true    -> bool
+//	null/undef    -> nil
+//	float         -> float64
+func Decode(b []byte) (any, error) {
+	d := decoder{buf: b}
+	v, err := d.item(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := v.(breakMarker); ok {
+		return nil, fmt.Errorf("cbor: unexpected break")
+	}
+	if d.off != len(d.buf) {
+		return nil, ErrTrailingData
+	}
+	return v, nil
+}
+
+type decoder struct {
+	buf []byte
+	off int
+}
+
+// breakMarker signals the end of an indefinite-length item.
+type breakMarker struct{}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.buf)-d.off < n {
+		return nil, fmt.Errorf("cbor: unexpected end of data at offset %d", d.off)
+	}
+	b := d.buf[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+// head reads the initial byte and argument of a data item. indefinite is set
+// when the additional info is 31.
+func (d *decoder) head() (major byte, info byte, arg uint64, indefinite bool, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), false, nil
+	case info == 24:
+		b, err = d.next(1)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		return major, info, uint64(b[0]), false, nil
+	case info == 25:
+		b, err = d.next(2)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		return major, info, uint64(binary.BigEndian.Uint16(b)), false, nil
+	case info == 26:
+		b, err = d.next(4)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		return major, info, uint64(binary.BigEndian.Uint32(b)), false, nil
+	case info == 27:
+		b, err = d.next(8)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		return major, info, binary.BigEndian.Uint64(b), false, nil
+	case info == 31:
+		return major, info, 0, true, nil
+	default:
+		return 0, 0, 0, false, fmt.Errorf("cbor: reserved additional info %d", info)
+	}
+}
+
+func (d *decoder) item(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("cbor: nesting exceeds %d levels", maxDepth)
+	}
+
+	major, info, arg, indefinite, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if indefinite && (major == 0 || major == 1 || major == 6) {
+		return nil, fmt.Errorf("cbor: indefinite length not allowed for major type %d", major)
+	}
+
+	switch major {
+	case 0:
+		return arg, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, fmt.Errorf("cbor: negative integer overflows int64")
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		var s []byte
+		if indefinite {
+			s, err = d.chunks(major)
+		} else {
+			s, err = d.bytes(arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if major == 3 {
+			return string(s), nil
+		}
+		return s, nil
+	case 4:
+		return d.array(arg, indefinite, depth)
+	case 5:
+		return d.mapping(arg, indefinite, depth)
+	case 6:
+		content, err := d.item(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := content.(breakMarker); ok {
+			return nil, fmt.Errorf("cbor: unexpected break")
+		}
+		return Tag{Number: arg, Content: content}, nil
+	default:
+		return d.simple(info, arg, indefinite)
+	}
+}
+
+func (d *decoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.buf)-d.off) {
+		return nil, fmt.Errorf("cbor: string length %d exceeds remaining data", n)
+	}
+	b, err := d.next(int(n))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out, nil
+}
+
+func (d *decoder) chunks(major byte) ([]byte, error) {
+	var out []byte
+	for {
+		m, _, arg, indefinite, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if m == 7 && indefinite {
+			return out, nil
+		}
+		if m != major || indefinite {
+			return nil, fmt.Errorf("cbor: invalid chunk in indefinite string")
+		}
+		b, err := d.bytes(arg)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+}
+
+func (d *decoder) array(n uint64, indefinite bool, depth int) ([]any, error) {
+	if !indefinite && n > uint64(len(d.buf)-d.off) {
+		return nil, fmt.Errorf("cbor: array length %d exceeds remaining data", n)
+	}
+	out := make([]any, 0, min(n, 64))
+	for i := uint64(0); indefinite || i < n; i++ {
+		v, err := d.item(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := v.(breakMarker); ok {
+			if !indefinite {
+				return nil, fmt.Errorf("cbor: unexpected break")
+			}
+			return out, nil
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (d *decoder) mapping(n uint64, indefinite bool, depth int) (map[any]any, error) {
+	if !indefinite && n > uint64(len(d.buf)-d.off) {
+		return nil, fmt.Errorf("cbor: map length %d exceeds remaining data", n)
+	}
+	out := make(map[any]any, min(n, 64))
+	for i := uint64(0); indefinite || i < n; i++ {
+		k, err := d.item(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := k.(breakMarker); ok {
+			if !indefinite {
+				return nil, fmt.Errorf("cbor: unexpected break")
+			}
+			return out, nil
+		}
+		switch k.(type) {
+		case uint64, int64, string, bool, nil:
+		default:
+			return nil, fmt.Errorf("cbor: unsupported map key type %T", k)
+		}
+		v, err := d.item(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (d *decoder) simple(info byte, arg uint64, indefinite bool) (any, error) {
+	if indefinite {
+		return breakMarker{}, nil
+	}
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return float64(halfToFloat(uint16(arg))), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	default:
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+	}
+}
+
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+	switch exp {
+	case 0:
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			return -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | frac<<13)
+	default:
+		return math.Float32frombits(sign | (exp+112)<<23 | frac<<13)
+	}
+}
+
+// Encode serializes v as CBOR. It accepts the value types Decode produces
+// plus int and uint, and writes map keys in length-first canonical order so
+// output is deterministic.
+func Encode(v any) ([]byte, error) {
+	return appendItem(nil, v, 0)
+}
+
+func appendHead(b []byte, major byte, arg uint64) []byte {
+	m := major << 5
+	switch {
+	case arg < 24:
+		return append(b, m|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(b, m|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, m|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, m|26), uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, m|27), arg)
+	}
+}
+
+func appendItem(b []byte, v any, depth int) ([]byte, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("cbor: nesting exceeds %d levels", maxDepth)
+	}
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xf6), nil
+	case bool:
+		if x {
+			return append(b, 0xf5), nil
+		}
+		return append(b, 0xf4), nil
+	case uint64:
+		return appendHead(b, 0, x), nil
+	case uint:
+		return appendHead(b, 0, uint64(x)), nil
+	case int:
+		return appendInt(b, int64(x)), nil
+	case int64:
+		return appendInt(b, x), nil
+	case []byte:
+		return append(appendHead(b, 2, uint64(len(x))), x...), nil
+	case string:
+		return append(appendHead(b, 3, uint64(len(x))), x...), nil
+	case []any:
+		b = appendHead(b, 4, uint64(len(x)))
+		for _, e := range x {
+			var err error
+			if b, err = appendItem(b, e, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[any]any:
+		return appendMap(b, x, depth)
+	case Tag:
+		return appendItem(appendHead(b, 6, x.Number), x.Content, depth+1)
+	default:
+		return nil, fmt.Errorf("cbor: cannot encode %T", v)
+	}
+}
+
+func appendInt(b []byte, i int64) []byte {
+	if i < 0 {
+		return appendHead(b, 1, uint64(-1-i))
+	}
+	return appendHead(b, 0, uint64(i))
+}
+
+func appendMap(b []byte, m map[any]any, depth int) ([]byte, error) {
+	type entry struct{ k, v []byte }
+	entries := make([]entry, 0, len(m))
+	for k, v := range m {
+		kb, err := appendItem(nil, k, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		vb, err := appendItem(nil, v, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{kb, vb})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, c := entries[i].k, entries[j].k
+		if len(a) != len(c) {
+			return len(a) < len(c)
+		}
+		return bytes.Compare(a, c) < 0
+	})
+	b = appendHead(b, 5, uint64(len(m)))
+	for _, e := range entries {
+		b = append(append(b, e.k...), e.v...)
+	}
+	return b, nil
+}
@@ -0,0 +1,103 @@
+package fdo
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		hex      string
+		expected any
+	}{
+		{name: "small uint", hex: "17", expected: uint64(23)},
+		{name: "uint16", hex: "190100", expected: uint64(256)},
+		{name: "negative int", hex: "3863", expected: int64(-100)},
+		{name: "byte string", hex: "43010203", expected: []byte{1, 2, 3}},
+		{name: "text string", hex: "6449455446", expected: "IETF"},
+		{name: "indefinite text", hex: "7f657374726561646d696e67ff", expected: "streaming"},
+		{name: "array", hex: "83010203", expected: []any{uint64(1), uint64(2), uint64(3)}},
+		{name: "indefinite array", hex: "9f0102ff", expected: []any{uint64(1), uint64(2)}},
+		{name: "map", hex: "a201020304", expected: map[any]any{uint64(1): uint64(2), uint64(3): uint64(4)}},
+		{name: "tag", hex: "c11a514b67b0", expected: Tag{Number: 1, Content: uint64(1363896240)}},
+		{name: "null", hex: "f6", expected: nil},
+		{name: "true", hex: "f5", expected: true},
+		{name: "half float", hex: "f93c00", expected: float64(1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := hex.DecodeString(tt.hex)
+			result, err := Decode(b)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("expected %#v, got %#v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+	}{
+		{name: "empty", hex: ""},
+		{name: "truncated string", hex: "4501"},
+		{name: "huge array length", hex: "9bffffffffffffffff"},
+		{name: "stray break", hex: "ff"},
+		{name: "byte string map key", hex: "a14101f6"},
+		{name: "reserved info", hex: "1c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := hex.DecodeString(tt.hex)
+			if _, err := Decode(b); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+
+	if _, err := Decode([]byte{0x01, 0x02}); !errors.Is(err, ErrTrailingData) {
+		t.Errorf("expected ErrTrailingData, got %v", err)
+	}
+}
+
+func TestDecode_NestingLimit(t *testing.T) {
+	b := bytes.Repeat([]byte{0x81}, maxDepth+2)
+	b = append(b, 0x00)
+	if _, err := Decode(b); err == nil {
+		t.Error("expected nesting error but got none")
+	}
+}
+
+func TestEncode_RoundTrip(t *testing.T) {
+	in := []any{
+		uint64(101),
+		int64(-5),
+		"text",
+		[]byte{0xde, 0xad},
+		map[any]any{"b": uint64(2), uint64(1): true},
+		Tag{Number: 24, Content: []byte{0x01}},
+		nil,
+	}
+
+	b, err := Encode(in)
+	if err != nil {
+		t.Fatalf("unexpected encode error: %v", err)
+	}
+	out, err := Decode(b)
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch: %#v != %#v", in, out)
+	}
+}
@@ -0,0 +1,105 @@
+package fdo
+
+import "fmt"
+
+// ErrorMessageType is the message type of an FDO ErrorMessage.
+const ErrorMessageType = 255
+
+// ErrorCode is the EMErrorCode of an ErrorMessage (FDO spec 3.8).
+type ErrorCode uint16
+
+// Error codes defined by the FDO specification.
+const (
+	ErrorInvalidJWTToken         ErrorCode = 1
+	ErrorInvalidOwnershipVoucher ErrorCode = 2
+	ErrorInvalidOwnerSignBody    ErrorCode = 3
+	ErrorInvalidIPAddress        ErrorCode = 4
+	ErrorInvalidGUID             ErrorCode = 5
+	ErrorResourceNotFound        ErrorCode = 6
+	ErrorMessageBody             ErrorCode = 100
+	ErrorInvalidMessage          ErrorCode = 101
+	ErrorCredReuse               ErrorCode = 102
+	ErrorInternalServer          ErrorCode = 500
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorInvalidJWTToken:
+		return "INVALID_JWT_TOKEN"
+	case ErrorInvalidOwnershipVoucher:
+		return "INVALID_OWNERSHIP_VOUCHER"
+	case ErrorInvalidOwnerSignBody:
+		return "INVALID_OWNER_SIGN_BODY"
+	case ErrorInvalidIPAddress:
+		return "INVALID_IP_ADDRESS"
+	case ErrorInvalidGUID:
+		return "INVALID_GUID"
+	case ErrorResourceNotFound:
+		return "RESOURCE_NOT_FOUND"
+	case ErrorMessageBody:
+		return "MESSAGE_BODY_ERROR"
+	case ErrorInvalidMessage:
+		return "INVALID_MESSAGE_ERROR"
+	case ErrorCredReuse:
+		return "CRED_REUSE_ERROR"
+	case ErrorInternalServer:
+		return "INTERNAL_SERVER_ERROR"
+	default:
+		return fmt.Sprintf("ErrorCode(%d)", uint16(c))
+	}
+}
+
+// ErrorMessage is the FDO ErrorMessage (msg 255):
+//
+//	ErrorMessage = [
+//	  EMErrorCode:   uint16,
+//	  EMPrevMsgID:   uint8,
+//	  EMErrorString: tstr,
+//	  EMErrorTS:     timestamp / null,
+//	  EMErrorCID:    uint
+//	]
+//
+// The timestamp is always sent as null.
+type ErrorMessage struct {
+	Code          ErrorCode
+	PrevMsgType   uint8
+	Message       string
+	CorrelationID uint64
+}
+
+// MarshalCBOR encodes the error message.
+func (e *ErrorMessage) MarshalCBOR() ([]byte, error) {
+	return Encode([]any{
+		uint64(e.Code),
+		uint64(e.PrevMsgType),
+		e.Message,
+		nil,
+		e.CorrelationID,
+	})
+}
+
+// ParseErrorMessage decodes an ErrorMessage body.
+func ParseErrorMessage(body []byte) (*ErrorMessage, error) {
+	fields, err := decodeArray(body, "ErrorMessage", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	var e ErrorMessage
+	code, ok := fields[0].(uint64)
+	if !ok || code > 0xffff {
+		return nil, fmt.Errorf("ErrorMessage: error code must be a uint16, got %v", fields[0])
+	}
+	e.Code = ErrorCode(code)
+	prev, ok := fields[1].(uint64)
+	if !ok || prev > 0xff {
+		return nil, fmt.Errorf("ErrorMessage: previous message ID must be a uint8, got %v", fields[1])
+	}
+	e.PrevMsgType = uint8(prev)
+	if e.Message, ok = fields[2].(string); !ok {
+		return nil, fmt.Errorf("ErrorMessage: error string is %T, want tstr", fields[2])
+	}
+	// Implementations disagree on the correlation ID; tolerate anything
+	e.CorrelationID, _ = fields[4].(uint64)
+	return &e, nil
+}
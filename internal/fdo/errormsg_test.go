@@ -0,0 +1,57 @@
+package fdo
+
+import "testing"
+
+func TestErrorMessage_RoundTrip(t *testing.T) {
+	in := &ErrorMessage{
+		Code:          ErrorInvalidMessage,
+		PrevMsgType:   10,
+		Message:       "device not allowed",
+		CorrelationID: 0xdeadbeef,
+	}
+	body, err := in.MarshalCBOR()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out, err := ParseErrorMessage(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *out != *in {
+		t.Errorf("expected %+v, got %+v", in, out)
+	}
+}
+
+func TestParseErrorMessage_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []any
+	}{
+		{"too short", []any{uint64(1), uint64(10), "x"}},
+		{"code too large", []any{uint64(70000), uint64(10), "x", nil, uint64(0)}},
+		{"previous message too large", []any{uint64(1), uint64(300), "x", nil, uint64(0)}},
+		{"string not text", []any{uint64(1), uint64(10), []byte("x"), nil, uint64(0)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := Encode(tt.msg)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if _, err := ParseErrorMessage(body); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestErrorCode_String(t *testing.T) {
+	if got := ErrorInternalServer.String(); got != "INTERNAL_SERVER_ERROR" {
+		t.Errorf("expected INTERNAL_SERVER_ERROR, got %s", got)
+	}
+	if got := ErrorCode(7).String(); got != "ErrorCode(7)" {
+		t.Errorf("expected ErrorCode(7), got %s", got)
+	}
+}
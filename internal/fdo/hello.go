@@ -0,0 +1,100 @@
+package fdo
+
+import "fmt"
+
+// NonceSize is the length of every FDO nonce.
+const NonceSize = 16
+
+// HelloDevice is the TO2.HelloDevice (msg 60) request:
+//
+//	TO2.HelloDevice = [
+//	  maxDeviceMessageSize: uint16,
+//	  Guid,
+//	  NonceTO2ProveOV,
+//	  kexSuiteName:         tstr,
+//	  cipherSuiteName:      CipherSuite,
+//	  eASigInfo:            eSigInfo
+//	]
+//
+// Only the fields the proxy uses are kept.
+type HelloDevice struct {
+	MaxMessageSize  uint64
+	GUID            GUID
+	NonceTO2ProveOV []byte
+	KexSuite        string
+}
+
+// ParseHelloDevice decodes a TO2.HelloDevice body.
+func ParseHelloDevice(body []byte) (*HelloDevice, error) {
+	fields, err := decodeArray(body, "TO2.HelloDevice", 6)
+	if err != nil {
+		return nil, err
+	}
+
+	var h HelloDevice
+	var ok bool
+	if h.MaxMessageSize, ok = fields[0].(uint64); !ok {
+		return nil, fmt.Errorf("TO2.HelloDevice: max message size is %T, want uint", fields[0])
+	}
+	if h.GUID, err = parseGUID(fields[1]); err != nil {
+		return nil, fmt.Errorf("TO2.HelloDevice: %w", err)
+	}
+	if h.NonceTO2ProveOV, err = parseNonce(fields[2]); err != nil {
+		return nil, fmt.Errorf("TO2.HelloDevice: %w", err)
+	}
+	if h.KexSuite, ok = fields[3].(string); !ok {
+		return nil, fmt.Errorf("TO2.HelloDevice: kex suite is %T, want tstr", fields[3])
+	}
+	return &h, nil
+}
+
+// ParseHelloRV decodes the device GUID from a TO1.HelloRV (msg 30) body:
+//
+//	TO1.HelloRV = [ Guid, eASigInfo ]
+func ParseHelloRV(body []byte) (GUID, error) {
+	fields, err := decodeArray(body, "TO1.HelloRV", 2)
+	if err != nil {
+		return GUID{}, err
+	}
+	g, err := parseGUID(fields[0])
+	if err != nil {
+		return GUID{}, fmt.Errorf("TO1.HelloRV: %w", err)
+	}
+	return g, nil
+}
+
+// ParseLeadingNonce decodes the nonce that opens TO0.HelloAck (msg 21) and
+// TO1.HelloRVAck (msg 31):
+//
+//	TO0.HelloAck   = [ NonceTO0Sign ]
+//	TO1.HelloRVAck = [ NonceTO1Proof, eBSigInfo ]
+func ParseLeadingNonce(body []byte) ([]byte, error) {
+	fields, err := decodeArray(body, "message", 1)
+	if err != nil {
+		return nil, err
+	}
+	return parseNonce(fields[0])
+}
+
+func decodeArray(body []byte, name string, minLen int) ([]any, error) {
+	v, err := Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", name, err)
+	}
+	fields, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected array, got %T", name, v)
+	}
+	if len(fields) < minLen {
+		return nil, fmt.Errorf("%s: expected at least %d fields, got %d", name, minLen, len(fields))
+	}
+	return fields, nil
+}
+
+func parseNonce(v any) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok || len(b) != NonceSize {
+		return nil, fmt.Errorf("nonce must be a %d byte bstr, got %T", NonceSize, v)
+	}
+	return b, nil
+}
@@ -0,0 +1,54 @@
+package fdo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseHelloDevice(t *testing.T) {
+	guid := bytes.Repeat([]byte{0x11}, 16)
+	nonce := bytes.Repeat([]byte{0x22}, 16)
+	body, _ := Encode([]any{uint64(1300), guid, nonce, "ECDH384", uint64(2), []any{int64(-35), []byte{}}})
+
+	h, err := ParseHelloDevice(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if h.MaxMessageSize != 1300 || h.KexSuite != "ECDH384" {
+		t.Errorf("unexpected HelloDevice %+v", h)
+	}
+	if !bytes.Equal(h.GUID[:], guid) || !bytes.Equal(h.NonceTO2ProveOV, nonce) {
+		t.Error("GUID or nonce mismatch")
+	}
+
+	short, _ := Encode([]any{uint64(1300), guid, []byte{0x01}, "ECDH384", uint64(2), nil})
+	if _, err := ParseHelloDevice(short); err == nil {
+		t.Error("expected error for short nonce")
+	}
+}
+
+func TestParseHelloRV(t *testing.T) {
+	guid := bytes.Repeat([]byte{0x33}, 16)
+	body, _ := Encode([]any{guid, []any{int64(-7), []byte{}}})
+
+	g, err := ParseHelloRV(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(g[:], guid) {
+		t.Error("GUID mismatch")
+	}
+}
+
+func TestParseLeadingNonce(t *testing.T) {
+	nonce := bytes.Repeat([]byte{0x44}, 16)
+	body, _ := Encode([]any{nonce, []any{int64(-7), []byte{}}})
+
+	n, err := ParseLeadingNonce(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(n, nonce) {
+		t.Error("nonce mismatch")
+	}
+}
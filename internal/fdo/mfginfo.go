@@ -0,0 +1,191 @@
+package fdo
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+// KeyType identifies the device attestation key algorithm (FDO spec 3.3.4).
+type KeyType uint64
+
+// Key types defined by the FDO specification.
+const (
+	KeyTypeRSA2048Restr KeyType = 1
+	KeyTypeRSAPKCS      KeyType = 5
+	KeyTypeRSAPSS       KeyType = 6
+	KeyTypeSecp256r1    KeyType = 10
+	KeyTypeSecp384r1    KeyType = 11
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyTypeRSA2048Restr:
+		return "RSA2048RESTR"
+	case KeyTypeRSAPKCS:
+		return "RSAPKCS"
+	case KeyTypeRSAPSS:
+		return "RSAPSS"
+	case KeyTypeSecp256r1:
+		return "SECP256R1"
+	case KeyTypeSecp384r1:
+		return "SECP384R1"
+	default:
+		return fmt.Sprintf("KeyType(%d)", uint64(t))
+	}
+}
+
+// KeyEncoding identifies how a public key is encoded (FDO spec 3.3.4).
+type KeyEncoding uint64
+
+// Key encodings defined by the FDO specification.
+const (
+	KeyEncodingCrypto  KeyEncoding = 0
+	KeyEncodingX509    KeyEncoding = 1
+	KeyEncodingX5Chain KeyEncoding = 2
+	KeyEncodingCOSEKey KeyEncoding = 3
+)
+
+// DeviceMfgInfo is the manufacturer-specific payload a device sends in
+// DI.AppStart. The spec leaves the layout open; this follows the array
+// shape used by the go-fdo, C and Java clients:
+//
+//	DeviceMfgInfo = [
+//	  pkType,      ; uint
+//	  pkEnc,       ; uint
+//	  ?hashAlg,    ; int, newer go-fdo clients only
+//	  serialNo,    ; tstr
+//	  deviceInfo,  ; tstr
+//	  CSR,         ; bstr, DER PKCS#10
+//	  ...          ; optional vendor fields, ignored
+//	]
+type DeviceMfgInfo struct {
+	KeyType      KeyType
+	KeyEncoding  KeyEncoding
+	SerialNumber string
+	DeviceInfo   string
+	CSR          []byte
+}
+
+// ParseAppStart decodes a DI.AppStart (msg 10) body:
+//
+//	DI.AppStart = [ DeviceMfgInfo ]
+//
+// DeviceMfgInfo may be carried inline or wrapped in a byte string, as go-fdo
+// does; both forms are accepted.
+func ParseAppStart(body []byte) (*DeviceMfgInfo, error) {
+	v, err := Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode DI.AppStart: %w", err)
+	}
+	msg, ok := v.([]any)
+	if !ok || len(msg) < 1 {
+		return nil, fmt.Errorf("DI.AppStart: expected non-empty array, got %T", v)
+	}
+
+	info := msg[0]
+	if wrapped, ok := info.([]byte); ok {
+		if info, err = Decode(wrapped); err != nil {
+			return nil, fmt.Errorf("decode DeviceMfgInfo: %w", err)
+		}
+	}
+	fields, ok := info.([]any)
+	if !ok {
+		return nil, fmt.Errorf("DeviceMfgInfo: expected array, got %T", info)
+	}
+	return parseMfgInfo(fields)
+}
+
+func parseMfgInfo(fields []any) (*DeviceMfgInfo, error) {
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("DeviceMfgInfo: expected at least 4 fields, got %d", len(fields))
+	}
+
+	keyType, ok := fields[0].(uint64)
+	if !ok {
+		return nil, fmt.Errorf("DeviceMfgInfo: key type is %T, want uint", fields[0])
+	}
+	keyEnc, ok := fields[1].(uint64)
+	if !ok {
+		return nil, fmt.Errorf("DeviceMfgInfo: key encoding is %T, want uint", fields[1])
+	}
+
+	rest := fields[2:]
+	switch rest[0].(type) {
+	case uint64, int64: // COSE hash algorithm identifiers are negative
+		rest = rest[1:]
+	}
+	if len(rest) < 2 {
+		return nil, fmt.Errorf("DeviceMfgInfo: missing serial number or device info")
+	}
+
+	serial, ok := rest[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("DeviceMfgInfo: serial number is %T, want tstr", rest[0])
+	}
+	deviceInfo, ok := rest[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("DeviceMfgInfo: device info is %T, want tstr", rest[1])
+	}
+
+	out := &DeviceMfgInfo{
+		KeyType:      KeyType(keyType),
+		KeyEncoding:  KeyEncoding(keyEnc),
+		SerialNumber: serial,
+		DeviceInfo:   deviceInfo,
+	}
+	if len(rest) > 2 {
+		if csr, ok := rest[2].([]byte); ok {
+			out.CSR = csr
+		}
+	}
+	return out, nil
+}
+
+// MfgInfoField selects which DeviceMfgInfo value identifies the device to
+// external services.
+type MfgInfoField string
+
+// Supported DeviceMfgInfo identifier fields.
+const (
+	MfgInfoSerialNumber MfgInfoField = "serial"
+	MfgInfoDeviceInfo   MfgInfoField = "device-info"
+	MfgInfoCSRSubjectCN MfgInfoField = "csr-cn"
+)
+
+// ParseMfgInfoField validates a field name, typically from a flag.
+func ParseMfgInfoField(s string) (MfgInfoField, error) {
+	switch f := MfgInfoField(s); f {
+	case MfgInfoSerialNumber, MfgInfoDeviceInfo, MfgInfoCSRSubjectCN:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown DeviceMfgInfo field %q (want %s, %s or %s)",
+			s, MfgInfoSerialNumber, MfgInfoDeviceInfo, MfgInfoCSRSubjectCN)
+	}
+}
+
+// Field returns the value of the selected field, or an error if the device
+// did not report it.
+func (m *DeviceMfgInfo) Field(f MfgInfoField) (string, error) {
+	var v string
+	switch f {
+	case MfgInfoSerialNumber:
+		v = m.SerialNumber
+	case MfgInfoDeviceInfo:
+		v = m.DeviceInfo
+	case MfgInfoCSRSubjectCN:
+		if len(m.CSR) == 0 {
+			return "", fmt.Errorf("device sent no CSR")
+		}
+		csr, err := x509.ParseCertificateRequest(m.CSR)
+		if err != nil {
+			return "", fmt.Errorf("parse CSR: %w", err)
+		}
+		v = csr.Subject.CommonName
+	default:
+		return "", fmt.Errorf("unknown DeviceMfgInfo field %q", f)
+	}
+	if v == "" {
+		return "", fmt.Errorf("DeviceMfgInfo field %q is empty", f)
+	}
+	return v, nil
+}
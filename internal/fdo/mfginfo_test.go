@@ -0,0 +1,140 @@
+package fdo
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func encodeAppStart(t *testing.T, fields []any, wrap bool) []byte {
+	t.Helper()
+	var info any = fields
+	if wrap {
+		b, err := Encode(fields)
+		if err != nil {
+			t.Fatalf("encode DeviceMfgInfo: %v", err)
+		}
+		info = b
+	}
+	body, err := Encode([]any{info})
+	if err != nil {
+		t.Fatalf("encode DI.AppStart: %v", err)
+	}
+	return body
+}
+
+func TestParseAppStart(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []any
+		wrap   bool
+	}{
+		{
+			name:   "bstr wrapped",
+			fields: []any{uint64(10), uint64(1), "SN-42", "model-x", []byte{0x30}},
+			wrap:   true,
+		},
+		{
+			name:   "inline",
+			fields: []any{uint64(10), uint64(1), "SN-42", "model-x", []byte{0x30}},
+		},
+		{
+			name:   "with hash algorithm",
+			fields: []any{uint64(10), uint64(1), int64(-16), "SN-42", "model-x", []byte{0x30}},
+			wrap:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ParseAppStart(encodeAppStart(t, tt.fields, tt.wrap))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if info.KeyType != KeyTypeSecp256r1 {
+				t.Errorf("expected key type %s, got %s", KeyTypeSecp256r1, info.KeyType)
+			}
+			if info.KeyEncoding != KeyEncodingX509 {
+				t.Errorf("expected key encoding %d, got %d", KeyEncodingX509, info.KeyEncoding)
+			}
+			if info.SerialNumber != "SN-42" {
+				t.Errorf("expected serial 'SN-42', got '%s'", info.SerialNumber)
+			}
+			if info.DeviceInfo != "model-x" {
+				t.Errorf("expected device info 'model-x', got '%s'", info.DeviceInfo)
+			}
+			if len(info.CSR) != 1 {
+				t.Errorf("expected 1 byte CSR, got %d", len(info.CSR))
+			}
+		})
+	}
+}
+
+func TestParseAppStart_Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		body any
+	}{
+		{name: "not an array", body: "hello"},
+		{name: "empty array", body: []any{}},
+		{name: "too few fields", body: []any{[]any{uint64(10), uint64(1), "SN"}}},
+		{name: "serial not text", body: []any{[]any{uint64(10), uint64(1), []byte("SN"), "model"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := Encode(tt.body)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if _, err := ParseAppStart(b); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestDeviceMfgInfo_Field(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "191e886b-dfff-4f39-9618-d7a364ec0c90"},
+	}, key)
+	if err != nil {
+		t.Fatalf("create CSR: %v", err)
+	}
+
+	info := &DeviceMfgInfo{SerialNumber: "SN-42", DeviceInfo: "model-x", CSR: csr}
+
+	tests := []struct {
+		field    MfgInfoField
+		expected string
+	}{
+		{MfgInfoSerialNumber, "SN-42"},
+		{MfgInfoDeviceInfo, "model-x"},
+		{MfgInfoCSRSubjectCN, "191e886b-dfff-4f39-9618-d7a364ec0c90"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.field), func(t *testing.T) {
+			v, err := info.Field(tt.field)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if v != tt.expected {
+				t.Errorf("expected '%s', got '%s'", tt.expected, v)
+			}
+		})
+	}
+
+	if _, err := (&DeviceMfgInfo{}).Field(MfgInfoCSRSubjectCN); err == nil {
+		t.Error("expected error for missing CSR")
+	}
+	if _, err := ParseMfgInfoField("board_sn"); err == nil {
+		t.Error("expected error for unknown field name")
+	}
+}
@@ -0,0 +1,76 @@
+package fdo
+
+import "fmt"
+
+// COSE header labels the proxy reads (FDO spec 3.3.2).
+const (
+	coseSign1Tag         = 18
+	cuphOwnerPubKeyLabel = 257
+)
+
+// ProveOVHdr is the part of a TO2.ProveOVHdr (msg 61) response the proxy
+// uses. The message is a COSE_Sign1 signed by the current owner:
+//
+//	TO2.ProveOVHdr = CoseSignature
+//	TO2ProveOVHdrPayload = [
+//	  bstr .cbor OVHeader,
+//	  NumOVEntries: uint8,
+//	  HMac,
+//	  NonceTO2ProveOV,
+//	  eBSigInfo,
+//	  xAKeyExchange,
+//	  helloDeviceHash: Hash,
+//	  maxOwnerMessageSize: uint16
+//	]
+//
+// The owner's public key travels in the CUPHOwnerPubKey unprotected header.
+// The signature is not verified; the device does that.
+type ProveOVHdr struct {
+	Header       *OVHeader
+	NumOVEntries uint64
+	// OwnerKey is nil if the backend did not send CUPHOwnerPubKey.
+	OwnerKey *PublicKey
+}
+
+// ParseProveOVHdr decodes a TO2.ProveOVHdr body. The COSE_Sign1 may be
+// tagged or untagged.
+func ParseProveOVHdr(body []byte) (*ProveOVHdr, error) {
+	v, err := Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode TO2.ProveOVHdr: %w", err)
+	}
+	if tag, ok := v.(Tag); ok && tag.Number == coseSign1Tag {
+		v = tag.Content
+	}
+	sign1, ok := v.([]any)
+	if !ok || len(sign1) != 4 {
+		return nil, fmt.Errorf("TO2.ProveOVHdr: expected 4 element COSE_Sign1, got %T", v)
+	}
+
+	var p ProveOVHdr
+	if unprotected, ok := sign1[1].(map[any]any); ok {
+		if raw, ok := unprotected[uint64(cuphOwnerPubKeyLabel)]; ok {
+			key, err := parsePublicKey(raw)
+			if err != nil {
+				return nil, fmt.Errorf("TO2.ProveOVHdr: owner %w", err)
+			}
+			p.OwnerKey = &key
+		}
+	}
+
+	payload, ok := sign1[2].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("TO2.ProveOVHdr: payload is %T, want bstr", sign1[2])
+	}
+	fields, err := decodeArray(payload, "TO2.ProveOVHdr payload", 2)
+	if err != nil {
+		return nil, err
+	}
+	if p.Header, err = parseOVHeader(fields[0]); err != nil {
+		return nil, fmt.Errorf("TO2.ProveOVHdr: %w", err)
+	}
+	if p.NumOVEntries, ok = fields[1].(uint64); !ok {
+		return nil, fmt.Errorf("TO2.ProveOVHdr: entry count is %T, want uint", fields[1])
+	}
+	return &p, nil
+}
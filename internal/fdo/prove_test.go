@@ -0,0 +1,112 @@
+package fdo
+
+import (
+	"strings"
+	"testing"
+)
+
+func testProveOVHdr(t *testing.T, tagged bool, unprotected map[any]any) []byte {
+	t.Helper()
+	hdr, _ := Encode(testOVHeader())
+	nonce := make([]byte, NonceSize)
+	payload, err := Encode([]any{hdr, uint64(2), []any{int64(5), []byte{0x01}}, nonce})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var sign1 any = []any{[]byte{0xa1, 0x01, 0x26}, unprotected, payload, []byte{0xde, 0xad}}
+	if tagged {
+		sign1 = Tag{Number: 18, Content: sign1}
+	}
+	body, err := Encode(sign1)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return body
+}
+
+func TestParseProveOVHdr(t *testing.T) {
+	ownerKey := []any{uint64(KeyTypeSecp256r1), uint64(KeyEncodingX509), []byte{0x30, 0x02}}
+	withKey := map[any]any{uint64(256): make([]byte, NonceSize), uint64(257): ownerKey}
+
+	tests := []struct {
+		name        string
+		body        []byte
+		expectOwner bool
+	}{
+		{name: "tagged", body: testProveOVHdr(t, true, withKey), expectOwner: true},
+		{name: "untagged", body: testProveOVHdr(t, false, withKey), expectOwner: true},
+		{name: "no owner key", body: testProveOVHdr(t, true, map[any]any{})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseProveOVHdr(tt.body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := p.Header.GUID.String(); got != "191e886b-dfff-4f39-9618-d7a364ec0c90" {
+				t.Errorf("unexpected GUID %s", got)
+			}
+			if p.NumOVEntries != 2 {
+				t.Errorf("expected 2 voucher entries, got %d", p.NumOVEntries)
+			}
+			if (p.OwnerKey != nil) != tt.expectOwner {
+				t.Fatalf("expected owner key %v, got %+v", tt.expectOwner, p.OwnerKey)
+			}
+			if tt.expectOwner && p.OwnerKey.Type != KeyTypeSecp256r1 {
+				t.Errorf("unexpected owner key %+v", p.OwnerKey)
+			}
+		})
+	}
+}
+
+func TestParseProveOVHdr_Malformed(t *testing.T) {
+	notSign1, _ := Encode([]any{[]byte{}, map[any]any{}})
+	badPayload, _ := Encode([]any{[]byte{}, map[any]any{}, "payload", []byte{}})
+	badKey, _ := Encode([]any{[]byte{}, map[any]any{uint64(257): "key"}, []byte{0x80}, []byte{}})
+
+	for name, body := range map[string][]byte{
+		"not cbor":         {0xff},
+		"not COSE_Sign1":   notSign1,
+		"payload not bstr": badPayload,
+		"bad owner key":    badKey,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseProveOVHdr(body); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestPublicKey_PEM(t *testing.T) {
+	chain, _ := Encode([]any{[]byte{0x30, 0x01}, []byte{0x30, 0x02}})
+
+	tests := []struct {
+		name        string
+		key         PublicKey
+		expectCerts int
+		expectKey   bool
+		expectError bool
+	}{
+		{name: "x509", key: PublicKey{Encoding: KeyEncodingX509, Body: []byte{0x30, 0x01}}, expectKey: true},
+		{name: "x5chain", key: PublicKey{Encoding: KeyEncodingX5Chain, Body: chain}, expectCerts: 2},
+		{name: "cose key", key: PublicKey{Encoding: KeyEncodingCOSEKey, Body: []byte{0xa0}}, expectError: true},
+		{name: "empty x509", key: PublicKey{Encoding: KeyEncodingX509}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.key.PEM()
+			if (err != nil) != tt.expectError {
+				t.Fatalf("expected error %v, got %v", tt.expectError, err)
+			}
+			if n := strings.Count(got, "BEGIN CERTIFICATE"); n != tt.expectCerts {
+				t.Errorf("expected %d certificates, got %d", tt.expectCerts, n)
+			}
+			if has := strings.Contains(got, "BEGIN PUBLIC KEY"); has != tt.expectKey {
+				t.Errorf("expected public key block %v, got %q", tt.expectKey, got)
+			}
+		})
+	}
+}
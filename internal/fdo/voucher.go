@@ -0,0 +1,267 @@
+package fdo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+)
+
+// GUID is the 16 byte device identifier assigned during DI.
+type GUID [16]byte
+
+// String formats the GUID in canonical 8-4-4-4-12 UUID form.
+func (g GUID) String() string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], g[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], g[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], g[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], g[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], g[10:])
+	return string(buf[:])
+}
+
+// PublicKey is an FDO PublicKey structure:
+//
+//	PublicKey = [ pkType, pkEnc, pkBody ]
+type PublicKey struct {
+	Type     KeyType
+	Encoding KeyEncoding
+	// Body is the raw key body. For X509 and Crypto encodings it is the DER
+	// bytes; for X5Chain and COSEKey it is the re-encoded CBOR item.
+	Body []byte
+}
+
+// PEM returns the key in PEM form: a PUBLIC KEY block for the X509
+// encoding, or one CERTIFICATE block per certificate, leaf first, for
+// X5Chain. Other encodings have no PEM form and return an error.
+func (k PublicKey) PEM() (string, error) {
+	var buf bytes.Buffer
+	switch k.Encoding {
+	case KeyEncodingX509:
+		if len(k.Body) == 0 {
+			return "", fmt.Errorf("public key: empty X509 body")
+		}
+		pem.Encode(&buf, &pem.Block{Type: "PUBLIC KEY", Bytes: k.Body})
+	case KeyEncodingX5Chain:
+		v, err := Decode(k.Body)
+		if err != nil {
+			return "", fmt.Errorf("decode X5Chain: %w", err)
+		}
+		chain, ok := v.([]any)
+		if !ok || len(chain) == 0 {
+			return "", fmt.Errorf("X5Chain: expected non-empty array, got %T", v)
+		}
+		for i, c := range chain {
+			der, ok := c.([]byte)
+			if !ok {
+				return "", fmt.Errorf("X5Chain: certificate %d is %T, want bstr", i, c)
+			}
+			pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		}
+	default:
+		return "", fmt.Errorf("public key encoding %d has no PEM form", uint64(k.Encoding))
+	}
+	return buf.String(), nil
+}
+
+// Fingerprint returns the hex SHA-256 of the key body, a stable identifier
+// for the key whatever its encoding.
+func (k PublicKey) Fingerprint() string {
+	sum := sha256.Sum256(k.Body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Hash is an FDO Hash or HMAC structure:
+//
+//	Hash = [ hashtype, hash ]
+type Hash struct {
+	Algorithm int64
+	Value     []byte
+}
+
+// RVInstruction is one rendezvous variable/value pair. Value is the CBOR
+// encoded argument, left undecoded since its type depends on Variable.
+type RVInstruction struct {
+	Variable uint64
+	Value    []byte
+}
+
+// RVDirective is a list of instructions describing one way to reach a
+// rendezvous server.
+type RVDirective []RVInstruction
+
+// OVHeader is the ownership voucher header the manufacturer issues in
+// DI.SetCredentials:
+//
+//	OVHeader = [
+//	  OVHProtVer:         protver,
+//	  OVGuid:             Guid,
+//	  OVRVInfo:           RendezvousInfo,
+//	  OVDeviceInfo:       tstr,
+//	  OVPubKey:           PublicKey,
+//	  OVDevCertChainHash: Hash / null
+//	]
+type OVHeader struct {
+	ProtocolVersion uint64
+	GUID            GUID
+	RendezvousInfo  []RVDirective
+	DeviceInfo      string
+	ManufacturerKey PublicKey
+	CertChainHash   *Hash
+}
+
+// ParseSetCredentials decodes a DI.SetCredentials (msg 11) body:
+//
+//	DI.SetCredentials = [ OVHeader ]
+//
+// The header may be carried inline or wrapped in a byte string as it is
+// inside a full ownership voucher; both forms are accepted.
+func ParseSetCredentials(body []byte) (*OVHeader, error) {
+	v, err := Decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode DI.SetCredentials: %w", err)
+	}
+	msg, ok := v.([]any)
+	if !ok || len(msg) < 1 {
+		return nil, fmt.Errorf("DI.SetCredentials: expected non-empty array, got %T", v)
+	}
+	return parseOVHeader(msg[0])
+}
+
+func parseOVHeader(v any) (*OVHeader, error) {
+	if wrapped, ok := v.([]byte); ok {
+		var err error
+		if v, err = Decode(wrapped); err != nil {
+			return nil, fmt.Errorf("decode OVHeader: %w", err)
+		}
+	}
+	fields, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("OVHeader: expected array, got %T", v)
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("OVHeader: expected 6 fields, got %d", len(fields))
+	}
+
+	var h OVHeader
+	if h.ProtocolVersion, ok = fields[0].(uint64); !ok {
+		return nil, fmt.Errorf("OVHeader: protocol version is %T, want uint", fields[0])
+	}
+	guid, err := parseGUID(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("OVHeader: %w", err)
+	}
+	h.GUID = guid
+	if h.RendezvousInfo, err = parseRVInfo(fields[2]); err != nil {
+		return nil, fmt.Errorf("OVHeader: %w", err)
+	}
+	if h.DeviceInfo, ok = fields[3].(string); !ok {
+		return nil, fmt.Errorf("OVHeader: device info is %T, want tstr", fields[3])
+	}
+	if h.ManufacturerKey, err = parsePublicKey(fields[4]); err != nil {
+		return nil, fmt.Errorf("OVHeader: %w", err)
+	}
+	if fields[5] != nil {
+		hash, err := parseHash(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("OVHeader: cert chain %w", err)
+		}
+		h.CertChainHash = hash
+	}
+	return &h, nil
+}
+
+func parseGUID(v any) (GUID, error) {
+	var g GUID
+	b, ok := v.([]byte)
+	if !ok || len(b) != len(g) {
+		return g, fmt.Errorf("GUID must be a 16 byte bstr, got %T", v)
+	}
+	copy(g[:], b)
+	return g, nil
+}
+
+func parsePublicKey(v any) (PublicKey, error) {
+	fields, ok := v.([]any)
+	if !ok || len(fields) != 3 {
+		return PublicKey{}, fmt.Errorf("public key must be a 3 element array")
+	}
+	keyType, ok := fields[0].(uint64)
+	if !ok {
+		return PublicKey{}, fmt.Errorf("public key type is %T, want uint", fields[0])
+	}
+	keyEnc, ok := fields[1].(uint64)
+	if !ok {
+		return PublicKey{}, fmt.Errorf("public key encoding is %T, want uint", fields[1])
+	}
+
+	body, ok := fields[2].([]byte)
+	if !ok {
+		var err error
+		if body, err = Encode(fields[2]); err != nil {
+			return PublicKey{}, fmt.Errorf("public key body: %w", err)
+		}
+	}
+	return PublicKey{Type: KeyType(keyType), Encoding: KeyEncoding(keyEnc), Body: body}, nil
+}
+
+func parseHash(v any) (*Hash, error) {
+	fields, ok := v.([]any)
+	if !ok || len(fields) != 2 {
+		return nil, fmt.Errorf("hash must be a 2 element array")
+	}
+	var alg int64
+	switch a := fields[0].(type) {
+	case int64:
+		alg = a
+	case uint64:
+		alg = int64(a)
+	default:
+		return nil, fmt.Errorf("hash algorithm is %T, want int", fields[0])
+	}
+	value, ok := fields[1].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("hash value is %T, want bstr", fields[1])
+	}
+	return &Hash{Algorithm: alg, Value: value}, nil
+}
+
+func parseRVInfo(v any) ([]RVDirective, error) {
+	directives, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("rendezvous info is %T, want array", v)
+	}
+	out := make([]RVDirective, 0, len(directives))
+	for i, d := range directives {
+		instrs, ok := d.([]any)
+		if !ok {
+			return nil, fmt.Errorf("rendezvous directive %d is %T, want array", i, d)
+		}
+		directive := make(RVDirective, 0, len(instrs))
+		for _, in := range instrs {
+			pair, ok := in.([]any)
+			if !ok || len(pair) < 1 || len(pair) > 2 {
+				return nil, fmt.Errorf("rendezvous directive %d: malformed instruction", i)
+			}
+			variable, ok := pair[0].(uint64)
+			if !ok {
+				return nil, fmt.Errorf("rendezvous directive %d: variable is %T, want uint", i, pair[0])
+			}
+			instr := RVInstruction{Variable: variable}
+			if len(pair) == 2 {
+				if instr.Value, ok = pair[1].([]byte); !ok {
+					return nil, fmt.Errorf("rendezvous directive %d: value is %T, want bstr", i, pair[1])
+				}
+			}
+			directive = append(directive, instr)
+		}
+		out = append(out, directive)
+	}
+	return out, nil
+}
@@ -0,0 +1,90 @@
+package fdo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testOVHeader() []any {
+	guid := []byte{0x19, 0x1e, 0x88, 0x6b, 0xdf, 0xff, 0x4f, 0x39, 0x96, 0x18, 0xd7, 0xa3, 0x64, 0xec, 0x0c, 0x90}
+	rvValue, _ := Encode("rv.example.com")
+	return []any{
+		uint64(101),
+		guid,
+		[]any{[]any{[]any{uint64(2), rvValue}, []any{uint64(14)}}},
+		"model-x",
+		[]any{uint64(KeyTypeSecp384r1), uint64(KeyEncodingX509), []byte{0x30, 0x01}},
+		[]any{int64(-43), []byte{0xaa, 0xbb}},
+	}
+}
+
+func TestParseSetCredentials(t *testing.T) {
+	inline, err := Encode([]any{testOVHeader()})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	hdr, _ := Encode(testOVHeader())
+	wrapped, err := Encode([]any{hdr})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	for name, body := range map[string][]byte{"inline": inline, "bstr wrapped": wrapped} {
+		t.Run(name, func(t *testing.T) {
+			h, err := ParseSetCredentials(body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if h.ProtocolVersion != 101 {
+				t.Errorf("expected protocol version 101, got %d", h.ProtocolVersion)
+			}
+			if got := h.GUID.String(); got != "191e886b-dfff-4f39-9618-d7a364ec0c90" {
+				t.Errorf("unexpected GUID %s", got)
+			}
+			if len(h.RendezvousInfo) != 1 || len(h.RendezvousInfo[0]) != 2 {
+				t.Fatalf("unexpected rendezvous info %+v", h.RendezvousInfo)
+			}
+			if h.RendezvousInfo[0][0].Variable != 2 || h.RendezvousInfo[0][1].Value != nil {
+				t.Errorf("unexpected rendezvous instructions %+v", h.RendezvousInfo[0])
+			}
+			if h.DeviceInfo != "model-x" {
+				t.Errorf("expected device info 'model-x', got '%s'", h.DeviceInfo)
+			}
+			if h.ManufacturerKey.Type != KeyTypeSecp384r1 || !bytes.Equal(h.ManufacturerKey.Body, []byte{0x30, 0x01}) {
+				t.Errorf("unexpected manufacturer key %+v", h.ManufacturerKey)
+			}
+			if h.CertChainHash == nil || h.CertChainHash.Algorithm != -43 {
+				t.Errorf("unexpected cert chain hash %+v", h.CertChainHash)
+			}
+		})
+	}
+}
+
+func TestParseSetCredentials_NullCertChainHash(t *testing.T) {
+	fields := testOVHeader()
+	fields[5] = nil
+	body, _ := Encode([]any{fields})
+
+	h, err := ParseSetCredentials(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if h.CertChainHash != nil {
+		t.Errorf("expected nil cert chain hash, got %+v", h.CertChainHash)
+	}
+}
+
+func TestParseSetCredentials_Malformed(t *testing.T) {
+	shortGUID := testOVHeader()
+	shortGUID[1] = []byte{0x01}
+	missingField := testOVHeader()[:5]
+
+	for name, fields := range map[string][]any{"short GUID": shortGUID, "missing field": missingField} {
+		t.Run(name, func(t *testing.T) {
+			body, _ := Encode([]any{fields})
+			if _, err := ParseSetCredentials(body); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Circuit breaker defaults.
+const (
+	DefaultBreakerFailures = 5
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without calling the service while its circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerConfig configures the circuit breaker in front of one endpoint.
+// Zero values use the defaults.
+type BreakerConfig struct {
+	// Failures is how many consecutive failed attempts open the breaker.
+	Failures int
+	// Cooldown is how long the breaker stays open before a single probe
+	// call is let through.
+	Cooldown time.Duration
+}
+
+// BreakerState is the state of an endpoint's circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets calls through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails calls immediately with ErrCircuitOpen.
+	BreakerOpen
+	// BreakerHalfOpen lets one probe call through; its outcome closes or
+	// reopens the breaker.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker trips after consecutive failures so a struggling service fails
+// fast instead of holding up every FDO message that depends on it.
+type breaker struct {
+	endpoint string
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	state       BreakerState
+	consecutive int
+	openedAt    time.Time
+	probing     bool
+}
+
+func newBreaker(endpoint string, cfg BreakerConfig) *breaker {
+	if cfg.Failures <= 0 {
+		cfg.Failures = DefaultBreakerFailures
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = DefaultBreakerCooldown
+	}
+	recordBreakerState(endpoint, BreakerClosed)
+	return &breaker{
+		endpoint: endpoint,
+		failures: cfg.Failures,
+		cooldown: cfg.Cooldown,
+		now:      time.Now,
+	}
+}
+
+// State returns the current state, moving an open breaker whose cooldown
+// has elapsed to half-open.
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+	return b.state
+}
+
+// allow returns nil if a call may proceed, or an error wrapping
+// ErrCircuitOpen. A nil breaker allows everything.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance()
+
+	switch b.state {
+	case BreakerOpen:
+		retryIn := b.cooldown - b.now().Sub(b.openedAt)
+		return fmt.Errorf("%s: %w, retry in %s", b.endpoint, ErrCircuitOpen, retryIn.Round(time.Second))
+	case BreakerHalfOpen:
+		if b.probing {
+			return fmt.Errorf("%s: %w, probe in progress", b.endpoint, ErrCircuitOpen)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record reports the outcome of a call let through by allow.
+func (b *breaker) record(ok bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok {
+		if b.state != BreakerClosed {
+			slog.Info("Ledger circuit breaker closed", "endpoint", b.endpoint)
+		}
+		b.state = BreakerClosed
+		recordBreakerState(b.endpoint, b.state)
+		b.consecutive = 0
+		b.probing = false
+		return
+	}
+
+	b.consecutive++
+	if b.state == BreakerHalfOpen || b.consecutive >= b.failures {
+		if b.state != BreakerOpen {
+			slog.Warn("Ledger circuit breaker opened",
+				"endpoint", b.endpoint,
+				"consecutive_failures", b.consecutive,
+				"cooldown", b.cooldown)
+		}
+		b.state = BreakerOpen
+		recordBreakerState(b.endpoint, b.state)
+		b.openedAt = b.now()
+		b.probing = false
+	}
+}
+
+// release gives back a call let through by allow whose outcome says
+// nothing about the service, such as one cancelled by the caller.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// advance moves an open breaker to half-open once its cooldown has elapsed.
+// Callers hold b.mu.
+func (b *breaker) advance() {
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+		recordBreakerState(b.endpoint, b.state)
+		b.probing = false
+		slog.Info("Ledger circuit breaker half-open, probing", "endpoint", b.endpoint)
+	}
+}
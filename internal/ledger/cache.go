@@ -0,0 +1,286 @@
+package ledger
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// API is the passport service surface used by the proxy. *Client and
+// *PassportCache implement it, and so satisfy proxy.LedgerClient.
+type API interface {
+	GetProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error)
+	CreateCommissioningPassport(ctx context.Context, body *CommissioningCreateRequest) error
+}
+
+// Passport cache defaults.
+const (
+	DefaultCacheTTL         = 5 * time.Minute
+	DefaultCacheNegativeTTL = 30 * time.Second
+	DefaultCacheMaxEntries  = 10000
+)
+
+// CacheConfig configures a PassportCache. Zero values use the defaults.
+type CacheConfig struct {
+	// TTL is how long a fetched passport is served from the cache.
+	TTL time.Duration
+	// NegativeTTL is how long a "no passport" (HTTP 404) answer is cached.
+	NegativeTTL time.Duration
+	// MaxEntries bounds the cache; the least recently used entry is evicted.
+	MaxEntries int
+}
+
+// CacheStats is a snapshot of cache activity.
+type CacheStats struct {
+	Entries      int    `json:"entries"`
+	Hits         uint64 `json:"hits"`
+	NegativeHits uint64 `json:"negative_hits"`
+	Misses       uint64 `json:"misses"`
+	Evictions    uint64 `json:"evictions"`
+}
+
+// PassportCache serves repeated product passport lookups from memory, so a
+// board that re-runs DI during rework does not cost another round trip to
+// the passport service. Commissioning calls pass straight through.
+type PassportCache struct {
+	next API
+	*cacheStore
+}
+
+// cacheStore holds the entries of a PassportCache, shared by the caches
+// WithBackend derives from it.
+type cacheStore struct {
+	cfg CacheConfig
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	stats   CacheStats
+	// fetches are the misses being looked up, so concurrent misses for one
+	// UUID share a single call to the backend.
+	fetches map[string]*cacheFetch
+}
+
+// cacheFetch is one backend lookup that concurrent misses wait for.
+type cacheFetch struct {
+	done     chan struct{}
+	passport *ProductItemPassport
+	err      error
+	// abandoned is set when the fetching caller's context ended first.
+	abandoned bool
+}
+
+type cacheEntry struct {
+	uuid     string
+	passport *ProductItemPassport
+	err      error // set for cached "not found" answers
+	expires  time.Time
+}
+
+// NewPassportCache returns a cache in front of next.
+func NewPassportCache(next API, cfg CacheConfig) *PassportCache {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultCacheTTL
+	}
+	if cfg.NegativeTTL <= 0 {
+		cfg.NegativeTTL = DefaultCacheNegativeTTL
+	}
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = DefaultCacheMaxEntries
+	}
+	return &PassportCache{
+		next: next,
+		cacheStore: &cacheStore{
+			cfg:     cfg,
+			now:     time.Now,
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+			fetches: make(map[string]*cacheFetch),
+		},
+	}
+}
+
+// WithBackend returns a cache in front of next that shares c's entries and
+// configuration, so replacing the client behind a cache, as a configuration
+// reload does, keeps the passports already fetched. c keeps using its own
+// client.
+func (c *PassportCache) WithBackend(next API) *PassportCache {
+	return &PassportCache{next: next, cacheStore: c.cacheStore}
+}
+
+// GetProductItemPassport returns the cached passport for uuid, fetching it
+// from the wrapped client on a miss. Concurrent misses for the same uuid
+// wait for one fetch. A not-found answer is cached for NegativeTTL and
+// returned as an error matching ErrPassportNotFound; other errors are not
+// cached.
+func (c *PassportCache) GetProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error) {
+	for {
+		if e, ok := c.lookup(uuid); ok {
+			return e.passport, e.err
+		}
+
+		c.mu.Lock()
+		f, waiting := c.fetches[uuid]
+		if !waiting {
+			f = &cacheFetch{done: make(chan struct{})}
+			c.fetches[uuid] = f
+		}
+		c.mu.Unlock()
+		if !waiting {
+			return c.fetch(ctx, uuid, f)
+		}
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// A fetch cut short by its own caller's context says nothing about
+		// the passport; look it up again
+		if f.abandoned {
+			continue
+		}
+		return f.passport, f.err
+	}
+}
+
+// fetch looks uuid up in the wrapped client on behalf of every miss
+// waiting on f.
+func (c *PassportCache) fetch(ctx context.Context, uuid string, f *cacheFetch) (*ProductItemPassport, error) {
+	f.passport, f.err = c.next.GetProductItemPassport(ctx, uuid)
+	f.abandoned = f.err != nil && ctx.Err() != nil
+	c.fill(uuid, f.passport, f.err, c.cfg.TTL)
+
+	c.mu.Lock()
+	delete(c.fetches, uuid)
+	c.mu.Unlock()
+	close(f.done)
+	return f.passport, f.err
+}
+
+// fill caches the outcome of a lookup: a passport for ttl, a not-found
+// answer for NegativeTTL, and nothing for other errors.
+func (c *PassportCache) fill(uuid string, passport *ProductItemPassport, err error, ttl time.Duration) {
+	switch {
+	case err == nil:
+		c.store(&cacheEntry{uuid: uuid, passport: passport, expires: c.now().Add(ttl)})
+	case errors.Is(err, ErrPassportNotFound):
+		cached := fmt.Errorf("%w (cached): %v", ErrPassportNotFound, err)
+		c.store(&cacheEntry{uuid: uuid, err: cached, expires: c.now().Add(c.cfg.NegativeTTL)})
+	}
+}
+
+// CreateCommissioningPassport calls the wrapped client.
+func (c *PassportCache) CreateCommissioningPassport(ctx context.Context, body *CommissioningCreateRequest) error {
+	return c.next.CreateCommissioningPassport(ctx, body)
+}
+
+// Flush flushes the wrapped client if it holds pending work.
+func (c *PassportCache) Flush(ctx context.Context) error {
+	if f, ok := c.next.(interface{ Flush(context.Context) error }); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// BreakerStates returns the circuit breaker states of the cached backend,
+// or nil if it has none.
+func (c *PassportCache) BreakerStates() map[string]BreakerState {
+	if b, ok := c.next.(interface {
+		BreakerStates() map[string]BreakerState
+	}); ok {
+		return b.BreakerStates()
+	}
+	return nil
+}
+
+// Ping checks that the cached backend can be reached, if it supports that.
+func (c *PassportCache) Ping(ctx context.Context) error {
+	if p, ok := c.next.(interface{ Ping(context.Context) error }); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// Invalidate drops the entry for uuid and reports whether there was one.
+func (c *PassportCache) Invalidate(uuid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[uuid]
+	if ok {
+		c.lru.Remove(el)
+		delete(c.entries, uuid)
+	}
+	return ok
+}
+
+// Purge drops every entry and returns how many there were.
+func (c *PassportCache) Purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	return n
+}
+
+// Stats returns a snapshot of cache activity.
+func (c *PassportCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.entries)
+	return s
+}
+
+func (c *PassportCache) lookup(uuid string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[uuid]
+	if !ok {
+		c.stats.Misses++
+		cacheLookups.With("miss").Inc()
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, uuid)
+		c.stats.Misses++
+		cacheLookups.With("miss").Inc()
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	if e.err != nil {
+		c.stats.NegativeHits++
+		cacheLookups.With("negative_hit").Inc()
+	} else {
+		c.stats.Hits++
+		cacheLookups.With("hit").Inc()
+	}
+	return e, true
+}
+
+func (c *PassportCache) store(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.uuid]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.uuid] = c.lru.PushFront(e)
+	for c.lru.Len() > c.cfg.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).uuid)
+		c.stats.Evictions++
+	}
+}
@@ -0,0 +1,231 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingAPI serves passports from a map and counts lookups.
+type countingAPI struct {
+	passports map[string]*ProductItemPassport
+	err       error
+	lookups   int
+}
+
+func (a *countingAPI) GetProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error) {
+	a.lookups++
+	if a.err != nil {
+		return nil, a.err
+	}
+	if p, ok := a.passports[uuid]; ok {
+		return p, nil
+	}
+	return nil, &StatusError{Op: "passport GET", StatusCode: 404, Body: "not found"}
+}
+
+func (a *countingAPI) CreateCommissioningPassport(ctx context.Context, body *CommissioningCreateRequest) error {
+	return nil
+}
+
+func TestPassportCache(t *testing.T) {
+	api := &countingAPI{passports: map[string]*ProductItemPassport{
+		"SN-0001": {UUID: "SN-0001"},
+		"SN-0002": {UUID: "SN-0002"},
+		"SN-0003": {UUID: "SN-0003"},
+	}}
+	now := time.Now()
+	cache := NewPassportCache(api, CacheConfig{TTL: time.Minute, NegativeTTL: 10 * time.Second, MaxEntries: 2})
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	get := func(uuid string) error {
+		t.Helper()
+		_, err := cache.GetProductItemPassport(ctx, uuid)
+		return err
+	}
+
+	// Repeated lookups hit the service once
+	for i := 0; i < 3; i++ {
+		if err := get("SN-0001"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if api.lookups != 1 {
+		t.Errorf("expected 1 lookup, got %d", api.lookups)
+	}
+
+	// Not found is cached, and still reported as not found
+	for i := 0; i < 2; i++ {
+		if err := get("SN-9999"); !errors.Is(err, ErrPassportNotFound) {
+			t.Errorf("expected ErrPassportNotFound, got %v", err)
+		}
+	}
+	if api.lookups != 2 {
+		t.Errorf("expected 2 lookups, got %d", api.lookups)
+	}
+
+	// The negative entry expires sooner than a passport
+	now = now.Add(15 * time.Second)
+	get("SN-9999")
+	get("SN-0001")
+	if api.lookups != 3 {
+		t.Errorf("expected negative entry to expire, got %d lookups", api.lookups)
+	}
+
+	// Passports expire after TTL
+	now = now.Add(time.Minute)
+	get("SN-0001")
+	if api.lookups != 4 {
+		t.Errorf("expected passport to expire, got %d lookups", api.lookups)
+	}
+
+	// The least recently used entry is evicted at MaxEntries
+	get("SN-0002")
+	get("SN-0003")
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Evictions == 0 {
+		t.Errorf("expected 2 entries after eviction, got %+v", stats)
+	}
+
+	// Invalidation forces a fresh lookup
+	if !cache.Invalidate("SN-0003") {
+		t.Error("expected SN-0003 to be cached")
+	}
+	if cache.Invalidate("SN-0003") {
+		t.Error("expected SN-0003 to be gone")
+	}
+	before := api.lookups
+	get("SN-0003")
+	if api.lookups != before+1 {
+		t.Errorf("expected a lookup after invalidation")
+	}
+	if n := cache.Purge(); n != 2 {
+		t.Errorf("expected 2 purged entries, got %d", n)
+	}
+}
+
+func TestPassportCache_DoesNotCacheErrors(t *testing.T) {
+	api := &countingAPI{err: errors.New("passport GET status 503: unavailable")}
+	cache := NewPassportCache(api, CacheConfig{})
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetProductItemPassport(context.Background(), "SN-0001"); err == nil {
+			t.Fatal("expected error but got none")
+		}
+	}
+	if api.lookups != 2 {
+		t.Errorf("expected every failed lookup to reach the service, got %d", api.lookups)
+	}
+}
+
+func TestPassportCache_WithBackend(t *testing.T) {
+	old := &countingAPI{passports: map[string]*ProductItemPassport{"SN-0001": {UUID: "SN-0001"}}}
+	cache := NewPassportCache(old, CacheConfig{})
+	cache.GetProductItemPassport(context.Background(), "SN-0001")
+
+	next := &countingAPI{}
+	replaced := cache.WithBackend(next)
+	if p, err := replaced.GetProductItemPassport(context.Background(), "SN-0001"); err != nil || p.UUID != "SN-0001" {
+		t.Fatalf("expected the cached passport, got %v, %v", p, err)
+	}
+	if next.lookups != 0 {
+		t.Errorf("expected no lookup from the new client, got %d", next.lookups)
+	}
+
+	replaced.GetProductItemPassport(context.Background(), "SN-0002")
+	if next.lookups != 1 || old.lookups != 1 {
+		t.Errorf("expected a miss to reach only the new client, got %d and %d lookups", next.lookups, old.lookups)
+	}
+	if n := cache.Stats().Entries; n != 2 {
+		t.Errorf("expected both caches to share 2 entries, got %d", n)
+	}
+}
+
+// gatedAPI blocks each lookup until release is closed or the caller gives up.
+type gatedAPI struct {
+	countingAPI
+	mu      sync.Mutex
+	calls   int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a *gatedAPI) GetProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error) {
+	a.mu.Lock()
+	a.calls++
+	a.mu.Unlock()
+	a.started <- struct{}{}
+	select {
+	case <-a.release:
+		return &ProductItemPassport{UUID: uuid}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestPassportCache_CollapsesConcurrentMisses(t *testing.T) {
+	api := &gatedAPI{started: make(chan struct{}, 10), release: make(chan struct{})}
+	cache := NewPassportCache(api, CacheConfig{})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.GetProductItemPassport(context.Background(), "SN-0001")
+			errs <- err
+		}()
+	}
+	<-api.started
+	// Let the other lookups reach the cache before the fetch completes
+	time.Sleep(20 * time.Millisecond)
+	close(api.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if api.calls != 1 {
+		t.Errorf("expected 1 backend call, got %d", api.calls)
+	}
+}
+
+func TestPassportCache_RefetchesAbandonedMiss(t *testing.T) {
+	api := &gatedAPI{started: make(chan struct{}, 10), release: make(chan struct{})}
+	cache := NewPassportCache(api, CacheConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := cache.GetProductItemPassport(ctx, "SN-0001")
+		first <- err
+	}()
+	<-api.started
+
+	second := make(chan error, 1)
+	go func() {
+		_, err := cache.GetProductItemPassport(context.Background(), "SN-0001")
+		second <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The first caller gives up; the waiting one fetches for itself
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the first lookup to be cancelled, got %v", err)
+	}
+	<-api.started
+	close(api.release)
+	if err := <-second; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if api.calls != 2 {
+		t.Errorf("expected 2 backend calls, got %d", api.calls)
+	}
+}
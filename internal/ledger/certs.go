@@ -0,0 +1,215 @@
+package ledger
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Certificate reload defaults.
+const (
+	DefaultCertCheckInterval = time.Minute
+	DefaultCertExpiryWarning = 7 * 24 * time.Hour
+)
+
+// CertConfig controls how the product endpoint's mTLS material is kept
+// current. Zero values use the defaults.
+type CertConfig struct {
+	// CheckInterval is how often the files are checked for changes, at
+	// most once per interval and only while passport calls are made.
+	CheckInterval time.Duration
+	// ExpiryWarning is how long before the client or CA certificate
+	// expires that warnings start, logged at most once an hour.
+	ExpiryWarning time.Duration
+}
+
+// certWarnEvery spaces out repeated expiry warnings for the same files.
+const certWarnEvery = time.Hour
+
+// certReloader is an http.RoundTripper presenting the client certificate
+// and trusting the CA in files that are checked for changes as requests
+// are made, so rotated certificates are used without a restart. Changed
+// files are loaded into a new transport; if they do not load, the last
+// good certificate stays in use.
+type certReloader struct {
+	caPath, certPath, keyPath string
+	cfg                       CertConfig
+
+	mu        sync.Mutex
+	transport *http.Transport
+	stamp     string // size and modification time of each file
+	checked   time.Time
+	notAfter  map[string]time.Time // by "client" and "ca"
+	warned    time.Time
+}
+
+// newCertReloader loads the mTLS material, failing if it does not load.
+func newCertReloader(caPath, certPath, keyPath string, cfg CertConfig) (*certReloader, error) {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = DefaultCertCheckInterval
+	}
+	if cfg.ExpiryWarning <= 0 {
+		cfg.ExpiryWarning = DefaultCertExpiryWarning
+	}
+	r := &certReloader{caPath: caPath, certPath: certPath, keyPath: keyPath, cfg: cfg}
+	stamp, _ := r.fileStamp() // load reports files it cannot read
+	if err := r.load(stamp); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	r.warnExpiry(r.checked)
+	return r, nil
+}
+
+// RoundTrip sends req over the transport for the current certificates.
+func (r *certReloader) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r.current().RoundTrip(req)
+}
+
+// current returns the transport to use, first reloading the files if the
+// check interval has passed and they changed.
+func (r *certReloader) current() *http.Transport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.Sub(r.checked) < r.cfg.CheckInterval {
+		return r.transport
+	}
+	r.checked = now
+
+	stamp, err := r.fileStamp()
+	switch {
+	case err != nil:
+		// Mid-rotation a file can be briefly missing; check again next time
+		slog.Warn("Cannot check passport mTLS certificates, keeping the loaded ones", "error", err)
+	case stamp != r.stamp:
+		if err := r.load(stamp); err != nil {
+			certReloads.With("error").Inc()
+			slog.Error("Failed to reload passport mTLS certificates, keeping the loaded ones", "error", err)
+			// Only retried once the files change again
+			r.stamp = stamp
+		} else {
+			certReloads.With("success").Inc()
+			slog.Info("Reloaded passport mTLS certificates",
+				"client_cert_expires", r.notAfter["client"],
+				"ca_expires", r.notAfter["ca"])
+			r.warned = time.Time{}
+		}
+	}
+	r.warnExpiry(now)
+	return r.transport
+}
+
+// load reads the files and, if they hold a usable client certificate and
+// CA, installs a transport for them. Callers hold r.mu, except in
+// newCertReloader.
+func (r *certReloader) load(stamp string) error {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("load client cert/key: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parse client cert: %w", err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("client cert expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	caCert, err := os.ReadFile(r.caPath)
+	if err != nil {
+		return fmt.Errorf("read CA cert: %w", err)
+	}
+	caPool := x509.NewCertPool()
+	if ok := caPool.AppendCertsFromPEM(caCert); !ok {
+		return fmt.Errorf("append CA cert")
+	}
+
+	old := r.transport
+	r.transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:      caPool,
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+	if old != nil {
+		// Idle connections still present the old certificate
+		old.CloseIdleConnections()
+	}
+	r.stamp = stamp
+	r.notAfter = map[string]time.Time{"client": leaf.NotAfter}
+	if t, ok := earliestExpiry(caCert); ok {
+		r.notAfter["ca"] = t
+	}
+	for name, t := range r.notAfter {
+		certExpiry.With(name).Set(float64(t.Unix()))
+	}
+	return nil
+}
+
+// warnExpiry logs a warning for each certificate within the expiry
+// warning window, at most once per certWarnEvery. Callers hold r.mu.
+func (r *certReloader) warnExpiry(now time.Time) {
+	if !r.warned.IsZero() && now.Sub(r.warned) < certWarnEvery {
+		return
+	}
+	for _, name := range []string{"client", "ca"} {
+		t, ok := r.notAfter[name]
+		if !ok || t.Sub(now) > r.cfg.ExpiryWarning {
+			continue
+		}
+		slog.Warn("Passport mTLS certificate expires soon",
+			"cert", name,
+			"expires", t,
+			"remaining", t.Sub(now).Round(time.Minute))
+		r.warned = now
+	}
+}
+
+// fileStamp identifies the current contents of the three files. Rotation
+// tools replace files or symlinks, either of which changes it.
+func (r *certReloader) fileStamp() (string, error) {
+	var stamp []byte
+	for _, path := range []string{r.caPath, r.certPath, r.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("stat mTLS file: %w", err)
+		}
+		stamp = strconv.AppendInt(stamp, info.Size(), 10)
+		stamp = append(stamp, '@')
+		stamp = strconv.AppendInt(stamp, info.ModTime().UnixNano(), 10)
+		stamp = append(stamp, ';')
+	}
+	return string(stamp), nil
+}
+
+// earliestExpiry returns the earliest NotAfter of the certificates in a
+// PEM bundle.
+func earliestExpiry(bundle []byte) (time.Time, bool) {
+	var earliest time.Time
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if earliest.IsZero() || cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
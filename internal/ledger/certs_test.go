@@ -0,0 +1,196 @@
+package ledger
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues client certificates for certificate reload tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue writes a client certificate with serial and notAfter, and its key,
+// to certPath and keyPath.
+func (ca *testCA) issue(t *testing.T, certPath, keyPath string, serial int64, notAfter time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "ucse-agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// writeFile replaces path, moving its modification time on so a rewrite
+// within the filesystem's timestamp resolution is still noticed.
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	var next time.Time
+	if info, err := os.Stat(path); err == nil {
+		next = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !next.IsZero() {
+		os.Chtimes(path, next, next)
+	}
+}
+
+func TestClient_CertReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caPath, certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	firstExpiry := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	ca.issue(t, certPath, keyPath, 100, firstExpiry)
+
+	// The passport service requires a client certificate from ca
+	var serials []int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serials = append(serials, r.TLS.PeerCertificates[0].SerialNumber.Int64())
+		w.Write([]byte(`{"uuid": "SN-0001"}`))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	writeFile(t, caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	client, err := NewClient(server.URL, "", caPath, certPath, keyPath, WithCertReload(CertConfig{CheckInterval: time.Hour}))
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	lookup := func() {
+		t.Helper()
+		if _, err := client.GetProductItemPassport(context.Background(), "SN-0001"); err != nil {
+			t.Fatalf("lookup: %v", err)
+		}
+	}
+	recheck := func() {
+		client.certs.mu.Lock()
+		client.certs.checked = time.Time{}
+		client.certs.mu.Unlock()
+	}
+	lookup()
+	if got := client.certs.notAfter["client"]; !got.Equal(firstExpiry) {
+		t.Errorf("expected client cert expiry %s, got %s", firstExpiry, got)
+	}
+	if got := certExpiry.With("client").Value(); got != float64(firstExpiry.Unix()) {
+		t.Errorf("expected expiry metric %d, got %v", firstExpiry.Unix(), got)
+	}
+
+	// Rotated files are not looked at before the check interval
+	ca.issue(t, certPath, keyPath, 101, firstExpiry.Add(30*24*time.Hour))
+	lookup()
+
+	// ... and are used once it has passed
+	reloads := certReloads.With("success").Value()
+	recheck()
+	lookup()
+	if got := certReloads.With("success").Value(); got != reloads+1 {
+		t.Errorf("expected a successful reload to be counted, got %v after %v", got, reloads)
+	}
+
+	// A certificate that does not load keeps the last good one
+	failures := certReloads.With("error").Value()
+	writeFile(t, certPath, []byte("not a certificate"))
+	recheck()
+	lookup()
+	ca.issue(t, certPath, keyPath, 102, time.Now().Add(-time.Minute))
+	recheck()
+	lookup()
+	if got := certReloads.With("error").Value(); got != failures+2 {
+		t.Errorf("expected 2 failed reloads, got %v", got-failures)
+	}
+
+	expected := []int64{100, 100, 101, 101, 101}
+	if len(serials) != len(expected) {
+		t.Fatalf("expected serials %v, got %v", expected, serials)
+	}
+	for i := range expected {
+		if serials[i] != expected[i] {
+			t.Errorf("expected serials %v, got %v", expected, serials)
+			break
+		}
+	}
+}
+
+func TestCertReloader_WarnExpiry(t *testing.T) {
+	now := time.Now()
+	r := &certReloader{
+		cfg:      CertConfig{ExpiryWarning: 7 * 24 * time.Hour},
+		notAfter: map[string]time.Time{"client": now.Add(8 * 24 * time.Hour), "ca": now.Add(365 * 24 * time.Hour)},
+	}
+	r.warnExpiry(now)
+	if !r.warned.IsZero() {
+		t.Error("expected no warning outside the window")
+	}
+
+	r.notAfter["client"] = now.Add(3 * 24 * time.Hour)
+	r.warnExpiry(now)
+	if !r.warned.Equal(now) {
+		t.Error("expected a warning inside the window")
+	}
+	r.warnExpiry(now.Add(time.Minute))
+	if !r.warned.Equal(now) {
+		t.Error("expected the warning not to repeat within an hour")
+	}
+	r.warnExpiry(now.Add(2 * time.Hour))
+	if !r.warned.Equal(now.Add(2 * time.Hour)) {
+		t.Error("expected the warning to repeat after an hour")
+	}
+}
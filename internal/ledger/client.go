@@ -3,65 +3,188 @@ package ledger
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"time"
+)
+
+// Endpoint names used in logs and BreakerStates.
+const (
+	EndpointProduct       = "product"
+	EndpointCommissioning = "commissioning"
 )
 
 // Client is a small helper around the two passport endpoints used by the proxy.
 // Keeps the layer thin and avoids unnecessary abstractions.
 type Client struct {
-	productBaseURL    string
-	commissioningURL  string
-	productHTTP       *http.Client
-	commissioningHTTP *http.Client
+	productBaseURL       string
+	commissioningURL     string
+	productHTTP          *http.Client
+	commissioningHTTP    *http.Client
+	productRetry         RetryPolicy
+	commissioningRetry   RetryPolicy
+	productBreaker       *breaker
+	commissioningBreaker *breaker
+	certs                *certReloader
+	calls                inflight
+}
+
+// ClientOption customizes a Client.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	productRetry       RetryPolicy
+	commissioningRetry RetryPolicy
+	breaker            BreakerConfig
+	certs              CertConfig
+}
+
+// WithProductRetry sets the retry policy for product passport lookups.
+func WithProductRetry(p RetryPolicy) ClientOption {
+	return func(o *clientOptions) {
+		o.productRetry = p
+	}
+}
+
+// WithCommissioningRetry sets the retry policy for commissioning passport
+// creation.
+func WithCommissioningRetry(p RetryPolicy) ClientOption {
+	return func(o *clientOptions) {
+		o.commissioningRetry = p
+	}
+}
+
+// WithCircuitBreaker configures the circuit breaker kept for each endpoint.
+func WithCircuitBreaker(cfg BreakerConfig) ClientOption {
+	return func(o *clientOptions) {
+		o.breaker = cfg
+	}
+}
+
+// WithCertReload sets how the product endpoint's mTLS files are checked
+// for rotated certificates and how early their expiry is warned about.
+func WithCertReload(cfg CertConfig) ClientOption {
+	return func(o *clientOptions) {
+		o.certs = cfg
+	}
 }
 
 // NewClient configures clients for:
 // - Product item passport (mTLS GET)
 // - Commissioning passport (HTTP POST)
-func NewClient(productBaseURL, commissioningURL, caCertPath, clientCertPath, clientKeyPath string) (*Client, error) {
-	productHTTP, err := newMTLSHTTPClient(caCertPath, clientCertPath, clientKeyPath)
-	if err != nil {
-		return nil, err
+//
+// The product endpoint gets DefaultRetryPolicy, the commissioning endpoint
+// DefaultCommissioningRetryPolicy, and each a circuit breaker unless
+// overridden by opts. The mTLS material is only needed, and only loaded,
+// when productBaseURL is set; the files are then checked for rotated
+// certificates as lookups are made.
+func NewClient(productBaseURL, commissioningURL, caCertPath, clientCertPath, clientKeyPath string, opts ...ClientOption) (*Client, error) {
+	o := clientOptions{
+		productRetry:       DefaultRetryPolicy(DefaultProductTimeout),
+		commissioningRetry: DefaultCommissioningRetryPolicy(DefaultCommissioningTimeout),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var productHTTP *http.Client
+	var certs *certReloader
+	if productBaseURL != "" {
+		var err error
+		if certs, err = newCertReloader(caCertPath, clientCertPath, clientKeyPath, o.certs); err != nil {
+			return nil, err
+		}
+		// Attempts are bounded by the endpoint's RetryPolicy.Timeout
+		productHTTP = &http.Client{Transport: certs}
 	}
 
 	return &Client{
-		productBaseURL:    productBaseURL,
-		commissioningURL:  commissioningURL,
-		productHTTP:       productHTTP,
-		commissioningHTTP: &http.Client{Timeout: 30 * time.Second},
+		productBaseURL:       productBaseURL,
+		commissioningURL:     commissioningURL,
+		productHTTP:          productHTTP,
+		commissioningHTTP:    &http.Client{},
+		productRetry:         o.productRetry,
+		commissioningRetry:   o.commissioningRetry,
+		productBreaker:       newBreaker(EndpointProduct, o.breaker),
+		commissioningBreaker: newBreaker(EndpointCommissioning, o.breaker),
+		certs:                certs,
 	}, nil
 }
 
-func newMTLSHTTPClient(caPath, certPath, keyPath string) (*http.Client, error) {
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-	if err != nil {
-		return nil, fmt.Errorf("load client cert/key: %w", err)
+// BreakerStates returns the circuit breaker state of each endpoint.
+func (c *Client) BreakerStates() map[string]BreakerState {
+	states := make(map[string]BreakerState, 2)
+	for name, b := range map[string]*breaker{
+		EndpointProduct:       c.productBreaker,
+		EndpointCommissioning: c.commissioningBreaker,
+	} {
+		if b != nil {
+			states[name] = b.State()
+		}
 	}
+	return states
+}
 
-	caCert, err := os.ReadFile(caPath)
-	if err != nil {
-		return nil, fmt.Errorf("read CA cert: %w", err)
+// Ping checks that each configured endpoint can be reached by sending it a
+// HEAD request. Any HTTP response counts, whatever its status; refused
+// connections, DNS and TLS failures and timeouts are returned. Pings are
+// not retried and do not count towards the circuit breakers.
+func (c *Client) Ping(ctx context.Context) error {
+	var errs []error
+	if c.productBaseURL != "" {
+		if err := ping(ctx, c.productHTTP, c.productBaseURL); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", EndpointProduct, err))
+		}
 	}
-	caPool := x509.NewCertPool()
-	if ok := caPool.AppendCertsFromPEM(caCert); !ok {
-		return nil, fmt.Errorf("append CA cert")
+	if c.commissioningURL != "" {
+		if err := ping(ctx, c.commissioningHTTP, c.commissioningURL); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", EndpointCommissioning, err))
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			RootCAs:      caPool,
-			Certificates: []tls.Certificate{cert},
-		},
+func ping(ctx context.Context, client *http.Client, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return err
 	}
-	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) productEndpoint() *endpoint {
+	return &endpoint{name: EndpointProduct, http: c.productHTTP, retry: c.productRetry, breaker: c.productBreaker}
+}
+
+func (c *Client) commissioningEndpoint() *endpoint {
+	return &endpoint{name: EndpointCommissioning, http: c.commissioningHTTP, retry: c.commissioningRetry, breaker: c.commissioningBreaker}
+}
+
+// ErrPassportNotFound matches the error returned when the passport service
+// has no passport for the requested UUID.
+var ErrPassportNotFound = errors.New("product passport not found")
+
+// StatusError reports an unexpected HTTP status from a passport service.
+type StatusError struct {
+	Op         string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s status %d: %s", e.Op, e.StatusCode, e.Body)
+}
+
+// Is makes a 404 from a product passport lookup match ErrPassportNotFound.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrPassportNotFound && e.StatusCode == http.StatusNotFound && e.Op == "passport GET"
 }
 
 // Shapes below mirror the service responses closely.
@@ -72,6 +195,10 @@ type ProductItemPassport struct {
 	Metadata      ProductItemMetadata `json:"metadata"`
 	Agent         ProductItemAgent    `json:"agent"`
 	Signature     string              `json:"signature"`
+
+	// Raw is the document as returned by the service. Signatures are
+	// verified over it so fields this struct does not model are covered.
+	Raw json.RawMessage `json:"-"`
 }
 
 type ProductItemRecord struct {
@@ -106,15 +233,20 @@ type ProductItemAgent struct {
 //	    - Returns nil passport and error if service unavailable or invalid response
 //
 //	  Error Conditions:
-//	    - Network errors: connection failures, timeouts
+//	    - Network errors: connection failures, timeouts (retried per policy)
+//	    - ErrCircuitOpen: the endpoint's breaker is open, no request is sent
 //	    - TLS errors: invalid certificates, mTLS handshake failures
 //	    - HTTP errors: non-200 status codes
 //	    - JSON errors: malformed response body
 //
 //		GET {productBaseURL}/product_item/?uuid={uuid}
 //
-// Uses mTLS with the configured CA, client cert, and key.
+// Uses mTLS with the configured CA, client cert, and key, reloaded when
+// the files change.
 func (c *Client) GetProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error) {
+	c.calls.add()
+	defer c.calls.done()
+
 	if c.productBaseURL == "" {
 		return nil, fmt.Errorf("product base URL not configured")
 	}
@@ -128,26 +260,22 @@ func (c *Client) GetProductItemPassport(ctx context.Context, uuid string) (*Prod
 	q.Set("uuid", uuid)
 	u.RawQuery = q.Encode()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	resp, err := c.productEndpoint().do(ctx, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("build request: %w", err)
-	}
-
-	resp, err := c.productHTTP.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("passport GET status %d: %s", resp.StatusCode, string(b))
+	if resp.status != http.StatusOK {
+		return nil, &StatusError{Op: "passport GET", StatusCode: resp.status, Body: string(resp.body)}
 	}
 
+	raw := resp.body
 	var out ProductItemPassport
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+	if err := json.Unmarshal(raw, &out); err != nil {
 		return nil, fmt.Errorf("decode response: %w", err)
 	}
+	out.Raw = raw
 	return &out, nil
 }
 
@@ -175,13 +303,18 @@ type CommissioningCreateRequest struct {
 //	    - Returns error on failure (HTTP 4xx/5xx status or network errors)
 //
 //	  Error Conditions:
-//	    - Network errors: connection failures, timeouts
+//	    - Network errors: connection failures, timeouts (retried per policy;
+//	      by default only failures to connect, as the POST is not idempotent)
+//	    - ErrCircuitOpen: the endpoint's breaker is open, no request is sent
 //	    - HTTP errors: non-2xx status codes
 //	    - JSON errors: malformed request body
 //	    - Validation errors: missing required fields
 //
 //		POST {commissioningURL}
 func (c *Client) CreateCommissioningPassport(ctx context.Context, body *CommissioningCreateRequest) error {
+	c.calls.add()
+	defer c.calls.done()
+
 	if c.commissioningURL == "" {
 		return fmt.Errorf("commissioning URL not configured")
 	}
@@ -191,20 +324,24 @@ func (c *Client) CreateCommissioningPassport(ctx context.Context, body *Commissi
 		return fmt.Errorf("marshal request: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.commissioningURL, bytes.NewReader(b))
-	if err != nil {
-		return fmt.Errorf("build request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.commissioningHTTP.Do(req)
+	resp, err := c.commissioningEndpoint().do(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.commissioningURL, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		bb, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("commissioning POST status %d: %s", resp.StatusCode, string(bb))
+	if resp.status < 200 || resp.status >= 300 {
+		return &StatusError{Op: "commissioning POST", StatusCode: resp.status, Body: string(resp.body)}
 	}
 	return nil
 }
+
+// Flush waits for outstanding passport calls to finish, or for ctx to be done.
+func (c *Client) Flush(ctx context.Context) error {
+	return c.calls.wait(ctx)
+}
@@ -30,14 +30,13 @@ func TestNewClient(t *testing.T) {
 			errorContains:    "load client cert/key",
 		},
 		{
-			name:             "missing product URL",
+			name:             "commissioning only skips mTLS",
 			productBaseURL:   "",
 			commissioningURL: "http://example.com/commissioning",
 			caCertPath:       "testdata/ca.pem",
 			clientCertPath:   "testdata/client.crt",
 			clientKeyPath:    "testdata/client.key",
-			expectError:      true,
-			errorContains:    "load client cert/key",
+			expectError:      false,
 		},
 	}
 
@@ -255,6 +254,47 @@ func TestCreateCommissioningPassport_Unconfigured(t *testing.T) {
 	}
 }
 
+func TestClient_Flush(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &Client{
+		commissioningURL:  server.URL,
+		commissioningHTTP: server.Client(),
+	}
+
+	// Nothing in flight
+	if err := client.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.CreateCommissioningPassport(context.Background(), &CommissioningCreateRequest{ControllerUUID: "test-uuid"})
+	}()
+	<-arrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Flush(ctx); err == nil {
+		t.Error("expected error while a call is in flight but got none")
+	}
+
+	close(release)
+	if err := client.Flush(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
 // Helper function to check if a string contains a substring
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(substr) == 0 ||
@@ -268,3 +308,32 @@ func contains(s, substr string) bool {
 				return false
 			}())))
 }
+
+func TestClient_Ping(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("expected HEAD, got %s", r.Method)
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+
+	client := &Client{
+		productBaseURL:    server.URL,
+		productHTTP:       server.Client(),
+		commissioningURL:  server.URL,
+		commissioningHTTP: server.Client(),
+	}
+	if err := client.Ping(context.Background()); err != nil {
+		t.Errorf("expected any response to count as reachable, got %v", err)
+	}
+
+	client.commissioningURL = downURL
+	err := client.Ping(context.Background())
+	if err == nil || !contains(err.Error(), EndpointCommissioning+":") {
+		t.Errorf("expected the commissioning endpoint to be unreachable, got %v", err)
+	}
+}
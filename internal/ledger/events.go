@@ -0,0 +1,27 @@
+package ledger
+
+import (
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// VoucherIssuedEvent is emitted when DI.SetCredentials hands a device its
+// ownership voucher header. It is the first point at which the device GUID
+// exists, and binds that GUID to the product passport fetched at DI.AppStart.
+type VoucherIssuedEvent struct {
+	DeviceGUID string
+	Header     *fdo.OVHeader
+
+	// MfgInfo, ProductUUID and ProductPassport come from the DI.AppStart
+	// request of the same exchange. They are empty when the lookup was
+	// disabled or failed.
+	MfgInfo         *fdo.DeviceMfgInfo
+	ProductUUID     string
+	ProductPassport *ProductItemPassport
+	// PassportVerification is the signature check of ProductPassport; nil
+	// when no verifier is configured.
+	PassportVerification *VerificationReport
+
+	Timestamp time.Time
+}
@@ -0,0 +1,212 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStoreConfig configures the "file" backend.
+type FileStoreConfig struct {
+	// Dir holds product item passport documents, one per *.json file, in
+	// the shape the passport service returns. Files are indexed by their
+	// "uuid" member, so they may be named anything; subdirectories are
+	// ignored.
+	Dir string `json:"dir"`
+	// CommissioningDir is the spool receiving one commissioning passport
+	// per onboarded device, for ExportSpool to upload later; empty
+	// disables commissioning.
+	CommissioningDir string `json:"commissioning_dir"`
+}
+
+// FileStore serves product item passports from JSON documents on disk and
+// spools commissioning passports to a directory, for factory lines with no
+// connectivity to the passport service. Passports are served byte for byte,
+// so signatures verify exactly as they would from the service.
+type FileStore struct {
+	dir              string
+	commissioningDir string
+
+	mu      sync.Mutex
+	index   map[string]string // product UUID -> file
+	modTime time.Time         // of dir when index was built
+}
+
+// NewFileStore opens the store described by cfg and indexes its passports.
+// The passport directory must exist; the spool directory is created if
+// needed.
+func NewFileStore(cfg FileStoreConfig) (*FileStore, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("passport directory not configured")
+	}
+	info, err := os.Stat(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("passport directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("passport directory %s is not a directory", cfg.Dir)
+	}
+	if cfg.CommissioningDir != "" {
+		if err := os.MkdirAll(cfg.CommissioningDir, 0o755); err != nil {
+			return nil, fmt.Errorf("create commissioning directory: %w", err)
+		}
+	}
+
+	s := &FileStore{dir: cfg.Dir, commissioningDir: cfg.CommissioningDir}
+	if err := s.reindex(); err != nil {
+		return nil, err
+	}
+	slog.Info("Indexed offline product passports", "dir", cfg.Dir, "passports", s.Len())
+	return s, nil
+}
+
+// Len returns the number of indexed passports.
+func (s *FileStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.index)
+}
+
+// GetProductItemPassport reads the passport indexed under uuid. When uuid
+// is not indexed and the directory has changed since it was last indexed,
+// for example because a new batch was copied in, it is re-indexed first. An
+// unknown UUID is reported as an error matching ErrPassportNotFound.
+func (s *FileStore) GetProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error) {
+	path, ok := s.lookup(uuid)
+	if !ok {
+		if err := s.refresh(); err != nil {
+			slog.Warn("Failed to re-index offline product passports, serving the previous index", "dir", s.dir, "error", err)
+		}
+		if path, ok = s.lookup(uuid); !ok {
+			return nil, fmt.Errorf("%w: no passport for %s in %s", ErrPassportNotFound, uuid, s.dir)
+		}
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read passport: %w", err)
+	}
+	var out ProductItemPassport
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	if out.UUID != uuid {
+		// The file was replaced since it was indexed
+		return nil, fmt.Errorf("%w: %s now holds passport %s", ErrPassportNotFound, path, out.UUID)
+	}
+	out.Raw = raw
+	return &out, nil
+}
+
+// CreateCommissioningPassport spools body to
+// {CommissioningDir}/{controller_uuid}-{timestamp}.json.
+func (s *FileStore) CreateCommissioningPassport(ctx context.Context, body *CommissioningCreateRequest) error {
+	if s.commissioningDir == "" {
+		return fmt.Errorf("commissioning directory not configured")
+	}
+	b, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	path := filepath.Join(s.commissioningDir, outboxFileName(body.ControllerUUID+"-"+body.Timestamp))
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, b); err != nil {
+		return fmt.Errorf("write commissioning passport: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write commissioning passport: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) lookup(uuid string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path, ok := s.index[uuid]
+	return path, ok
+}
+
+// refresh re-indexes the directory if it changed since the last index.
+func (s *FileStore) refresh() error {
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return fmt.Errorf("passport directory: %w", err)
+	}
+	s.mu.Lock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	return s.reindex()
+}
+
+// reindex maps the "uuid" member of every passport document in the
+// directory to its file. Documents that cannot be read or have no UUID are
+// skipped with a warning; two documents with the same UUID are an error,
+// since there is no telling which one the factory meant.
+func (s *FileStore) reindex() error {
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return fmt.Errorf("passport directory: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("list passports: %w", err)
+	}
+	sort.Strings(paths)
+
+	index := make(map[string]string, len(paths))
+	for _, path := range paths {
+		uuid, err := passportUUID(path)
+		if err != nil {
+			slog.Warn("Skipping offline passport file", "file", path, "error", err)
+			continue
+		}
+		if other, dup := index[uuid]; dup {
+			return fmt.Errorf("passport %s is in both %s and %s", uuid, filepath.Base(other), filepath.Base(path))
+		}
+		index[uuid] = path
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index = index
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func passportUUID(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var doc struct {
+		UUID string `json:"uuid"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return "", fmt.Errorf("decode: %w", err)
+	}
+	if strings.TrimSpace(doc.UUID) == "" {
+		return "", errors.New("no uuid member")
+	}
+	return doc.UUID, nil
+}
+
+func init() {
+	RegisterBackend("file", func(config json.RawMessage) (API, error) {
+		var cfg FileStoreConfig
+		if err := decodeConfig(config, &cfg); err != nil {
+			return nil, err
+		}
+		return NewFileStore(cfg)
+	})
+}
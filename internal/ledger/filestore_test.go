@@ -0,0 +1,122 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePassportFile(t *testing.T, dir, name, uuid string) string {
+	t.Helper()
+	doc := `{"schema_version": 1.0, "uuid": "` + uuid + `", "records": [{"uuid": "r1", "descriptor": "PRODUCT PASSPORT"}], "signature": "sig", "extra": true}`
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestFileStore_GetProductItemPassport(t *testing.T) {
+	dir := t.TempDir()
+	doc := writePassportFile(t, dir, "batch-42-board-1.json", "product-1")
+	os.WriteFile(filepath.Join(dir, "notes.json"), []byte(`{"comment": "no uuid"}`), 0o600)
+	os.WriteFile(filepath.Join(dir, "README.txt"), []byte("not a passport"), 0o600)
+
+	store, err := NewFileStore(FileStoreConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := store.Len(); n != 1 {
+		t.Errorf("expected 1 indexed passport, got %d", n)
+	}
+
+	passport, err := store.GetProductItemPassport(context.Background(), "product-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if passport.UUID != "product-1" || len(passport.Records) != 1 {
+		t.Errorf("unexpected passport %+v", passport)
+	}
+	if string(passport.Raw) != doc {
+		t.Errorf("expected raw document to be kept, got %s", passport.Raw)
+	}
+
+	for _, uuid := range []string{"product-2", "../product-1", "batch-42-board-1"} {
+		if _, err := store.GetProductItemPassport(context.Background(), uuid); !errors.Is(err, ErrPassportNotFound) {
+			t.Errorf("%s: expected ErrPassportNotFound, got %v", uuid, err)
+		}
+	}
+}
+
+func TestFileStore_Reindex(t *testing.T) {
+	dir := t.TempDir()
+	writePassportFile(t, dir, "a.json", "product-1")
+	store, err := NewFileStore(FileStoreConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A batch copied in later is picked up on the first miss
+	writePassportFile(t, dir, "b.json", "product-2")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(dir, later, later)
+	if _, err := store.GetProductItemPassport(context.Background(), "product-2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A duplicate keeps the previous index rather than guessing
+	writePassportFile(t, dir, "c.json", "product-1")
+	writePassportFile(t, dir, "d.json", "product-3")
+	later = later.Add(time.Second)
+	os.Chtimes(dir, later, later)
+	if _, err := store.GetProductItemPassport(context.Background(), "product-3"); !errors.Is(err, ErrPassportNotFound) {
+		t.Errorf("expected ErrPassportNotFound, got %v", err)
+	}
+	if _, err := store.GetProductItemPassport(context.Background(), "product-1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := NewFileStore(FileStoreConfig{Dir: dir}); err == nil || !strings.Contains(err.Error(), "product-1") {
+		t.Errorf("expected duplicate UUID error, got %v", err)
+	}
+}
+
+func TestFileStore_CreateCommissioningPassport(t *testing.T) {
+	commissioning := filepath.Join(t.TempDir(), "commissioning")
+	store, err := NewFileStore(FileStoreConfig{Dir: t.TempDir(), CommissioningDir: commissioning})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := &CommissioningCreateRequest{ControllerUUID: "device-1", Timestamp: "1754509904342152960", DeployedLocation: "plant-7"}
+	if err := store.CreateCommissioningPassport(context.Background(), req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(commissioning, "device-1-1754509904342152960.json"))
+	if err != nil {
+		t.Fatalf("expected commissioning passport file: %v", err)
+	}
+	var got CommissioningCreateRequest
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != *req {
+		t.Errorf("expected %+v, got %+v", *req, got)
+	}
+
+	readOnly, _ := NewFileStore(FileStoreConfig{Dir: t.TempDir()})
+	if err := readOnly.CreateCommissioningPassport(context.Background(), req); err == nil {
+		t.Error("expected error without a commissioning directory")
+	}
+}
+
+func TestNewFileStore_MissingDir(t *testing.T) {
+	if _, err := NewFileStore(FileStoreConfig{Dir: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("expected error but got none")
+	}
+}
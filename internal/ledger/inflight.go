@@ -0,0 +1,54 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// inflight counts outstanding ledger calls so shutdown can wait for them.
+// Unlike sync.WaitGroup it may be waited on while new calls keep starting.
+type inflight struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func (f *inflight) add() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.n == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.n++
+}
+
+func (f *inflight) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+	if f.n == 0 {
+		close(f.idle)
+	}
+}
+
+// wait blocks until no calls are outstanding or ctx is done.
+func (f *inflight) wait(ctx context.Context) error {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		f.mu.Lock()
+		n := f.n
+		f.mu.Unlock()
+		return fmt.Errorf("%d ledger calls still in flight: %w", n, ctx.Err())
+	}
+}
@@ -0,0 +1,57 @@
+package ledger
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+)
+
+// Ledger metrics, exposed by the admin server at /metrics.
+var (
+	callsTotal = metrics.Default.NewCounterVec("fdo_proxy_ledger_calls_total",
+		"Passport service calls by endpoint and result: success, not_found, http_error, error or circuit_open.", "endpoint", "result")
+	callDuration = metrics.Default.NewHistogramVec("fdo_proxy_ledger_call_duration_seconds",
+		"Time taken by passport service calls, including retries.", nil, "endpoint")
+	retriesTotal = metrics.Default.NewCounterVec("fdo_proxy_ledger_retries_total",
+		"Passport service attempts retried after a transient failure.", "endpoint")
+	breakerStateGauge = metrics.Default.NewGaugeVec("fdo_proxy_ledger_breaker_state",
+		"Circuit breaker state per endpoint: 0 closed, 1 open, 2 half-open.", "endpoint")
+	outboxItems = metrics.Default.NewGaugeVec("fdo_proxy_outbox_items",
+		"Commissioning passports in the outbox, by state (pending or failed).", "state")
+	outboxDeliveries = metrics.Default.NewCounterVec("fdo_proxy_outbox_deliveries_total",
+		"Outbox delivery attempts by result: delivered, retry or gave_up.", "result")
+	certExpiry = metrics.Default.NewGaugeVec("fdo_proxy_ledger_cert_expiry_timestamp_seconds",
+		"Unix time the loaded passport mTLS certificate expires, by cert: client or ca (earliest in the bundle).", "cert")
+	certReloads = metrics.Default.NewCounterVec("fdo_proxy_ledger_cert_reloads_total",
+		"Reloads of changed passport mTLS certificate files by result: success or error (the loaded certificates are kept).", "result")
+	cacheLookups = metrics.Default.NewCounterVec("fdo_proxy_passport_cache_lookups_total",
+		"Product passport cache lookups by result: hit, negative_hit or miss.", "result")
+)
+
+// callResult labels the outcome of an endpoint call.
+func callResult(resp *response, err error) string {
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case err != nil:
+		return "error"
+	case resp.status == http.StatusNotFound:
+		return "not_found"
+	case resp.status >= 400:
+		return "http_error"
+	default:
+		return "success"
+	}
+}
+
+// recordBreakerState publishes the state of endpoint's breaker.
+func recordBreakerState(endpoint string, state BreakerState) {
+	breakerStateGauge.With(endpoint).Set(float64(state))
+}
+
+// recordOutbox publishes the outbox sizes. Callers hold o.mu.
+func (o *Outbox) recordOutbox() {
+	outboxItems.With("pending").Set(float64(len(o.pending)))
+	outboxItems.With("failed").Set(float64(len(o.failed)))
+}
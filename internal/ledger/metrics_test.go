@@ -0,0 +1,66 @@
+package ledger
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEndpoint_Metrics(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		expectResult  string
+		expectRetries float64
+	}{
+		{name: "success after retry", statuses: []int{503, 200}, expectResult: "success", expectRetries: 1},
+		{name: "not found", statuses: []int{404}, expectResult: "not_found"},
+		{name: "exhausted", statuses: []int{503}, expectResult: "http_error", expectRetries: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := statusServer(t, &calls, tt.statuses...)
+			name := "metrics-test-" + tt.name
+			e := &endpoint{name: name, http: server.Client(), retry: fastRetry()}
+			// The counters are package globals, so check what this call adds
+			calls0 := callsTotal.With(name, tt.expectResult).Value()
+			retries0 := retriesTotal.With(name).Value()
+
+			e.do(context.Background(), func(ctx context.Context) (*http.Request, error) {
+				return http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			})
+			if got := callsTotal.With(name, tt.expectResult).Value() - calls0; got != 1 {
+				t.Errorf("expected 1 %s call, got %v", tt.expectResult, got)
+			}
+			if got := retriesTotal.With(name).Value() - retries0; got != tt.expectRetries {
+				t.Errorf("expected %v retries, got %v", tt.expectRetries, got)
+			}
+		})
+	}
+}
+
+func TestBreaker_Metrics(t *testing.T) {
+	const name = "metrics-test-breaker"
+	now := time.Now()
+	b := newBreaker(name, BreakerConfig{Failures: 1, Cooldown: time.Minute})
+	b.now = func() time.Time { return now }
+
+	expectState := func(expected BreakerState) {
+		t.Helper()
+		if got := breakerStateGauge.With(name).Value(); got != float64(expected) {
+			t.Errorf("expected breaker state %v, got %v", float64(expected), got)
+		}
+	}
+	expectState(BreakerClosed)
+	b.record(false)
+	expectState(BreakerOpen)
+	now = now.Add(time.Minute)
+	b.State()
+	expectState(BreakerHalfOpen)
+	b.record(true)
+	expectState(BreakerClosed)
+}
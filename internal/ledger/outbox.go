@@ -0,0 +1,436 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/audit"
+)
+
+// Outbox defaults.
+const (
+	DefaultOutboxMaxAttempts = 10
+	DefaultOutboxMinBackoff  = time.Second
+	DefaultOutboxMaxBackoff  = 5 * time.Minute
+)
+
+// CommissioningSender delivers commissioning passports; *Client implements it.
+type CommissioningSender interface {
+	CreateCommissioningPassport(ctx context.Context, body *CommissioningCreateRequest) error
+}
+
+// ErrNotInOutbox is returned by Retry for a controller UUID with no failed item.
+var ErrNotInOutbox = errors.New("no failed commissioning passport")
+
+// OutboxConfig configures an Outbox. Zero durations and attempts use the defaults.
+type OutboxConfig struct {
+	// Dir holds one JSON file per item, under pending/ and failed/.
+	Dir string
+	// MaxAttempts is how many deliveries are tried before an item is moved
+	// to failed/.
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	// Audit, if set, records each passport delivered or given up on.
+	Audit *audit.Log
+}
+
+// OutboxItem is one commissioning passport waiting for delivery.
+type OutboxItem struct {
+	ControllerUUID string                      `json:"controller_uuid"`
+	Request        *CommissioningCreateRequest `json:"request"`
+	EnqueuedAt     time.Time                   `json:"enqueued_at"`
+	Attempts       int                         `json:"attempts"`
+	NextAttempt    time.Time                   `json:"next_attempt"`
+	LastError      string                      `json:"last_error,omitempty"`
+}
+
+// Outbox persists commissioning passport requests on disk and delivers them
+// in the background, so an outage of the commissioning service does not lose
+// the record of an onboarded device. There is at most one item per
+// controller UUID; enqueueing a controller that is already pending keeps the
+// existing item. Items that exhaust their attempts move to failed/ until
+// retried.
+type Outbox struct {
+	cfg OutboxConfig
+
+	mu      sync.Mutex
+	sender  CommissioningSender
+	pending map[string]*OutboxItem
+	failed  map[string]*OutboxItem
+	kick    chan struct{}
+
+	// delivering serialises delivery passes from Run and Flush.
+	delivering sync.Mutex
+}
+
+// NewOutbox opens the outbox in cfg.Dir, creating it if needed, and loads
+// the items left by a previous run.
+func NewOutbox(sender CommissioningSender, cfg OutboxConfig) (*Outbox, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("outbox directory not configured")
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultOutboxMaxAttempts
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultOutboxMinBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultOutboxMaxBackoff
+	}
+
+	o := &Outbox{
+		sender: sender,
+		cfg:    cfg,
+		kick:   make(chan struct{}, 1),
+	}
+	var err error
+	if o.pending, err = o.load("pending"); err != nil {
+		return nil, err
+	}
+	if o.failed, err = o.load("failed"); err != nil {
+		return nil, err
+	}
+	o.recordOutbox()
+	return o, nil
+}
+
+func (o *Outbox) load(state string) (map[string]*OutboxItem, error) {
+	dir := filepath.Join(o.cfg.Dir, state)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create outbox: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read outbox: %w", err)
+	}
+
+	items := make(map[string]*OutboxItem)
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read outbox item: %w", err)
+		}
+		var item OutboxItem
+		if err := json.Unmarshal(b, &item); err != nil || item.Request == nil {
+			slog.Warn("Skipping unreadable outbox item", "file", e.Name(), "error", err)
+			continue
+		}
+		items[item.ControllerUUID] = &item
+	}
+	return items, nil
+}
+
+// Enqueue durably records req for delivery and wakes the delivery loop.
+// It returns once the item is on disk.
+func (o *Outbox) Enqueue(req *CommissioningCreateRequest) error {
+	if req == nil || req.ControllerUUID == "" {
+		return fmt.Errorf("commissioning request has no controller UUID")
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.pending[req.ControllerUUID]; ok {
+		slog.Debug("Commissioning passport already queued", "controller_uuid", req.ControllerUUID)
+		return nil
+	}
+
+	now := time.Now()
+	item := &OutboxItem{
+		ControllerUUID: req.ControllerUUID,
+		Request:        req,
+		EnqueuedAt:     now,
+		NextAttempt:    now,
+	}
+	if err := o.write("pending", item); err != nil {
+		return err
+	}
+	o.pending[item.ControllerUUID] = item
+	if _, ok := o.failed[item.ControllerUUID]; ok {
+		delete(o.failed, item.ControllerUUID)
+		o.remove("failed", item.ControllerUUID)
+	}
+	o.recordOutbox()
+	o.wake()
+	return nil
+}
+
+// SetSender delivers later attempts through sender, for example after the
+// passport backend was reconfigured. An attempt under way finishes with the
+// previous sender.
+func (o *Outbox) SetSender(sender CommissioningSender) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sender = sender
+	o.wake()
+}
+
+// Pending returns the items waiting for delivery, oldest first.
+func (o *Outbox) Pending() []OutboxItem {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return sortedItems(o.pending)
+}
+
+// Failed returns the items that exhausted their attempts, oldest first.
+func (o *Outbox) Failed() []OutboxItem {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return sortedItems(o.failed)
+}
+
+// Retry moves a failed item back to pending with a fresh attempt budget.
+// It returns an error matching ErrNotInOutbox if there is no such item.
+func (o *Outbox) Retry(controllerUUID string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	item, ok := o.failed[controllerUUID]
+	if !ok {
+		return fmt.Errorf("%w for %s", ErrNotInOutbox, controllerUUID)
+	}
+	retry := *item
+	retry.Attempts = 0
+	retry.NextAttempt = time.Now()
+	if err := o.write("pending", &retry); err != nil {
+		return err
+	}
+	o.pending[controllerUUID] = &retry
+	delete(o.failed, controllerUUID)
+	o.remove("failed", controllerUUID)
+	o.recordOutbox()
+	o.wake()
+	return nil
+}
+
+// Run delivers pending items until ctx is done, sleeping until the next
+// item is due or a new one is enqueued.
+func (o *Outbox) Run(ctx context.Context) {
+	for {
+		next := o.deliver(ctx, false)
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-o.kick:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Flush makes one delivery attempt for every pending item, ignoring
+// backoff, and waits for it to finish or for ctx to be done. Items that
+// still fail stay on disk for the next run, so Flush only returns an error
+// if ctx expires.
+func (o *Outbox) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.deliver(ctx, true)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("flush commissioning outbox: %w", ctx.Err())
+	}
+	if n := len(o.Pending()); n > 0 {
+		slog.Warn("Commissioning passports left in outbox for next start", "pending", n, "dir", o.cfg.Dir)
+	}
+	return nil
+}
+
+// deliver sends every due item (or every item, if all is set) and returns
+// when the earliest remaining item is due, or the zero time if none remain.
+func (o *Outbox) deliver(ctx context.Context, all bool) time.Time {
+	o.delivering.Lock()
+	defer o.delivering.Unlock()
+
+	now := time.Now()
+	for _, item := range o.Pending() {
+		if ctx.Err() != nil {
+			break
+		}
+		if !all && item.NextAttempt.After(now) {
+			continue
+		}
+		o.mu.Lock()
+		sender := o.sender
+		o.mu.Unlock()
+		err := sender.CreateCommissioningPassport(ctx, item.Request)
+		if err != nil && ctx.Err() != nil {
+			// Interrupted by shutdown; not the service's fault
+			break
+		}
+		o.settle(item, err)
+	}
+
+	var next time.Time
+	for _, item := range o.Pending() {
+		if next.IsZero() || item.NextAttempt.Before(next) {
+			next = item.NextAttempt
+		}
+	}
+	return next
+}
+
+// settle records the outcome of one delivery attempt.
+func (o *Outbox) settle(item OutboxItem, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	id := item.ControllerUUID
+	if err == nil {
+		delete(o.pending, id)
+		o.remove("pending", id)
+		o.recordOutbox()
+		outboxDeliveries.With("delivered").Inc()
+		slog.Info("Delivered commissioning passport",
+			"controller_uuid", id,
+			"attempts", item.Attempts+1)
+		o.cfg.Audit.Record(context.Background(), audit.EventCommissioningDelivered, id, "attempts", item.Attempts+1)
+		return
+	}
+
+	item.Attempts++
+	item.LastError = err.Error()
+	// Back off even if the item cannot be moved to failed/, so a disk error
+	// does not turn into a loop of repeated POSTs
+	item.NextAttempt = time.Now().Add(o.backoff(item.Attempts))
+	if item.Attempts >= o.cfg.MaxAttempts {
+		if werr := o.write("failed", &item); werr != nil {
+			slog.Error("Failed to record undeliverable commissioning passport", "controller_uuid", id, "error", werr)
+			o.pending[id] = &item
+			return
+		}
+		delete(o.pending, id)
+		o.remove("pending", id)
+		o.failed[id] = &item
+		o.recordOutbox()
+		outboxDeliveries.With("gave_up").Inc()
+		slog.Error("Giving up on commissioning passport",
+			"controller_uuid", id,
+			"attempts", item.Attempts,
+			"error", err)
+		o.cfg.Audit.Record(context.Background(), audit.EventCommissioningAbandoned, id, "attempts", item.Attempts, "error", err)
+		return
+	}
+
+	if werr := o.write("pending", &item); werr != nil {
+		slog.Error("Failed to update outbox item", "controller_uuid", id, "error", werr)
+	}
+	o.pending[id] = &item
+	outboxDeliveries.With("retry").Inc()
+	slog.Warn("Commissioning passport delivery failed, will retry",
+		"controller_uuid", id,
+		"attempts", item.Attempts,
+		"next_attempt", item.NextAttempt,
+		"error", err)
+}
+
+// backoff doubles from MinBackoff for each failed attempt, up to MaxBackoff.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	d := o.cfg.MinBackoff
+	for i := 1; i < attempts && d < o.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, o.cfg.MaxBackoff)
+}
+
+func (o *Outbox) wake() {
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+}
+
+// write stores item atomically under state/.
+func (o *Outbox) write(state string, item *OutboxItem) error {
+	b, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal outbox item: %w", err)
+	}
+	path := o.path(state, item.ControllerUUID)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, b); err != nil {
+		return fmt.Errorf("write outbox item: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write outbox item: %w", err)
+	}
+	return nil
+}
+
+func (o *Outbox) remove(state, controllerUUID string) {
+	if err := os.Remove(o.path(state, controllerUUID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Failed to remove outbox item", "controller_uuid", controllerUUID, "error", err)
+	}
+}
+
+func (o *Outbox) path(state, controllerUUID string) string {
+	return filepath.Join(o.cfg.Dir, state, outboxFileName(controllerUUID))
+}
+
+// outboxFileName maps a controller UUID to a safe file name.
+func outboxFileName(controllerUUID string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, controllerUUID)
+	return safe + ".json"
+}
+
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sortedItems(m map[string]*OutboxItem) []OutboxItem {
+	items := make([]OutboxItem, 0, len(m))
+	for _, item := range m {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].EnqueuedAt.Before(items[j].EnqueuedAt)
+	})
+	return items
+}
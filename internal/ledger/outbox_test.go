@@ -0,0 +1,219 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSender fails the first failures calls and records delivered requests.
+type fakeSender struct {
+	mu        sync.Mutex
+	failures  int
+	calls     int
+	delivered []string
+}
+
+func (s *fakeSender) CreateCommissioningPassport(ctx context.Context, body *CommissioningCreateRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.calls <= s.failures {
+		return errors.New("commissioning POST status 503")
+	}
+	s.delivered = append(s.delivered, body.ControllerUUID)
+	return nil
+}
+
+func (s *fakeSender) snapshot() (int, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls, append([]string(nil), s.delivered...)
+}
+
+func newTestOutbox(t *testing.T, dir string, sender CommissioningSender, maxAttempts int) *Outbox {
+	t.Helper()
+	o, err := NewOutbox(sender, OutboxConfig{
+		Dir:         dir,
+		MaxAttempts: maxAttempts,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return o
+}
+
+func TestOutbox_DeliversWithRetries(t *testing.T) {
+	sender := &fakeSender{failures: 2}
+	o := newTestOutbox(t, t.TempDir(), sender, 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+
+	if err := o.Enqueue(&CommissioningCreateRequest{ControllerUUID: "device-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(o.Pending()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	calls, delivered := sender.snapshot()
+	if len(delivered) != 1 || delivered[0] != "device-1" {
+		t.Fatalf("expected device-1 delivered, got %v", delivered)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+}
+
+func TestOutbox_PersistsAndDedupes(t *testing.T) {
+	dir := t.TempDir()
+	o := newTestOutbox(t, dir, &fakeSender{}, 5)
+
+	for _, id := range []string{"device-1", "device-2", "device-1"} {
+		if err := o.Enqueue(&CommissioningCreateRequest{ControllerUUID: id}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if n := len(o.Pending()); n != 2 {
+		t.Fatalf("expected 2 pending items, got %d", n)
+	}
+
+	// A new outbox on the same directory picks up where the first left off
+	sender := &fakeSender{}
+	reopened := newTestOutbox(t, dir, sender, 5)
+	if n := len(reopened.Pending()); n != 2 {
+		t.Fatalf("expected 2 pending items after reopen, got %d", n)
+	}
+	if err := reopened.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, delivered := sender.snapshot(); len(delivered) != 2 {
+		t.Errorf("expected 2 deliveries, got %v", delivered)
+	}
+	if n := len(newTestOutbox(t, dir, sender, 5).Pending()); n != 0 {
+		t.Errorf("expected delivered items removed from disk, got %d", n)
+	}
+}
+
+func TestOutbox_FailedAndRetry(t *testing.T) {
+	dir := t.TempDir()
+	sender := &fakeSender{failures: 2}
+	o := newTestOutbox(t, dir, sender, 2)
+
+	if err := o.Enqueue(&CommissioningCreateRequest{ControllerUUID: "device-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := o.Flush(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	failed := o.Failed()
+	if len(failed) != 1 || failed[0].Attempts != 2 || failed[0].LastError == "" {
+		t.Fatalf("expected device-1 failed after 2 attempts, got %+v", failed)
+	}
+	if n := len(o.Pending()); n != 0 {
+		t.Errorf("expected no pending items, got %d", n)
+	}
+	if n := len(newTestOutbox(t, dir, sender, 2).Failed()); n != 1 {
+		t.Errorf("expected failed item on disk, got %d", n)
+	}
+
+	if err := o.Retry("device-2"); err == nil {
+		t.Errorf("expected error retrying unknown item")
+	}
+	if err := o.Retry("device-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := o.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, delivered := sender.snapshot(); len(delivered) != 1 {
+		t.Errorf("expected retried item delivered, got %v", delivered)
+	}
+	if n := len(o.Failed()); n != 0 {
+		t.Errorf("expected no failed items, got %d", n)
+	}
+}
+
+func TestOutbox_BacksOffWhenFailedIsUnwritable(t *testing.T) {
+	dir := t.TempDir()
+	sender := &fakeSender{failures: 1}
+	o, err := NewOutbox(sender, OutboxConfig{Dir: dir, MaxAttempts: 1, MinBackoff: time.Minute})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := o.Enqueue(&CommissioningCreateRequest{ControllerUUID: "device-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A file in place of failed/ makes giving up fail
+	if err := os.RemoveAll(filepath.Join(dir, "failed")); err != nil {
+		t.Fatalf("remove failed dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "failed"), nil, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	start := time.Now()
+	o.deliver(context.Background(), false)
+
+	pending := o.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 1 || !pending[0].NextAttempt.After(start) {
+		t.Fatalf("expected device-1 pending with a backed-off attempt, got %+v", pending)
+	}
+	if next := o.deliver(context.Background(), false); !next.After(start) {
+		t.Errorf("expected the next attempt after %s, got %s", start, next)
+	}
+	if calls, _ := sender.snapshot(); calls != 1 {
+		t.Errorf("expected 1 call before the backoff elapses, got %d", calls)
+	}
+}
+
+func TestOutbox_SetSender(t *testing.T) {
+	down := &fakeSender{failures: 100}
+	o := newTestOutbox(t, t.TempDir(), down, 5)
+	if err := o.Enqueue(&CommissioningCreateRequest{ControllerUUID: "device-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.Flush(context.Background())
+
+	up := &fakeSender{}
+	o.SetSender(up)
+	o.Flush(context.Background())
+
+	if _, delivered := up.snapshot(); len(delivered) != 1 || delivered[0] != "device-1" {
+		t.Errorf("expected device-1 delivered through the new sender, got %v", delivered)
+	}
+	if calls, _ := down.snapshot(); calls != 1 {
+		t.Errorf("expected 1 call to the old sender, got %d", calls)
+	}
+}
+
+func TestOutbox_Backoff(t *testing.T) {
+	o := &Outbox{cfg: OutboxConfig{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{30, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := o.backoff(tt.attempts); got != tt.expected {
+			t.Errorf("attempt %d: expected %s, got %s", tt.attempts, tt.expected, got)
+		}
+	}
+}
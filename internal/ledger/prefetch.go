@@ -0,0 +1,236 @@
+package ledger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPrefetchConcurrency bounds parallel lookups during a prefetch.
+const DefaultPrefetchConcurrency = 8
+
+// PrefetchOptions configures PassportCache.Prefetch. Zero values use the
+// defaults.
+type PrefetchOptions struct {
+	// Concurrency is the number of lookups in flight at once.
+	Concurrency int
+	// TTL overrides the cache TTL for prefetched passports, so a batch
+	// loaded at the start of a shift stays warm until its boards reach DI.
+	TTL time.Duration
+}
+
+// PrefetchReport summarises a prefetch run.
+type PrefetchReport struct {
+	Requested int `json:"requested"`
+	Loaded    int `json:"loaded"`
+	// Missing lists product UUIDs the service has no passport for.
+	Missing []string `json:"missing"`
+	// Failed maps product UUIDs whose lookup failed to the error.
+	Failed   map[string]string `json:"failed"`
+	Duration string            `json:"duration"`
+}
+
+// Prefetch looks up every UUID in uuids from the passport service, bypassing
+// and refreshing the cache, with bounded concurrency. It returns once every
+// lookup has finished or ctx is done; UUIDs not attempted by then are
+// reported as failed.
+func (c *PassportCache) Prefetch(ctx context.Context, uuids []string, opts PrefetchOptions) *PrefetchReport {
+	start := time.Now()
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultPrefetchConcurrency
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = c.cfg.TTL
+	}
+	uuids = dedupe(uuids)
+
+	report := &PrefetchReport{
+		Requested: len(uuids),
+		Missing:   []string{},
+		Failed:    map[string]string{},
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Concurrency)
+
+	for _, uuid := range uuids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			report.Failed[uuid] = ctx.Err().Error()
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(uuid string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			passport, err := c.next.GetProductItemPassport(ctx, uuid)
+			c.fill(uuid, passport, err, opts.TTL)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				report.Loaded++
+			case errors.Is(err, ErrPassportNotFound):
+				report.Missing = append(report.Missing, uuid)
+			default:
+				report.Failed[uuid] = err.Error()
+			}
+		}(uuid)
+	}
+	wg.Wait()
+
+	sort.Strings(report.Missing)
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+	slog.Info("Prefetched product passports",
+		"requested", report.Requested,
+		"loaded", report.Loaded,
+		"missing", len(report.Missing),
+		"failed", len(report.Failed),
+		"duration", report.Duration)
+	if len(report.Missing) > 0 {
+		slog.Warn("Product UUIDs in manifest have no passport", "uuids", report.Missing)
+	}
+	return report
+}
+
+// ParseManifest reads the product UUIDs in a manufacturing manifest. JSON
+// manifests are an array of UUID strings, an array of objects with a "uuid"
+// member, or an object with such an array under "uuids". Anything else is
+// read as CSV: the first column holds the UUID, an optional header row
+// naming it "uuid" is skipped, and blank lines and lines starting with # are
+// ignored.
+func ParseManifest(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var uuids []string
+	if first == '[' || first == '{' {
+		uuids, err = parseJSONManifest(br)
+	} else {
+		uuids, err = parseCSVManifest(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(uuids) == 0 {
+		return nil, fmt.Errorf("manifest lists no product UUIDs")
+	}
+	return uuids, nil
+}
+
+// peekNonSpace skips leading whitespace and any UTF-8 byte order mark and
+// returns the first significant byte without consuming it.
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return 0, fmt.Errorf("manifest is empty")
+		}
+		if err != nil {
+			return 0, fmt.Errorf("read manifest: %w", err)
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n', 0xEF, 0xBB, 0xBF:
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
+
+func parseJSONManifest(r io.Reader) ([]string, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	b = bytes.TrimSpace(b)
+
+	var wrapped struct {
+		UUIDs json.RawMessage `json:"uuids"`
+	}
+	if b[0] == '{' {
+		if err := json.Unmarshal(b, &wrapped); err != nil {
+			return nil, fmt.Errorf("decode manifest: %w", err)
+		}
+		if wrapped.UUIDs == nil {
+			return nil, fmt.Errorf("decode manifest: no \"uuids\" member")
+		}
+		b = wrapped.UUIDs
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	uuids := make([]string, 0, len(items))
+	for i, item := range items {
+		var s string
+		if err := json.Unmarshal(item, &s); err == nil {
+			uuids = append(uuids, strings.TrimSpace(s))
+			continue
+		}
+		var obj struct {
+			UUID string `json:"uuid"`
+		}
+		if err := json.Unmarshal(item, &obj); err != nil || obj.UUID == "" {
+			return nil, fmt.Errorf("decode manifest: entry %d has no uuid", i)
+		}
+		uuids = append(uuids, strings.TrimSpace(obj.UUID))
+	}
+	return uuids, nil
+}
+
+func parseCSVManifest(r io.Reader) ([]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+
+	var uuids []string
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode manifest: %w", err)
+		}
+		uuid := strings.TrimSpace(rec[0])
+		if uuid == "" || (line == 1 && strings.EqualFold(uuid, "uuid")) {
+			continue
+		}
+		uuids = append(uuids, uuid)
+	}
+	return uuids, nil
+}
+
+// dedupe removes repeated and empty UUIDs, keeping first occurrences.
+func dedupe(uuids []string) []string {
+	seen := make(map[string]bool, len(uuids))
+	out := make([]string, 0, len(uuids))
+	for _, u := range uuids {
+		if u != "" && !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name        string
+		manifest    string
+		expected    []string
+		expectError bool
+	}{
+		{
+			name:     "CSV with header",
+			manifest: "uuid,batch\nSN-0001,B7\nSN-0002,B7\n",
+			expected: []string{"SN-0001", "SN-0002"},
+		},
+		{
+			name:     "CSV without header, comments and blank lines",
+			manifest: "# batch B7\r\nSN-0001\r\n\r\n SN-0002\r\n",
+			expected: []string{"SN-0001", "SN-0002"},
+		},
+		{
+			name:     "JSON strings",
+			manifest: `["SN-0001", "SN-0002"]`,
+			expected: []string{"SN-0001", "SN-0002"},
+		},
+		{
+			name:     "JSON objects",
+			manifest: "\ufeff" + `[{"uuid": "SN-0001", "line": 3}, {"uuid": "SN-0002"}]`,
+			expected: []string{"SN-0001", "SN-0002"},
+		},
+		{
+			name:     "JSON wrapped",
+			manifest: `{"batch": "B7", "uuids": ["SN-0001"]}`,
+			expected: []string{"SN-0001"},
+		},
+		{name: "empty", manifest: "  \n", expectError: true},
+		{name: "header only", manifest: "uuid\n", expectError: true},
+		{name: "JSON object without uuid", manifest: `[{"serial": "SN-0001"}]`, expectError: true},
+		{name: "JSON without uuids member", manifest: `{"batch": "B7"}`, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseManifest(strings.NewReader(tt.manifest))
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// flakyAPI fails lookups for UUIDs in failing and serves the rest like countingAPI.
+type flakyAPI struct {
+	countingAPI
+	failing map[string]bool
+}
+
+func (a *flakyAPI) GetProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error) {
+	if a.failing[uuid] {
+		return nil, errors.New("passport GET status 503: unavailable")
+	}
+	return a.countingAPI.GetProductItemPassport(ctx, uuid)
+}
+
+func TestPassportCache_Prefetch(t *testing.T) {
+	api := &flakyAPI{
+		countingAPI: countingAPI{passports: map[string]*ProductItemPassport{
+			"SN-0001": {UUID: "SN-0001"},
+			"SN-0002": {UUID: "SN-0002"},
+		}},
+		failing: map[string]bool{"SN-0004": true},
+	}
+	now := time.Now()
+	cache := NewPassportCache(api, CacheConfig{TTL: time.Minute})
+	cache.now = func() time.Time { return now }
+
+	// Concurrency 1 keeps the fake API free of races
+	report := cache.Prefetch(context.Background(),
+		[]string{"SN-0001", "SN-0002", "SN-0003", "SN-0004", "SN-0001"},
+		PrefetchOptions{Concurrency: 1, TTL: time.Hour})
+
+	if report.Requested != 4 || report.Loaded != 2 {
+		t.Errorf("expected 4 requested and 2 loaded, got %+v", report)
+	}
+	if !slices.Equal(report.Missing, []string{"SN-0003"}) {
+		t.Errorf("expected SN-0003 missing, got %v", report.Missing)
+	}
+	if _, ok := report.Failed["SN-0004"]; !ok || len(report.Failed) != 1 {
+		t.Errorf("expected SN-0004 failed, got %v", report.Failed)
+	}
+
+	// Prefetched passports outlive the normal TTL
+	now = now.Add(30 * time.Minute)
+	lookups := api.lookups
+	if _, err := cache.GetProductItemPassport(context.Background(), "SN-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if api.lookups != lookups {
+		t.Errorf("expected prefetched passport to be served from the cache")
+	}
+}
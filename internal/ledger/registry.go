@@ -0,0 +1,148 @@
+package ledger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BackendFactory opens a passport backend from its JSON configuration. An
+// empty config is passed as nil.
+type BackendFactory func(config json.RawMessage) (API, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a passport backend available to OpenBackend under
+// name. It panics if name is already registered, so it is meant to be
+// called from init.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if factory == nil {
+		panic("ledger: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("ledger: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns the names of the registered backends, sorted.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenBackend opens the backend registered under name with config.
+func OpenBackend(name string, config json.RawMessage) (API, error) {
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown passport backend %q (available: %v)", name, Backends())
+	}
+	api, err := factory(config)
+	if err != nil {
+		return nil, fmt.Errorf("open %s passport backend: %w", name, err)
+	}
+	return api, nil
+}
+
+// decodeConfig decodes a backend configuration into v, rejecting unknown
+// members so a misspelt setting is not silently ignored.
+func decodeConfig(config json.RawMessage, v any) error {
+	if len(bytes.TrimSpace(config)) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(config))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("decode config: %w", err)
+	}
+	return nil
+}
+
+// Duration is a time.Duration written in JSON as a string such as "5s".
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON formats the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// RESTConfig configures the "rest" backend: the passport service Client
+// speaks to. Zero retry, breaker and certificate settings use the defaults.
+type RESTConfig struct {
+	ProductBaseURL       string   `json:"product_base_url"`
+	CommissioningURL     string   `json:"commissioning_url"`
+	CACert               string   `json:"ca_cert"`
+	ClientCert           string   `json:"client_cert"`
+	ClientKey            string   `json:"client_key"`
+	RetryAttempts        int      `json:"retry_attempts"`
+	ProductTimeout       Duration `json:"product_timeout"`
+	CommissioningTimeout Duration `json:"commissioning_timeout"`
+	BreakerFailures      int      `json:"breaker_failures"`
+	BreakerCooldown      Duration `json:"breaker_cooldown"`
+	CertCheckInterval    Duration `json:"cert_check_interval"`
+	CertExpiryWarning    Duration `json:"cert_expiry_warning"`
+}
+
+// Open returns a Client for the configured service.
+func (c RESTConfig) Open() (*Client, error) {
+	productRetry := DefaultRetryPolicy(DefaultProductTimeout)
+	if c.ProductTimeout > 0 {
+		productRetry.Timeout = time.Duration(c.ProductTimeout)
+	}
+	commissioningRetry := DefaultCommissioningRetryPolicy(DefaultCommissioningTimeout)
+	if c.CommissioningTimeout > 0 {
+		commissioningRetry.Timeout = time.Duration(c.CommissioningTimeout)
+	}
+	if c.RetryAttempts > 0 {
+		productRetry.MaxAttempts = c.RetryAttempts
+		commissioningRetry.MaxAttempts = c.RetryAttempts
+	}
+	return NewClient(c.ProductBaseURL, c.CommissioningURL, c.CACert, c.ClientCert, c.ClientKey,
+		WithProductRetry(productRetry),
+		WithCommissioningRetry(commissioningRetry),
+		WithCircuitBreaker(BreakerConfig{Failures: c.BreakerFailures, Cooldown: time.Duration(c.BreakerCooldown)}),
+		WithCertReload(CertConfig{CheckInterval: time.Duration(c.CertCheckInterval), ExpiryWarning: time.Duration(c.CertExpiryWarning)}))
+}
+
+func init() {
+	RegisterBackend("rest", func(config json.RawMessage) (API, error) {
+		var cfg RESTConfig
+		if err := decodeConfig(config, &cfg); err != nil {
+			return nil, err
+		}
+		if cfg.ProductBaseURL == "" && cfg.CommissioningURL == "" {
+			return nil, fmt.Errorf("product_base_url or commissioning_url is required")
+		}
+		return cfg.Open()
+	})
+}
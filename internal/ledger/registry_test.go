@@ -0,0 +1,77 @@
+package ledger
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackends_BuiltIn(t *testing.T) {
+	got := Backends()
+	for _, name := range []string{"file", "rest", "webhook"} {
+		if !slices.Contains(got, name) {
+			t.Errorf("expected backend %q to be registered, got %v", name, got)
+		}
+	}
+}
+
+func TestOpenBackend(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name        string
+		backend     string
+		config      string
+		expectError string
+	}{
+		{name: "file", backend: "file", config: `{"dir": "` + dir + `"}`},
+		{name: "webhook", backend: "webhook", config: `{"product": {"url": "http://passports/{{.UUID | path}}"}}`},
+		{name: "unknown backend", backend: "ftp", expectError: "unknown passport backend"},
+		{name: "unknown setting", backend: "file", config: `{"dir": "` + dir + `", "directory": "x"}`, expectError: "unknown field"},
+		{name: "rest without URLs", backend: "rest", config: `{}`, expectError: "product_base_url"},
+		{name: "bad template", backend: "webhook", config: `{"product": {"url": "{{.UUID"}}`, expectError: "parse url template"},
+		{name: "bad duration", backend: "webhook", config: `{"product": {"url": "http://p"}, "timeout": 5}`, expectError: "duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, err := OpenBackend(tt.backend, json.RawMessage(tt.config))
+			if tt.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectError) {
+					t.Errorf("expected error containing %q, got %v", tt.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if api == nil {
+				t.Error("expected backend but got nil")
+			}
+		})
+	}
+}
+
+func TestRegisterBackend_Duplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic registering a backend twice")
+		}
+	}()
+	RegisterBackend("rest", func(json.RawMessage) (API, error) { return nil, nil })
+}
+
+func TestDuration_JSON(t *testing.T) {
+	var d Duration
+	if err := json.Unmarshal([]byte(`"1m30s"`), &d); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if time.Duration(d) != 90*time.Second {
+		t.Errorf("expected 1m30s, got %s", time.Duration(d))
+	}
+	b, _ := json.Marshal(d)
+	if string(b) != `"1m30s"` {
+		t.Errorf("expected \"1m30s\", got %s", b)
+	}
+}
@@ -0,0 +1,264 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/trace"
+)
+
+// Retry defaults used by NewClient.
+const (
+	DefaultRetryAttempts   = 3
+	DefaultRetryMinBackoff = 200 * time.Millisecond
+	DefaultRetryMaxBackoff = 2 * time.Second
+
+	DefaultProductTimeout       = 5 * time.Second
+	DefaultCommissioningTimeout = 15 * time.Second
+)
+
+// DefaultRetryStatuses are the HTTP statuses retried by default: the service
+// is overloaded or a gateway in front of it could not reach it.
+var DefaultRetryStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy controls how calls to one ledger endpoint are attempted. The
+// zero value makes a single attempt bounded only by the caller's context.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int
+	// Timeout bounds each attempt; 0 leaves it to the caller's context.
+	Timeout time.Duration
+	// Statuses are the HTTP response statuses worth another attempt.
+	Statuses []int
+	// NetworkErrors retries timeouts, refused or reset connections and
+	// connections closed mid-response. TLS and DNS errors are never retried.
+	NetworkErrors bool
+	// UnsentOnly narrows NetworkErrors to failures to connect, so a request
+	// the service may already have received is never sent again.
+	UnsentOnly bool
+	// MinBackoff is the delay before the second attempt; it doubles for
+	// each further attempt up to MaxBackoff. Each delay is jittered down by
+	// up to half, and a Retry-After header is honoured up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy returns the policy NewClient uses for an endpoint whose
+// attempts time out after timeout.
+func DefaultRetryPolicy(timeout time.Duration) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:   DefaultRetryAttempts,
+		Timeout:       timeout,
+		Statuses:      DefaultRetryStatuses,
+		NetworkErrors: true,
+		MinBackoff:    DefaultRetryMinBackoff,
+		MaxBackoff:    DefaultRetryMaxBackoff,
+	}
+}
+
+// UnsentRetryStatuses are the HTTP statuses that say the service did not
+// act on the request.
+var UnsentRetryStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusServiceUnavailable,
+}
+
+// DefaultCommissioningRetryPolicy returns the policy NewClient uses for the
+// commissioning endpoint. Creating a passport is not idempotent, so only
+// attempts the service cannot have acted on are retried: failed connections
+// and 429 or 503 responses. A timeout, reset or gateway error after the
+// request was sent could otherwise create a duplicate passport.
+func DefaultCommissioningRetryPolicy(timeout time.Duration) RetryPolicy {
+	p := DefaultRetryPolicy(timeout)
+	p.Statuses = UnsentRetryStatuses
+	p.UnsentOnly = true
+	return p
+}
+
+// response is a fully read HTTP response.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// endpoint is one ledger service endpoint with its retry policy and breaker.
+type endpoint struct {
+	name    string
+	http    *http.Client
+	retry   RetryPolicy
+	breaker *breaker
+}
+
+// do sends the request built by newRequest until it succeeds, fails with a
+// non-retryable error, or runs out of attempts. Any response with a status
+// is returned as-is for the caller to interpret; err is set only when no
+// response was obtained.
+func (e *endpoint) do(ctx context.Context, newRequest func(context.Context) (*http.Request, error)) (*response, error) {
+	start := time.Now()
+	attempts := max(e.retry.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		resp, err := e.attempt(ctx, newRequest)
+		retryable := e.retryable(resp, err)
+		if !retryable || attempt >= attempts || ctx.Err() != nil {
+			callsTotal.With(e.name, callResult(resp, err)).Inc()
+			callDuration.With(e.name).ObserveSince(start)
+			return resp, err
+		}
+
+		wait := e.backoff(attempt, resp)
+		slog.Debug("Retrying ledger call",
+			"endpoint", e.name,
+			"attempt", attempt,
+			"wait", wait,
+			"status", statusOf(resp),
+			"error", err)
+		retriesTotal.With(e.name).Inc()
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			callsTotal.With(e.name, callResult(resp, err)).Inc()
+			callDuration.With(e.name).ObserveSince(start)
+			return resp, err
+		}
+	}
+}
+
+func (e *endpoint) attempt(ctx context.Context, newRequest func(context.Context) (*http.Request, error)) (*response, error) {
+	if err := e.breaker.allow(); err != nil {
+		trace.SpanFromContext(ctx).SetAttributes("ledger.circuit_open", true)
+		return nil, err
+	}
+
+	actx := ctx
+	if e.retry.Timeout > 0 {
+		var cancel context.CancelFunc
+		actx, cancel = context.WithTimeout(ctx, e.retry.Timeout)
+		defer cancel()
+	}
+
+	actx, span := trace.Start(actx, "ledger "+e.name, trace.WithKind(trace.KindClient))
+	defer span.End()
+
+	req, err := newRequest(actx)
+	if err != nil {
+		e.breaker.release()
+		span.SetError(err)
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	trace.Inject(actx, req.Header)
+	span.SetAttributes("http.method", req.Method, "http.url", req.URL.Redacted())
+	resp, err := e.http.Do(req)
+	if err == nil {
+		var body []byte
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			e.breaker.record(resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests)
+			span.SetAttributes("http.status_code", resp.StatusCode)
+			if resp.StatusCode >= 500 {
+				span.SetError(fmt.Errorf("HTTP status %d", resp.StatusCode))
+			}
+			return &response{status: resp.StatusCode, header: resp.Header, body: body}, nil
+		}
+		err = fmt.Errorf("read response: %w", err)
+	} else {
+		err = fmt.Errorf("request failed: %w", err)
+	}
+	span.SetError(err)
+
+	if ctx.Err() != nil {
+		// The caller gave up; that says nothing about the service
+		e.breaker.release()
+	} else {
+		e.breaker.record(false)
+	}
+	return nil, err
+}
+
+func (e *endpoint) retryable(resp *response, err error) bool {
+	if err != nil {
+		if e.retry.UnsentOnly {
+			return e.retry.NetworkErrors && unsentNetworkError(err)
+		}
+		return e.retry.NetworkErrors && retryableNetworkError(err)
+	}
+	return slices.Contains(e.retry.Statuses, resp.status)
+}
+
+// backoff returns the jittered delay after attempt, stretched to honour a
+// Retry-After header.
+func (e *endpoint) backoff(attempt int, resp *response) time.Duration {
+	d := e.retry.MinBackoff
+	for i := 1; i < attempt && d < e.retry.MaxBackoff; i++ {
+		d *= 2
+	}
+	if e.retry.MaxBackoff > 0 {
+		d = min(d, e.retry.MaxBackoff)
+	}
+	if d > 0 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.header.Get("Retry-After")); err == nil && secs > 0 {
+			d = max(d, min(time.Duration(secs)*time.Second, e.retry.MaxBackoff))
+		}
+	}
+	return d
+}
+
+// retryableNetworkError reports whether err is a transient transport failure.
+func retryableNetworkError(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// unsentNetworkError reports whether err is a transient failure to connect,
+// before any of the request was written.
+func unsentNetworkError(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func statusOf(resp *response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.status
+}
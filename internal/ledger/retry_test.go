@@ -0,0 +1,345 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/trace"
+)
+
+// fastRetry is a policy that retries quickly enough for tests.
+func fastRetry() RetryPolicy {
+	p := DefaultRetryPolicy(time.Second)
+	p.MinBackoff = time.Millisecond
+	p.MaxBackoff = 5 * time.Millisecond
+	return p
+}
+
+// statusServer answers with statuses in turn, repeating the last one.
+func statusServer(t *testing.T, calls *atomic.Int32, statuses ...int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient_Retry(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		expectCalls   int32
+		expectSuccess bool
+	}{
+		{name: "success first time", statuses: []int{200}, expectCalls: 1, expectSuccess: true},
+		{name: "retries unavailable", statuses: []int{503, 502, 200}, expectCalls: 3, expectSuccess: true},
+		{name: "gives up after max attempts", statuses: []int{503}, expectCalls: 3},
+		{name: "does not retry internal error", statuses: []int{500, 200}, expectCalls: 1},
+		{name: "does not retry client error", statuses: []int{400, 200}, expectCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := statusServer(t, &calls, tt.statuses...)
+			client := &Client{
+				commissioningURL:   server.URL,
+				commissioningHTTP:  server.Client(),
+				commissioningRetry: fastRetry(),
+			}
+
+			err := client.CreateCommissioningPassport(context.Background(), &CommissioningCreateRequest{ControllerUUID: "test-uuid"})
+			if (err == nil) != tt.expectSuccess {
+				t.Errorf("expected success %v, got %v", tt.expectSuccess, err)
+			}
+			if got := calls.Load(); got != tt.expectCalls {
+				t.Errorf("expected %d calls, got %d", tt.expectCalls, got)
+			}
+		})
+	}
+}
+
+func TestClient_RetryNetworkErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close() // Connections are now refused
+
+	var attempts atomic.Int32
+	client := &Client{
+		commissioningURL: url,
+		commissioningHTTP: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			attempts.Add(1)
+			return http.DefaultTransport.RoundTrip(r)
+		})},
+		commissioningRetry: fastRetry(),
+	}
+
+	err := client.CreateCommissioningPassport(context.Background(), &CommissioningCreateRequest{ControllerUUID: "test-uuid"})
+	if err == nil {
+		t.Fatal("expected error but got none")
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("expected 3 attempts, got %d", got)
+	}
+}
+
+func TestClient_CommissioningRetry(t *testing.T) {
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refusedURL := refused.URL
+	refused.Close()
+
+	tests := []struct {
+		name        string
+		url         string
+		handler     http.HandlerFunc
+		expectCalls int32
+	}{
+		{
+			name:        "retries refused connection",
+			url:         refusedURL,
+			expectCalls: 3,
+		},
+		{
+			name:        "retries unavailable",
+			handler:     func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			expectCalls: 3,
+		},
+		{
+			name:        "does not retry gateway timeout",
+			handler:     func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusGatewayTimeout) },
+			expectCalls: 1,
+		},
+		{
+			name: "does not retry connection closed after sending",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+			},
+			expectCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := tt.url
+			if tt.handler != nil {
+				server := httptest.NewServer(tt.handler)
+				defer server.Close()
+				url = server.URL
+			}
+			policy := DefaultCommissioningRetryPolicy(time.Second)
+			policy.MinBackoff = time.Millisecond
+			policy.MaxBackoff = 5 * time.Millisecond
+
+			var attempts atomic.Int32
+			client := &Client{
+				commissioningURL: url,
+				commissioningHTTP: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+					attempts.Add(1)
+					return http.DefaultTransport.RoundTrip(r)
+				})},
+				commissioningRetry: policy,
+			}
+
+			err := client.CreateCommissioningPassport(context.Background(), &CommissioningCreateRequest{ControllerUUID: "test-uuid"})
+			if err == nil {
+				t.Fatal("expected error but got none")
+			}
+			if got := attempts.Load(); got != tt.expectCalls {
+				t.Errorf("expected %d attempts, got %d", tt.expectCalls, got)
+			}
+		})
+	}
+}
+
+func TestClient_AttemptTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	policy := fastRetry()
+	policy.Timeout = 20 * time.Millisecond
+	policy.MaxAttempts = 2
+	client := &Client{
+		productBaseURL: server.URL,
+		productHTTP:    server.Client(),
+		productRetry:   policy,
+	}
+
+	start := time.Now()
+	_, err := client.GetProductItemPassport(context.Background(), "test-uuid")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected attempts to time out quickly, took %s", elapsed)
+	}
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	server := statusServer(t, &calls, 503, 503, 503, 200)
+
+	now := time.Now()
+	b := newBreaker(EndpointCommissioning, BreakerConfig{Failures: 3, Cooldown: time.Minute})
+	b.now = func() time.Time { return now }
+	client := &Client{
+		commissioningURL:     server.URL,
+		commissioningHTTP:    server.Client(),
+		commissioningRetry:   fastRetry(),
+		commissioningBreaker: b,
+	}
+	create := func() error {
+		return client.CreateCommissioningPassport(context.Background(), &CommissioningCreateRequest{ControllerUUID: "test-uuid"})
+	}
+
+	// Three failed attempts open the breaker
+	if err := create(); err == nil {
+		t.Fatal("expected error but got none")
+	}
+	if got := client.BreakerStates()[EndpointCommissioning]; got != BreakerOpen {
+		t.Fatalf("expected breaker open, got %s", got)
+	}
+
+	// While open, calls fail fast without reaching the service
+	if err := create(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("expected 3 calls, got %d", got)
+	}
+
+	// After the cooldown a probe is let through and closes the breaker
+	now = now.Add(time.Minute)
+	if got := b.State(); got != BreakerHalfOpen {
+		t.Fatalf("expected breaker half-open, got %s", got)
+	}
+	if err := create(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Errorf("expected breaker closed, got %s", got)
+	}
+}
+
+func TestBreaker_HalfOpenProbe(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(EndpointProduct, BreakerConfig{Failures: 1, Cooldown: time.Second})
+	b.now = func() time.Time { return now }
+
+	b.record(false)
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+
+	now = now.Add(time.Second)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected probe to be allowed, got %v", err)
+	}
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected second call to wait for the probe, got %v", err)
+	}
+
+	// A failed probe reopens the breaker for another cooldown
+	b.record(false)
+	if got := b.State(); got != BreakerOpen {
+		t.Errorf("expected breaker open, got %s", got)
+	}
+}
+
+func TestEndpoint_Backoff(t *testing.T) {
+	e := &endpoint{retry: RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}}
+	tests := []struct {
+		attempt    int
+		retryAfter string
+		lo, hi     time.Duration
+	}{
+		{attempt: 1, lo: 50 * time.Millisecond, hi: 100 * time.Millisecond},
+		{attempt: 3, lo: 200 * time.Millisecond, hi: 400 * time.Millisecond},
+		{attempt: 10, lo: 500 * time.Millisecond, hi: time.Second},
+		{attempt: 1, retryAfter: "30", lo: time.Second, hi: time.Second},
+	}
+	for _, tt := range tests {
+		resp := &response{header: make(http.Header)}
+		if tt.retryAfter != "" {
+			resp.header.Set("Retry-After", tt.retryAfter)
+		}
+		if got := e.backoff(tt.attempt, resp); got < tt.lo || got > tt.hi {
+			t.Errorf("attempt %d: expected backoff in [%s, %s], got %s", tt.attempt, tt.lo, tt.hi, got)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+type spanRecorder struct{ spans []trace.SpanData }
+
+func (r *spanRecorder) Export(ctx context.Context, spans []trace.SpanData) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestEndpoint_TraceContext(t *testing.T) {
+	rec := &spanRecorder{}
+	tracer := trace.NewTracer(rec)
+	trace.SetDefault(tracer)
+	defer trace.SetDefault(nil)
+
+	var calls atomic.Int32
+	var seen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get(trace.TraceparentHeader))
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	ctx, parent := tracer.Start(context.Background(), "middleware DIMiddleware")
+	e := &endpoint{name: EndpointProduct, http: server.Client(), retry: fastRetry()}
+	if _, err := e.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/product_item/SN-1", nil)
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parent.End()
+	tracer.Shutdown(context.Background())
+
+	var attempts []trace.SpanData
+	for _, s := range rec.spans {
+		if s.Name == "ledger "+EndpointProduct {
+			attempts = append(attempts, s)
+		}
+	}
+	if len(attempts) != 2 || len(seen) != 2 {
+		t.Fatalf("expected 2 attempt spans and requests, got %d and %d", len(attempts), len(seen))
+	}
+	for i, s := range attempts {
+		if s.Parent != parent.Context().SpanID {
+			t.Errorf("expected attempt %d under the caller's span", i+1)
+		}
+		if seen[i] != s.Context.Traceparent() {
+			t.Errorf("expected traceparent %s, got %q", s.Context.Traceparent(), seen[i])
+		}
+	}
+	if !attempts[0].Error {
+		t.Error("expected the 503 attempt to be marked failed")
+	}
+}
@@ -0,0 +1,114 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SpoolExportedDir is the subdirectory of a spool that exported
+// commissioning passports are moved to.
+const SpoolExportedDir = "exported"
+
+// SpoolExportReport summarises an ExportSpool run.
+type SpoolExportReport struct {
+	Spooled int `json:"spooled"`
+	// Exported lists the spool files uploaded, or that would be with DryRun.
+	Exported []string `json:"exported"`
+	// Failed maps spool files that could not be uploaded to the error.
+	Failed map[string]string `json:"failed"`
+}
+
+// ExportSpool uploads the commissioning passports a FileStore spooled in
+// dir through sender, oldest first. Each uploaded file is moved to
+// dir/exported/, so a later run never sends it twice and a record of what
+// left the factory remains; files that fail stay for the next run. With
+// dryRun nothing is sent or moved.
+func ExportSpool(ctx context.Context, dir string, sender CommissioningSender, dryRun bool) (*SpoolExportReport, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("spool directory: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("list spool: %w", err)
+	}
+	sortByModTime(paths)
+	if !dryRun {
+		if err := os.MkdirAll(filepath.Join(dir, SpoolExportedDir), 0o755); err != nil {
+			return nil, fmt.Errorf("create exported directory: %w", err)
+		}
+	}
+
+	report := &SpoolExportReport{
+		Spooled:  len(paths),
+		Exported: []string{},
+		Failed:   map[string]string{},
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if err := ctx.Err(); err != nil {
+			report.Failed[name] = err.Error()
+			continue
+		}
+
+		req, err := readSpooled(path)
+		if err == nil && !dryRun {
+			err = sender.CreateCommissioningPassport(ctx, req)
+			if err == nil {
+				if err = os.Rename(path, filepath.Join(dir, SpoolExportedDir, name)); err != nil {
+					// Sent, but it will be sent again next run
+					err = fmt.Errorf("uploaded but not moved: %w", err)
+				}
+			}
+		}
+		if err != nil {
+			slog.Warn("Failed to export spooled commissioning passport", "file", name, "error", err)
+			report.Failed[name] = err.Error()
+			continue
+		}
+		report.Exported = append(report.Exported, name)
+	}
+
+	slog.Info("Exported commissioning passport spool",
+		"dir", dir,
+		"spooled", report.Spooled,
+		"exported", len(report.Exported),
+		"failed", len(report.Failed),
+		"dry_run", dryRun)
+	return report, nil
+}
+
+func readSpooled(path string) (*CommissioningCreateRequest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read spool file: %w", err)
+	}
+	var req CommissioningCreateRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, fmt.Errorf("decode spool file: %w", err)
+	}
+	if req.ControllerUUID == "" {
+		return nil, fmt.Errorf("spool file has no controller_uuid")
+	}
+	return &req, nil
+}
+
+// sortByModTime orders paths oldest first, by name for equal times.
+func sortByModTime(paths []string) {
+	mod := make(map[string]int64, len(paths))
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			mod[p] = info.ModTime().UnixNano()
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if mod[paths[i]] != mod[paths[j]] {
+			return mod[paths[i]] < mod[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+}
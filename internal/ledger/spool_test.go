@@ -0,0 +1,97 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// flakySender fails commissioning for the controllers in fail.
+type flakySender struct {
+	fail map[string]bool
+	sent []string
+}
+
+func (s *flakySender) CreateCommissioningPassport(ctx context.Context, req *CommissioningCreateRequest) error {
+	if s.fail[req.ControllerUUID] {
+		return errors.New("commissioning POST status 503")
+	}
+	s.sent = append(s.sent, req.ControllerUUID)
+	return nil
+}
+
+func spoolPassports(t *testing.T, controllers ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := NewFileStore(FileStoreConfig{Dir: t.TempDir(), CommissioningDir: dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range controllers {
+		if err := store.CreateCommissioningPassport(context.Background(), &CommissioningCreateRequest{ControllerUUID: c, Timestamp: "1"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestExportSpool(t *testing.T) {
+	dir := spoolPassports(t, "device-1", "device-2", "device-3")
+	os.WriteFile(filepath.Join(dir, "corrupt.json"), []byte("{"), 0o600)
+	sender := &flakySender{fail: map[string]bool{"device-2": true}}
+
+	report, err := ExportSpool(context.Background(), dir, sender, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Spooled != 4 || len(report.Exported) != 2 || len(report.Failed) != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if _, ok := report.Failed["device-2-1.json"]; !ok {
+		t.Errorf("expected device-2 to fail, got %v", report.Failed)
+	}
+	if !slices.Equal(sender.sent, []string{"device-1", "device-3"}) {
+		t.Errorf("expected device-1 and device-3 sent, got %v", sender.sent)
+	}
+	if _, err := os.Stat(filepath.Join(dir, SpoolExportedDir, "device-1-1.json")); err != nil {
+		t.Errorf("expected exported file to be moved: %v", err)
+	}
+
+	// The next run only retries what failed
+	sender = &flakySender{}
+	report, err = ExportSpool(context.Background(), dir, sender, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(sender.sent, []string{"device-2"}) {
+		t.Errorf("expected only device-2 sent, got %v", sender.sent)
+	}
+	if len(report.Failed) != 1 {
+		t.Errorf("expected only the corrupt file to fail, got %v", report.Failed)
+	}
+}
+
+func TestExportSpool_DryRun(t *testing.T) {
+	dir := spoolPassports(t, "device-1")
+	sender := &flakySender{}
+
+	report, err := ExportSpool(context.Background(), dir, sender, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(report.Exported) != 1 || len(sender.sent) != 0 {
+		t.Errorf("expected nothing sent on a dry run, got report %+v sent %v", report, sender.sent)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "device-1-1.json")); err != nil {
+		t.Errorf("expected spool file to stay: %v", err)
+	}
+}
+
+func TestExportSpool_MissingDir(t *testing.T) {
+	if _, err := ExportSpool(context.Background(), filepath.Join(t.TempDir(), "missing"), &flakySender{}, false); err == nil {
+		t.Error("expected error but got none")
+	}
+}
@@ -0,0 +1,101 @@
+package ledger
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TrustStore holds the public keys passport signatures are checked against.
+// Issuer keys sign whole passports; agent keys, looked up by agent UUID,
+// sign the records they add and countersign the passport content.
+type TrustStore struct {
+	Issuers map[string]*ecdsa.PublicKey
+	Agents  map[string]*ecdsa.PublicKey
+}
+
+// LoadTrustStore reads a trust store directory laid out as:
+//
+//	issuers/<name>.pem        issuer keys, any file name
+//	agents/<agent-uuid>.pem   agent keys, named by agent UUID
+//
+// Each file holds a PKIX "PUBLIC KEY" or a "CERTIFICATE" PEM block with an
+// ECDSA key. A missing subdirectory is treated as empty.
+func LoadTrustStore(dir string) (*TrustStore, error) {
+	issuers, err := loadKeyDir(filepath.Join(dir, "issuers"))
+	if err != nil {
+		return nil, err
+	}
+	agents, err := loadKeyDir(filepath.Join(dir, "agents"))
+	if err != nil {
+		return nil, err
+	}
+	if len(issuers) == 0 && len(agents) == 0 {
+		return nil, fmt.Errorf("trust store %s has no keys", dir)
+	}
+	return &TrustStore{Issuers: issuers, Agents: agents}, nil
+}
+
+func loadKeyDir(dir string) (map[string]*ecdsa.PublicKey, error) {
+	keys := make(map[string]*ecdsa.PublicKey)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read trust store: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".pem" {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read trust store key: %w", err)
+		}
+		key, err := ParsePublicKeyPEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys[strings.TrimSuffix(e.Name(), ".pem")] = key
+	}
+	return keys, nil
+}
+
+// ParsePublicKeyPEM parses an ECDSA public key from a PKIX "PUBLIC KEY" or
+// "CERTIFICATE" PEM block.
+func ParsePublicKeyPEM(b []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var pub any
+	switch block.Type {
+	case "PUBLIC KEY":
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+		pub = k
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate: %w", err)
+		}
+		pub = cert.PublicKey
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key is %T, want ECDSA", pub)
+	}
+	return key, nil
+}
@@ -0,0 +1,276 @@
+package ledger
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrSignature is wrapped by every passport signature verification failure.
+var ErrSignature = errors.New("passport signature invalid")
+
+// Verifier checks the signatures on product item passports against a
+// trust store.
+//
+// Signatures are base64 ASN.1 DER ECDSA signatures over the SHA-2 digest
+// matching the key's curve (SHA-256 for P-256, SHA-384 for P-384, SHA-512
+// for P-521) of a canonical JSON payload:
+//
+//   - each record: the record object without its "signature" member, signed
+//     by the agent;
+//   - agent: the passport without the top-level "signature" and without
+//     "agent.signature", signed by the agent;
+//   - passport: the passport without the top-level "signature", signed by an
+//     issuer.
+//
+// Canonical JSON has object members sorted by key, no insignificant
+// whitespace, no HTML escaping, and numbers exactly as the service sent them.
+type Verifier struct {
+	trust *TrustStore
+}
+
+// NewVerifier returns a Verifier using the keys in trust.
+func NewVerifier(trust *TrustStore) *Verifier {
+	return &Verifier{trust: trust}
+}
+
+// SignatureResult is the outcome of checking one signature.
+type SignatureResult struct {
+	// Subject names what was signed: "passport", "agent" or "record <uuid>".
+	Subject string
+	// KeyID is the trust store entry that verified the signature, if any.
+	KeyID string
+	Err   error
+}
+
+// Valid reports whether the signature verified.
+func (r SignatureResult) Valid() bool {
+	return r.Err == nil
+}
+
+// VerificationReport lists the result of every signature on a passport.
+type VerificationReport struct {
+	PassportUUID string
+	AgentUUID    string
+	Passport     SignatureResult
+	Agent        SignatureResult
+	Records      []SignatureResult
+}
+
+// Valid reports whether every signature on the passport verified.
+func (r *VerificationReport) Valid() bool {
+	return r.Err() == nil
+}
+
+// Err joins the failures in the report, or returns nil if there are none.
+func (r *VerificationReport) Err() error {
+	var errs []error
+	for _, res := range r.results() {
+		if res.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", res.Subject, res.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Failed returns the subjects whose signatures did not verify.
+func (r *VerificationReport) Failed() []string {
+	var failed []string
+	for _, res := range r.results() {
+		if res.Err != nil {
+			failed = append(failed, res.Subject)
+		}
+	}
+	return failed
+}
+
+func (r *VerificationReport) results() []SignatureResult {
+	return append([]SignatureResult{r.Passport, r.Agent}, r.Records...)
+}
+
+// Verify checks every signature on p and reports the outcome of each. It
+// never stops at the first failure so the report shows everything that was
+// tampered with.
+func (v *Verifier) Verify(p *ProductItemPassport) *VerificationReport {
+	report := &VerificationReport{
+		Passport: SignatureResult{Subject: "passport"},
+		Agent:    SignatureResult{Subject: "agent"},
+	}
+	if p == nil {
+		report.Passport.Err = fmt.Errorf("%w: no passport", ErrSignature)
+		report.Agent.Err = report.Passport.Err
+		return report
+	}
+	report.PassportUUID = p.UUID
+	report.AgentUUID = p.Agent.UUID
+
+	doc, err := passportDocument(p)
+	if err != nil {
+		report.Passport.Err = err
+		report.Agent.Err = err
+		return report
+	}
+
+	agentKey, agentErr := v.agentKey(p.Agent.UUID)
+
+	records, _ := doc["records"].([]any)
+	for i, rec := range p.Records {
+		res := SignatureResult{Subject: "record " + rec.UUID}
+		switch {
+		case agentErr != nil:
+			res.Err = agentErr
+		case i >= len(records):
+			res.Err = fmt.Errorf("%w: record missing from document", ErrSignature)
+		default:
+			obj, _ := records[i].(map[string]any)
+			res.KeyID = p.Agent.UUID
+			res.Err = verifyPayload(agentKey, rec.Signature, without(obj, "signature"))
+		}
+		report.Records = append(report.Records, res)
+	}
+
+	if agentErr != nil {
+		report.Agent.Err = agentErr
+	} else {
+		agent, _ := doc["agent"].(map[string]any)
+		payload := without(doc, "signature")
+		payload["agent"] = without(agent, "signature")
+		report.Agent.KeyID = p.Agent.UUID
+		report.Agent.Err = verifyPayload(agentKey, p.Agent.Signature, payload)
+	}
+
+	report.Passport.KeyID, report.Passport.Err = v.verifyIssuer(p.Signature, without(doc, "signature"))
+	return report
+}
+
+func (v *Verifier) agentKey(uuid string) (*ecdsa.PublicKey, error) {
+	if uuid == "" {
+		return nil, fmt.Errorf("%w: passport names no agent", ErrSignature)
+	}
+	key, ok := v.trust.Agents[uuid]
+	if !ok {
+		return nil, fmt.Errorf("%w: agent %s not in trust store", ErrSignature, uuid)
+	}
+	return key, nil
+}
+
+// verifyIssuer tries every issuer key, in key ID order, and returns the ID
+// of the one that verified sig.
+func (v *Verifier) verifyIssuer(sig string, payload map[string]any) (string, error) {
+	if len(v.trust.Issuers) == 0 {
+		return "", fmt.Errorf("%w: no issuer keys in trust store", ErrSignature)
+	}
+	ids := make([]string, 0, len(v.trust.Issuers))
+	for id := range v.trust.Issuers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var err error
+	for _, id := range ids {
+		if err = verifyPayload(v.trust.Issuers[id], sig, payload); err == nil {
+			return id, nil
+		}
+	}
+	if len(ids) > 1 {
+		return "", fmt.Errorf("%w: no issuer key matches", ErrSignature)
+	}
+	return "", err
+}
+
+// passportDocument returns the passport as a generic JSON document, taken
+// from the service response when available.
+func passportDocument(p *ProductItemPassport) (map[string]any, error) {
+	raw := p.Raw
+	if len(raw) == 0 {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return nil, fmt.Errorf("marshal passport: %w", err)
+		}
+		raw = b
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: decode passport: %v", ErrSignature, err)
+	}
+	return doc, nil
+}
+
+// without returns a shallow copy of obj lacking key.
+func without(obj map[string]any, key string) map[string]any {
+	out := make(map[string]any, len(obj))
+	for k, v := range obj {
+		if k != key {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// CanonicalJSON encodes v with sorted object keys, no whitespace and no
+// HTML escaping. Decode input with UseNumber to keep numbers byte-exact.
+func CanonicalJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func verifyPayload(key *ecdsa.PublicKey, sig string, payload map[string]any) error {
+	if sig == "" {
+		return fmt.Errorf("%w: missing signature", ErrSignature)
+	}
+	der, err := decodeSignature(sig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+	msg, err := CanonicalJSON(payload)
+	if err != nil {
+		return fmt.Errorf("canonicalize payload: %w", err)
+	}
+	h := hashFor(key.Curve).New()
+	h.Write(msg)
+	if !ecdsa.VerifyASN1(key, h.Sum(nil), der) {
+		return fmt.Errorf("%w: signature does not match", ErrSignature)
+	}
+	return nil
+}
+
+// decodeSignature accepts standard or URL-safe base64, padded or not.
+func decodeSignature(sig string) ([]byte, error) {
+	sig = strings.TrimRight(sig, "=")
+	if b, err := base64.RawStdEncoding.DecodeString(sig); err == nil {
+		return b, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, fmt.Errorf("decode signature: %w", err)
+	}
+	return b, nil
+}
+
+// hashFor returns the digest paired with curve.
+func hashFor(curve elliptic.Curve) crypto.Hash {
+	switch curve {
+	case elliptic.P384():
+		return crypto.SHA384
+	case elliptic.P521():
+		return crypto.SHA512
+	default:
+		return crypto.SHA256
+	}
+}
@@ -0,0 +1,243 @@
+package ledger
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testAgentUUID = "agent-1"
+
+// signedPassport returns a passport signed as the service would sign it,
+// with Raw holding the signed document.
+func signedPassport(t *testing.T, issuer, agent *ecdsa.PrivateKey) *ProductItemPassport {
+	t.Helper()
+	p := &ProductItemPassport{
+		SchemaVersion: 0.1,
+		UUID:          "passport-1",
+		Records: []ProductItemRecord{
+			{UUID: "record-1", Descriptor: "PRODUCT PASSPORT"},
+			{UUID: "record-2", Descriptor: "TEST REPORT <final>"},
+		},
+		Metadata: ProductItemMetadata{Version: "1.0", CreationTime: "1700000000", BoardSN: "SN-0001"},
+		Agent:    ProductItemAgent{UUID: testAgentUUID},
+	}
+
+	doc := mustDocument(t, p)
+	records := doc["records"].([]any)
+	for i := range p.Records {
+		p.Records[i].Signature = sign(t, agent, without(records[i].(map[string]any), "signature"))
+	}
+
+	doc = mustDocument(t, p)
+	payload := without(doc, "signature")
+	payload["agent"] = without(doc["agent"].(map[string]any), "signature")
+	p.Agent.Signature = sign(t, agent, payload)
+
+	p.Signature = sign(t, issuer, without(mustDocument(t, p), "signature"))
+
+	raw, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Raw = raw
+	return p
+}
+
+func mustDocument(t *testing.T, p *ProductItemPassport) map[string]any {
+	t.Helper()
+	doc, err := passportDocument(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, payload map[string]any) string {
+	t.Helper()
+	msg, err := CanonicalJSON(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(msg)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	issuer, agent, other := newKey(t), newKey(t), newKey(t)
+	trust := &TrustStore{
+		Issuers: map[string]*ecdsa.PublicKey{"issuer": &issuer.PublicKey},
+		Agents:  map[string]*ecdsa.PublicKey{testAgentUUID: &agent.PublicKey},
+	}
+
+	tests := []struct {
+		name     string
+		trust    *TrustStore
+		tamper   func(p *ProductItemPassport)
+		expected []string
+	}{
+		{
+			name: "valid passport",
+		},
+		{
+			name: "valid without raw document",
+			tamper: func(p *ProductItemPassport) {
+				p.Raw = nil
+			},
+		},
+		{
+			name: "tampered metadata",
+			tamper: func(p *ProductItemPassport) {
+				p.Raw = []byte(strings.Replace(string(p.Raw), "SN-0001", "SN-0002", 1))
+			},
+			expected: []string{"passport", "agent"},
+		},
+		{
+			name: "tampered record",
+			tamper: func(p *ProductItemPassport) {
+				p.Raw = []byte(strings.Replace(string(p.Raw), "TEST REPORT", "FAKE REPORT", 1))
+			},
+			expected: []string{"passport", "agent", "record record-2"},
+		},
+		{
+			name: "unmodelled field added",
+			tamper: func(p *ProductItemPassport) {
+				p.Raw = []byte(strings.Replace(string(p.Raw), `"uuid":"passport-1"`, `"uuid":"passport-1","extra":1`, 1))
+			},
+			expected: []string{"passport", "agent"},
+		},
+		{
+			name: "unknown agent",
+			trust: &TrustStore{
+				Issuers: trust.Issuers,
+				Agents:  map[string]*ecdsa.PublicKey{"agent-2": &agent.PublicKey},
+			},
+			expected: []string{"agent", "record record-1", "record record-2"},
+		},
+		{
+			name: "untrusted issuer",
+			trust: &TrustStore{
+				Issuers: map[string]*ecdsa.PublicKey{"other": &other.PublicKey},
+				Agents:  trust.Agents,
+			},
+			expected: []string{"passport"},
+		},
+		{
+			name: "missing passport signature",
+			tamper: func(p *ProductItemPassport) {
+				p.Signature = ""
+			},
+			expected: []string{"passport"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := signedPassport(t, issuer, agent)
+			if tt.tamper != nil {
+				tt.tamper(p)
+			}
+			ts := trust
+			if tt.trust != nil {
+				ts = tt.trust
+			}
+
+			report := NewVerifier(ts).Verify(p)
+			failed := report.Failed()
+			if strings.Join(failed, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected failures %v, got %v (%v)", tt.expected, failed, report.Err())
+			}
+			if report.Valid() != (len(tt.expected) == 0) {
+				t.Errorf("expected Valid %v, got %v", len(tt.expected) == 0, report.Valid())
+			}
+			if err := report.Err(); err != nil && !errors.Is(err, ErrSignature) {
+				t.Errorf("expected error wrapping ErrSignature, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifier_KeyIDs(t *testing.T) {
+	issuer, agent := newKey(t), newKey(t)
+	trust := &TrustStore{
+		Issuers: map[string]*ecdsa.PublicKey{
+			"a-retired": &newKey(t).PublicKey,
+			"b-current": &issuer.PublicKey,
+		},
+		Agents: map[string]*ecdsa.PublicKey{testAgentUUID: &agent.PublicKey},
+	}
+
+	report := NewVerifier(trust).Verify(signedPassport(t, issuer, agent))
+	if !report.Valid() {
+		t.Fatalf("expected valid report, got %v", report.Err())
+	}
+	if report.Passport.KeyID != "b-current" {
+		t.Errorf("expected issuer key b-current, got %q", report.Passport.KeyID)
+	}
+	if report.Agent.KeyID != testAgentUUID {
+		t.Errorf("expected agent key %s, got %q", testAgentUUID, report.Agent.KeyID)
+	}
+}
+
+func TestLoadTrustStore(t *testing.T) {
+	dir := t.TempDir()
+	issuer, agent := newKey(t), newKey(t)
+	writeKey(t, filepath.Join(dir, "issuers", "passport-service.pem"), &issuer.PublicKey)
+	writeKey(t, filepath.Join(dir, "agents", testAgentUUID+".pem"), &agent.PublicKey)
+	if err := os.WriteFile(filepath.Join(dir, "agents", "README"), []byte("ignored"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	trust, err := LoadTrustStore(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !trust.Issuers["passport-service"].Equal(&issuer.PublicKey) {
+		t.Errorf("expected issuer key passport-service to be loaded")
+	}
+	if !trust.Agents[testAgentUUID].Equal(&agent.PublicKey) {
+		t.Errorf("expected agent key %s to be loaded", testAgentUUID)
+	}
+
+	if _, err := LoadTrustStore(t.TempDir()); err == nil {
+		t.Errorf("expected error for empty trust store")
+	}
+}
+
+func writeKey(t *testing.T, path string, pub *ecdsa.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
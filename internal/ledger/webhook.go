@@ -0,0 +1,344 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// WebhookConfig configures the "webhook" backend, which calls arbitrary
+// HTTP endpoints described by templates.
+type WebhookConfig struct {
+	Product       WebhookEndpoint `json:"product"`
+	Commissioning WebhookEndpoint `json:"commissioning"`
+
+	// Optional TLS material; client cert and key enable mTLS.
+	CACert     string `json:"ca_cert"`
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+
+	// Zero retry and breaker settings use the defaults.
+	RetryAttempts   int      `json:"retry_attempts"`
+	Timeout         Duration `json:"timeout"`
+	BreakerFailures int      `json:"breaker_failures"`
+	BreakerCooldown Duration `json:"breaker_cooldown"`
+}
+
+// WebhookEndpoint describes one templated call. URL, Headers and Body are
+// text/template templates. Product templates see {{.UUID}}; commissioning
+// templates see the CommissioningCreateRequest fields ({{.ControllerUUID}},
+// {{.Cert}}, {{.DeployedLocation}}, {{.Timestamp}}). Templates may use:
+//
+//	query  escapes a value for a URL query
+//	path   escapes a value for a URL path segment
+//	json   encodes a value as a JSON string, quotes included
+//	env    reads an environment variable, e.g. for a bearer token
+type WebhookEndpoint struct {
+	// Method defaults to GET for product lookups and POST for commissioning.
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Body is the request body. A commissioning call without one sends the
+	// request as JSON, as the REST backend does.
+	Body string `json:"body"`
+	// ResultPath is the dot-separated path of the passport document within
+	// the product response, e.g. "data.passport"; empty uses the whole body.
+	ResultPath string `json:"result_path"`
+	// NotFoundStatuses are response statuses meaning the service has no
+	// passport for the UUID; default 404.
+	NotFoundStatuses []int `json:"not_found_statuses"`
+}
+
+// Webhook is a passport backend for services with their own REST shape.
+type Webhook struct {
+	product       *webhookCall
+	commissioning *webhookCall
+	calls         inflight
+}
+
+type webhookCall struct {
+	endpoint   *endpoint
+	method     string
+	url        *template.Template
+	headers    map[string]*template.Template
+	body       *template.Template
+	resultPath []string
+	notFound   []int
+}
+
+var webhookFuncs = template.FuncMap{
+	"query": url.QueryEscape,
+	"path":  url.PathEscape,
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"env": os.Getenv,
+}
+
+// NewWebhook compiles the templates in cfg. At least one endpoint URL must
+// be set; calls to an endpoint without one fail.
+func NewWebhook(cfg WebhookConfig) (*Webhook, error) {
+	if cfg.Product.URL == "" && cfg.Commissioning.URL == "" {
+		return nil, fmt.Errorf("product.url or commissioning.url is required")
+	}
+	httpClient, err := newHTTPClient(cfg.CACert, cfg.ClientCert, cfg.ClientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	productRetry := DefaultRetryPolicy(DefaultProductTimeout)
+	commissioningRetry := DefaultCommissioningRetryPolicy(DefaultCommissioningTimeout)
+	if cfg.Timeout > 0 {
+		productRetry.Timeout = time.Duration(cfg.Timeout)
+		commissioningRetry.Timeout = time.Duration(cfg.Timeout)
+	}
+	if cfg.RetryAttempts > 0 {
+		productRetry.MaxAttempts = cfg.RetryAttempts
+		commissioningRetry.MaxAttempts = cfg.RetryAttempts
+	}
+	breakerCfg := BreakerConfig{Failures: cfg.BreakerFailures, Cooldown: time.Duration(cfg.BreakerCooldown)}
+
+	w := &Webhook{}
+	if cfg.Product.URL != "" {
+		e := &endpoint{name: EndpointProduct, http: httpClient, retry: productRetry, breaker: newBreaker(EndpointProduct, breakerCfg)}
+		if w.product, err = compileWebhookCall(e, cfg.Product, http.MethodGet); err != nil {
+			return nil, fmt.Errorf("product: %w", err)
+		}
+	}
+	if cfg.Commissioning.URL != "" {
+		e := &endpoint{name: EndpointCommissioning, http: httpClient, retry: commissioningRetry, breaker: newBreaker(EndpointCommissioning, breakerCfg)}
+		if w.commissioning, err = compileWebhookCall(e, cfg.Commissioning, http.MethodPost); err != nil {
+			return nil, fmt.Errorf("commissioning: %w", err)
+		}
+	}
+	return w, nil
+}
+
+func compileWebhookCall(e *endpoint, cfg WebhookEndpoint, method string) (*webhookCall, error) {
+	parse := func(name, text string) (*template.Template, error) {
+		t, err := template.New(name).Funcs(webhookFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s template: %w", name, err)
+		}
+		return t, nil
+	}
+
+	c := &webhookCall{endpoint: e, method: method, notFound: cfg.NotFoundStatuses}
+	if cfg.Method != "" {
+		c.method = strings.ToUpper(cfg.Method)
+	}
+	if len(c.notFound) == 0 {
+		c.notFound = []int{http.StatusNotFound}
+	}
+	if cfg.ResultPath != "" {
+		c.resultPath = strings.Split(cfg.ResultPath, ".")
+	}
+
+	var err error
+	if c.url, err = parse("url", cfg.URL); err != nil {
+		return nil, err
+	}
+	if cfg.Body != "" {
+		if c.body, err = parse("body", cfg.Body); err != nil {
+			return nil, err
+		}
+	}
+	c.headers = make(map[string]*template.Template, len(cfg.Headers))
+	for name, text := range cfg.Headers {
+		if c.headers[name], err = parse("header "+name, text); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// GetProductItemPassport renders and sends the product call. A status in
+// NotFoundStatuses is reported as an error matching ErrPassportNotFound.
+func (w *Webhook) GetProductItemPassport(ctx context.Context, uuid string) (*ProductItemPassport, error) {
+	w.calls.add()
+	defer w.calls.done()
+
+	if w.product == nil {
+		return nil, fmt.Errorf("product webhook not configured")
+	}
+	resp, err := w.product.do(ctx, struct{ UUID string }{uuid}, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range w.product.notFound {
+		if resp.status == status {
+			return nil, fmt.Errorf("%w: %w", ErrPassportNotFound, &StatusError{Op: "passport webhook", StatusCode: resp.status, Body: string(resp.body)})
+		}
+	}
+	if resp.status < 200 || resp.status >= 300 {
+		return nil, &StatusError{Op: "passport webhook", StatusCode: resp.status, Body: string(resp.body)}
+	}
+
+	raw, err := extractJSON(resp.body, w.product.resultPath)
+	if err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	var out ProductItemPassport
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	out.Raw = raw
+	return &out, nil
+}
+
+// CreateCommissioningPassport renders and sends the commissioning call.
+func (w *Webhook) CreateCommissioningPassport(ctx context.Context, body *CommissioningCreateRequest) error {
+	w.calls.add()
+	defer w.calls.done()
+
+	if w.commissioning == nil {
+		return fmt.Errorf("commissioning webhook not configured")
+	}
+	var fallback []byte
+	if w.commissioning.body == nil {
+		var err error
+		if fallback, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("marshal request: %w", err)
+		}
+	}
+	resp, err := w.commissioning.do(ctx, body, fallback)
+	if err != nil {
+		return err
+	}
+	if resp.status < 200 || resp.status >= 300 {
+		return &StatusError{Op: "commissioning webhook", StatusCode: resp.status, Body: string(resp.body)}
+	}
+	return nil
+}
+
+// Flush waits for outstanding webhook calls to finish, or for ctx to be done.
+func (w *Webhook) Flush(ctx context.Context) error {
+	return w.calls.wait(ctx)
+}
+
+// BreakerStates returns the circuit breaker state of each configured endpoint.
+func (w *Webhook) BreakerStates() map[string]BreakerState {
+	states := make(map[string]BreakerState, 2)
+	for _, c := range []*webhookCall{w.product, w.commissioning} {
+		if c != nil {
+			states[c.endpoint.name] = c.endpoint.breaker.State()
+		}
+	}
+	return states
+}
+
+// do renders the call's templates with data and sends it. body is sent
+// when the call has no body template.
+func (c *webhookCall) do(ctx context.Context, data any, body []byte) (*response, error) {
+	render := func(t *template.Template) (string, error) {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("render webhook %s: %w", t.Name(), err)
+		}
+		return buf.String(), nil
+	}
+
+	target, err := render(c.url)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(http.Header, len(c.headers))
+	for name, t := range c.headers {
+		v, err := render(t)
+		if err != nil {
+			return nil, err
+		}
+		headers.Set(name, v)
+	}
+	if c.body != nil {
+		s, err := render(c.body)
+		if err != nil {
+			return nil, err
+		}
+		body = []byte(s)
+	}
+	if body != nil && headers.Get("Content-Type") == "" {
+		headers.Set("Content-Type", "application/json")
+	}
+
+	return c.endpoint.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, c.method, target, r)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = headers.Clone()
+		return req, nil
+	})
+}
+
+// extractJSON returns the member of a JSON document at path.
+func extractJSON(doc []byte, path []string) (json.RawMessage, error) {
+	raw := json.RawMessage(doc)
+	for i, key := range path {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, fmt.Errorf("%s is not an object", strings.Join(path[:i], "."))
+		}
+		var ok bool
+		if raw, ok = obj[key]; !ok {
+			return nil, fmt.Errorf("no member %s", strings.Join(path[:i+1], "."))
+		}
+	}
+	return raw, nil
+}
+
+// newHTTPClient returns a client trusting caPath, if set, and presenting
+// the client certificate, if set. With neither it is a plain client.
+func newHTTPClient(caPath, certPath, keyPath string) (*http.Client, error) {
+	if caPath == "" && certPath == "" && keyPath == "" {
+		return &http.Client{}, nil
+	}
+	if (certPath == "") != (keyPath == "") {
+		return nil, fmt.Errorf("client cert and key must be set together")
+	}
+
+	tlsConfig := &tls.Config{}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("load client cert/key: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caPath != "" {
+		caCert, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("read CA cert: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if ok := tlsConfig.RootCAs.AppendCertsFromPEM(caCert); !ok {
+			return nil, fmt.Errorf("append CA cert")
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+func init() {
+	RegisterBackend("webhook", func(config json.RawMessage) (API, error) {
+		var cfg WebhookConfig
+		if err := decodeConfig(config, &cfg); err != nil {
+			return nil, err
+		}
+		return NewWebhook(cfg)
+	})
+}
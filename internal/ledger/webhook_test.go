@@ -0,0 +1,142 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWebhook_GetProductItemPassport(t *testing.T) {
+	t.Setenv("PASSPORT_TOKEN", "secret")
+	var gotPath, gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		gotAuth = r.Header.Get("Authorization")
+		switch r.URL.Query().Get("tenant") {
+		case "missing":
+			w.WriteHeader(http.StatusGone)
+		default:
+			w.Write([]byte(`{"data": {"passport": {"uuid": "product 1", "signature": "sig"}}}`))
+		}
+	}))
+	defer server.Close()
+
+	newWebhook := func(tenant string) *Webhook {
+		w, err := NewWebhook(WebhookConfig{Product: WebhookEndpoint{
+			URL:              server.URL + "/items/{{.UUID | path}}?tenant=" + tenant,
+			Headers:          map[string]string{"Authorization": `Bearer {{env "PASSPORT_TOKEN"}}`},
+			ResultPath:       "data.passport",
+			NotFoundStatuses: []int{http.StatusNotFound, http.StatusGone},
+		}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return w
+	}
+
+	passport, err := newWebhook("acme").GetProductItemPassport(context.Background(), "product 1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if passport.UUID != "product 1" || string(passport.Raw) != `{"uuid": "product 1", "signature": "sig"}` {
+		t.Errorf("unexpected passport %+v raw %s", passport, passport.Raw)
+	}
+	if gotPath != "/items/product%201" {
+		t.Errorf("expected escaped path, got %s", gotPath)
+	}
+	if gotAuth != "Bearer secret" {
+		t.Errorf("expected templated header, got %q", gotAuth)
+	}
+
+	if _, err := newWebhook("missing").GetProductItemPassport(context.Background(), "product 1"); !errors.Is(err, ErrPassportNotFound) {
+		t.Errorf("expected ErrPassportNotFound, got %v", err)
+	}
+}
+
+func TestWebhook_CreateCommissioningPassport(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		expectBody string
+	}{
+		{
+			name:       "default body",
+			expectBody: `{"controller_uuid":"device-1","cert":"","deployed_location":"plant \"7\"","timestamp":"1"}`,
+		},
+		{
+			name:       "templated body",
+			body:       `{"device": {{json .ControllerUUID}}, "site": {{json .DeployedLocation}}}`,
+			expectBody: `{"device": "device-1", "site": "plant \"7\""}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotMethod, gotBody, gotType string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				gotMethod, gotBody, gotType = r.Method, string(b), r.Header.Get("Content-Type")
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer server.Close()
+
+			w, err := NewWebhook(WebhookConfig{Commissioning: WebhookEndpoint{Method: "put", URL: server.URL + "/controllers/{{.ControllerUUID}}", Body: tt.body}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			req := &CommissioningCreateRequest{ControllerUUID: "device-1", DeployedLocation: `plant "7"`, Timestamp: "1"}
+			if err := w.CreateCommissioningPassport(context.Background(), req); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotMethod != http.MethodPut {
+				t.Errorf("expected PUT, got %s", gotMethod)
+			}
+			if gotBody != tt.expectBody {
+				t.Errorf("expected body %s, got %s", tt.expectBody, gotBody)
+			}
+			if gotType != "application/json" {
+				t.Errorf("expected JSON content type, got %q", gotType)
+			}
+			if !json.Valid([]byte(gotBody)) {
+				t.Errorf("expected valid JSON body, got %s", gotBody)
+			}
+		})
+	}
+}
+
+func TestWebhook_CommissioningNotRetriedAfterSending(t *testing.T) {
+	var calls atomic.Int32
+	server := statusServer(t, &calls, http.StatusGatewayTimeout)
+
+	w, err := NewWebhook(WebhookConfig{Commissioning: WebhookEndpoint{URL: server.URL}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.CreateCommissioningPassport(context.Background(), &CommissioningCreateRequest{ControllerUUID: "device-1"}); err == nil {
+		t.Error("expected error but got none")
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("expected 1 call, got %d", got)
+	}
+	if got := w.commissioning.endpoint.retry.Timeout; got != DefaultCommissioningTimeout {
+		t.Errorf("expected the commissioning timeout %s, got %s", DefaultCommissioningTimeout, got)
+	}
+}
+
+func TestWebhook_NotConfigured(t *testing.T) {
+	w, err := NewWebhook(WebhookConfig{Product: WebhookEndpoint{URL: "http://passports/{{.UUID}}"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.CreateCommissioningPassport(context.Background(), &CommissioningCreateRequest{}); err == nil {
+		t.Error("expected error but got none")
+	}
+	if states := w.BreakerStates(); len(states) != 1 || states[EndpointProduct] != BreakerClosed {
+		t.Errorf("expected only a closed product breaker, got %v", states)
+	}
+}
@@ -0,0 +1,360 @@
+// Package metrics is a small Prometheus instrumentation library: labelled
+// counters, gauges and histograms exposed in the Prometheus text format.
+//
+// Packages declare their metrics as package variables registered with
+// Default, and the admin server exposes Default at /metrics.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default is the registry the proxy's packages register their metrics with.
+var Default = NewRegistry()
+
+// DefaultBuckets are histogram buckets in seconds suited to request latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Registry holds metric families and writes them in the text format.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]family
+}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]family)}
+}
+
+func (r *Registry) register(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.families[name]; dup {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.families[name] = f
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format,
+// families sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	families := make([]family, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		families[i] = r.families[name]
+	}
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the registry for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// desc is what every metric family shares.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.typ)
+}
+
+// labelKey joins label values into a map key.
+func (d *desc) labelKey(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats label values as {a="x",b="y"}, with extra appended.
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range d.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extra[i], escapeLabel(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// vec keeps one child per combination of label values.
+type vec[T any] struct {
+	desc
+	mu       sync.Mutex
+	children map[string]*T
+	values   map[string][]string
+	newChild func() *T
+}
+
+func (v *vec[T]) with(values []string) *T {
+	key := v.labelKey(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.children[key]
+	if !ok {
+		c = v.newChild()
+		v.children[key] = c
+		v.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// each calls f for every child, ordered by label values.
+func (v *vec[T]) each(f func(values []string, c *T)) {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	children := make([]*T, len(keys))
+	values := make([][]string, len(keys))
+	for i, k := range keys {
+		children[i], values[i] = v.children[k], v.values[k]
+	}
+	v.mu.Unlock()
+
+	for i := range keys {
+		f(values[i], children[i])
+	}
+}
+
+func newVec[T any](name, help, typ string, labels []string, newChild func() *T) *vec[T] {
+	return &vec[T]{
+		desc:     desc{name: name, help: help, typ: typ, labels: labels},
+		children: make(map[string]*T),
+		values:   make(map[string][]string),
+		newChild: newChild,
+	}
+}
+
+// value is a float64 updated atomically.
+type value struct{ bits atomic.Uint64 }
+
+func (v *value) add(d float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+d)) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) { v.bits.Store(math.Float64bits(f)) }
+func (v *value) get() float64  { return math.Float64frombits(v.bits.Load()) }
+
+// Counter is a value that only goes up.
+type Counter struct{ v value }
+
+// Inc adds one.
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add adds d, which must not be negative.
+func (c *Counter) Add(d float64) {
+	if d < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.v.add(d)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() float64 { return c.v.get() }
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct{ v *vec[Counter] }
+
+// NewCounterVec registers a counter family with r.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{v: newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	r.register(name, c)
+	return c
+}
+
+// With returns the counter for the label values, in label order.
+func (c *CounterVec) With(values ...string) *Counter { return c.v.with(values) }
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.v.header(w)
+	c.v.each(func(values []string, ch *Counter) {
+		fmt.Fprintf(w, "%s%s %s\n", c.v.name, c.v.labelPairs(values), formatFloat(ch.v.get()))
+	})
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ v value }
+
+// Set sets the gauge to f.
+func (g *Gauge) Set(f float64) { g.v.set(f) }
+
+// Add adds d, which may be negative.
+func (g *Gauge) Add(d float64) { g.v.add(d) }
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 { return g.v.get() }
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct{ v *vec[Gauge] }
+
+// NewGaugeVec registers a gauge family with r.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{v: newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	r.register(name, g)
+	return g
+}
+
+// With returns the gauge for the label values, in label order.
+func (g *GaugeVec) With(values ...string) *Gauge { return g.v.with(values) }
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.v.header(w)
+	g.v.each(func(values []string, ch *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", g.v.name, g.v.labelPairs(values), formatFloat(ch.v.get()))
+	})
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	upper  []float64
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+// Observe records one observation.
+func (h *Histogram) Observe(f float64) {
+	i := sort.SearchFloat64s(h.upper, f)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += f
+	h.count++
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct{ v *vec[Histogram] }
+
+// NewHistogramVec registers a histogram family with r. Nil buckets use
+// DefaultBuckets.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	upper := append([]float64(nil), buckets...)
+	sort.Float64s(upper)
+	h := &HistogramVec{v: newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{upper: upper, counts: make([]uint64, len(upper)+1)}
+	})}
+	r.register(name, h)
+	return h
+}
+
+// With returns the histogram for the label values, in label order.
+func (h *HistogramVec) With(values ...string) *Histogram { return h.v.with(values) }
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.v.header(w)
+	h.v.each(func(values []string, ch *Histogram) {
+		ch.mu.Lock()
+		counts := append([]uint64(nil), ch.counts...)
+		sum, count := ch.sum, ch.count
+		ch.mu.Unlock()
+
+		var cumulative uint64
+		for i, upper := range ch.upper {
+			cumulative += counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.v.name, h.v.labelPairs(values, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.v.name, h.v.labelPairs(values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.v.name, h.v.labelPairs(values), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.v.name, h.v.labelPairs(values), count)
+	})
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
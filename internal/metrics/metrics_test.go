@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("test_requests_total", "Requests handled.", "type", "status")
+	state := r.NewGaugeVec("test_state", "Current state.\nSecond line.")
+	latency := r.NewHistogramVec("test_latency_seconds", "Latency.", []float64{1, 0.1}, "type")
+
+	requests.With("TO2.HelloDevice", "200").Inc()
+	requests.With("TO2.HelloDevice", "200").Add(2)
+	requests.With(`DI."AppStart"`, "403").Inc()
+	state.With().Set(2)
+	state.With().Add(-0.5)
+	latency.With("DI").Observe(0.05)
+	latency.With("DI").Observe(0.1)
+	latency.With("DI").Observe(3)
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{type="DI",le="0.1"} 2
+test_latency_seconds_bucket{type="DI",le="1"} 2
+test_latency_seconds_bucket{type="DI",le="+Inf"} 3
+test_latency_seconds_sum{type="DI"} 3.15
+test_latency_seconds_count{type="DI"} 3
+# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total{type="DI.\"AppStart\"",status="403"} 1
+test_requests_total{type="TO2.HelloDevice",status="200"} 3
+# HELP test_state Current state.\nSecond line.
+# TYPE test_state gauge
+test_state 1.5
+`
+	if got := b.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestRegistry_Panics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_total", "Test.", "a")
+
+	tests := []struct {
+		name string
+		f    func()
+	}{
+		{name: "duplicate name", f: func() { r.NewGaugeVec("test_total", "Again.") }},
+		{name: "wrong label count", f: func() { c.With("x", "y") }},
+		{name: "negative counter", f: func() { c.With("x").Add(-1) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic")
+				}
+			}()
+			tt.f()
+		})
+	}
+}
+
+func TestCounter_Concurrent(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_total", "Test.", "a")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.With("x").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := c.With("x").v.get(); got != 8000 {
+		t.Errorf("expected 8000, got %v", got)
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test.").With().Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected Prometheus text content type, got %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "test_total 1\n") {
+		t.Errorf("expected counter in body, got %q", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rec.Code)
+	}
+}
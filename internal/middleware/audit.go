@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/fdo-server-wrapper/internal/audit"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// AuditMiddleware records the progress of DI and TO2 sessions in the audit
+// log. It should run first so it sees every message before other
+// middleware can reject it; passport and commissioning events are recorded
+// by the DI and TO2 middleware themselves.
+type AuditMiddleware struct {
+	log *audit.Log
+}
+
+// diGUIDKey holds the GUID issued in DI.SetCredentials for the rest of the
+// DI session. The proxy only learns GUIDs from TO1 and TO2 hellos.
+type diGUIDKey struct{}
+
+// NewAuditMiddleware creates middleware recording FDO protocol events to log.
+func NewAuditMiddleware(log *audit.Log) *AuditMiddleware {
+	return &AuditMiddleware{log: log}
+}
+
+// Name reports the middleware as "audit" in metrics.
+func (m *AuditMiddleware) Name() string { return "audit" }
+
+// Messages subscribes to DI.AppStart (msg 10) and TO2.HelloDevice (msg 60)
+// requests, and DI.SetCredentials (msg 11), DI.Done (msg 13), TO2.Done2
+// (msg 71) and ErrorMessage (msg 255) responses.
+func (m *AuditMiddleware) Messages() []proxy.MessageType {
+	return []proxy.MessageType{
+		proxy.MsgDIAppStart,
+		proxy.MsgDISetCredentials,
+		proxy.MsgDIDone,
+		proxy.MsgTO2HelloDevice,
+		proxy.MsgTO2Done2,
+		proxy.MsgErrorMessage,
+	}
+}
+
+// HandleRequest records the start of DI and TO2 sessions.
+//
+// Contract:
+//
+//	Preconditions:
+//	  - msg is not nil and carries an FDO request
+//	  - ctx is not nil
+//
+//	Postconditions:
+//	  - Always returns nil; an undecodable body is recorded without its fields
+//
+//	Integration Points:
+//	  - DI.AppStart (msg type 10): records di.started with the device's serial number
+//	  - TO2.HelloDevice (msg type 60): records to2.started with the device GUID
+//	  - Both record the verified client certificate of a device that presented one
+func (m *AuditMiddleware) HandleRequest(ctx context.Context, msg *proxy.Message) error {
+	switch msg.Type {
+	case proxy.MsgDIAppStart:
+		kv := peerFields(msg, "remote_addr", remoteAddr(msg))
+		if body, err := msg.Body(); err == nil {
+			if info, err := fdo.ParseAppStart(body); err == nil {
+				kv = append(kv, "serial_number", info.SerialNumber, "device_info", info.DeviceInfo)
+			}
+		}
+		m.log.Record(ctx, audit.EventDIStarted, "", kv...)
+	case proxy.MsgTO2HelloDevice:
+		m.log.Record(ctx, audit.EventTO2Started, msg.Session.GUID(), peerFields(msg, "remote_addr", remoteAddr(msg))...)
+	}
+	return nil
+}
+
+// HandleResponse records vouchers issued, completed sessions and protocol
+// errors.
+//
+// Contract:
+//
+//	Preconditions:
+//	  - msg is not nil and carries an FDO response
+//	  - ctx is not nil
+//
+//	Postconditions:
+//	  - Always returns nil (does not interrupt FDO flow)
+//
+//	Integration Points:
+//	  - DI.SetCredentials (msg type 11): records di.voucher_issued with the new GUID
+//	  - DI.Done (msg type 13): records di.completed
+//	  - TO2.Done2 (msg type 71): records to2.completed
+//	  - ErrorMessage (msg type 255): records fdo.error with the code and the request it answers
+func (m *AuditMiddleware) HandleResponse(ctx context.Context, msg *proxy.Message) error {
+	switch msg.Type {
+	case proxy.MsgDISetCredentials:
+		body, err := msg.Body()
+		if err != nil {
+			return nil
+		}
+		header, err := fdo.ParseSetCredentials(body)
+		if err != nil {
+			slog.Debug("Could not decode DI.SetCredentials for audit", "error", err)
+			m.log.Record(ctx, audit.EventVoucherIssued, "")
+			return nil
+		}
+		guid := header.GUID.String()
+		msg.Session.Set(diGUIDKey{}, guid)
+		m.log.Record(ctx, audit.EventVoucherIssued, guid,
+			"device_info", header.DeviceInfo,
+			"mfg_key_type", header.ManufacturerKey.Type)
+	case proxy.MsgDIDone:
+		m.log.Record(ctx, audit.EventDICompleted, sessionGUID(msg))
+	case proxy.MsgTO2Done2:
+		m.log.Record(ctx, audit.EventTO2Completed, sessionGUID(msg))
+	case proxy.MsgErrorMessage:
+		kv := []any{"request", msg.RequestType.String(), "status", msg.Response.StatusCode}
+		if body, err := msg.Body(); err == nil {
+			if em, err := fdo.ParseErrorMessage(body); err == nil {
+				kv = append(kv, "code", em.Code.String(), "message", em.Message, "correlation_id", em.CorrelationID)
+			}
+		}
+		m.log.Record(ctx, audit.EventProtocolError, sessionGUID(msg), kv...)
+	}
+	return nil
+}
+
+// sessionGUID returns the device GUID of msg's session, from TO2.HelloDevice
+// or DI.SetCredentials.
+func sessionGUID(msg *proxy.Message) string {
+	if guid := msg.Session.GUID(); guid != "" {
+		return guid
+	}
+	guid, _ := msg.Session.Value(diGUIDKey{}).(string)
+	return guid
+}
+
+func remoteAddr(msg *proxy.Message) string {
+	if msg.Request == nil {
+		return ""
+	}
+	return msg.Request.RemoteAddr
+}
+
+// peerFields appends the subject and fingerprint of the device's verified
+// client certificate, if it presented one, to kv.
+func peerFields(msg *proxy.Message, kv ...any) []any {
+	if peer := msg.Peer(); peer != nil {
+		kv = append(kv, "peer_subject", peer.Subject, "peer_fingerprint", peer.Fingerprint)
+	}
+	return kv
+}
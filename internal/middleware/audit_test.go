@@ -0,0 +1,240 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/fdo-server-wrapper/internal/audit"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/proxy"
+)
+
+// openAuditLog returns a fresh audit log and a function reading back the
+// records written after audit.opened.
+func openAuditLog(t *testing.T) (*audit.Log, func() []audit.Record) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := audit.Open(path)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, func() []audit.Record {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("read audit log: %v", err)
+		}
+		defer f.Close()
+		var recs []audit.Record
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var rec audit.Record
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				t.Fatalf("decode audit record: %v", err)
+			}
+			if rec.Event != audit.EventOpened {
+				recs = append(recs, rec)
+			}
+		}
+		return recs
+	}
+}
+
+func events(recs []audit.Record) []string {
+	var out []string
+	for _, rec := range recs {
+		out = append(out, rec.Event)
+	}
+	return out
+}
+
+// fdoResponse builds a backend response of msgType carrying body.
+func fdoResponse(msgType proxy.MessageType, status int, body []byte) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}
+	resp.Header.Set("Message-Type", strconv.Itoa(int(msgType)))
+	return resp
+}
+
+func TestAuditMiddleware_DI(t *testing.T) {
+	log, read := openAuditLog(t)
+	middleware := NewAuditMiddleware(log)
+	ctx := context.Background()
+	session := &proxy.Session{}
+
+	req := httptest.NewRequest("POST", "/fdo/101/msg/10", bytes.NewReader(appStartBody(t, "SN-0001", "board-rev-b")))
+	msg := requestMessage(req, proxy.MsgDIAppStart)
+	msg.Session = session
+	if err := middleware.HandleRequest(ctx, msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	guid := []byte{0x19, 0x1e, 0x88, 0x6b, 0xdf, 0xff, 0x4f, 0x39, 0x96, 0x18, 0xd7, 0xa3, 0x64, 0xec, 0x0c, 0x90}
+	msg = responseMessage(fdoResponse(proxy.MsgDISetCredentials, http.StatusOK, setCredentialsBody(t, guid)), proxy.MsgDIAppStart)
+	msg.Session = session
+	if err := middleware.HandleResponse(ctx, msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	errBody, err := (&fdo.ErrorMessage{Code: fdo.ErrorInvalidMessage, PrevMsgType: 12, Message: "bad HMAC", CorrelationID: 7}).MarshalCBOR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = responseMessage(fdoResponse(proxy.MsgErrorMessage, http.StatusInternalServerError, errBody), proxy.MsgDISetHMAC)
+	msg.Session = session
+	middleware.HandleResponse(ctx, msg)
+
+	msg = responseMessage(fdoResponse(proxy.MsgDIDone, http.StatusOK, nil), proxy.MsgDISetHMAC)
+	msg.Session = session
+	middleware.HandleResponse(ctx, msg)
+
+	recs := read()
+	expected := []string{audit.EventDIStarted, audit.EventVoucherIssued, audit.EventProtocolError, audit.EventDICompleted}
+	if got := events(recs); !slices.Equal(got, expected) {
+		t.Fatalf("expected events %v, got %v", expected, got)
+	}
+	if recs[0].Fields["serial_number"] != "SN-0001" {
+		t.Errorf("expected serial number in di.started, got %v", recs[0].Fields)
+	}
+	for _, rec := range recs[1:] {
+		if rec.GUID != "191e886b-dfff-4f39-9618-d7a364ec0c90" {
+			t.Errorf("expected %s to carry the issued GUID, got %q", rec.Event, rec.GUID)
+		}
+	}
+	if recs[2].Fields["code"] != fdo.ErrorInvalidMessage.String() || recs[2].Fields["request"] != proxy.MsgDISetHMAC.String() {
+		t.Errorf("unexpected fdo.error fields %v", recs[2].Fields)
+	}
+}
+
+func TestAuditMiddleware_TO2(t *testing.T) {
+	log, read := openAuditLog(t)
+	middleware := NewAuditMiddleware(log)
+	session := &proxy.Session{}
+	session.SetGUID("191e886b-dfff-4f39-9618-d7a364ec0c90")
+
+	// The device presented a verified client certificate
+	req := httptest.NewRequest("POST", "/fdo/101/msg/60", nil)
+	deviceCert := &x509.Certificate{Raw: []byte("device"), Subject: pkix.Name{CommonName: "device-0001"}, SerialNumber: big.NewInt(7)}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{deviceCert}}}
+	msg := requestMessage(req, proxy.MsgTO2HelloDevice)
+	msg.Session = session
+	middleware.HandleRequest(context.Background(), msg)
+	msg = responseMessage(fdoResponse(proxy.MsgTO2Done2, http.StatusOK, nil), proxy.MsgTO2Done)
+	msg.Session = session
+	middleware.HandleResponse(context.Background(), msg)
+
+	recs := read()
+	expected := []string{audit.EventTO2Started, audit.EventTO2Completed}
+	if got := events(recs); !slices.Equal(got, expected) {
+		t.Fatalf("expected events %v, got %v", expected, got)
+	}
+	for _, rec := range recs {
+		if rec.GUID != session.GUID() {
+			t.Errorf("expected %s to carry the session GUID, got %q", rec.Event, rec.GUID)
+		}
+	}
+	if recs[0].Fields["peer_subject"] != "CN=device-0001" {
+		t.Errorf("expected peer subject CN=device-0001, got %v", recs[0].Fields["peer_subject"])
+	}
+	if fp, _ := recs[0].Fields["peer_fingerprint"].(string); len(fp) != 64 {
+		t.Errorf("expected a peer fingerprint, got %v", recs[0].Fields["peer_fingerprint"])
+	}
+}
+
+func TestDIMiddleware_PassportAudit(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   *MockLedgerClient
+		opts     []DIOption
+		expected []string
+	}{
+		{
+			name:     "passport fetched",
+			client:   &MockLedgerClient{passport: validPassport()},
+			expected: []string{audit.EventPassportFetched},
+		},
+		{
+			name:     "lookup failed",
+			client:   &MockLedgerClient{err: errors.New("passport GET status 404")},
+			expected: []string{audit.EventPassportLookupFailed},
+		},
+		{
+			name:     "rejected by policy",
+			client:   &MockLedgerClient{err: errors.New("passport GET status 404")},
+			opts:     []DIOption{WithPassportPolicy(PassportPolicy{})},
+			expected: []string{audit.EventPassportLookupFailed, audit.EventDIRejected},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log, read := openAuditLog(t)
+			opts := append([]DIOption{WithPassportAudit(log)}, tt.opts...)
+			middleware := NewDIMiddleware(tt.client, true, opts...)
+
+			req := httptest.NewRequest("POST", "/fdo/101/msg/10", bytes.NewReader(appStartBody(t, "SN-0001", "board-rev-b")))
+			middleware.HandleRequest(context.Background(), requestMessage(req, proxy.MsgDIAppStart))
+
+			recs := read()
+			if got := events(recs); !slices.Equal(got, tt.expected) {
+				t.Fatalf("expected events %v, got %v", tt.expected, got)
+			}
+			for _, rec := range recs {
+				if rec.Fields["product_id"] != "SN-0001" {
+					t.Errorf("expected product_id in %s, got %v", rec.Event, rec.Fields)
+				}
+			}
+		})
+	}
+}
+
+func TestTO2Middleware_CommissioningAudit(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "created", expected: audit.EventCommissioningCreated},
+		{name: "failed", err: errors.New("service unavailable"), expected: audit.EventCommissioningFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log, read := openAuditLog(t)
+			client := &recordingLedgerClient{MockLedgerClient: MockLedgerClient{err: tt.err}}
+			middleware := NewTO2Middleware(client, "owner", WithCommissioningAudit(log))
+			session := &proxy.Session{}
+			session.SetGUID("191e886b-dfff-4f39-9618-d7a364ec0c90")
+
+			msg := responseMessage(fdoResponse(proxy.MsgTO2Done2, http.StatusOK, nil), proxy.MsgTO2Done)
+			msg.Session = session
+			middleware.HandleResponse(context.Background(), msg)
+
+			recs := read()
+			if got := events(recs); !slices.Equal(got, []string{tt.expected}) {
+				t.Fatalf("expected events %v, got %v", []string{tt.expected}, got)
+			}
+			if recs[0].GUID != session.GUID() {
+				t.Errorf("expected GUID %s, got %q", session.GUID(), recs[0].GUID)
+			}
+		})
+	}
+}
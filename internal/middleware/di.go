@@ -3,11 +3,14 @@ package middleware
 import (
 	"context"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/fdo-server-wrapper/internal/audit"
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/ledger"
 	"github.com/fdo-server-wrapper/internal/proxy"
 )
 
@@ -16,149 +19,302 @@ import (
 type DIMiddleware struct {
 	ledgerClient          proxy.LedgerClient
 	enableProductPassport bool
+	productIDField        fdo.MfgInfoField
+	voucherListeners      []proxy.VoucherListener
+	policy                *PassportPolicy
+	verifier              *ledger.Verifier
+	audit                 *audit.Log
+}
+
+// appStartState is what DI.AppStart learned, handed to the DI.SetCredentials
+// response of the same exchange.
+type appStartState struct {
+	mfgInfo   *fdo.DeviceMfgInfo
+	productID string
+	passport  *ledger.ProductItemPassport
+	report    *ledger.VerificationReport
+}
+
+type appStartKey struct{}
+
+// DIOption customizes a DIMiddleware.
+type DIOption func(*DIMiddleware)
+
+// WithProductIDField selects which DeviceMfgInfo field is used as the
+// product passport UUID. The default is the device serial number.
+func WithProductIDField(f fdo.MfgInfoField) DIOption {
+	return func(m *DIMiddleware) {
+		m.productIDField = f
+	}
+}
+
+// WithVoucherListener registers listeners notified when DI.SetCredentials
+// issues an ownership voucher header.
+func WithVoucherListener(listeners ...proxy.VoucherListener) DIOption {
+	return func(m *DIMiddleware) {
+		m.voucherListeners = append(m.voucherListeners, listeners...)
+	}
+}
+
+// WithPassportPolicy turns on enforcement: DI.AppStart is rejected with an
+// FDO ErrorMessage unless the device has a product passport satisfying
+// policy, so un-passported hardware never receives credentials. The
+// passport is looked up even if lookup was not otherwise enabled.
+func WithPassportPolicy(policy PassportPolicy) DIOption {
+	return func(m *DIMiddleware) {
+		m.policy = &policy
+	}
+}
+
+// WithPassportVerifier checks the signatures on every fetched passport and
+// logs the result. Together with WithPassportPolicy, a passport whose
+// signatures do not all verify blocks DI.
+func WithPassportVerifier(v *ledger.Verifier) DIOption {
+	return func(m *DIMiddleware) {
+		m.verifier = v
+	}
+}
+
+// WithPassportAudit records passport lookups, signature checks and policy
+// rejections in the audit log.
+func WithPassportAudit(l *audit.Log) DIOption {
+	return func(m *DIMiddleware) {
+		m.audit = l
+	}
 }
 
 // NewDIMiddleware creates middleware for DI protocol integration.
 // When enabled, it will attempt to fetch product item passports during DI.AppStart.
-func NewDIMiddleware(ledgerClient proxy.LedgerClient, enableProductPassport bool) *DIMiddleware {
-	return &DIMiddleware{
+func NewDIMiddleware(ledgerClient proxy.LedgerClient, enableProductPassport bool, opts ...DIOption) *DIMiddleware {
+	m := &DIMiddleware{
 		ledgerClient:          ledgerClient,
 		enableProductPassport: enableProductPassport,
+		productIDField:        fdo.MfgInfoSerialNumber,
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
 }
 
-// ProcessRequest handles incoming DI protocol requests.
+// Messages subscribes to DI.AppStart (msg 10) requests and
+// DI.SetCredentials (msg 11) responses.
+func (m *DIMiddleware) Messages() []proxy.MessageType {
+	return []proxy.MessageType{proxy.MsgDIAppStart, proxy.MsgDISetCredentials}
+}
+
+// HandleRequest handles incoming DI protocol requests.
 //
 // Contract:
 //
 //	Preconditions:
-//	  - req is not nil and contains valid HTTP request
+//	  - msg is not nil and carries a DI request
 //	  - ctx is not nil
 //
 //	Postconditions:
-//	  - Returns nil if request is not DI-related or processing succeeds
-//	  - Returns error if request processing fails (does not interrupt FDO flow)
+//	  - Returns nil if the message is not handled or processing succeeds
+//	  - Returns error if request processing fails
+//	  - With a passport policy, returns a *proxy.Rejection if the device
+//	    has no passport satisfying it, or, with a verifier, if the passport
+//	    signatures do not verify
 //
 //	Integration Points:
-//	  - DI.AppStart (msg type 10): extracts product UUID and fetches passport
-func (m *DIMiddleware) ProcessRequest(ctx context.Context, req *http.Request) error {
-	// Only process DI protocol requests
-	if !m.isDIRequest(req) {
-		return nil
-	}
-
-	// Parse message type from URL path: /fdo/101/msg/{msgType}
-	pathParts := strings.Split(req.URL.Path, "/")
-	if len(pathParts) < 5 {
-		return nil
-	}
-
-	msgType := pathParts[4]
-	if msgType == "10" { // DI.AppStart message
-		return m.handleDIAppStart(ctx, req)
+//	  - DI.AppStart (msg type 10): extracts product UUID, fetches and checks passport
+func (m *DIMiddleware) HandleRequest(ctx context.Context, msg *proxy.Message) error {
+	if msg.Type == proxy.MsgDIAppStart {
+		return m.handleDIAppStart(ctx, msg)
 	}
-
 	return nil
 }
 
-// ProcessResponse handles outgoing DI protocol responses.
+// HandleResponse handles outgoing DI protocol responses.
 //
 // Contract:
 //
 //	Preconditions:
-//	  - resp is not nil and contains valid HTTP response
+//	  - msg is not nil and carries a DI response
 //	  - ctx is not nil
 //
 //	Postconditions:
-//	  - Returns nil if response is not DI-related or processing succeeds
+//	  - Returns nil if the message is not handled or processing succeeds
 //	  - Returns error if response processing fails (does not interrupt FDO flow)
 //
 //	Integration Points:
-//	  - DI.SetCredentials (msg type 11): logs successful credential setup
-func (m *DIMiddleware) ProcessResponse(ctx context.Context, resp *http.Response) error {
-	// Only process DI protocol responses
-	if !m.isDIResponse(resp) {
-		return nil
-	}
-
-	// Extract message type from response headers
-	msgType := resp.Header.Get("Message-Type")
-	if msgType == "11" { // DI.SetCredentials response
-		return m.handleDISetCredentials(ctx, resp)
+//	  - DI.SetCredentials (msg type 11): decodes the OVHeader and notifies voucher listeners
+func (m *DIMiddleware) HandleResponse(ctx context.Context, msg *proxy.Message) error {
+	if msg.Type == proxy.MsgDISetCredentials {
+		return m.handleDISetCredentials(ctx, msg)
 	}
-
 	return nil
 }
 
-// isDIRequest identifies DI protocol requests by URL pattern.
-// DI requests follow the pattern /fdo/101/msg/10 or /fdo/101/msg/12.
-func (m *DIMiddleware) isDIRequest(req *http.Request) bool {
-	return strings.Contains(req.URL.Path, "/fdo/101/msg/") &&
-		(strings.HasSuffix(req.URL.Path, "/10") || strings.HasSuffix(req.URL.Path, "/12"))
-}
-
-// isDIResponse identifies DI protocol responses by message type header.
-// DI responses have Message-Type header set to "11" (SetCredentials) or "13" (Done).
-func (m *DIMiddleware) isDIResponse(resp *http.Response) bool {
-	msgType := resp.Header.Get("Message-Type")
-	return msgType == "11" || msgType == "13" // DI.SetCredentials or DI.Done
-}
-
 // handleDIAppStart processes DI.AppStart requests to fetch product passports.
 // When enabled, it extracts the product UUID from the request body and calls
-// the passport service to retrieve product item information.
-func (m *DIMiddleware) handleDIAppStart(ctx context.Context, req *http.Request) error {
-	if !m.enableProductPassport || m.ledgerClient == nil {
+// the passport service to retrieve product item information. With a passport
+// policy configured, any failure along the way blocks DI.
+func (m *DIMiddleware) handleDIAppStart(ctx context.Context, msg *proxy.Message) error {
+	enforce := m.policy != nil
+	if !enforce && (!m.enableProductPassport || m.ledgerClient == nil) {
 		return nil
 	}
 
 	// Read request body to extract product information
-	body, err := io.ReadAll(req.Body)
+	body, err := msg.Body()
 	if err != nil {
-		return fmt.Errorf("failed to read request body: %w", err)
+		return err
 	}
-	req.Body = io.NopCloser(strings.NewReader(string(body))) // Restore body for backend
 
-	// Extract product UUID from CBOR body
-	// Note: This is a simplified implementation - production code would need proper CBOR parsing
-	productID := m.extractProductID(body)
-	if productID == "" {
-		return nil
+	// Extract product UUID from the DeviceMfgInfo the device reports
+	info, productID, err := m.extractProductID(body)
+	if err != nil {
+		slog.Warn("Could not determine product ID from DI.AppStart", "field", m.productIDField, "error", err)
+		if enforce {
+			m.audit.Record(ctx, audit.EventDIRejected, "", "reason", "cannot determine product ID", "error", err)
+			return proxy.Reject(http.StatusInternalServerError, fdo.ErrorMessageBody, "cannot determine product ID")
+		}
+		return nil // Don't fail the request - passport lookup is optional
+	}
+
+	// Remember what the device reported so the SetCredentials response can bind it to the GUID
+	state := &appStartState{mfgInfo: info, productID: productID}
+	msg.Exchange.Set(appStartKey{}, state)
+
+	if m.ledgerClient == nil {
+		return m.block(ctx, productID, fdo.ErrorResourceNotFound, fmt.Errorf("%w: passport lookup not configured", ErrPassportPolicy))
 	}
 
 	// Fetch product item passport from external service
 	passport, err := m.ledgerClient.GetProductItemPassport(ctx, productID)
 	if err != nil {
 		slog.Warn("Failed to get product passport", "product_id", productID, "error", err)
+		m.audit.Record(ctx, audit.EventPassportLookupFailed, "", "product_id", productID, "error", err)
+		if enforce {
+			return m.block(ctx, productID, fdo.ErrorResourceNotFound, fmt.Errorf("%w: no product passport found", ErrPassportPolicy))
+		}
 		return nil // Don't fail the request - passport lookup is optional
 	}
+	state.passport = passport
 
 	slog.Info("Retrieved product item passport",
 		"uuid", passport.UUID,
 		"records", len(passport.Records))
+	m.audit.Record(ctx, audit.EventPassportFetched, "",
+		"product_id", productID,
+		"passport_uuid", passport.UUID,
+		"records", len(passport.Records))
 
+	if m.verifier != nil {
+		state.report = m.verifier.Verify(passport)
+		if err := state.report.Err(); err != nil {
+			slog.Warn("Product passport signature verification failed",
+				"uuid", passport.UUID,
+				"agent", passport.Agent.UUID,
+				"failed", state.report.Failed(),
+				"error", err)
+			m.audit.Record(ctx, audit.EventPassportInvalid, "",
+				"product_id", productID,
+				"passport_uuid", passport.UUID,
+				"failed", state.report.Failed(),
+				"error", err)
+			if enforce {
+				return m.block(ctx, productID, fdo.ErrorInvalidMessage,
+					fmt.Errorf("%w: invalid signature on %s", ErrPassportPolicy, strings.Join(state.report.Failed(), ", ")))
+			}
+		} else {
+			slog.Info("Product passport signatures verified",
+				"uuid", passport.UUID,
+				"issuer_key", state.report.Passport.KeyID,
+				"agent", passport.Agent.UUID,
+				"records", len(state.report.Records))
+			m.audit.Record(ctx, audit.EventPassportVerified, "",
+				"product_id", productID,
+				"passport_uuid", passport.UUID,
+				"issuer_key", state.report.Passport.KeyID)
+		}
+	}
+
+	if enforce {
+		if err := m.policy.Check(passport, info); err != nil {
+			return m.block(ctx, productID, fdo.ErrorInvalidMessage, err)
+		}
+	}
 	return nil
 }
 
-// handleDISetCredentials logs successful DI credential setup.
-// This provides visibility into the DI protocol completion.
-func (m *DIMiddleware) handleDISetCredentials(ctx context.Context, resp *http.Response) error {
-	slog.Info("DI.SetCredentials completed successfully")
+// block rejects DI.AppStart for a device that failed the passport policy.
+func (m *DIMiddleware) block(ctx context.Context, productID string, code fdo.ErrorCode, reason error) error {
+	slog.Warn("Blocked DI for device without a valid product passport",
+		"product_id", productID,
+		"reason", reason)
+	m.audit.Record(ctx, audit.EventDIRejected, "",
+		"product_id", productID,
+		"code", code.String(),
+		"reason", reason)
+	return proxy.Reject(http.StatusInternalServerError, code, reason.Error())
+}
+
+// handleDISetCredentials decodes the ownership voucher header issued to the
+// device and publishes it, together with the product passport fetched for the
+// DI.AppStart of the same exchange, to the registered voucher listeners.
+func (m *DIMiddleware) handleDISetCredentials(ctx context.Context, msg *proxy.Message) error {
+	body, err := msg.Body()
+	if err != nil || body == nil {
+		return err
+	}
+
+	header, err := fdo.ParseSetCredentials(body)
+	if err != nil {
+		return fmt.Errorf("failed to parse DI.SetCredentials: %w", err)
+	}
+
+	event := &ledger.VoucherIssuedEvent{
+		DeviceGUID: header.GUID.String(),
+		Header:     header,
+		Timestamp:  time.Now(),
+	}
+	if state, ok := msg.Exchange.Value(appStartKey{}).(*appStartState); ok {
+		event.MfgInfo = state.mfgInfo
+		event.ProductUUID = state.productID
+		event.ProductPassport = state.passport
+		event.PassportVerification = state.report
+	}
+
+	slog.Info("DI.SetCredentials issued ownership voucher header",
+		"guid", event.DeviceGUID,
+		"protocol_version", header.ProtocolVersion,
+		"device_info", header.DeviceInfo,
+		"mfg_key_type", header.ManufacturerKey.Type,
+		"product_uuid", event.ProductUUID,
+		"passport_bound", event.ProductPassport != nil,
+		"passport_verified", event.PassportVerification != nil && event.PassportVerification.Valid())
+
+	for _, l := range m.voucherListeners {
+		l.VoucherIssued(ctx, event)
+	}
 	return nil
 }
 
-// extractProductID parses the product UUID from DI.AppStart request body.
-// This is a placeholder implementation - production code would need:
-// 1. Proper CBOR parsing of the request body
-// 2. Extraction of device manufacturing info
-// 3. Location of the productId field within the CBOR structure
-func (m *DIMiddleware) extractProductID(body []byte) string {
-	// Simple string search as placeholder
-	// TODO: Implement proper CBOR parsing
-	if strings.Contains(string(body), "productId") {
-		// Extract actual product ID from CBOR data
-		return "example-product-id"
+// extractProductID decodes the DeviceMfgInfo carried in a DI.AppStart body
+// and returns it with the field configured as the product passport UUID.
+func (m *DIMiddleware) extractProductID(body []byte) (*fdo.DeviceMfgInfo, string, error) {
+	info, err := fdo.ParseAppStart(body)
+	if err != nil {
+		return nil, "", err
 	}
 
-	return ""
+	slog.Debug("Decoded DI.AppStart DeviceMfgInfo",
+		"serial_number", info.SerialNumber,
+		"device_info", info.DeviceInfo,
+		"key_type", info.KeyType,
+		"csr_len", len(info.CSR))
+
+	field := m.productIDField
+	if field == "" {
+		field = fdo.MfgInfoSerialNumber
+	}
+	productID, err := info.Field(field)
+	if err != nil {
+		return nil, "", err
+	}
+	return info, productID, nil
 }
@@ -1,13 +1,22 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/fdo-server-wrapper/internal/fdo"
 	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/proxy"
 )
 
 // MockLedgerClient implements proxy.LedgerClient for testing
@@ -24,6 +33,32 @@ func (m *MockLedgerClient) CreateCommissioningPassport(ctx context.Context, req
 	return m.err
 }
 
+// appStartBody encodes a DI.AppStart message the way go-fdo clients send it,
+// with DeviceMfgInfo wrapped in a byte string.
+func appStartBody(t *testing.T, serial, deviceInfo string) []byte {
+	t.Helper()
+	info, err := fdo.Encode([]any{uint64(fdo.KeyTypeSecp256r1), uint64(fdo.KeyEncodingX509), serial, deviceInfo, []byte{0x30, 0x00}})
+	if err != nil {
+		t.Fatalf("encode DeviceMfgInfo: %v", err)
+	}
+	body, err := fdo.Encode([]any{info})
+	if err != nil {
+		t.Fatalf("encode DI.AppStart: %v", err)
+	}
+	return body
+}
+
+// requestMessage wraps req the way the proxy hands it to HandleRequest.
+func requestMessage(req *http.Request, msgType proxy.MessageType) *proxy.Message {
+	return &proxy.Message{Version: 101, Type: msgType, RequestType: msgType, Request: req}
+}
+
+// responseMessage wraps resp the way the proxy hands it to HandleResponse.
+func responseMessage(resp *http.Response, reqType proxy.MessageType) *proxy.Message {
+	msgType, _ := proxy.ClassifyResponse(resp.Header)
+	return &proxy.Message{Version: 101, Type: msgType, RequestType: reqType, Response: resp}
+}
+
 func TestNewDIMiddleware(t *testing.T) {
 	mockClient := &MockLedgerClient{}
 	middleware := NewDIMiddleware(mockClient, true)
@@ -39,97 +74,27 @@ func TestNewDIMiddleware(t *testing.T) {
 	if !middleware.enableProductPassport {
 		t.Error("expected product passport to be enabled")
 	}
-}
-
-func TestDIMiddleware_IsDIRequest(t *testing.T) {
-	middleware := &DIMiddleware{}
 
-	tests := []struct {
-		name     string
-		path     string
-		expected bool
-	}{
-		{
-			name:     "DI.AppStart request",
-			path:     "/fdo/101/msg/10",
-			expected: true,
-		},
-		{
-			name:     "DI.SetCredentials request",
-			path:     "/fdo/101/msg/12",
-			expected: true,
-		},
-		{
-			name:     "non-DI request",
-			path:     "/fdo/101/msg/20",
-			expected: false,
-		},
-		{
-			name:     "different path",
-			path:     "/api/health",
-			expected: false,
-		},
+	if middleware.productIDField != fdo.MfgInfoSerialNumber {
+		t.Errorf("expected default product ID field %q, got %q", fdo.MfgInfoSerialNumber, middleware.productIDField)
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest("POST", tt.path, nil)
-			result := middleware.isDIRequest(req)
-
-			if result != tt.expected {
-				t.Errorf("expected %v, got %v for path %s", tt.expected, result, tt.path)
-			}
-		})
+	middleware = NewDIMiddleware(mockClient, true, WithProductIDField(fdo.MfgInfoDeviceInfo))
+	if middleware.productIDField != fdo.MfgInfoDeviceInfo {
+		t.Errorf("expected product ID field %q, got %q", fdo.MfgInfoDeviceInfo, middleware.productIDField)
 	}
 }
 
-func TestDIMiddleware_IsDIResponse(t *testing.T) {
+func TestDIMiddleware_Messages(t *testing.T) {
 	middleware := &DIMiddleware{}
 
-	tests := []struct {
-		name     string
-		msgType  string
-		expected bool
-	}{
-		{
-			name:     "DI.SetCredentials response",
-			msgType:  "11",
-			expected: true,
-		},
-		{
-			name:     "DI.Done response",
-			msgType:  "13",
-			expected: true,
-		},
-		{
-			name:     "non-DI response",
-			msgType:  "20",
-			expected: false,
-		},
-		{
-			name:     "empty message type",
-			msgType:  "",
-			expected: false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			resp := &http.Response{
-				Header: make(http.Header),
-			}
-			resp.Header.Set("Message-Type", tt.msgType)
-
-			result := middleware.isDIResponse(resp)
-
-			if result != tt.expected {
-				t.Errorf("expected %v, got %v for message type %s", tt.expected, result, tt.msgType)
-			}
-		})
+	expected := []proxy.MessageType{proxy.MsgDIAppStart, proxy.MsgDISetCredentials}
+	if got := middleware.Messages(); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
 	}
 }
 
-func TestDIMiddleware_ProcessRequest_DIAppStart(t *testing.T) {
+func TestDIMiddleware_HandleRequest_DIAppStart(t *testing.T) {
 	mockPassport := &ledger.ProductItemPassport{
 		UUID: "test-uuid",
 		Records: []ledger.ProductItemRecord{
@@ -151,35 +116,35 @@ func TestDIMiddleware_ProcessRequest_DIAppStart(t *testing.T) {
 		enableProductPassport: true,
 	}
 
-	// Create a request that looks like DI.AppStart
-	body := strings.NewReader("some cbor data with productId")
+	// Create a DI.AppStart request carrying a DeviceMfgInfo
+	body := bytes.NewReader(appStartBody(t, "test-uuid", "board-rev-b"))
 	req := httptest.NewRequest("POST", "/fdo/101/msg/10", body)
 
 	ctx := context.Background()
-	err := middleware.ProcessRequest(ctx, req)
+	err := middleware.HandleRequest(ctx, requestMessage(req, 10))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
 
-func TestDIMiddleware_ProcessRequest_NonDI(t *testing.T) {
+func TestDIMiddleware_HandleRequest_NonAppStart(t *testing.T) {
 	middleware := &DIMiddleware{
 		enableProductPassport: true,
 	}
 
-	// Create a non-DI request
-	req := httptest.NewRequest("POST", "/api/health", nil)
+	// Create a DI.SetHMAC request, which the middleware ignores
+	req := httptest.NewRequest("POST", "/fdo/101/msg/12", nil)
 
 	ctx := context.Background()
-	err := middleware.ProcessRequest(ctx, req)
+	err := middleware.HandleRequest(ctx, requestMessage(req, 12))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
 
-func TestDIMiddleware_ProcessResponse_DISetCredentials(t *testing.T) {
+func TestDIMiddleware_HandleResponse_DISetCredentials(t *testing.T) {
 	middleware := &DIMiddleware{}
 
 	resp := &http.Response{
@@ -188,23 +153,100 @@ func TestDIMiddleware_ProcessResponse_DISetCredentials(t *testing.T) {
 	resp.Header.Set("Message-Type", "11") // DI.SetCredentials
 
 	ctx := context.Background()
-	err := middleware.ProcessResponse(ctx, resp)
+	err := middleware.HandleResponse(ctx, responseMessage(resp, 10))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
 
-func TestDIMiddleware_ProcessResponse_NonDI(t *testing.T) {
+// recordingVoucherListener captures voucher events for assertions
+type recordingVoucherListener struct {
+	events []*ledger.VoucherIssuedEvent
+}
+
+func (l *recordingVoucherListener) VoucherIssued(ctx context.Context, ev *ledger.VoucherIssuedEvent) {
+	l.events = append(l.events, ev)
+}
+
+// setCredentialsBody encodes a DI.SetCredentials message carrying an OVHeader.
+func setCredentialsBody(t *testing.T, guid []byte) []byte {
+	t.Helper()
+	body, err := fdo.Encode([]any{[]any{
+		uint64(101),
+		guid,
+		[]any{},
+		"board-rev-b",
+		[]any{uint64(fdo.KeyTypeSecp256r1), uint64(fdo.KeyEncodingX509), []byte{0x30, 0x00}},
+		nil,
+	}})
+	if err != nil {
+		t.Fatalf("encode DI.SetCredentials: %v", err)
+	}
+	return body
+}
+
+func TestDIMiddleware_SetCredentials_BindsPassport(t *testing.T) {
+	mockClient := &MockLedgerClient{
+		passport: &ledger.ProductItemPassport{UUID: "SN-0001"},
+	}
+	listener := &recordingVoucherListener{}
+	middleware := NewDIMiddleware(mockClient, true, WithVoucherListener(listener))
+
+	ctx := context.Background()
+	exchange := &proxy.Exchange{}
+
+	req := httptest.NewRequest("POST", "/fdo/101/msg/10", bytes.NewReader(appStartBody(t, "SN-0001", "board-rev-b")))
+	reqMsg := requestMessage(req, 10)
+	reqMsg.Exchange = exchange
+	if err := middleware.HandleRequest(ctx, reqMsg); err != nil {
+		t.Fatalf("unexpected request error: %v", err)
+	}
+
+	guid := []byte{0x19, 0x1e, 0x88, 0x6b, 0xdf, 0xff, 0x4f, 0x39, 0x96, 0x18, 0xd7, 0xa3, 0x64, 0xec, 0x0c, 0x90}
+	body := setCredentialsBody(t, guid)
+	resp := &http.Response{
+		Header: make(http.Header),
+		Body:   io.NopCloser(bytes.NewReader(body)),
+	}
+	resp.Header.Set("Message-Type", "11")
+	respMsg := responseMessage(resp, 10)
+	respMsg.Exchange = exchange
+	if err := middleware.HandleResponse(ctx, respMsg); err != nil {
+		t.Fatalf("unexpected response error: %v", err)
+	}
+
+	if len(listener.events) != 1 {
+		t.Fatalf("expected 1 voucher event, got %d", len(listener.events))
+	}
+	ev := listener.events[0]
+	if ev.DeviceGUID != "191e886b-dfff-4f39-9618-d7a364ec0c90" {
+		t.Errorf("unexpected device GUID %s", ev.DeviceGUID)
+	}
+	if ev.ProductUUID != "SN-0001" {
+		t.Errorf("expected product UUID 'SN-0001', got '%s'", ev.ProductUUID)
+	}
+	if ev.ProductPassport == nil || ev.ProductPassport.UUID != "SN-0001" {
+		t.Errorf("expected passport to be bound, got %+v", ev.ProductPassport)
+	}
+
+	// The body must still be readable by the client
+	restored, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(restored, body) {
+		t.Error("response body was not restored")
+	}
+}
+
+func TestDIMiddleware_HandleResponse_NonSetCredentials(t *testing.T) {
 	middleware := &DIMiddleware{}
 
 	resp := &http.Response{
 		Header: make(http.Header),
 	}
-	resp.Header.Set("Message-Type", "20") // Non-DI message
+	resp.Header.Set("Message-Type", "13") // DI.Done
 
 	ctx := context.Background()
-	err := middleware.ProcessResponse(ctx, resp)
+	err := middleware.HandleResponse(ctx, responseMessage(resp, 12))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -212,36 +254,57 @@ func TestDIMiddleware_ProcessResponse_NonDI(t *testing.T) {
 }
 
 func TestDIMiddleware_ExtractProductID(t *testing.T) {
-	middleware := &DIMiddleware{}
-
 	tests := []struct {
-		name     string
-		body     string
-		expected string
+		name        string
+		field       fdo.MfgInfoField
+		body        []byte
+		expected    string
+		expectError bool
 	}{
 		{
-			name:     "contains productId",
-			body:     "some data with productId field",
-			expected: "example-product-id",
+			name:     "serial number by default",
+			body:     appStartBody(t, "SN-0001", "board-rev-b"),
+			expected: "SN-0001",
+		},
+		{
+			name:     "device info field",
+			field:    fdo.MfgInfoDeviceInfo,
+			body:     appStartBody(t, "SN-0001", "191e886b-dfff-4f39-9618-d7a364ec0c90"),
+			expected: "191e886b-dfff-4f39-9618-d7a364ec0c90",
+		},
+		{
+			name:        "empty serial number",
+			body:        appStartBody(t, "", "board-rev-b"),
+			expectError: true,
 		},
 		{
-			name:     "no productId",
-			body:     "some other data",
-			expected: "",
+			name:        "not CBOR",
+			body:        []byte("some data with productId field"),
+			expectError: true,
 		},
 		{
-			name:     "empty body",
-			body:     "",
-			expected: "",
+			name:        "empty body",
+			body:        nil,
+			expectError: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := middleware.extractProductID([]byte(tt.body))
-
+			middleware := &DIMiddleware{productIDField: tt.field}
+			_, result, err := middleware.extractProductID(tt.body)
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error but got product ID '%s'", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 			if result != tt.expected {
-				t.Errorf("expected '%s', got '%s' for body '%s'", tt.expected, result, tt.body)
+				t.Errorf("expected '%s', got '%s'", tt.expected, result)
 			}
 		})
 	}
@@ -255,7 +318,7 @@ func TestDIMiddleware_HandleDIAppStart_Disabled(t *testing.T) {
 	req := httptest.NewRequest("POST", "/fdo/101/msg/10", strings.NewReader("test"))
 
 	ctx := context.Background()
-	err := middleware.handleDIAppStart(ctx, req)
+	err := middleware.handleDIAppStart(ctx, requestMessage(req, 10))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -271,9 +334,139 @@ func TestDIMiddleware_HandleDIAppStart_NoClient(t *testing.T) {
 	req := httptest.NewRequest("POST", "/fdo/101/msg/10", strings.NewReader("test"))
 
 	ctx := context.Background()
-	err := middleware.handleDIAppStart(ctx, req)
+	err := middleware.handleDIAppStart(ctx, requestMessage(req, 10))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
+
+func TestDIMiddleware_PassportPolicy(t *testing.T) {
+	unsigned := validPassport()
+	unsigned.Signature = ""
+
+	tests := []struct {
+		name         string
+		client       proxy.LedgerClient
+		body         []byte
+		expectStatus int
+		expectCode   fdo.ErrorCode
+	}{
+		{
+			name:   "valid passport",
+			client: &MockLedgerClient{passport: validPassport()},
+			body:   appStartBody(t, "SN-0001", "board-rev-b"),
+		},
+		{
+			name:         "passport lookup fails",
+			client:       &MockLedgerClient{err: errors.New("passport GET status 404")},
+			body:         appStartBody(t, "SN-0001", "board-rev-b"),
+			expectStatus: http.StatusInternalServerError,
+			expectCode:   fdo.ErrorResourceNotFound,
+		},
+		{
+			name:         "unsigned passport",
+			client:       &MockLedgerClient{passport: unsigned},
+			body:         appStartBody(t, "SN-0001", "board-rev-b"),
+			expectStatus: http.StatusInternalServerError,
+			expectCode:   fdo.ErrorInvalidMessage,
+		},
+		{
+			name:         "board serial mismatch",
+			client:       &MockLedgerClient{passport: validPassport()},
+			body:         appStartBody(t, "SN-0002", "board-rev-b"),
+			expectStatus: http.StatusInternalServerError,
+			expectCode:   fdo.ErrorInvalidMessage,
+		},
+		{
+			name:         "no ledger client",
+			body:         appStartBody(t, "SN-0001", "board-rev-b"),
+			expectStatus: http.StatusInternalServerError,
+			expectCode:   fdo.ErrorResourceNotFound,
+		},
+		{
+			name:         "undecodable DeviceMfgInfo",
+			client:       &MockLedgerClient{passport: validPassport()},
+			body:         []byte("not cbor"),
+			expectStatus: http.StatusInternalServerError,
+			expectCode:   fdo.ErrorMessageBody,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			middleware := NewDIMiddleware(tt.client, false, WithPassportPolicy(PassportPolicy{
+				Descriptor:       DefaultPassportDescriptor,
+				MatchBoardSerial: true,
+			}))
+
+			req := httptest.NewRequest("POST", "/fdo/101/msg/10", bytes.NewReader(tt.body))
+			err := middleware.HandleRequest(context.Background(), requestMessage(req, proxy.MsgDIAppStart))
+
+			if tt.expectStatus == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			var rejection *proxy.Rejection
+			if !errors.As(err, &rejection) {
+				t.Fatalf("expected a rejection, got %v", err)
+			}
+			if rejection.Status != tt.expectStatus || rejection.Code != tt.expectCode {
+				t.Errorf("expected %d/%s, got %d/%s", tt.expectStatus, tt.expectCode, rejection.Status, rejection.Code)
+			}
+		})
+	}
+}
+
+func TestDIMiddleware_PassportVerifier(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := ledger.NewVerifier(&ledger.TrustStore{
+		Issuers: map[string]*ecdsa.PublicKey{"issuer": &key.PublicKey},
+	})
+
+	tests := []struct {
+		name          string
+		opts          []DIOption
+		expectRejects bool
+	}{
+		{name: "logs only without a policy"},
+		{
+			name:          "blocks with a policy",
+			opts:          []DIOption{WithPassportPolicy(PassportPolicy{})},
+			expectRejects: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]DIOption{WithPassportVerifier(verifier)}, tt.opts...)
+			middleware := NewDIMiddleware(&MockLedgerClient{passport: validPassport()}, true, opts...)
+
+			req := httptest.NewRequest("POST", "/fdo/101/msg/10", bytes.NewReader(appStartBody(t, "SN-0001", "board-rev-b")))
+			msg := requestMessage(req, proxy.MsgDIAppStart)
+			msg.Exchange = &proxy.Exchange{}
+			err := middleware.HandleRequest(context.Background(), msg)
+
+			var rejection *proxy.Rejection
+			if got := errors.As(err, &rejection); got != tt.expectRejects {
+				t.Fatalf("expected rejection %v, got %v", tt.expectRejects, err)
+			}
+			if rejection != nil && rejection.Code != fdo.ErrorInvalidMessage {
+				t.Errorf("expected %s, got %s", fdo.ErrorInvalidMessage, rejection.Code)
+			}
+
+			state, ok := msg.Exchange.Value(appStartKey{}).(*appStartState)
+			if !ok || state.report == nil {
+				t.Fatal("expected a verification report in the exchange")
+			}
+			if state.report.Valid() {
+				t.Errorf("expected report to flag forged signatures")
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// DefaultLocationHeader is the request header a site gateway sets to tell
+// the proxy where the devices it forwards are being deployed.
+const DefaultLocationHeader = "X-Deployed-Location"
+
+// LocationSource says where the deployment location recorded in a
+// commissioning passport comes from. Sources are tried in order: the
+// gateway header, the per-owner mapping, then the static location.
+type LocationSource struct {
+	// Header names the request header carrying the location; empty
+	// ignores request headers.
+	Header string
+	// ByOwner maps an owner to its location. Keys are the hex SHA-256
+	// fingerprint of the owner public key sent in TO2.ProveOVHdr, or the
+	// configured owner ID; the fingerprint takes precedence.
+	ByOwner map[string]string
+	// Static is the location used when no other source has one.
+	Static string
+}
+
+// LoadLocationMap reads a JSON object mapping owner key fingerprints or
+// owner IDs to deployment locations.
+func LoadLocationMap(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read location map: %w", err)
+	}
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("decode location map %s: %w", path, err)
+	}
+	// Fingerprints are matched in lower case whatever case the file uses
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[strings.ToLower(strings.TrimSpace(k))] = v
+	}
+	return out, nil
+}
+
+// fromHeader returns the location in the gateway header of req, or "".
+func (s *LocationSource) fromHeader(req *http.Request) string {
+	if s == nil || s.Header == "" || req == nil {
+		return ""
+	}
+	return strings.TrimSpace(req.Header.Get(s.Header))
+}
+
+// resolve picks the location for a device onboarded by ownerID with
+// ownerKey, given the gateway header value seen during the session. It
+// returns the location and the name of the source it came from.
+func (s *LocationSource) resolve(header, ownerID string, ownerKey *fdo.PublicKey) (location, source string) {
+	if s == nil {
+		return "", ""
+	}
+	if header != "" {
+		return header, "header"
+	}
+	if ownerKey != nil {
+		if loc, ok := s.ByOwner[ownerKey.Fingerprint()]; ok {
+			return loc, "owner-key"
+		}
+	}
+	if loc, ok := s.ByOwner[strings.ToLower(ownerID)]; ok && ownerID != "" {
+		return loc, "owner-id"
+	}
+	if s.Static != "" {
+		return s.Static, "static"
+	}
+	return "", ""
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// DefaultPassportDescriptor is the record descriptor that marks a product passport.
+const DefaultPassportDescriptor = "PRODUCT PASSPORT"
+
+// ErrPassportPolicy is wrapped by every PassportPolicy.Check failure.
+var ErrPassportPolicy = errors.New("product passport rejected")
+
+// PassportPolicy decides whether a device may complete DI based on its
+// product item passport. A passport must always exist and carry a
+// signature; the remaining checks apply only when configured.
+type PassportPolicy struct {
+	// SchemaVersions lists the accepted schema_version values; empty accepts any.
+	SchemaVersions []float64
+	// Descriptor must appear in at least one record descriptor; empty skips the check.
+	Descriptor string
+	// MatchBoardSerial requires metadata.board_sn to equal the device serial
+	// number, or its hex-encoded SHA-256 digest.
+	MatchBoardSerial bool
+}
+
+// Check returns nil if passport satisfies the policy for the device that
+// reported info, or an error wrapping ErrPassportPolicy explaining why not.
+func (p *PassportPolicy) Check(passport *ledger.ProductItemPassport, info *fdo.DeviceMfgInfo) error {
+	if passport == nil {
+		return fmt.Errorf("%w: no passport", ErrPassportPolicy)
+	}
+	if passport.Signature == "" {
+		return fmt.Errorf("%w: passport %s is unsigned", ErrPassportPolicy, passport.UUID)
+	}
+
+	if len(p.SchemaVersions) > 0 && !slices.Contains(p.SchemaVersions, passport.SchemaVersion) {
+		return fmt.Errorf("%w: schema version %v not accepted", ErrPassportPolicy, passport.SchemaVersion)
+	}
+
+	if p.Descriptor != "" {
+		found := slices.ContainsFunc(passport.Records, func(r ledger.ProductItemRecord) bool {
+			return strings.Contains(r.Descriptor, p.Descriptor)
+		})
+		if !found {
+			return fmt.Errorf("%w: no record with descriptor %q", ErrPassportPolicy, p.Descriptor)
+		}
+	}
+
+	if p.MatchBoardSerial {
+		if info == nil || info.SerialNumber == "" {
+			return fmt.Errorf("%w: device reported no serial number", ErrPassportPolicy)
+		}
+		if !boardSerialMatches(passport.Metadata.BoardSN, info.SerialNumber) {
+			return fmt.Errorf("%w: board_sn does not match device serial %q", ErrPassportPolicy, info.SerialNumber)
+		}
+	}
+	return nil
+}
+
+// boardSerialMatches compares a passport board_sn with a device serial. The
+// passport service may store the serial itself or its SHA-256 digest.
+func boardSerialMatches(boardSN, serial string) bool {
+	if boardSN == "" {
+		return false
+	}
+	if boardSN == serial {
+		return true
+	}
+	digest := sha256.Sum256([]byte(serial))
+	return strings.EqualFold(boardSN, hex.EncodeToString(digest[:]))
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+)
+
+// validPassport returns a signed passport for board serial SN-0001.
+func validPassport() *ledger.ProductItemPassport {
+	return &ledger.ProductItemPassport{
+		SchemaVersion: 0.1,
+		UUID:          "SN-0001",
+		Records: []ledger.ProductItemRecord{
+			{UUID: "record-uuid", Signature: "record-signature", Descriptor: "PRODUCT PASSPORT"},
+		},
+		Metadata:  ledger.ProductItemMetadata{BoardSN: "SN-0001"},
+		Signature: "passport-signature",
+	}
+}
+
+func TestPassportPolicy_Check(t *testing.T) {
+	digest := sha256.Sum256([]byte("SN-0001"))
+	strict := PassportPolicy{
+		SchemaVersions:   []float64{0.1},
+		Descriptor:       DefaultPassportDescriptor,
+		MatchBoardSerial: true,
+	}
+
+	tests := []struct {
+		name        string
+		policy      PassportPolicy
+		modify      func(p *ledger.ProductItemPassport)
+		nilPassport bool
+		serial      string
+		expectError bool
+	}{
+		{
+			name:   "valid passport passes strict policy",
+			policy: strict,
+			serial: "SN-0001",
+		},
+		{
+			name:   "board_sn stored as SHA-256 digest",
+			policy: strict,
+			modify: func(p *ledger.ProductItemPassport) {
+				p.Metadata.BoardSN = hex.EncodeToString(digest[:])
+			},
+			serial: "SN-0001",
+		},
+		{
+			name:        "missing passport",
+			nilPassport: true,
+			expectError: true,
+		},
+		{
+			name:        "unsigned passport fails even the default policy",
+			modify:      func(p *ledger.ProductItemPassport) { p.Signature = "" },
+			expectError: true,
+		},
+		{
+			name:        "schema version not accepted",
+			policy:      strict,
+			modify:      func(p *ledger.ProductItemPassport) { p.SchemaVersion = 0.2 },
+			serial:      "SN-0001",
+			expectError: true,
+		},
+		{
+			name:        "no product passport descriptor",
+			policy:      strict,
+			modify:      func(p *ledger.ProductItemPassport) { p.Records[0].Descriptor = "COMPONENT" },
+			serial:      "SN-0001",
+			expectError: true,
+		},
+		{
+			name:        "board_sn does not match",
+			policy:      strict,
+			serial:      "SN-0002",
+			expectError: true,
+		},
+		{
+			name:   "board_sn ignored unless configured",
+			serial: "SN-0002",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var passport *ledger.ProductItemPassport
+			if !tt.nilPassport {
+				passport = validPassport()
+				if tt.modify != nil {
+					tt.modify(passport)
+				}
+			}
+			err := tt.policy.Check(passport, &fdo.DeviceMfgInfo{SerialNumber: tt.serial})
+
+			if tt.expectError {
+				if !errors.Is(err, ErrPassportPolicy) {
+					t.Errorf("expected ErrPassportPolicy, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -4,159 +4,284 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"net/http"
-	"strings"
 	"time"
 
+	"github.com/fdo-server-wrapper/internal/audit"
+	"github.com/fdo-server-wrapper/internal/fdo"
 	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/metrics"
 	"github.com/fdo-server-wrapper/internal/proxy"
 )
 
+// commissioningTotal counts commissioning passports by result: created,
+// queued (handed to the outbox) or failed. Outbox deliveries are counted by
+// the ledger package.
+var commissioningTotal = metrics.Default.NewCounterVec("fdo_proxy_commissioning_passports_total",
+	"Commissioning passports by result: created, queued or failed.", "result")
+
 // TO2Middleware intercepts TO2 protocol messages to create commissioning passports.
 // It tracks device onboarding completion and records commissioning events.
 type TO2Middleware struct {
 	ledgerClient proxy.LedgerClient
 	ownerID      string
+	outbox       *ledger.Outbox
+	location     *LocationSource
+	audit        *audit.Log
+}
+
+// Session keys for what TO2 learns before TO2.Done2.
+type (
+	proveOVHdrKey  struct{}
+	locationHdrKey struct{}
+)
+
+// TO2Option customizes a TO2Middleware.
+type TO2Option func(*TO2Middleware)
+
+// WithCommissioningOutbox queues commissioning passports in a durable outbox
+// instead of creating them inline, so they survive an outage of the
+// commissioning service. The caller runs the outbox's delivery loop.
+func WithCommissioningOutbox(o *ledger.Outbox) TO2Option {
+	return func(m *TO2Middleware) {
+		m.outbox = o
+	}
+}
+
+// WithDeployedLocation records a deployment location in each commissioning
+// passport, taken from src.
+func WithDeployedLocation(src LocationSource) TO2Option {
+	return func(m *TO2Middleware) {
+		m.location = &src
+	}
+}
+
+// WithCommissioningAudit records each commissioning passport created, queued
+// or failed in the audit log.
+func WithCommissioningAudit(l *audit.Log) TO2Option {
+	return func(m *TO2Middleware) {
+		m.audit = l
+	}
 }
 
 // NewTO2Middleware creates middleware for TO2 protocol integration.
 // When configured, it will create commissioning passports upon successful device onboarding.
-func NewTO2Middleware(ledgerClient proxy.LedgerClient, ownerID string) *TO2Middleware {
-	return &TO2Middleware{
+func NewTO2Middleware(ledgerClient proxy.LedgerClient, ownerID string, opts ...TO2Option) *TO2Middleware {
+	m := &TO2Middleware{
 		ledgerClient: ledgerClient,
 		ownerID:      ownerID,
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
-// ProcessRequest handles incoming TO2 protocol requests.
+// Messages subscribes to TO2.HelloDevice (msg 60) requests and
+// TO2.ProveOVHdr (msg 61) and TO2.Done2 (msg 71) responses.
+func (m *TO2Middleware) Messages() []proxy.MessageType {
+	return []proxy.MessageType{proxy.MsgTO2HelloDevice, proxy.MsgTO2ProveOVHdr, proxy.MsgTO2Done2}
+}
+
+// HandleRequest handles incoming TO2 protocol requests.
 //
 // Contract:
 //
 //	Preconditions:
-//	  - req is not nil and contains valid HTTP request
+//	  - msg is not nil and carries a TO2 request
 //	  - ctx is not nil
 //
 //	Postconditions:
-//	  - Returns nil if request is not TO2-related or processing succeeds
-//	  - Returns error if request processing fails (does not interrupt FDO flow)
+//	  - Returns nil if the message is not handled or processing succeeds
+//	  - Returns error if request processing fails
 //
 //	Integration Points:
-//	  - TO2.HelloDevice (msg type 60): logs device hello for tracking
-func (m *TO2Middleware) ProcessRequest(ctx context.Context, req *http.Request) error {
-	// Only process TO2 protocol requests
-	if !m.isTO2Request(req) {
-		return nil
+//	  - TO2.HelloDevice (msg type 60): logs device hello for tracking and
+//	    remembers the site gateway's location header for the session
+func (m *TO2Middleware) HandleRequest(ctx context.Context, msg *proxy.Message) error {
+	if msg.Type == proxy.MsgTO2HelloDevice {
+		return m.handleTO2HelloDevice(ctx, msg)
 	}
-
-	// Parse message type from URL path: /fdo/101/msg/{msgType}
-	pathParts := strings.Split(req.URL.Path, "/")
-	if len(pathParts) < 5 {
-		return nil
-	}
-
-	msgType := pathParts[4]
-	if msgType == "60" { // TO2.HelloDevice message
-		return m.handleTO2HelloDevice(ctx, req)
-	}
-
 	return nil
 }
 
-// ProcessResponse handles outgoing TO2 protocol responses.
+// HandleResponse handles outgoing TO2 protocol responses.
 //
 // Contract:
 //
 //	Preconditions:
-//	  - resp is not nil and contains valid HTTP response
+//	  - msg is not nil and carries a TO2 response
 //	  - ctx is not nil
 //
 //	Postconditions:
-//	  - Returns nil if response is not TO2-related or processing succeeds
+//	  - Returns nil if the message is not handled or processing succeeds
 //	  - Returns error if response processing fails (does not interrupt FDO flow)
 //
 //	Integration Points:
+//	  - TO2.ProveOVHdr (msg type 61): remembers the voucher header and owner key
 //	  - TO2.Done2 (msg type 71): creates commissioning passport upon completion
-func (m *TO2Middleware) ProcessResponse(ctx context.Context, resp *http.Response) error {
-	// Only process TO2 protocol responses
-	if !m.isTO2Response(resp) {
-		return nil
+func (m *TO2Middleware) HandleResponse(ctx context.Context, msg *proxy.Message) error {
+	switch msg.Type {
+	case proxy.MsgTO2ProveOVHdr:
+		return m.handleTO2ProveOVHdr(ctx, msg)
+	case proxy.MsgTO2Done2:
+		return m.handleTO2Done2(ctx, msg)
 	}
+	return nil
+}
 
-	// Extract message type from response headers
-	msgType := resp.Header.Get("Message-Type")
-	if msgType == "71" { // TO2.Done2 response
-		return m.handleTO2Done2(ctx, resp)
+// handleTO2HelloDevice logs TO2.HelloDevice requests for tracking.
+// The proxy has already recorded the device GUID on the session.
+func (m *TO2Middleware) handleTO2HelloDevice(ctx context.Context, msg *proxy.Message) error {
+	slog.Info("TO2.HelloDevice request received", "guid", msg.Session.GUID())
+	if loc := m.location.fromHeader(msg.Request); loc != "" {
+		msg.Session.Set(locationHdrKey{}, loc)
 	}
-
 	return nil
 }
 
-// isTO2Request identifies TO2 protocol requests by URL pattern.
-// TO2 requests follow the pattern /fdo/101/msg/60 or /fdo/101/msg/70.
-func (m *TO2Middleware) isTO2Request(req *http.Request) bool {
-	return strings.Contains(req.URL.Path, "/fdo/101/msg/") &&
-		(strings.HasSuffix(req.URL.Path, "/60") || strings.HasSuffix(req.URL.Path, "/70"))
-}
+// handleTO2ProveOVHdr keeps the ownership voucher header and owner key the
+// backend proves to the device, for the commissioning passport at TO2.Done2.
+// Later TO2 messages are encrypted, so this is the last look at them.
+func (m *TO2Middleware) handleTO2ProveOVHdr(ctx context.Context, msg *proxy.Message) error {
+	body, err := msg.Body()
+	if err != nil || body == nil {
+		return err
+	}
 
-// isTO2Response identifies TO2 protocol responses by message type header.
-// TO2 responses have Message-Type header set to "71" (Done2).
-func (m *TO2Middleware) isTO2Response(resp *http.Response) bool {
-	msgType := resp.Header.Get("Message-Type")
-	return msgType == "71" // TO2.Done2
-}
+	proof, err := fdo.ParseProveOVHdr(body)
+	if err != nil {
+		slog.Warn("Could not parse TO2.ProveOVHdr", "guid", msg.Session.GUID(), "error", err)
+		return nil // Don't fail the response - the passport just lacks the certificate
+	}
+	msg.Session.Set(proveOVHdrKey{}, proof)
 
-// handleTO2HelloDevice logs TO2.HelloDevice requests for tracking.
-// This provides visibility into device onboarding initiation.
-func (m *TO2Middleware) handleTO2HelloDevice(ctx context.Context, req *http.Request) error {
-	slog.Info("TO2.HelloDevice request received")
+	attrs := []any{
+		"guid", proof.Header.GUID.String(),
+		"ov_entries", proof.NumOVEntries,
+		"mfg_key_encoding", proof.Header.ManufacturerKey.Encoding,
+	}
+	if proof.OwnerKey != nil {
+		attrs = append(attrs, "owner_key", proof.OwnerKey.Fingerprint())
+	}
+	slog.Debug("TO2.ProveOVHdr proved ownership voucher", attrs...)
 	return nil
 }
 
 // handleTO2Done2 processes TO2.Done2 responses to create commissioning passports.
 // When a device completes onboarding successfully, this creates a record
 // of the commissioning event in the external passport service.
-func (m *TO2Middleware) handleTO2Done2(ctx context.Context, resp *http.Response) error {
-	if m.ledgerClient == nil {
+func (m *TO2Middleware) handleTO2Done2(ctx context.Context, msg *proxy.Message) error {
+	if m.ledgerClient == nil && m.outbox == nil {
 		return nil
 	}
 
-	// Extract device GUID from response or session context
-	// Note: This is a simplified implementation - production code would need proper CBOR parsing
-	deviceGUID := m.extractDeviceGUID(resp)
+	// TO2.Done2 is encrypted, so the GUID comes from the session's TO2.HelloDevice
+	deviceGUID := m.extractDeviceGUID(msg)
 	if deviceGUID == "" {
 		slog.Warn("Could not extract device GUID from TO2.Done2 response")
+		commissioningTotal.With("failed").Inc()
+		m.audit.Record(ctx, audit.EventCommissioningFailed, "", "error", "device GUID unknown")
 		return nil
 	}
 
 	// Build commissioning passport request
+	proof, _ := msg.Session.Value(proveOVHdrKey{}).(*fdo.ProveOVHdr)
 	reqBody := &ledger.CommissioningCreateRequest{
 		ControllerUUID:   deviceGUID,
-		Cert:             "", // TODO: Extract actual certificate if available
-		DeployedLocation: "", // TODO: Extract location from device info or config
+		Cert:             m.manufacturerCert(deviceGUID, proof),
+		DeployedLocation: m.deployedLocation(msg, proof),
 		Timestamp:        fmt.Sprintf("%d", time.Now().UnixNano()),
 	}
 
+	if m.outbox != nil {
+		if err := m.outbox.Enqueue(reqBody); err != nil {
+			commissioningTotal.With("failed").Inc()
+			slog.Error("Failed to queue commissioning passport",
+				"controller_uuid", deviceGUID,
+				"error", err)
+			m.audit.Record(ctx, audit.EventCommissioningFailed, deviceGUID, "error", err)
+			return nil // Don't fail the response - the device is already onboarded
+		}
+		commissioningTotal.With("queued").Inc()
+		m.audit.Record(ctx, audit.EventCommissioningQueued, deviceGUID, "deployed_location", reqBody.DeployedLocation)
+		slog.Info("Queued commissioning passport", "controller_uuid", reqBody.ControllerUUID)
+		return nil
+	}
+
 	// Create commissioning passport in external service
 	if err := m.ledgerClient.CreateCommissioningPassport(ctx, reqBody); err != nil {
+		commissioningTotal.With("failed").Inc()
 		slog.Warn("Failed to create commissioning passport",
 			"controller_uuid", deviceGUID,
 			"error", err)
+		m.audit.Record(ctx, audit.EventCommissioningFailed, deviceGUID, "error", err)
 		return nil // Don't fail the response - passport creation is optional
 	}
 
+	commissioningTotal.With("created").Inc()
+	m.audit.Record(ctx, audit.EventCommissioningCreated, deviceGUID, "deployed_location", reqBody.DeployedLocation)
 	slog.Info("Created commissioning passport",
 		"controller_uuid", reqBody.ControllerUUID)
 
 	return nil
 }
 
-// extractDeviceGUID parses the device GUID from TO2.Done2 response.
-// This is a placeholder implementation - production code would need:
-// 1. Proper CBOR parsing of the response body
-// 2. Extraction of device GUID from the response structure
-// 3. Or extraction from session context if available
-func (m *TO2Middleware) extractDeviceGUID(resp *http.Response) string {
-	// Placeholder implementation
-	// TODO: Implement proper CBOR parsing to extract device GUID
-	return "example-device-guid"
+// Flush gives queued commissioning passports a last delivery attempt
+// before shutdown. Undelivered ones stay in the outbox for the next start.
+func (m *TO2Middleware) Flush(ctx context.Context) error {
+	if m.outbox == nil {
+		return nil
+	}
+	return m.outbox.Flush(ctx)
+}
+
+// extractDeviceGUID returns the device GUID the proxy learned from
+// TO2.HelloDevice earlier in the same session, or "" if none was seen.
+func (m *TO2Middleware) extractDeviceGUID(msg *proxy.Message) string {
+	return msg.Session.GUID()
+}
+
+// manufacturerCert returns, in PEM form, the manufacturer certificate chain
+// or public key the ownership voucher proved in TO2.ProveOVHdr is rooted in.
+// It is the same for every device of that manufacturer and identifies no
+// single device: the device certificate chain only crosses the wire in TO2
+// as a hash, and the DI data naming the device is seen, if at all, at a
+// different site and time. It returns "" if the session has no voucher
+// header or the key has no PEM form.
+func (m *TO2Middleware) manufacturerCert(deviceGUID string, proof *fdo.ProveOVHdr) string {
+	if proof == nil {
+		slog.Debug("No TO2.ProveOVHdr seen for session, commissioning passport has no certificate", "guid", deviceGUID)
+		return ""
+	}
+	cert, err := proof.Header.ManufacturerKey.PEM()
+	if err != nil {
+		slog.Debug("Voucher manufacturer key has no certificate form", "guid", deviceGUID, "error", err)
+		return ""
+	}
+	return cert
+}
+
+// deployedLocation resolves the device's deployment location from the
+// configured source. A gateway header on TO2.Done2 wins over one seen on
+// TO2.HelloDevice.
+func (m *TO2Middleware) deployedLocation(msg *proxy.Message, proof *fdo.ProveOVHdr) string {
+	if m.location == nil {
+		return ""
+	}
+	header := m.location.fromHeader(msg.Request)
+	if header == "" {
+		header, _ = msg.Session.Value(locationHdrKey{}).(string)
+	}
+	var ownerKey *fdo.PublicKey
+	if proof != nil {
+		ownerKey = proof.OwnerKey
+	}
+
+	location, source := m.location.resolve(header, m.ownerID, ownerKey)
+	if location == "" {
+		slog.Warn("No deployment location for commissioning passport", "guid", msg.Session.GUID())
+		return ""
+	}
+	slog.Debug("Resolved deployment location", "guid", msg.Session.GUID(), "location", location, "source", source)
+	return location
 }
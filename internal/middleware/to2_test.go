@@ -1,12 +1,34 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/proxy"
 )
 
+// recordingLedgerClient captures commissioning requests for assertions
+type recordingLedgerClient struct {
+	MockLedgerClient
+	created []*ledger.CommissioningCreateRequest
+}
+
+func (m *recordingLedgerClient) CreateCommissioningPassport(ctx context.Context, req *ledger.CommissioningCreateRequest) error {
+	m.created = append(m.created, req)
+	return m.err
+}
+
 func TestNewTO2Middleware(t *testing.T) {
 	mockClient := &MockLedgerClient{}
 	ownerID := "test-owner"
@@ -26,118 +48,44 @@ func TestNewTO2Middleware(t *testing.T) {
 	}
 }
 
-func TestTO2Middleware_IsTO2Request(t *testing.T) {
-	middleware := &TO2Middleware{}
-
-	tests := []struct {
-		name     string
-		path     string
-		expected bool
-	}{
-		{
-			name:     "TO2.HelloDevice request",
-			path:     "/fdo/101/msg/60",
-			expected: true,
-		},
-		{
-			name:     "TO2.ProveDevice request",
-			path:     "/fdo/101/msg/70",
-			expected: true,
-		},
-		{
-			name:     "non-TO2 request",
-			path:     "/fdo/101/msg/80",
-			expected: false,
-		},
-		{
-			name:     "different path",
-			path:     "/api/health",
-			expected: false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest("POST", tt.path, nil)
-			result := middleware.isTO2Request(req)
-
-			if result != tt.expected {
-				t.Errorf("expected %v, got %v for path %s", tt.expected, result, tt.path)
-			}
-		})
-	}
-}
-
-func TestTO2Middleware_IsTO2Response(t *testing.T) {
+func TestTO2Middleware_Messages(t *testing.T) {
 	middleware := &TO2Middleware{}
 
-	tests := []struct {
-		name     string
-		msgType  string
-		expected bool
-	}{
-		{
-			name:     "TO2.Done2 response",
-			msgType:  "71",
-			expected: true,
-		},
-		{
-			name:     "non-TO2 response",
-			msgType:  "80",
-			expected: false,
-		},
-		{
-			name:     "empty message type",
-			msgType:  "",
-			expected: false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			resp := &http.Response{
-				Header: make(http.Header),
-			}
-			resp.Header.Set("Message-Type", tt.msgType)
-
-			result := middleware.isTO2Response(resp)
-
-			if result != tt.expected {
-				t.Errorf("expected %v, got %v for message type %s", tt.expected, result, tt.msgType)
-			}
-		})
+	expected := []proxy.MessageType{proxy.MsgTO2HelloDevice, proxy.MsgTO2ProveOVHdr, proxy.MsgTO2Done2}
+	if got := middleware.Messages(); !slices.Equal(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
 	}
 }
 
-func TestTO2Middleware_ProcessRequest_TO2HelloDevice(t *testing.T) {
+func TestTO2Middleware_HandleRequest_TO2HelloDevice(t *testing.T) {
 	middleware := &TO2Middleware{}
 
 	// Create a request that looks like TO2.HelloDevice
 	req := httptest.NewRequest("POST", "/fdo/101/msg/60", nil)
 
 	ctx := context.Background()
-	err := middleware.ProcessRequest(ctx, req)
+	err := middleware.HandleRequest(ctx, requestMessage(req, 60))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
 
-func TestTO2Middleware_ProcessRequest_NonTO2(t *testing.T) {
+func TestTO2Middleware_HandleRequest_NonHelloDevice(t *testing.T) {
 	middleware := &TO2Middleware{}
 
-	// Create a non-TO2 request
-	req := httptest.NewRequest("POST", "/api/health", nil)
+	// Create a TO2.ProveDevice request, which the middleware ignores
+	req := httptest.NewRequest("POST", "/fdo/101/msg/64", nil)
 
 	ctx := context.Background()
-	err := middleware.ProcessRequest(ctx, req)
+	err := middleware.HandleRequest(ctx, requestMessage(req, 64))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
 
-func TestTO2Middleware_ProcessResponse_TO2Done2(t *testing.T) {
+func TestTO2Middleware_HandleResponse_TO2Done2(t *testing.T) {
 	mockClient := &MockLedgerClient{
 		err: nil, // No error from commissioning passport creation
 	}
@@ -153,23 +101,23 @@ func TestTO2Middleware_ProcessResponse_TO2Done2(t *testing.T) {
 	resp.Header.Set("Message-Type", "71") // TO2.Done2
 
 	ctx := context.Background()
-	err := middleware.ProcessResponse(ctx, resp)
+	err := middleware.HandleResponse(ctx, responseMessage(resp, 70))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
 
-func TestTO2Middleware_ProcessResponse_NonTO2(t *testing.T) {
+func TestTO2Middleware_HandleResponse_NonDone2(t *testing.T) {
 	middleware := &TO2Middleware{}
 
 	resp := &http.Response{
 		Header: make(http.Header),
 	}
-	resp.Header.Set("Message-Type", "80") // Non-TO2 message
+	resp.Header.Set("Message-Type", "61") // TO2.ProveOVHdr
 
 	ctx := context.Background()
-	err := middleware.ProcessResponse(ctx, resp)
+	err := middleware.HandleResponse(ctx, responseMessage(resp, 60))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -188,7 +136,7 @@ func TestTO2Middleware_HandleTO2Done2_NoClient(t *testing.T) {
 	resp.Header.Set("Message-Type", "71")
 
 	ctx := context.Background()
-	err := middleware.handleTO2Done2(ctx, resp)
+	err := middleware.handleTO2Done2(ctx, responseMessage(resp, 70))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -211,7 +159,7 @@ func TestTO2Middleware_HandleTO2Done2_WithClient(t *testing.T) {
 	resp.Header.Set("Message-Type", "71")
 
 	ctx := context.Background()
-	err := middleware.handleTO2Done2(ctx, resp)
+	err := middleware.handleTO2Done2(ctx, responseMessage(resp, 70))
 
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -221,16 +169,76 @@ func TestTO2Middleware_HandleTO2Done2_WithClient(t *testing.T) {
 func TestTO2Middleware_ExtractDeviceGUID(t *testing.T) {
 	middleware := &TO2Middleware{}
 
+	// No session: the GUID is unknown
+	if result := middleware.extractDeviceGUID(&proxy.Message{}); result != "" {
+		t.Errorf("expected empty GUID without a session, got '%s'", result)
+	}
+
+	session := &proxy.Session{}
+	session.SetGUID("191e886b-dfff-4f39-9618-d7a364ec0c90")
+	result := middleware.extractDeviceGUID(&proxy.Message{Session: session})
+	if result != "191e886b-dfff-4f39-9618-d7a364ec0c90" {
+		t.Errorf("expected GUID from session, got '%s'", result)
+	}
+}
+
+func TestTO2Middleware_HandleTO2Done2_UsesSessionGUID(t *testing.T) {
+	mockClient := &recordingLedgerClient{}
+	middleware := &TO2Middleware{
+		ledgerClient: mockClient,
+		ownerID:      "test-owner",
+	}
+
+	session := &proxy.Session{}
+	session.SetGUID("191e886b-dfff-4f39-9618-d7a364ec0c90")
+
 	resp := &http.Response{
 		Header: make(http.Header),
 	}
+	resp.Header.Set("Message-Type", "71")
 
-	result := middleware.extractDeviceGUID(resp)
+	msg := responseMessage(resp, 70)
+	msg.Session = session
+	if err := middleware.handleTO2Done2(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(mockClient.created) != 1 {
+		t.Fatalf("expected 1 commissioning passport, got %d", len(mockClient.created))
+	}
+	if got := mockClient.created[0].ControllerUUID; got != "191e886b-dfff-4f39-9618-d7a364ec0c90" {
+		t.Errorf("expected controller UUID from session, got '%s'", got)
+	}
+}
+
+func TestTO2Middleware_HandleTO2Done2_Metrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		result string
+	}{
+		{name: "created", result: "created"},
+		{name: "failed", err: errors.New("commissioning POST status 500"), result: "failed"},
+	}
 
-	// Currently returns placeholder value
-	expected := "example-device-guid"
-	if result != expected {
-		t.Errorf("expected '%s', got '%s'", expected, result)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			middleware := &TO2Middleware{ledgerClient: &MockLedgerClient{err: tt.err}}
+			session := &proxy.Session{}
+			session.SetGUID("191e886b-dfff-4f39-9618-d7a364ec0c90")
+			resp := &http.Response{Header: make(http.Header)}
+			resp.Header.Set("Message-Type", "71")
+			msg := responseMessage(resp, 70)
+			msg.Session = session
+
+			before := commissioningTotal.With(tt.result).Value()
+			if err := middleware.handleTO2Done2(context.Background(), msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := commissioningTotal.With(tt.result).Value() - before; got != 1 {
+				t.Errorf("expected 1 %s commissioning passport, got %v", tt.result, got)
+			}
+		})
 	}
 }
 
@@ -240,9 +248,218 @@ func TestTO2Middleware_HandleTO2HelloDevice(t *testing.T) {
 	req := httptest.NewRequest("POST", "/fdo/101/msg/60", nil)
 
 	ctx := context.Background()
-	err := middleware.handleTO2HelloDevice(ctx, req)
+	err := middleware.handleTO2HelloDevice(ctx, requestMessage(req, 60))
+
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTO2Middleware_HandleTO2Done2_Outbox(t *testing.T) {
+	mockClient := &recordingLedgerClient{MockLedgerClient: MockLedgerClient{err: errors.New("commissioning POST status 503")}}
+	outbox, err := ledger.NewOutbox(mockClient, ledger.OutboxConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	middleware := NewTO2Middleware(mockClient, "test-owner", WithCommissioningOutbox(outbox))
+
+	session := &proxy.Session{}
+	session.SetGUID("191e886b-dfff-4f39-9618-d7a364ec0c90")
+
+	resp := &http.Response{
+		Header: make(http.Header),
+	}
+	resp.Header.Set("Message-Type", "71")
+
+	msg := responseMessage(resp, 70)
+	msg.Session = session
+	if err := middleware.handleTO2Done2(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Nothing is sent inline; the outbox owns delivery
+	if len(mockClient.created) != 0 {
+		t.Errorf("expected no inline commissioning call, got %d", len(mockClient.created))
+	}
+	pending := outbox.Pending()
+	if len(pending) != 1 || pending[0].ControllerUUID != "191e886b-dfff-4f39-9618-d7a364ec0c90" {
+		t.Fatalf("expected queued commissioning passport, got %+v", pending)
+	}
+
+	// Flush tries once more; the service is still down so the item stays queued
+	if err := middleware.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mockClient.created) != 1 {
+		t.Errorf("expected 1 delivery attempt on flush, got %d", len(mockClient.created))
+	}
+	if n := len(outbox.Pending()); n != 1 {
+		t.Errorf("expected item to remain pending, got %d", n)
+	}
+}
 
+// proveOVHdrBody builds a TO2.ProveOVHdr response for the test GUID whose
+// voucher is rooted in an X5Chain and whose owner key body is ownerKey.
+func proveOVHdrBody(t *testing.T, ownerKey []byte) []byte {
+	t.Helper()
+	guid := []byte{0x19, 0x1e, 0x88, 0x6b, 0xdf, 0xff, 0x4f, 0x39, 0x96, 0x18, 0xd7, 0xa3, 0x64, 0xec, 0x0c, 0x90}
+	header, err := fdo.Encode([]any{
+		uint64(101),
+		guid,
+		[]any{},
+		"model-x",
+		[]any{uint64(fdo.KeyTypeSecp384r1), uint64(fdo.KeyEncodingX5Chain), []any{[]byte{0x30, 0x01}, []byte{0x30, 0x02}}},
+		nil,
+	})
 	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	payload, _ := fdo.Encode([]any{header, uint64(1)})
+	unprotected := map[any]any{uint64(257): []any{uint64(fdo.KeyTypeSecp384r1), uint64(fdo.KeyEncodingX509), ownerKey}}
+	body, err := fdo.Encode(fdo.Tag{Number: 18, Content: []any{[]byte{}, unprotected, payload, []byte{}}})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return body
+}
+
+func TestTO2Middleware_CommissioningEnrichment(t *testing.T) {
+	ownerKey := []byte{0x30, 0x59}
+	fingerprint := fdo.PublicKey{Body: ownerKey}.Fingerprint()
+
+	tests := []struct {
+		name            string
+		source          LocationSource
+		helloHeader     string
+		done2Header     string
+		skipProve       bool
+		expectLocation  string
+		expectCertBlock int
+	}{
+		{
+			name:            "header on hello device",
+			source:          LocationSource{Header: DefaultLocationHeader, Static: "static-site"},
+			helloHeader:     "plant-7/line-2",
+			expectLocation:  "plant-7/line-2",
+			expectCertBlock: 2,
+		},
+		{
+			name:            "header on done2 wins",
+			source:          LocationSource{Header: DefaultLocationHeader},
+			helloHeader:     "plant-7/line-2",
+			done2Header:     "plant-7/line-3",
+			expectLocation:  "plant-7/line-3",
+			expectCertBlock: 2,
+		},
+		{
+			name:            "owner key mapping",
+			source:          LocationSource{Header: DefaultLocationHeader, ByOwner: map[string]string{fingerprint: "by-key", "test-owner": "by-id"}, Static: "static-site"},
+			expectLocation:  "by-key",
+			expectCertBlock: 2,
+		},
+		{
+			name:           "owner ID mapping without voucher",
+			source:         LocationSource{ByOwner: map[string]string{fingerprint: "by-key", "test-owner": "by-id"}},
+			skipProve:      true,
+			expectLocation: "by-id",
+		},
+		{
+			name:            "static",
+			source:          LocationSource{Header: DefaultLocationHeader, ByOwner: map[string]string{"other-owner": "elsewhere"}, Static: "static-site"},
+			expectLocation:  "static-site",
+			expectCertBlock: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &recordingLedgerClient{}
+			middleware := NewTO2Middleware(mockClient, "test-owner", WithDeployedLocation(tt.source))
+			session := &proxy.Session{}
+			session.SetGUID("191e886b-dfff-4f39-9618-d7a364ec0c90")
+			ctx := context.Background()
+
+			hello := httptest.NewRequest("POST", "/fdo/101/msg/60", nil)
+			if tt.helloHeader != "" {
+				hello.Header.Set(DefaultLocationHeader, tt.helloHeader)
+			}
+			msg := requestMessage(hello, 60)
+			msg.Session = session
+			if err := middleware.HandleRequest(ctx, msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !tt.skipProve {
+				resp := &http.Response{Header: make(http.Header), Body: io.NopCloser(bytes.NewReader(proveOVHdrBody(t, ownerKey)))}
+				resp.Header.Set("Message-Type", "61")
+				msg = responseMessage(resp, 60)
+				msg.Session = session
+				if err := middleware.HandleResponse(ctx, msg); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			done := httptest.NewRequest("POST", "/fdo/101/msg/70", nil)
+			if tt.done2Header != "" {
+				done.Header.Set(DefaultLocationHeader, tt.done2Header)
+			}
+			resp := &http.Response{Header: make(http.Header), Request: done}
+			resp.Header.Set("Message-Type", "71")
+			msg = responseMessage(resp, 70)
+			msg.Request = done
+			msg.Session = session
+			if err := middleware.HandleResponse(ctx, msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(mockClient.created) != 1 {
+				t.Fatalf("expected 1 commissioning passport, got %d", len(mockClient.created))
+			}
+			created := mockClient.created[0]
+			if created.DeployedLocation != tt.expectLocation {
+				t.Errorf("expected location '%s', got '%s'", tt.expectLocation, created.DeployedLocation)
+			}
+			if n := strings.Count(created.Cert, "BEGIN CERTIFICATE"); n != tt.expectCertBlock {
+				t.Errorf("expected %d certificates, got %d in %q", tt.expectCertBlock, n, created.Cert)
+			}
+		})
+	}
+}
+
+func TestTO2Middleware_ProveOVHdr_Malformed(t *testing.T) {
+	middleware := &TO2Middleware{}
+	session := &proxy.Session{}
+
+	resp := &http.Response{Header: make(http.Header), Body: io.NopCloser(bytes.NewReader([]byte{0x80}))}
+	resp.Header.Set("Message-Type", "61")
+	msg := responseMessage(resp, 60)
+	msg.Session = session
+
+	if err := middleware.HandleResponse(context.Background(), msg); err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
+	if v := session.Value(proveOVHdrKey{}); v != nil {
+		t.Errorf("expected nothing stored for a malformed message, got %+v", v)
+	}
+}
+
+func TestLoadLocationMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locations.json")
+	if err := os.WriteFile(path, []byte(`{"ABCDEF": "plant-7", "owner-a": "plant-9"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadLocationMap(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m["abcdef"] != "plant-7" || m["owner-a"] != "plant-9" {
+		t.Errorf("unexpected location map %v", m)
+	}
+
+	if err := os.WriteFile(path, []byte(`["plant-7"]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadLocationMap(path); err == nil {
+		t.Error("expected error but got none")
+	}
 }
@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Backend launch defaults, matching the layout produced by `make setup-fdo-backend`.
+const (
+	DefaultBackendBinary     = "../go-fdo/fdo-server"
+	DefaultBackendSubcommand = "server"
+	DefaultBackendDB         = "./fdo-backend.db"
+	DefaultBackendListenAddr = "localhost:8081"
+)
+
+// Supervision defaults.
+const (
+	DefaultBackendReadyTimeout   = 60 * time.Second
+	DefaultBackendHealthInterval = 10 * time.Second
+	DefaultBackendHealthFailures = 3
+	DefaultBackendMinBackoff     = time.Second
+	DefaultBackendMaxBackoff     = time.Minute
+	DefaultBackendStopTimeout    = 10 * time.Second
+)
+
+// BackendConfig describes how to reach the go-fdo server: either a process
+// the proxy launches itself, or an already running instance at URL.
+type BackendConfig struct {
+	// URL selects external-backend mode. When set, no process is started
+	// and traffic is forwarded to this http or https base URL; the launch
+	// fields below are ignored.
+	URL string
+	// CACertPath verifies an https backend; empty uses the system roots.
+	CACertPath string
+	// ProbePath is requested to decide the backend is ready. Any response
+	// below 500 counts, since go-fdo has no dedicated health endpoint.
+	ProbePath string
+	// ReadyTimeout bounds how long Start waits for the backend.
+	ReadyTimeout time.Duration
+	// HealthInterval is how often a ready backend is probed.
+	HealthInterval time.Duration
+	// HealthFailures consecutive failed probes mark the backend down; a
+	// launched process is then killed and restarted.
+	HealthFailures int
+	// MinBackoff and MaxBackoff bound the delay between restarts of a
+	// launched process, which doubles after each crash.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// StopTimeout is how long a launched process has to exit after SIGTERM
+	// before it is killed.
+	StopTimeout time.Duration
+
+	// BinaryPath is the fdo-server executable, or a go-fdo checkout
+	// directory containing one.
+	BinaryPath string
+	// Subcommand is passed before all flags; empty for binaries without one.
+	Subcommand string
+	// WorkDir is the process working directory; empty inherits the proxy's.
+	WorkDir string
+	// DBPath is passed as -db.
+	DBPath string
+	// ListenAddr is passed as -http and is where the proxy forwards traffic.
+	ListenAddr string
+	// Args are appended after the managed flags (e.g. "-debug").
+	Args []string
+	// Env holds KEY=VALUE pairs added to the proxy's own environment.
+	Env []string
+	// LogPath receives the backend's stdout and stderr; empty uses the proxy's.
+	LogPath string
+}
+
+// DefaultBackendConfig returns the launch configuration used when none is given.
+func DefaultBackendConfig() BackendConfig {
+	return BackendConfig{
+		BinaryPath: DefaultBackendBinary,
+		Subcommand: DefaultBackendSubcommand,
+		DBPath:     DefaultBackendDB,
+		ListenAddr: DefaultBackendListenAddr,
+	}
+}
+
+// External reports whether the proxy forwards to an already running backend.
+func (c BackendConfig) External() bool {
+	return c.URL != ""
+}
+
+// target returns the base URL traffic is forwarded to.
+func (c BackendConfig) target() (*url.URL, error) {
+	if !c.External() {
+		return url.Parse("http://" + c.listenAddr())
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("backend URL scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("backend URL %q has no host", c.URL)
+	}
+	return u, nil
+}
+
+// transport builds the HTTP transport used to reach the backend.
+func (c BackendConfig) transport() (*http.Transport, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+	if c.CACertPath == "" {
+		return transport, nil
+	}
+
+	caCert, err := os.ReadFile(c.CACertPath)
+	if err != nil {
+		return nil, fmt.Errorf("read backend CA cert: %w", err)
+	}
+	caPool := x509.NewCertPool()
+	if ok := caPool.AppendCertsFromPEM(caCert); !ok {
+		return nil, fmt.Errorf("append backend CA cert")
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: caPool}
+	return transport, nil
+}
+
+// probeURL is the URL requested to check the backend is up.
+func (c BackendConfig) probeURL(target *url.URL) string {
+	probe := *target
+	probe.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(c.ProbePath, "/")
+	return probe.String()
+}
+
+// probe makes a single readiness request against the backend.
+func probe(ctx context.Context, client *http.Client, probeURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		return fmt.Errorf("build probe request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("probe status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// waitReady polls the backend until it answers or the ready timeout expires.
+func (c BackendConfig) waitReady(ctx context.Context, target *url.URL, transport http.RoundTripper) error {
+	timeout := c.ReadyTimeout
+	if timeout <= 0 {
+		timeout = DefaultBackendReadyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	probeURL := c.probeURL(target)
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	delay := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := probe(ctx, client, probeURL)
+		if err == nil {
+			return nil
+		}
+		slog.Debug("Backend not ready", "url", probeURL, "attempt", attempt, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("backend %s not ready after %s: %w", target, timeout, err)
+		case <-time.After(delay):
+		}
+		if delay < 2*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// binary resolves BinaryPath, accepting a go-fdo checkout directory for
+// compatibility with the -fdo-path flag.
+func (c BackendConfig) binary() (string, error) {
+	path := c.BinaryPath
+	if path == "" {
+		path = DefaultBackendBinary
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("backend binary: %w", err)
+	}
+	if info.IsDir() {
+		path = filepath.Join(path, "fdo-server")
+		if info, err = os.Stat(path); err != nil {
+			return "", fmt.Errorf("backend binary: %w", err)
+		}
+	}
+	if info.Mode()&0o111 == 0 {
+		return "", fmt.Errorf("backend binary %s is not executable", path)
+	}
+	return path, nil
+}
+
+// args builds the backend argument list: subcommand, managed flags, extras.
+func (c BackendConfig) args() []string {
+	var args []string
+	if c.Subcommand != "" {
+		args = append(args, c.Subcommand)
+	}
+	if c.DBPath != "" {
+		args = append(args, "-db", c.DBPath)
+	}
+	args = append(args, "-http", c.listenAddr())
+	return append(args, c.Args...)
+}
+
+func (c BackendConfig) listenAddr() string {
+	if c.ListenAddr == "" {
+		return DefaultBackendListenAddr
+	}
+	return c.ListenAddr
+}
+
+func (c BackendConfig) stopTimeout() time.Duration {
+	if c.StopTimeout <= 0 {
+		return DefaultBackendStopTimeout
+	}
+	return c.StopTimeout
+}
+
+// command prepares the backend process. The returned closer releases the
+// log file, if any, and must be called once the process has exited.
+func (c BackendConfig) command(ctx context.Context) (*exec.Cmd, io.Closer, error) {
+	bin, err := c.binary()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, bin, c.args()...)
+	// Give the backend a chance to close its database when ctx is cancelled
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = c.stopTimeout()
+	cmd.Dir = c.WorkDir
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+
+	var closer io.Closer = io.NopCloser(nil)
+	if c.LogPath == "" {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	} else {
+		f, err := os.OpenFile(c.LogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open backend log: %w", err)
+		}
+		cmd.Stdout = f
+		cmd.Stderr = f
+		closer = f
+	}
+	return cmd, closer, nil
+}
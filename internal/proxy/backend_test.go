@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeExecutable(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nexit 0\n"), 0o755); err != nil {
+		t.Fatalf("write executable: %v", err)
+	}
+}
+
+func TestBackendConfig_Args(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   BackendConfig
+		expected []string
+	}{
+		{
+			name:     "defaults",
+			config:   DefaultBackendConfig(),
+			expected: []string{"server", "-db", "./fdo-backend.db", "-http", "localhost:8081"},
+		},
+		{
+			name: "custom without subcommand",
+			config: BackendConfig{
+				DBPath:     "/var/lib/fdo/fdo.db",
+				ListenAddr: "127.0.0.1:9000",
+				Args:       []string{"-ext-http", "fdo.example.com:443"},
+			},
+			expected: []string{"-db", "/var/lib/fdo/fdo.db", "-http", "127.0.0.1:9000", "-ext-http", "fdo.example.com:443"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.args(); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBackendConfig_Binary(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "fdo-server")
+	writeExecutable(t, bin)
+
+	notExec := filepath.Join(dir, "data.db")
+	if err := os.WriteFile(notExec, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		expected    string
+		expectError bool
+	}{
+		{name: "binary path", path: bin, expected: bin},
+		{name: "checkout directory", path: dir, expected: bin},
+		{name: "missing", path: filepath.Join(dir, "missing"), expectError: true},
+		{name: "not executable", path: notExec, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BackendConfig{BinaryPath: tt.path}.binary()
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error but got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBackendConfig_Command(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "fdo-server")
+	writeExecutable(t, bin)
+	logPath := filepath.Join(dir, "backend.log")
+
+	config := BackendConfig{
+		BinaryPath: bin,
+		WorkDir:    dir,
+		Env:        []string{"FDO_TEST=1"},
+		LogPath:    logPath,
+	}
+	cmd, closer, err := config.command(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closer.Close()
+
+	if cmd.Dir != dir {
+		t.Errorf("expected working dir %s, got %s", dir, cmd.Dir)
+	}
+	if env := strings.Join(cmd.Env, "\n"); !strings.Contains(env, "FDO_TEST=1") {
+		t.Error("expected FDO_TEST in backend environment")
+	}
+	if f, ok := cmd.Stdout.(*os.File); !ok || f.Name() != logPath {
+		t.Errorf("expected stdout to go to %s", logPath)
+	}
+}
+
+func TestBackendConfig_Target(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      BackendConfig
+		expected    string
+		expectError bool
+	}{
+		{name: "managed default", config: DefaultBackendConfig(), expected: "http://localhost:8081"},
+		{name: "managed custom", config: BackendConfig{ListenAddr: "127.0.0.1:9000"}, expected: "http://127.0.0.1:9000"},
+		{name: "external http", config: BackendConfig{URL: "http://fdo-go-server:8081"}, expected: "http://fdo-go-server:8081"},
+		{name: "external https", config: BackendConfig{URL: "https://fdo.internal"}, expected: "https://fdo.internal"},
+		{name: "unsupported scheme", config: BackendConfig{URL: "ftp://fdo.internal"}, expectError: true},
+		{name: "missing host", config: BackendConfig{URL: "http://"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := tt.config.target()
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error but got %s", u)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if u.String() != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, u)
+			}
+		})
+	}
+}
+
+func TestBackendConfig_WaitReady(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/probe" {
+			t.Errorf("expected probe path /probe, got %s", r.URL.Path)
+		}
+		// Report unavailable twice before coming up
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	config := BackendConfig{URL: server.URL, ProbePath: "probe", ReadyTimeout: 10 * time.Second}
+	target, _ := config.target()
+	if err := config.waitReady(context.Background(), target, http.DefaultTransport); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 probes, got %d", calls.Load())
+	}
+}
+
+func TestBackendConfig_WaitReady_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	config := BackendConfig{URL: server.URL, ReadyTimeout: 300 * time.Millisecond}
+	target, _ := config.target()
+	if err := config.waitReady(context.Background(), target, http.DefaultTransport); err == nil {
+		t.Error("expected timeout error but got none")
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// MessageType is an FDO message type number (FDO spec 3.2).
+type MessageType int
+
+// Message types defined by the FDO specification.
+const (
+	MsgDIAppStart       MessageType = 10
+	MsgDISetCredentials MessageType = 11
+	MsgDISetHMAC        MessageType = 12
+	MsgDIDone           MessageType = 13
+
+	MsgTO0Hello       MessageType = 20
+	MsgTO0HelloAck    MessageType = 21
+	MsgTO0OwnerSign   MessageType = 22
+	MsgTO0AcceptOwner MessageType = 23
+
+	MsgTO1HelloRV    MessageType = 30
+	MsgTO1HelloRVAck MessageType = 31
+	MsgTO1ProveToRV  MessageType = 32
+	MsgTO1RVRedirect MessageType = 33
+
+	MsgTO2HelloDevice MessageType = 60
+	MsgTO2ProveOVHdr  MessageType = 61
+	MsgTO2GetOVNext   MessageType = 62
+	MsgTO2OVNextEntry MessageType = 63
+	MsgTO2ProveDevice MessageType = 64
+	MsgTO2SetupDevice MessageType = 65
+	MsgTO2DeviceSIRdy MessageType = 66
+	MsgTO2OwnerSIRdy  MessageType = 67
+	MsgTO2DeviceSI    MessageType = 68
+	MsgTO2OwnerSI     MessageType = 69
+	MsgTO2Done        MessageType = 70
+	MsgTO2Done2       MessageType = 71
+
+	MsgErrorMessage MessageType = fdo.ErrorMessageType
+)
+
+// msgUnknown is reported for responses without a recognisable Message-Type.
+const msgUnknown MessageType = 0
+
+// Protocol is the FDO sub-protocol a message belongs to.
+type Protocol int
+
+// FDO sub-protocols. ProtocolError covers ErrorMessage, which any of them may send.
+const (
+	ProtocolUnknown Protocol = iota
+	ProtocolDI
+	ProtocolTO0
+	ProtocolTO1
+	ProtocolTO2
+	ProtocolError
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolDI:
+		return "DI"
+	case ProtocolTO0:
+		return "TO0"
+	case ProtocolTO1:
+		return "TO1"
+	case ProtocolTO2:
+		return "TO2"
+	case ProtocolError:
+		return "Error"
+	default:
+		return "unknown"
+	}
+}
+
+// messageNames maps each known message type to its spec name.
+var messageNames = map[MessageType]string{
+	MsgDIAppStart:       "DI.AppStart",
+	MsgDISetCredentials: "DI.SetCredentials",
+	MsgDISetHMAC:        "DI.SetHMAC",
+	MsgDIDone:           "DI.Done",
+	MsgTO0Hello:         "TO0.Hello",
+	MsgTO0HelloAck:      "TO0.HelloAck",
+	MsgTO0OwnerSign:     "TO0.OwnerSign",
+	MsgTO0AcceptOwner:   "TO0.AcceptOwner",
+	MsgTO1HelloRV:       "TO1.HelloRV",
+	MsgTO1HelloRVAck:    "TO1.HelloRVAck",
+	MsgTO1ProveToRV:     "TO1.ProveToRV",
+	MsgTO1RVRedirect:    "TO1.RVRedirect",
+	MsgTO2HelloDevice:   "TO2.HelloDevice",
+	MsgTO2ProveOVHdr:    "TO2.ProveOVHdr",
+	MsgTO2GetOVNext:     "TO2.GetOVNextEntry",
+	MsgTO2OVNextEntry:   "TO2.OVNextEntry",
+	MsgTO2ProveDevice:   "TO2.ProveDevice",
+	MsgTO2SetupDevice:   "TO2.SetupDevice",
+	MsgTO2DeviceSIRdy:   "TO2.DeviceServiceInfoReady",
+	MsgTO2OwnerSIRdy:    "TO2.OwnerServiceInfoReady",
+	MsgTO2DeviceSI:      "TO2.DeviceServiceInfo",
+	MsgTO2OwnerSI:       "TO2.OwnerServiceInfo",
+	MsgTO2Done:          "TO2.Done",
+	MsgTO2Done2:         "TO2.Done2",
+	MsgErrorMessage:     "ErrorMessage",
+}
+
+// Known reports whether t is a message type defined by the specification.
+func (t MessageType) Known() bool {
+	_, ok := messageNames[t]
+	return ok
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MessageType(%d)", int(t))
+}
+
+// Protocol returns the sub-protocol t belongs to.
+func (t MessageType) Protocol() Protocol {
+	switch {
+	case !t.Known():
+		return ProtocolUnknown
+	case t == MsgErrorMessage:
+		return ProtocolError
+	case t < 20:
+		return ProtocolDI
+	case t < 30:
+		return ProtocolTO0
+	case t < 40:
+		return ProtocolTO1
+	default:
+		return ProtocolTO2
+	}
+}
+
+// IsRequest reports whether t is sent by the client (device, owner or
+// rendezvous client) in an HTTP request. Requests have even numbers; an
+// ErrorMessage may travel either way.
+func (t MessageType) IsRequest() bool {
+	return t == MsgErrorMessage || (t.Known() && t%2 == 0)
+}
+
+// IsResponse reports whether t is returned by the server in an HTTP response.
+func (t MessageType) IsResponse() bool {
+	return t == MsgErrorMessage || (t.Known() && t%2 == 1)
+}
+
+// Ends reports whether a response of type t concludes its protocol session.
+func (t MessageType) Ends() bool {
+	switch t {
+	case MsgDIDone, MsgTO0AcceptOwner, MsgTO1RVRedirect, MsgTO2Done2, MsgErrorMessage:
+		return true
+	}
+	return false
+}
+
+// Supported FDO protocol versions, as they appear in the URL path.
+var supportedVersions = map[int]bool{100: true, 101: true}
+
+// Classification errors.
+var (
+	ErrNotFDOPath         = errors.New("not an FDO message path")
+	ErrUnsupportedVersion = errors.New("unsupported FDO protocol version")
+	ErrUnknownMessage     = errors.New("unknown FDO message type")
+	ErrUnexpectedMessage  = errors.New("FDO message sent in the wrong direction")
+)
+
+// MessageInfo describes a classified FDO message.
+type MessageInfo struct {
+	// Version is the protocol version from the URL path, e.g. 101.
+	Version int
+	Type    MessageType
+}
+
+// ClassifyRequest parses /fdo/{version}/msg/{type} and checks that the
+// version is supported and the type is one a client may send. Paths outside
+// /fdo/ return ErrNotFDOPath.
+func ClassifyRequest(path string) (MessageInfo, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) == 0 || parts[0] != "fdo" {
+		return MessageInfo{}, ErrNotFDOPath
+	}
+	if len(parts) != 4 || parts[2] != "msg" {
+		return MessageInfo{}, fmt.Errorf("%w: malformed path %q", ErrUnknownMessage, path)
+	}
+
+	version, err := strconv.Atoi(parts[1])
+	if err != nil || !supportedVersions[version] {
+		return MessageInfo{}, fmt.Errorf("%w: %q", ErrUnsupportedVersion, parts[1])
+	}
+	num, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return MessageInfo{}, fmt.Errorf("%w: %q", ErrUnknownMessage, parts[3])
+	}
+
+	info := MessageInfo{Version: version, Type: MessageType(num)}
+	if !info.Type.Known() {
+		return info, fmt.Errorf("%w: %d", ErrUnknownMessage, num)
+	}
+	if !info.Type.IsRequest() {
+		return info, fmt.Errorf("%w: %s is a response", ErrUnexpectedMessage, info.Type)
+	}
+	return info, nil
+}
+
+// ClassifyResponse reads the Message-Type header of a backend response. An
+// absent or unrecognised header yields msgUnknown and an error.
+func ClassifyResponse(header http.Header) (MessageType, error) {
+	v := header.Get("Message-Type")
+	if v == "" {
+		return msgUnknown, fmt.Errorf("%w: no Message-Type header", ErrUnknownMessage)
+	}
+	num, err := strconv.Atoi(v)
+	if err != nil || !MessageType(num).Known() {
+		return msgUnknown, fmt.Errorf("%w: %q", ErrUnknownMessage, v)
+	}
+	t := MessageType(num)
+	if !t.IsResponse() {
+		return t, fmt.Errorf("%w: %s is a request", ErrUnexpectedMessage, t)
+	}
+	return t, nil
+}
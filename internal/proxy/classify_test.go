@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestClassifyRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		expected    MessageInfo
+		expectError error
+	}{
+		{
+			name:     "DI.AppStart",
+			path:     "/fdo/101/msg/10",
+			expected: MessageInfo{Version: 101, Type: MsgDIAppStart},
+		},
+		{
+			name:     "TO2.HelloDevice on protocol 100",
+			path:     "/fdo/100/msg/60",
+			expected: MessageInfo{Version: 100, Type: MsgTO2HelloDevice},
+		},
+		{
+			name:     "device ErrorMessage",
+			path:     "/fdo/101/msg/255",
+			expected: MessageInfo{Version: 101, Type: MsgErrorMessage},
+		},
+		{
+			name:        "not an FDO path",
+			path:        "/api/health",
+			expectError: ErrNotFDOPath,
+		},
+		{
+			name:        "unsupported version",
+			path:        "/fdo/99/msg/10",
+			expectError: ErrUnsupportedVersion,
+		},
+		{
+			name:        "unknown message type",
+			path:        "/fdo/101/msg/80",
+			expectError: ErrUnknownMessage,
+		},
+		{
+			name:        "non-numeric message type",
+			path:        "/fdo/101/msg/hello",
+			expectError: ErrUnknownMessage,
+		},
+		{
+			name:        "malformed path",
+			path:        "/fdo/101/10",
+			expectError: ErrUnknownMessage,
+		},
+		{
+			name:        "response type sent as request",
+			path:        "/fdo/101/msg/11",
+			expectError: ErrUnexpectedMessage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ClassifyRequest(tt.path)
+			if tt.expectError != nil {
+				if !errors.Is(err, tt.expectError) {
+					t.Errorf("expected error %v, got %v", tt.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if info != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, info)
+			}
+		})
+	}
+}
+
+func TestClassifyResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		msgType     string
+		expected    MessageType
+		expectError bool
+	}{
+		{name: "DI.SetCredentials", msgType: "11", expected: MsgDISetCredentials},
+		{name: "TO2.Done2", msgType: "71", expected: MsgTO2Done2},
+		{name: "ErrorMessage", msgType: "255", expected: MsgErrorMessage},
+		{name: "missing header", msgType: "", expectError: true},
+		{name: "unknown type", msgType: "80", expectError: true},
+		{name: "request type", msgType: "10", expected: MsgDIAppStart, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			if tt.msgType != "" {
+				header.Set("Message-Type", tt.msgType)
+			}
+			got, err := ClassifyResponse(header)
+			if (err != nil) != tt.expectError {
+				t.Errorf("expected error %v, got %v", tt.expectError, err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMessageType(t *testing.T) {
+	tests := []struct {
+		msgType  MessageType
+		name     string
+		protocol Protocol
+		request  bool
+		response bool
+		ends     bool
+	}{
+		{MsgDIAppStart, "DI.AppStart", ProtocolDI, true, false, false},
+		{MsgDIDone, "DI.Done", ProtocolDI, false, true, true},
+		{MsgTO0OwnerSign, "TO0.OwnerSign", ProtocolTO0, true, false, false},
+		{MsgTO1RVRedirect, "TO1.RVRedirect", ProtocolTO1, false, true, true},
+		{MsgTO2DeviceSIRdy, "TO2.DeviceServiceInfoReady", ProtocolTO2, true, false, false},
+		{MsgTO2OwnerSI, "TO2.OwnerServiceInfo", ProtocolTO2, false, true, false},
+		{MsgErrorMessage, "ErrorMessage", ProtocolError, true, true, true},
+		{MessageType(80), "MessageType(80)", ProtocolUnknown, false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.msgType.String(); got != tt.name {
+				t.Errorf("expected name %s, got %s", tt.name, got)
+			}
+			if got := tt.msgType.Protocol(); got != tt.protocol {
+				t.Errorf("expected protocol %s, got %s", tt.protocol, got)
+			}
+			if got := tt.msgType.IsRequest(); got != tt.request {
+				t.Errorf("expected IsRequest %v, got %v", tt.request, got)
+			}
+			if got := tt.msgType.IsResponse(); got != tt.response {
+				t.Errorf("expected IsResponse %v, got %v", tt.response, got)
+			}
+			if got := tt.msgType.Ends(); got != tt.ends {
+				t.Errorf("expected Ends %v, got %v", tt.ends, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+)
+
+// Exchange carries state for a single request/response round trip so that
+// middleware can hand facts learned while processing a request to its own
+// response hook. The zero value is ready to use.
+type Exchange struct {
+	mu     sync.Mutex
+	values map[any]any
+}
+
+type exchangeKey struct{}
+
+// WithExchange returns a context carrying a fresh Exchange.
+func WithExchange(ctx context.Context) context.Context {
+	return context.WithValue(ctx, exchangeKey{}, &Exchange{})
+}
+
+// ExchangeFromContext returns the Exchange attached by the proxy, or nil when
+// running outside the proxy (e.g. in unit tests). A nil Exchange is safe to use.
+func ExchangeFromContext(ctx context.Context) *Exchange {
+	e, _ := ctx.Value(exchangeKey{}).(*Exchange)
+	return e
+}
+
+// Set stores a value for the remainder of the exchange.
+func (e *Exchange) Set(key, value any) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.values == nil {
+		e.values = make(map[any]any)
+	}
+	e.values[key] = value
+}
+
+// Value returns a value stored with Set, or nil.
+func (e *Exchange) Value(key any) any {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.values[key]
+}
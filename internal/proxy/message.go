@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// Message is one FDO message handed to middleware: the device's request in
+// HandleRequest, or the backend's response in HandleResponse.
+type Message struct {
+	// Version is the FDO protocol version from the request path.
+	Version int
+	// Type is the FDO message type being handled: the request type taken
+	// from the URL path, or the response's Message-Type header.
+	Type MessageType
+	// RequestType is the type of the request this message belongs to. It
+	// equals Type in HandleRequest.
+	RequestType MessageType
+
+	Request *http.Request
+	// Response is nil in HandleRequest.
+	Response *http.Response
+
+	// Session is the FDO session the message belongs to; values attached
+	// with Session.Set are visible to later messages of the same session.
+	Session *Session
+	// Exchange carries values from HandleRequest to HandleResponse of the
+	// same round trip.
+	Exchange *Exchange
+}
+
+// IsResponse reports whether the message is the backend's response.
+func (m *Message) IsResponse() bool {
+	return m.Response != nil
+}
+
+// Body returns the message body. The body is restored so later middleware
+// and the receiving side still see it.
+func (m *Message) Body() ([]byte, error) {
+	body := m.bodyRef()
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	b, err := io.ReadAll(*body)
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("read message body: %w", err)
+	}
+	return b, nil
+}
+
+// SetBody replaces the message body that is forwarded to the backend or
+// returned to the device.
+func (m *Message) SetBody(b []byte) {
+	*m.bodyRef() = io.NopCloser(bytes.NewReader(b))
+	if m.Response != nil {
+		m.Response.ContentLength = int64(len(b))
+		m.Response.Header.Set("Content-Length", strconv.Itoa(len(b)))
+		return
+	}
+	m.Request.ContentLength = int64(len(b))
+	m.Request.Header.Set("Content-Length", strconv.Itoa(len(b)))
+}
+
+func (m *Message) bodyRef() *io.ReadCloser {
+	if m.Response != nil {
+		return &m.Response.Body
+	}
+	return &m.Request.Body
+}
+
+// MaxMessageSize bounds the body of an FDO message accepted from a device.
+const MaxMessageSize = 1 << 20
+
+// bufferBody reads a device request body of at most limit bytes into
+// memory, so session tracking and middleware never read more than that
+// from the device. Larger bodies are rejected.
+func bufferBody(r *http.Request, limit int64) error {
+	tooLarge := Reject(0, fdo.ErrorMessageBody, fmt.Sprintf("message body exceeds %d bytes", limit))
+	if r.ContentLength > limit {
+		return tooLarge
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body.Close()
+	if err != nil {
+		return Reject(0, fdo.ErrorMessageBody, "failed to read message body")
+	}
+	if int64(len(b)) > limit {
+		return tooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	return nil
+}
+
+// Rejection stops a message and answers the device with an FDO ErrorMessage.
+// Middleware returns it from HandleRequest to keep a request from reaching
+// the backend, or from HandleResponse to replace the backend's response.
+type Rejection struct {
+	// Status is the HTTP status of the error response; 0 means 500.
+	Status  int
+	Code    fdo.ErrorCode
+	Message string
+}
+
+// Reject returns a Rejection answering with status and an ErrorMessage
+// carrying code and message.
+func Reject(status int, code fdo.ErrorCode, message string) *Rejection {
+	return &Rejection{Status: status, Code: code, Message: message}
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("rejected with %s: %s", r.Code, r.Message)
+}
+
+// errorResponse builds the ErrorMessage answering a message of prevType.
+func (r *Rejection) errorResponse(prevType MessageType) (status int, body []byte, cid uint64, err error) {
+	status = r.Status
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	cid = correlationID()
+	em := &fdo.ErrorMessage{
+		Code:          r.Code,
+		PrevMsgType:   uint8(prevType),
+		Message:       r.Message,
+		CorrelationID: cid,
+	}
+	body, err = em.MarshalCBOR()
+	return status, body, cid, err
+}
+
+// correlationID returns a random ID tying an ErrorMessage to the proxy log.
+func correlationID() uint64 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0
+	}
+	return uint64(binary.BigEndian.Uint32(b[:]))
+}
+
+// setErrorHeaders marks h as carrying an FDO ErrorMessage body.
+func setErrorHeaders(h http.Header, length int) {
+	h.Set("Content-Type", "application/cbor")
+	h.Set("Message-Type", strconv.Itoa(fdo.ErrorMessageType))
+	h.Set("Content-Length", strconv.Itoa(length))
+}
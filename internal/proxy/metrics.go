@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/metrics"
+	"github.com/fdo-server-wrapper/internal/trace"
+)
+
+// Proxy metrics, exposed by the admin server at /metrics.
+var (
+	requestsTotal = metrics.Default.NewCounterVec("fdo_proxy_requests_total",
+		"FDO requests answered, by request message type and HTTP status.", "msg_type", "status")
+	requestDuration = metrics.Default.NewHistogramVec("fdo_proxy_request_duration_seconds",
+		"Time to answer an FDO request, including middleware and the backend.", nil, "msg_type")
+	backendDuration = metrics.Default.NewHistogramVec("fdo_proxy_backend_duration_seconds",
+		"Round trip time of requests forwarded to the go-fdo backend.", nil, "msg_type")
+	rejectionsTotal = metrics.Default.NewCounterVec("fdo_proxy_rejections_total",
+		"FDO messages answered with an ErrorMessage by the proxy, by request message type and FDO error code.", "msg_type", "code")
+	middlewareDuration = metrics.Default.NewHistogramVec("fdo_proxy_middleware_duration_seconds",
+		"Time spent in each middleware, by phase (request or response).", nil, "middleware", "phase")
+	middlewareErrors = metrics.Default.NewCounterVec("fdo_proxy_middleware_errors_total",
+		"Errors and rejections returned by each middleware, by phase.", "middleware", "phase")
+	backendStateGauge = metrics.Default.NewGaugeVec("fdo_proxy_backend_state",
+		"1 for the go-fdo backend's current state, 0 for the others.", "state")
+	backendRestarts = metrics.Default.NewCounterVec("fdo_proxy_backend_restarts_total",
+		"Restarts of the launched go-fdo backend process.")
+)
+
+// Named is implemented by middleware that chooses the name it is reported
+// under in metrics. Others are named after their type.
+type Named interface {
+	Name() string
+}
+
+// middlewareName returns the metrics name of mw.
+func middlewareName(mw Middleware) string {
+	if n, ok := mw.(Named); ok {
+		return n.Name()
+	}
+	name := strings.TrimPrefix(fmt.Sprintf("%T", mw), "*")
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// metricType labels a message type, folding undefined numbers together so
+// a misbehaving client cannot create unbounded series.
+func metricType(t MessageType) string {
+	if !t.Known() {
+		return "unknown"
+	}
+	return t.String()
+}
+
+// recordBackendState marks state as the backend's current one.
+func recordBackendState(state BackendState) {
+	for _, s := range []BackendState{BackendStarting, BackendReady, BackendCrashed, BackendRestarting, BackendStopped} {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		backendStateGauge.With(s.String()).Set(v)
+	}
+}
+
+// statusRecorder remembers the status written to an FDO response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Status returns the status written, or 200 if none was, as net/http
+// would send.
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// backendTransport records the backend round trip of FDO requests as a
+// metric and a client span, and passes the trace context to go-fdo.
+type backendTransport struct {
+	next http.RoundTripper
+}
+
+func (t backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	info, ok := ExchangeFromContext(req.Context()).Value(messageInfoKey{}).(MessageInfo)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	ctx, span := trace.Start(req.Context(), "backend "+metricType(info.Type), trace.WithKind(trace.KindClient))
+	out := req
+	if span != nil {
+		out = req.Clone(ctx)
+		trace.Inject(ctx, out.Header)
+	}
+	resp, err := t.next.RoundTrip(out)
+	backendDuration.With(metricType(info.Type)).ObserveSince(start)
+	if err != nil {
+		span.SetError(err)
+	} else {
+		// Response middleware runs in the message span, not this one
+		resp.Request = req
+		span.SetAttributes("http.status_code", resp.StatusCode)
+	}
+	span.End()
+	return resp, err
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+type namedMiddleware struct {
+	funcMiddleware
+	name string
+}
+
+func (m *namedMiddleware) Name() string { return m.name }
+
+func TestMiddlewareName(t *testing.T) {
+	tests := []struct {
+		name     string
+		mw       Middleware
+		expected string
+	}{
+		{name: "type name", mw: &funcMiddleware{}, expected: "funcMiddleware"},
+		{name: "named", mw: &namedMiddleware{name: "allowlist"}, expected: "allowlist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := middlewareName(tt.mw); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMetricType(t *testing.T) {
+	if got := metricType(MsgTO2HelloDevice); got != "TO2.HelloDevice" {
+		t.Errorf("expected TO2.HelloDevice, got %q", got)
+	}
+	if got := metricType(MessageType(9999)); got != "unknown" {
+		t.Errorf("expected unknown, got %q", got)
+	}
+}
+
+func TestFDOProxy_Metrics(t *testing.T) {
+	passed := &namedMiddleware{name: "metrics-test-pass", funcMiddleware: funcMiddleware{
+		types: []MessageType{MsgDIAppStart, MsgDISetCredentials},
+	}}
+	rejecting := &namedMiddleware{name: "metrics-test-reject", funcMiddleware: funcMiddleware{
+		types: []MessageType{MsgTO0Hello},
+		onRequest: func(ctx context.Context, msg *Message) error {
+			return Reject(http.StatusForbidden, fdo.ErrorInvalidMessage, "not allowed")
+		},
+	}}
+	server := startTestProxy(t, fdoBackend(11, []byte{0x80}, nil), passed, rejecting)
+
+	okBefore := requestsTotal.With("DI.AppStart", "200").Value()
+	forbiddenBefore := requestsTotal.With("TO0.Hello", "403").Value()
+	rejectedBefore := rejectionsTotal.With("TO0.Hello", fdo.ErrorInvalidMessage.String()).Value()
+	errorsBefore := middlewareErrors.With("metrics-test-reject", "request").Value()
+
+	postMessage(t, server, 10, []byte{0x80})
+	postMessage(t, server, 10, []byte{0x80})
+	postMessage(t, server, 20, []byte{0x80})
+
+	tests := []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		{name: "forwarded requests", got: requestsTotal.With("DI.AppStart", "200").Value() - okBefore, expected: 2},
+		{name: "rejected requests", got: requestsTotal.With("TO0.Hello", "403").Value() - forbiddenBefore, expected: 1},
+		{name: "rejections", got: rejectionsTotal.With("TO0.Hello", fdo.ErrorInvalidMessage.String()).Value() - rejectedBefore, expected: 1},
+		{name: "middleware errors", got: middlewareErrors.With("metrics-test-reject", "request").Value() - errorsBefore, expected: 1},
+		{name: "passing middleware errors", got: middlewareErrors.With("metrics-test-pass", "request").Value(), expected: 0},
+		{name: "backend state", got: backendStateGauge.With("ready").Value(), expected: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, tt.got)
+			}
+		})
+	}
+}
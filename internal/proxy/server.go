@@ -1,28 +1,95 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
-	"os/exec"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/fdo-server-wrapper/internal/fdo"
 	"github.com/fdo-server-wrapper/internal/ledger"
+	"github.com/fdo-server-wrapper/internal/trace"
 )
 
-// FDOProxy represents a reverse proxy that runs the FDO server as a backend
+// FDOProxy represents a reverse proxy in front of the FDO server, which it
+// either runs as a backend process or reaches at an external URL
 type FDOProxy struct {
-	backendURL   *url.URL
-	backendCmd   *exec.Cmd
-	backendPort  int
-	ledgerClient LedgerClient
-	middleware   []Middleware
-	server       *http.Server
-	mu           sync.Mutex
+	backendURL    *url.URL
+	backend       *Supervisor
+	backendConfig BackendConfig
+	chain         atomic.Pointer[chain]
+	retiring      sync.WaitGroup // flushes of chains replaced by Reload
+	sessions      *SessionTracker
+	server        *http.Server
+	mu            sync.Mutex
+	stopped       bool
+	draining      atomic.Bool
+	tlsConfig     *tls.Config // nil serves plain HTTP
+}
+
+// chain is the middleware and ledger client installed together. Reload
+// replaces it as a whole, and each round trip runs a single chain from
+// request to response.
+type chain struct {
+	ledgerClient  LedgerClient
+	middleware    []Middleware
+	subscriptions []map[MessageType]bool
+	names         []string // middleware names in metrics
+}
+
+func newChain(ledgerClient LedgerClient, middleware []Middleware) *chain {
+	subscriptions := make([]map[MessageType]bool, len(middleware))
+	names := make([]string, len(middleware))
+	for i, mw := range middleware {
+		names[i] = middlewareName(mw)
+		if types := mw.Messages(); types != nil {
+			subscriptions[i] = make(map[MessageType]bool, len(types))
+			for _, t := range types {
+				subscriptions[i][t] = true
+			}
+		}
+	}
+	return &chain{
+		ledgerClient:  ledgerClient,
+		middleware:    middleware,
+		subscriptions: subscriptions,
+		names:         names,
+	}
+}
+
+// subscribed reports whether middleware i handles msgType.
+func (c *chain) subscribed(i int, msgType MessageType) bool {
+	return c.subscriptions[i] == nil || c.subscriptions[i][msgType]
+}
+
+// flush flushes the ledger client and middleware that hold pending work.
+func (c *chain) flush(ctx context.Context) []error {
+	flushers := make([]any, 0, len(c.middleware)+1)
+	flushers = append(flushers, c.ledgerClient)
+	for _, m := range c.middleware {
+		flushers = append(flushers, m)
+	}
+	var errs []error
+	for _, f := range flushers {
+		if f, ok := f.(Flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				slog.Error("Failed to flush pending work", "error", err)
+				errs = append(errs, fmt.Errorf("flush: %w", err))
+			}
+		}
+	}
+	return errs
 }
 
 // LedgerClient defines the minimal surface the proxy needs from the ledger layer
@@ -31,137 +98,530 @@ type LedgerClient interface {
 	CreateCommissioningPassport(ctx context.Context, req *ledger.CommissioningCreateRequest) error
 }
 
+// Flusher is implemented by ledger clients and middleware that hold work
+// which must complete before the process exits. Stop calls Flush once
+// traffic has drained.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
 // Data models live in the ledger package to avoid duplication
 
-// Middleware interface for request/response processing
+// VoucherListener receives ownership voucher events emitted by DI middleware.
+// Other middleware and ledger implementations may implement it to learn the
+// device GUID as soon as it is assigned.
+type VoucherListener interface {
+	VoucherIssued(ctx context.Context, ev *ledger.VoucherIssuedEvent)
+}
+
+// Middleware inspects and acts on FDO messages passing through the proxy.
+//
+// Messages lists the FDO message types the middleware handles: HandleRequest
+// is called for requests of those types and HandleResponse for responses
+// whose Message-Type is one of them. A nil list subscribes to every message.
+//
+// Returning a *Rejection answers the device with an FDO ErrorMessage instead
+// of the request being forwarded or the response being returned. Any other
+// error from HandleRequest is answered with INTERNAL_SERVER_ERROR; other
+// errors from HandleResponse are logged and the response passes unchanged.
 type Middleware interface {
-	ProcessRequest(ctx context.Context, req *http.Request) error
-	ProcessResponse(ctx context.Context, resp *http.Response) error
+	Messages() []MessageType
+	HandleRequest(ctx context.Context, msg *Message) error
+	HandleResponse(ctx context.Context, msg *Message) error
+}
+
+// Option configures an FDOProxy.
+type Option func(*FDOProxy)
+
+// WithTLS serves the device-facing listener over TLS with cfg, built by
+// ListenerTLS.Config. With client certificates requested, middleware sees
+// the verified device identity through Message.Peer.
+func WithTLS(cfg *tls.Config) Option {
+	return func(p *FDOProxy) {
+		p.tlsConfig = cfg
+	}
 }
 
 // NewFDOProxy creates a new FDO proxy server
 func NewFDOProxy(
-	fdoServerPath string,
-	fdoArgs []string,
+	backend BackendConfig,
 	listenAddr string,
 	ledgerClient LedgerClient,
 	middleware []Middleware,
+	opts ...Option,
 ) *FDOProxy {
-	return &FDOProxy{
-		backendPort:  8081, // FDO server will run on this port
-		ledgerClient: ledgerClient,
-		middleware:   middleware,
+	p := &FDOProxy{
+		backendConfig: backend,
+		sessions:      NewSessionTracker(DefaultSessionTTL),
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
+	p.chain.Store(newChain(ledgerClient, middleware))
+	return p
 }
 
-// Start starts the proxy server and the backend FDO server
-func (p *FDOProxy) Start(ctx context.Context, listenAddr string) error {
-	// Start the backend FDO server
-	if err := p.startBackendServer(ctx); err != nil {
-		return fmt.Errorf("failed to start backend FDO server: %w", err)
+// DefaultReloadFlushTimeout bounds the wait for a ledger client replaced by
+// Reload.
+const DefaultReloadFlushTimeout = 30 * time.Second
+
+// Reload installs a new ledger client and middleware chain. Round trips
+// already under way finish on the chain they started with; new ones use
+// the new chain. Outstanding calls of the old ledger client are waited for
+// in the background, and Stop waits for them too. The old middleware is
+// not flushed: work it queued, such as a commissioning outbox, is expected
+// to carry over to the new chain.
+func (p *FDOProxy) Reload(ledgerClient LedgerClient, middleware []Middleware) {
+	old := p.chain.Swap(newChain(ledgerClient, middleware))
+	f, ok := old.ledgerClient.(Flusher)
+	if !ok || old.ledgerClient == ledgerClient {
+		return
 	}
+	p.retiring.Add(1)
+	go func() {
+		defer p.retiring.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultReloadFlushTimeout)
+		defer cancel()
+		if err := f.Flush(ctx); err != nil {
+			slog.Error("Failed to flush replaced ledger client", "error", err)
+		}
+	}()
+}
+
+// LedgerClient returns the ledger client currently installed.
+func (p *FDOProxy) LedgerClient() LedgerClient {
+	return p.chain.Load().ledgerClient
+}
+
+// Sessions returns the tracker correlating FDO messages into protocol sessions.
+func (p *FDOProxy) Sessions() *SessionTracker {
+	return p.sessions
+}
 
-	// Create reverse proxy
-	backendURL, err := url.Parse(fmt.Sprintf("http://localhost:%d", p.backendPort))
+// MiddlewareInfo describes one installed middleware.
+type MiddlewareInfo struct {
+	Name string `json:"name"`
+	// Messages lists the subscribed message types, nil for every message.
+	Messages []string `json:"messages"`
+}
+
+// Middleware describes the installed middleware in the order they run.
+func (p *FDOProxy) Middleware() []MiddlewareInfo {
+	c := p.chain.Load()
+	infos := make([]MiddlewareInfo, len(c.middleware))
+	for i, mw := range c.middleware {
+		infos[i].Name = c.names[i]
+		for _, t := range mw.Messages() {
+			infos[i].Messages = append(infos[i].Messages, t.String())
+		}
+	}
+	return infos
+}
+
+// Draining reports whether Stop has been called and new sessions are
+// being refused.
+func (p *FDOProxy) Draining() bool {
+	return p.draining.Load()
+}
+
+// Start starts the proxy server and, unless an external backend URL is
+// configured, the backend FDO server
+func (p *FDOProxy) Start(ctx context.Context, listenAddr string) error {
+	backendURL, err := p.backendConfig.target()
 	if err != nil {
-		return fmt.Errorf("invalid backend URL: %w", err)
+		return err
 	}
 	p.backendURL = backendURL
 
-	// Create proxy handler
-	proxy := httputil.NewSingleHostReverseProxy(backendURL)
-	proxy.ModifyResponse = p.modifyResponse
-	proxy.Transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
+	transport, err := p.backendConfig.transport()
+	if err != nil {
+		return err
+	}
+
+	// Bring the backend up and keep it up; traffic is only accepted once it answers
+	supervisor := NewSupervisor(p.backendConfig, backendURL, transport)
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	p.backend = supervisor
+	p.mu.Unlock()
+	slog.Info("Waiting for FDO backend", "backend_url", backendURL.String(), "external", p.backendConfig.External())
+	if err := supervisor.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start backend FDO server: %w", err)
 	}
 
+	// Forget sessions abandoned mid-protocol
+	go p.sessions.Run(ctx)
+
 	// Create server with middleware
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if err := p.processRequest(ctx, r); err != nil {
-			slog.Error("Request processing failed", "error", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	handler := p.handler(backendURL, transport)
+
+	p.mu.Lock()
+	p.server = &http.Server{
+		Addr:      listenAddr,
+		Handler:   handler,
+		TLSConfig: p.tlsConfig,
+	}
+	server := p.server
+	p.mu.Unlock()
+
+	slog.Info("FDO proxy server starting", "listen_addr", listenAddr, "backend_url", backendURL.String(), "tls", p.tlsConfig != nil)
+	if p.tlsConfig != nil {
+		// The certificate is in TLSConfig
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// handler returns the proxy's HTTP handler forwarding to backendURL.
+func (p *FDOProxy) handler(backendURL *url.URL, transport http.RoundTripper) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(backendURL)
+	proxy.ModifyResponse = p.modifyResponse
+	proxy.Transport = backendTransport{next: transport}
+	proxy.ErrorHandler = p.backendError
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, err := ClassifyRequest(r.URL.Path)
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		if !errors.Is(err, ErrNotFDOPath) {
+			start := time.Now()
+			defer func() {
+				requestsTotal.With(metricType(info.Type), strconv.Itoa(rec.Status())).Inc()
+				requestDuration.With(metricType(info.Type)).ObserveSince(start)
+			}()
+		}
+
+		if state := p.BackendState(); state != BackendReady {
+			p.backendUnavailable(w, state)
+			return
+		}
+
+		// While draining only sessions already under way may continue
+		if p.draining.Load() && p.sessions.Lookup(bearerToken(r.Header.Get("Authorization"))) == nil {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "FDO proxy shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		if errors.Is(err, ErrNotFDOPath) {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			p.rejectRequest(w, nil, info.Type, Reject(http.StatusInternalServerError, fdo.ErrorInvalidMessage, err.Error()))
+			return
+		}
+
+		if err := bufferBody(r, MaxMessageSize); err != nil {
+			p.rejectRequest(w, nil, info.Type, err)
+			return
+		}
+
+		// The exchange and session travel with the request context to modifyResponse
+		session := p.sessions.begin(r, info.Type)
+		ctx := WithSession(WithExchange(r.Context()), session)
+		ctx, span := startMessageSpan(ctx, r, session, info)
+		defer func() {
+			span.SetAttributes("http.status_code", rec.Status())
+			if guid := session.GUID(); guid != "" {
+				span.SetAttributes("fdo.guid", guid)
+			}
+			if rec.Status() >= http.StatusInternalServerError {
+				span.SetError(fmt.Errorf("HTTP status %d", rec.Status()))
+			}
+			span.End()
+		}()
+		exchange := ExchangeFromContext(ctx)
+		exchange.Set(messageInfoKey{}, info)
+		c := p.chain.Load()
+		exchange.Set(chainKey{}, c)
+		r = r.WithContext(ctx)
+
+		msg := &Message{
+			Version:     info.Version,
+			Type:        info.Type,
+			RequestType: info.Type,
+			Request:     r,
+			Session:     session,
+			Exchange:    exchange,
+		}
+		if err := p.processRequest(ctx, c, msg); err != nil {
+			span.SetError(err)
+			p.rejectRequest(w, session, info.Type, err)
 			return
 		}
 		proxy.ServeHTTP(w, r)
 	})
+}
 
-	p.server = &http.Server{
-		Addr:    listenAddr,
-		Handler: handler,
+// BackendState reports the supervised backend's state.
+func (p *FDOProxy) BackendState() BackendState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.backend == nil {
+		return BackendStarting
 	}
-
-	slog.Info("FDO proxy server starting", "listen_addr", listenAddr, "backend_port", p.backendPort)
-	return p.server.ListenAndServe()
+	return p.backend.State()
 }
 
-// Stop stops the proxy server and the backend FDO server
+// DrainIdle is how recently a session must have sent a message for Stop
+// to wait for it. A device that dropped mid-protocol would otherwise hold
+// up shutdown until its session expired.
+const DrainIdle = 30 * time.Second
+
+// DefaultStopFlushTimeout bounds closing the listener and flushing ledger
+// work in Stop, independently of the drain.
+const DefaultStopFlushTimeout = 30 * time.Second
+
+// Stop shuts the proxy down without cutting FDO sessions short. It refuses
+// new sessions, waits for those still active to finish, closes the listener
+// once in-flight requests complete, flushes ledger work, and finally stops
+// the backend. ctx bounds the wait for sessions; closing the listener and
+// flushing get DefaultStopFlushTimeout more, and the backend its own
+// StopTimeout. A nil error means everything drained cleanly.
 func (p *FDOProxy) Stop(ctx context.Context) error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	p.stopped = true
+	server, backend := p.server, p.backend
+	p.mu.Unlock()
+
+	var errs []error
+
+	// Let sessions that are still active run to completion
+	p.draining.Store(true)
+	if n := p.sessions.Active(DrainIdle); n > 0 {
+		slog.Info("Waiting for FDO sessions to finish", "sessions", n)
+		if err := p.waitSessions(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// A drain that ran out of time must not also cut the flush short
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), DefaultStopFlushTimeout)
+	defer cancel()
 
 	// Stop proxy server
-	if p.server != nil {
-		if err := p.server.Shutdown(ctx); err != nil {
+	if server != nil {
+		if err := server.Shutdown(flushCtx); err != nil {
 			slog.Error("Failed to shutdown proxy server", "error", err)
+			errs = append(errs, fmt.Errorf("shutdown proxy server: %w", err))
+			server.Close()
 		}
 	}
 
+	// Flush pending ledger work, including that of clients replaced by Reload
+	errs = append(errs, p.chain.Load().flush(flushCtx)...)
+	retired := make(chan struct{})
+	go func() {
+		p.retiring.Wait()
+		close(retired)
+	}()
+	select {
+	case <-retired:
+	case <-flushCtx.Done():
+		errs = append(errs, fmt.Errorf("flush replaced ledger client: %w", flushCtx.Err()))
+	}
+
 	// Stop backend server
-	if p.backendCmd != nil && p.backendCmd.Process != nil {
-		if err := p.backendCmd.Process.Kill(); err != nil {
-			slog.Error("Failed to kill backend process", "error", err)
+	if backend != nil {
+		if err := backend.Stop(); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
-// startBackendServer starts the FDO server as a backend process
-func (p *FDOProxy) startBackendServer(ctx context.Context) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	// Build FDO server command
-	args := []string{
-		"server",
-		"-db", "./fdo-backend.db",
-		"-http", fmt.Sprintf("localhost:%d", p.backendPort),
-		"-debug",
+// waitSessions blocks until no FDO session is active within DrainIdle or
+// ctx is done. Sessions idle for longer are left to expire.
+func (p *FDOProxy) waitSessions(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n := p.sessions.Active(DrainIdle)
+		if n == 0 {
+			if idle := p.sessions.Len(); idle > 0 {
+				slog.Info("Not waiting for idle FDO sessions", "sessions", idle, "idle_for", DrainIdle)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d FDO sessions still active: %w", n, ctx.Err())
+		case <-ticker.C:
+		}
 	}
+}
 
-	// Create command
-	p.backendCmd = exec.CommandContext(ctx, "../go-fdo/fdo-server", args...)
-	p.backendCmd.Dir = "." // Run from current directory
-	p.backendCmd.Stdout = os.Stdout
-	p.backendCmd.Stderr = os.Stderr
+// backendUnavailable answers 503 with a Retry-After hint while the backend is down.
+func (p *FDOProxy) backendUnavailable(w http.ResponseWriter, state BackendState) {
+	p.mu.Lock()
+	backend := p.backend
+	p.mu.Unlock()
 
-	// Start the backend server
-	if err := p.backendCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start FDO server: %w", err)
+	retryAfter := time.Second
+	if backend != nil {
+		retryAfter = backend.RetryAfter()
 	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "FDO backend "+state.String(), http.StatusServiceUnavailable)
+}
 
-	slog.Info("Backend FDO server started", "pid", p.backendCmd.Process.Pid, "port", p.backendPort)
-	return nil
+// backendError handles transport failures reaching the backend. If the
+// supervisor has noticed the backend is down the client is told to retry.
+func (p *FDOProxy) backendError(w http.ResponseWriter, r *http.Request, err error) {
+	slog.Error("Backend request failed", "path", r.URL.Path, "error", err)
+	if state := p.BackendState(); state != BackendReady {
+		p.backendUnavailable(w, state)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
 }
 
+// messageInfoKey stores the classified request on the Exchange so the
+// response can be matched to it whatever the backend path looks like.
+type messageInfoKey struct{}
+
+// chainKey stores the chain a request ran so its response runs the same one.
+type chainKey struct{}
+
 // processRequest processes the request through middleware
-func (p *FDOProxy) processRequest(ctx context.Context, req *http.Request) error {
-	for _, mw := range p.middleware {
-		if err := mw.ProcessRequest(ctx, req); err != nil {
-			return fmt.Errorf("middleware request processing failed: %w", err)
+func (p *FDOProxy) processRequest(ctx context.Context, c *chain, msg *Message) error {
+	for i, mw := range c.middleware {
+		if !c.subscribed(i, msg.Type) {
+			continue
+		}
+		name := c.names[i]
+		start := time.Now()
+		mctx, span := trace.Start(ctx, "middleware "+name,
+			trace.WithAttributes("fdo.middleware", name, "fdo.phase", "request"))
+		err := mw.HandleRequest(mctx, msg)
+		span.SetError(err)
+		span.End()
+		middlewareDuration.With(name, "request").ObserveSince(start)
+		if err != nil {
+			middlewareErrors.With(name, "request").Inc()
+			return err
 		}
 	}
 	return nil
 }
 
+// rejectRequest answers a request middleware refused with an FDO ErrorMessage.
+func (p *FDOProxy) rejectRequest(w http.ResponseWriter, session *Session, msgType MessageType, err error) {
+	var rejection *Rejection
+	if !errors.As(err, &rejection) {
+		slog.Error("Request processing failed", "msg_type", msgType.String(), "error", err)
+		rejection = Reject(http.StatusInternalServerError, fdo.ErrorInternalServer, "request processing failed")
+	}
+	status, body, cid, err := rejection.errorResponse(msgType)
+	if err != nil {
+		slog.Error("Failed to encode ErrorMessage", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rejectionsTotal.With(metricType(msgType), rejection.Code.String()).Inc()
+	slog.Warn("Rejected FDO request",
+		"msg_type", msgType.String(),
+		"code", rejection.Code.String(),
+		"reason", rejection.Message,
+		"correlation_id", cid)
+
+	setErrorHeaders(w.Header(), len(body))
+	w.WriteHeader(status)
+	w.Write(body)
+	if session != nil {
+		p.sessions.finish(session, &http.Response{StatusCode: status}, MsgErrorMessage)
+	}
+}
+
 // modifyResponse processes the response through middleware
 func (p *FDOProxy) modifyResponse(resp *http.Response) error {
-	ctx := context.Background()
-	for _, mw := range p.middleware {
-		if err := mw.ProcessResponse(ctx, resp); err != nil {
-			slog.Error("Middleware response processing failed", "error", err)
-			// Don't fail the response, just log the error
+	ctx := resp.Request.Context()
+	session := SessionFromContext(ctx)
+	exchange := ExchangeFromContext(ctx)
+	info, _ := exchange.Value(messageInfoKey{}).(MessageInfo)
+	reqType := info.Type
+	respType, err := ClassifyResponse(resp.Header)
+	if err != nil && info.Type != msgUnknown {
+		slog.Debug("Unclassified backend response", "request", reqType.String(), "status", resp.StatusCode, "error", err)
+	}
+	if session != nil {
+		p.sessions.observe(session, resp, respType)
+	}
+
+	c, ok := exchange.Value(chainKey{}).(*chain)
+	if !ok {
+		c = p.chain.Load()
+	}
+	msg := &Message{
+		Version:     info.Version,
+		Type:        respType,
+		RequestType: reqType,
+		Request:     resp.Request,
+		Response:    resp,
+		Session:     session,
+		Exchange:    exchange,
+	}
+	for i, mw := range c.middleware {
+		if !c.subscribed(i, respType) {
+			continue
+		}
+		name := c.names[i]
+		start := time.Now()
+		mctx, span := trace.Start(ctx, "middleware "+name,
+			trace.WithAttributes("fdo.middleware", name, "fdo.phase", "response"))
+		err := mw.HandleResponse(mctx, msg)
+		span.SetError(err)
+		span.End()
+		middlewareDuration.With(name, "response").ObserveSince(start)
+		if err == nil {
+			continue
+		}
+		middlewareErrors.With(name, "response").Inc()
+		var rejection *Rejection
+		if errors.As(err, &rejection) {
+			p.rejectResponse(resp, reqType, rejection)
+			respType = MsgErrorMessage
+			break
 		}
+		slog.Error("Middleware response processing failed", "error", err)
+		// Don't fail the response, just log the error
+	}
+
+	if session != nil {
+		p.sessions.finish(session, resp, respType)
 	}
 	return nil
 }
+
+// rejectResponse replaces a backend response with an FDO ErrorMessage.
+func (p *FDOProxy) rejectResponse(resp *http.Response, reqType MessageType, rejection *Rejection) {
+	status, body, cid, err := rejection.errorResponse(reqType)
+	if err != nil {
+		slog.Error("Failed to encode ErrorMessage", "error", err)
+		return
+	}
+	rejectionsTotal.With(metricType(reqType), rejection.Code.String()).Inc()
+	trace.SpanFromContext(resp.Request.Context()).SetAttributes("fdo.error_code", rejection.Code.String())
+	slog.Warn("Rejected FDO response",
+		"msg_type", reqType.String(),
+		"code", rejection.Code.String(),
+		"reason", rejection.Message,
+		"correlation_id", cid)
+
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	resp.StatusCode = status
+	resp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	resp.Header.Del("Content-Encoding")
+	setErrorHeaders(resp.Header, len(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+}
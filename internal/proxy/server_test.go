@@ -0,0 +1,499 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// funcMiddleware adapts functions to Middleware for tests.
+type funcMiddleware struct {
+	types      []MessageType
+	onRequest  func(ctx context.Context, msg *Message) error
+	onResponse func(ctx context.Context, msg *Message) error
+}
+
+func (m *funcMiddleware) Messages() []MessageType { return m.types }
+
+func (m *funcMiddleware) HandleRequest(ctx context.Context, msg *Message) error {
+	if m.onRequest == nil {
+		return nil
+	}
+	return m.onRequest(ctx, msg)
+}
+
+func (m *funcMiddleware) HandleResponse(ctx context.Context, msg *Message) error {
+	if m.onResponse == nil {
+		return nil
+	}
+	return m.onResponse(ctx, msg)
+}
+
+type recordingFlusher struct {
+	funcMiddleware
+	flushed bool
+}
+
+func (f *recordingFlusher) Flush(ctx context.Context) error {
+	f.flushed = true
+	return nil
+}
+
+// flushingLedger is a LedgerClient recording whether it was flushed.
+type flushingLedger struct {
+	LedgerClient
+	flushed bool
+}
+
+func (l *flushingLedger) Flush(ctx context.Context) error {
+	l.flushed = true
+	return nil
+}
+
+// openSession registers a session whose first round trip has completed.
+func openSession(t *testing.T, tracker *SessionTracker, token string) *Session {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/fdo/101/msg/60", nil)
+	s := tracker.begin(req, 60)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+	resp.Header.Set("Authorization", "Bearer "+token)
+	tracker.observe(s, resp, 61)
+	tracker.finish(s, resp, 61)
+	return s
+}
+
+func TestFDOProxy_Stop_WaitsForSessions(t *testing.T) {
+	flusher := &recordingFlusher{}
+	p := NewFDOProxy(BackendConfig{}, "", nil, []Middleware{flusher})
+	s := openSession(t, p.sessions, "token")
+
+	// Complete the session shortly after shutdown begins
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+		p.sessions.finish(s, resp, 71)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Stop(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.sessions.Len() != 0 {
+		t.Errorf("expected no open sessions, got %d", p.sessions.Len())
+	}
+	if !flusher.flushed {
+		t.Error("expected middleware to be flushed")
+	}
+}
+
+func TestFDOProxy_Stop_Deadline(t *testing.T) {
+	flusher := &recordingFlusher{}
+	p := NewFDOProxy(BackendConfig{}, "", nil, []Middleware{flusher})
+	openSession(t, p.sessions, "token")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	if err := p.Stop(ctx); err == nil {
+		t.Error("expected error for a session still open at the deadline but got none")
+	}
+	if !flusher.flushed {
+		t.Error("expected middleware to be flushed after the drain timed out")
+	}
+}
+
+func TestFDOProxy_Stop_IgnoresIdleSessions(t *testing.T) {
+	now := time.Now()
+	p := NewFDOProxy(BackendConfig{}, "", nil, nil)
+	p.sessions.now = func() time.Time { return now }
+	openSession(t, p.sessions, "token")
+
+	// The device went quiet mid-protocol
+	now = now.Add(DrainIdle + time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	if err := p.Stop(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFDOProxy_BackendUnavailable(t *testing.T) {
+	p := &FDOProxy{}
+	w := httptest.NewRecorder()
+	p.backendUnavailable(w, BackendRestarting)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected Retry-After 1, got %q", got)
+	}
+	if !strings.Contains(w.Body.String(), "restarting") {
+		t.Errorf("expected state in body, got %q", w.Body.String())
+	}
+}
+
+// startTestProxy serves a proxy in front of backend with the given middleware.
+func startTestProxy(t *testing.T, backend http.HandlerFunc, middleware ...Middleware) *httptest.Server {
+	t.Helper()
+	backendServer := httptest.NewServer(backend)
+	t.Cleanup(backendServer.Close)
+
+	config := BackendConfig{URL: backendServer.URL}
+	p := NewFDOProxy(config, "", nil, middleware)
+	target, _ := config.target()
+	p.backend = NewSupervisor(config, target, http.DefaultTransport)
+	if err := p.backend.Start(context.Background()); err != nil {
+		t.Fatalf("start backend: %v", err)
+	}
+	t.Cleanup(func() { p.backend.Stop() })
+
+	server := httptest.NewServer(p.handler(target, http.DefaultTransport))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fdoBackend answers every FDO message with msg type respType and body.
+func fdoBackend(respType int, body []byte, seen *[]byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			return // readiness probe
+		}
+		b, _ := io.ReadAll(r.Body)
+		if seen != nil {
+			*seen = b
+		}
+		w.Header().Set("Message-Type", strconv.Itoa(respType))
+		w.Write(body)
+	}
+}
+
+func postMessage(t *testing.T, server *httptest.Server, msgType int, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/fdo/101/msg/"+strconv.Itoa(msgType), "application/cbor", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, b
+}
+
+func TestFDOProxy_RejectRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectStatus int
+		expectCode   fdo.ErrorCode
+	}{
+		{
+			name:         "rejection",
+			err:          Reject(http.StatusForbidden, fdo.ErrorInvalidMessage, "device not allowed"),
+			expectStatus: http.StatusForbidden,
+			expectCode:   fdo.ErrorInvalidMessage,
+		},
+		{
+			name:         "rejection without status",
+			err:          &Rejection{Code: fdo.ErrorResourceNotFound},
+			expectStatus: http.StatusInternalServerError,
+			expectCode:   fdo.ErrorResourceNotFound,
+		},
+		{
+			name:         "other error",
+			err:          errors.New("boom"),
+			expectStatus: http.StatusInternalServerError,
+			expectCode:   fdo.ErrorInternalServer,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded bool
+			backend := func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/" {
+					forwarded = true
+				}
+			}
+			mw := &funcMiddleware{
+				types:     []MessageType{MsgDIAppStart},
+				onRequest: func(ctx context.Context, msg *Message) error { return tt.err },
+			}
+			server := startTestProxy(t, backend, mw)
+
+			resp, body := postMessage(t, server, 10, []byte{0x80})
+			if forwarded {
+				t.Error("expected rejected request not to reach the backend")
+			}
+			if resp.StatusCode != tt.expectStatus {
+				t.Errorf("expected status %d, got %d", tt.expectStatus, resp.StatusCode)
+			}
+			if got := resp.Header.Get("Message-Type"); got != "255" {
+				t.Errorf("expected Message-Type 255, got %q", got)
+			}
+			em, err := fdo.ParseErrorMessage(body)
+			if err != nil {
+				t.Fatalf("parse ErrorMessage: %v", err)
+			}
+			if em.Code != tt.expectCode {
+				t.Errorf("expected code %s, got %s", tt.expectCode, em.Code)
+			}
+			if em.PrevMsgType != 10 {
+				t.Errorf("expected previous message 10, got %d", em.PrevMsgType)
+			}
+		})
+	}
+}
+
+func TestFDOProxy_RejectResponse(t *testing.T) {
+	mw := &funcMiddleware{
+		types: []MessageType{MsgDISetCredentials},
+		onResponse: func(ctx context.Context, msg *Message) error {
+			return Reject(http.StatusInternalServerError, fdo.ErrorInvalidOwnershipVoucher, "voucher refused")
+		},
+	}
+	server := startTestProxy(t, fdoBackend(11, []byte{0x80}, nil), mw)
+
+	resp, body := postMessage(t, server, 10, []byte{0x80})
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Message-Type"); got != "255" {
+		t.Errorf("expected Message-Type 255, got %q", got)
+	}
+	em, err := fdo.ParseErrorMessage(body)
+	if err != nil {
+		t.Fatalf("parse ErrorMessage: %v", err)
+	}
+	if em.Code != fdo.ErrorInvalidOwnershipVoucher || em.Message != "voucher refused" {
+		t.Errorf("unexpected ErrorMessage %+v", em)
+	}
+}
+
+func TestFDOProxy_RewriteBodies(t *testing.T) {
+	var seen []byte
+	mw := &funcMiddleware{
+		types: []MessageType{MsgDIAppStart, MsgDISetCredentials},
+		onRequest: func(ctx context.Context, msg *Message) error {
+			msg.SetBody([]byte("rewritten request"))
+			return nil
+		},
+		onResponse: func(ctx context.Context, msg *Message) error {
+			body, err := msg.Body()
+			if err != nil {
+				return err
+			}
+			msg.SetBody(append(body, " and response"...))
+			return nil
+		},
+	}
+	server := startTestProxy(t, fdoBackend(11, []byte("original"), &seen), mw)
+
+	_, body := postMessage(t, server, 10, []byte("original request"))
+	if string(seen) != "rewritten request" {
+		t.Errorf("expected backend to see the rewritten request, got %q", seen)
+	}
+	if string(body) != "original and response" {
+		t.Errorf("expected rewritten response, got %q", body)
+	}
+}
+
+func TestFDOProxy_Subscriptions(t *testing.T) {
+	var requests, responses []MessageType
+	record := func(into *[]MessageType) func(ctx context.Context, msg *Message) error {
+		return func(ctx context.Context, msg *Message) error {
+			*into = append(*into, msg.Type)
+			return nil
+		}
+	}
+	subscribed := &funcMiddleware{types: []MessageType{60, 61}, onRequest: record(&requests), onResponse: record(&responses)}
+	var all []MessageType
+	wildcard := &funcMiddleware{onRequest: record(&all)}
+	server := startTestProxy(t, fdoBackend(61, []byte{0x80}, nil), subscribed, wildcard)
+
+	postMessage(t, server, 10, []byte{0x80})
+	postMessage(t, server, 60, []byte{0x80})
+
+	if !slices.Equal(requests, []MessageType{60}) {
+		t.Errorf("expected requests [60], got %v", requests)
+	}
+	if !slices.Equal(responses, []MessageType{61, 61}) {
+		t.Errorf("expected responses [61 61], got %v", responses)
+	}
+	if !slices.Equal(all, []MessageType{10, 60}) {
+		t.Errorf("expected a nil subscription to see every request, got %v", all)
+	}
+}
+
+func TestFDOProxy_Reload(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			return
+		}
+		if r.URL.Path == "/fdo/101/msg/60" {
+			close(arrived)
+			<-release
+		}
+		w.Header().Set("Message-Type", "61")
+	}))
+	t.Cleanup(backend.Close)
+
+	var mu sync.Mutex
+	var seen []string
+	record := func(name string) func(ctx context.Context, msg *Message) error {
+		return func(ctx context.Context, msg *Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, name+" "+msg.Type.String())
+			return nil
+		}
+	}
+	old := &funcMiddleware{onRequest: record("old"), onResponse: record("old")}
+	replacement := &funcMiddleware{onRequest: record("new"), onResponse: record("new")}
+	oldClient, newClient := &flushingLedger{}, &flushingLedger{}
+
+	config := BackendConfig{URL: backend.URL}
+	p := NewFDOProxy(config, "", oldClient, []Middleware{old})
+	target, _ := config.target()
+	p.backend = NewSupervisor(config, target, http.DefaultTransport)
+	if err := p.backend.Start(context.Background()); err != nil {
+		t.Fatalf("start backend: %v", err)
+	}
+	t.Cleanup(func() { p.backend.Stop() })
+	server := httptest.NewServer(p.handler(target, http.DefaultTransport))
+	t.Cleanup(server.Close)
+
+	// A round trip under way when the chain is replaced finishes on the old one
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		postMessage(t, server, 60, nil)
+	}()
+	<-arrived
+	p.Reload(newClient, []Middleware{replacement})
+	close(release)
+	<-done
+	postMessage(t, server, 62, nil)
+
+	expected := []string{"old TO2.HelloDevice", "old TO2.ProveOVHdr", "new TO2.GetOVNextEntry", "new TO2.ProveOVHdr"}
+	if !slices.Equal(seen, expected) {
+		t.Errorf("expected %v, got %v", expected, seen)
+	}
+	p.retiring.Wait()
+	if !oldClient.flushed {
+		t.Error("expected the replaced ledger client to be flushed")
+	}
+	if p.LedgerClient() != newClient {
+		t.Error("expected the new ledger client to be installed")
+	}
+	if infos := p.Middleware(); len(infos) != 1 || infos[0].Name != "funcMiddleware" {
+		t.Errorf("expected the new chain to be listed, got %+v", infos)
+	}
+}
+
+func TestFDOProxy_RejectsUnclassifiedRequests(t *testing.T) {
+	var forwarded []string
+	backend := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			forwarded = append(forwarded, r.URL.Path)
+		}
+	}
+	var seen []MessageType
+	wildcard := &funcMiddleware{onRequest: func(ctx context.Context, msg *Message) error {
+		seen = append(seen, msg.Type)
+		return nil
+	}}
+	server := startTestProxy(t, backend, wildcard)
+
+	for _, path := range []string{"/fdo/99/msg/10", "/fdo/101/msg/80", "/fdo/101/msg/11"} {
+		resp, err := http.Post(server.URL+path, "application/cbor", bytes.NewReader([]byte{0x80}))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("Message-Type") != "255" {
+			t.Errorf("%s: expected a 500 ErrorMessage, got %d %q", path, resp.StatusCode, resp.Header.Get("Message-Type"))
+		}
+	}
+
+	// Non-FDO paths pass straight through
+	resp, err := http.Get(server.URL + "/health")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+
+	if !slices.Equal(forwarded, []string{"/health"}) {
+		t.Errorf("expected only /health to be forwarded, got %v", forwarded)
+	}
+	if len(seen) != 0 {
+		t.Errorf("expected middleware to see no messages, got %v", seen)
+	}
+}
+
+func TestFDOProxy_RejectsOversizedBodies(t *testing.T) {
+	tests := []struct {
+		name string
+		body func() io.Reader
+	}{
+		{
+			name: "content length",
+			body: func() io.Reader { return bytes.NewReader(make([]byte, MaxMessageSize+1)) },
+		},
+		{
+			name: "chunked",
+			body: func() io.Reader { return io.LimitReader(zeroReader{}, MaxMessageSize+1) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded bool
+			backend := func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/" {
+					forwarded = true
+				}
+			}
+			server := startTestProxy(t, backend)
+
+			resp, err := http.Post(server.URL+"/fdo/101/msg/10", "application/cbor", tt.body())
+			if err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if forwarded {
+				t.Error("expected oversized request not to reach the backend")
+			}
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Errorf("expected status 500, got %d", resp.StatusCode)
+			}
+			em, err := fdo.ParseErrorMessage(body)
+			if err != nil {
+				t.Fatalf("parse ErrorMessage: %v", err)
+			}
+			if em.Code != fdo.ErrorMessageBody {
+				t.Errorf("expected code %s, got %s", fdo.ErrorMessageBody, em.Code)
+			}
+		})
+	}
+}
+
+// zeroReader reads an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,429 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+// DefaultSessionTTL bounds how long an idle protocol session is remembered.
+const DefaultSessionTTL = 10 * time.Minute
+
+// Nonce names recorded on a Session.
+const (
+	NonceTO0Sign    = "NonceTO0Sign"
+	NonceTO1Proof   = "NonceTO1Proof"
+	NonceTO2ProveOV = "NonceTO2ProveOV"
+)
+
+// MessageRecord is one request/response round trip within a session.
+type MessageRecord struct {
+	RequestType  MessageType
+	ResponseType MessageType
+	Status       int
+	Received     time.Time
+	Duration     time.Duration
+}
+
+// Session accumulates what the proxy learns about one FDO protocol session.
+// go-fdo issues an Authorization bearer token in the response to the first
+// message of each DI, TO0, TO1 and TO2 session and the client echoes it on
+// every following message, so the token is the session key.
+//
+// The zero value is ready to use, and all methods are safe on a nil Session.
+type Session struct {
+	mu       sync.Mutex
+	token    string
+	started  time.Time
+	lastSeen time.Time
+	guid     string
+	nonces   map[string][]byte
+	history  []MessageRecord
+	pending  *MessageRecord
+	values   map[any]any
+}
+
+func newSession(now time.Time) *Session {
+	return &Session{started: now, lastSeen: now}
+}
+
+// Token returns the bearer token, or "" before the backend has issued one.
+func (s *Session) Token() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+// Started returns when the first message of the session was received.
+func (s *Session) Started() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.started
+}
+
+// GUID returns the device GUID learned so far, or "".
+func (s *Session) GUID() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.guid
+}
+
+// SetGUID records the device GUID.
+func (s *Session) SetGUID(guid string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.guid = guid
+}
+
+// Nonce returns a nonce recorded under name, or nil.
+func (s *Session) Nonce(name string) []byte {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nonces[name]
+}
+
+// SetNonce records a nonce under name.
+func (s *Session) SetNonce(name string, nonce []byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nonces == nil {
+		s.nonces = make(map[string][]byte)
+	}
+	s.nonces[name] = nonce
+}
+
+// History returns a copy of the completed round trips, oldest first.
+func (s *Session) History() []MessageRecord {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MessageRecord(nil), s.history...)
+}
+
+// Set stores a value for the remainder of the session.
+func (s *Session) Set(key, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[any]any)
+	}
+	s.values[key] = value
+}
+
+// Value returns a value stored with Set, or nil.
+func (s *Session) Value(key any) any {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+func (s *Session) beginMessage(msgType MessageType, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen = now
+	s.pending = &MessageRecord{RequestType: msgType, Received: now}
+}
+
+func (s *Session) endMessage(respType MessageType, status int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen = now
+	if s.pending == nil {
+		return
+	}
+	rec := *s.pending
+	rec.ResponseType = respType
+	rec.Status = status
+	rec.Duration = now.Sub(rec.Received)
+	s.history = append(s.history, rec)
+	s.pending = nil
+}
+
+type sessionKey struct{}
+
+// WithSession returns a context carrying s.
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// SessionFromContext returns the Session attached by the proxy, or nil.
+func SessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// SessionTracker correlates FDO messages into sessions by bearer token.
+type SessionTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+// NewSessionTracker creates a tracker that forgets sessions idle for ttl.
+func NewSessionTracker(ttl time.Duration) *SessionTracker {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &SessionTracker{
+		sessions: make(map[string]*Session),
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+// Len returns the number of sessions currently tracked.
+func (t *SessionTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sessions)
+}
+
+// Active returns the number of tracked sessions with a request in flight
+// or a message seen within idle.
+func (t *SessionTracker) Active(idle time.Duration) int {
+	cutoff := t.now().Add(-idle)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, s := range t.sessions {
+		s.mu.Lock()
+		if s.pending != nil || !s.lastSeen.Before(cutoff) {
+			n++
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// SessionInfo is a point-in-time view of a tracked session for operators.
+// It leaves out the bearer token.
+type SessionInfo struct {
+	Protocol string    `json:"protocol"`
+	GUID     string    `json:"guid,omitempty"`
+	Started  time.Time `json:"started"`
+	LastSeen time.Time `json:"last_seen"`
+	// Messages counts completed round trips.
+	Messages    int    `json:"messages"`
+	LastMessage string `json:"last_message,omitempty"`
+	// InFlight is set while a request is waiting for its response.
+	InFlight bool `json:"in_flight"`
+}
+
+// Snapshot describes every tracked session, oldest first.
+func (t *SessionTracker) Snapshot() []SessionInfo {
+	t.mu.Lock()
+	sessions := make([]*Session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	t.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	return infos
+}
+
+func (s *Session) info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := SessionInfo{
+		GUID:     s.guid,
+		Started:  s.started,
+		LastSeen: s.lastSeen,
+		Messages: len(s.history),
+		InFlight: s.pending != nil,
+	}
+	switch {
+	case s.pending != nil:
+		info.LastMessage = s.pending.RequestType.String()
+	case len(s.history) > 0:
+		info.LastMessage = s.history[len(s.history)-1].ResponseType.String()
+	}
+	if len(s.history) > 0 {
+		info.Protocol = s.history[0].RequestType.Protocol().String()
+	} else if s.pending != nil {
+		info.Protocol = s.pending.RequestType.Protocol().String()
+	}
+	return info
+}
+
+// Lookup returns the session bound to token, or nil.
+func (t *SessionTracker) Lookup(token string) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[token]
+}
+
+// Sweep forgets sessions idle longer than the TTL and returns how many were removed.
+func (t *SessionTracker) Sweep() int {
+	cutoff := t.now().Add(-t.ttl)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := 0
+	for token, s := range t.sessions {
+		s.mu.Lock()
+		idle := s.lastSeen.Before(cutoff)
+		lastSeen := s.lastSeen
+		s.mu.Unlock()
+		if idle {
+			delete(t.sessions, token)
+			endSessionSpan(s, lastSeen, "expired")
+			removed++
+		}
+	}
+	return removed
+}
+
+// Run sweeps idle sessions until ctx is cancelled.
+func (t *SessionTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := t.Sweep(); n > 0 {
+				slog.Debug("Expired idle FDO sessions", "count", n)
+			}
+		}
+	}
+}
+
+// begin finds the session for an incoming request, or starts a new one when
+// the request carries no known token, and records request-side facts.
+func (t *SessionTracker) begin(req *http.Request, msgType MessageType) *Session {
+	now := t.now()
+
+	var s *Session
+	if token := bearerToken(req.Header.Get("Authorization")); token != "" {
+		s = t.Lookup(token)
+	}
+	if s == nil {
+		s = newSession(now)
+	}
+	s.beginMessage(msgType, now)
+
+	switch msgType {
+	case MsgTO1HelloRV:
+		if body, ok := peekBody(&req.Body); ok {
+			if guid, err := fdo.ParseHelloRV(body); err == nil {
+				s.SetGUID(guid.String())
+			}
+		}
+	case MsgTO2HelloDevice:
+		if body, ok := peekBody(&req.Body); ok {
+			if hello, err := fdo.ParseHelloDevice(body); err == nil {
+				s.SetGUID(hello.GUID.String())
+				s.SetNonce(NonceTO2ProveOV, hello.NonceTO2ProveOV)
+			} else {
+				slog.Debug("Could not decode TO2.HelloDevice", "error", err)
+			}
+		}
+	}
+	return s
+}
+
+// observe binds a newly issued token and records response-side facts.
+func (t *SessionTracker) observe(s *Session, resp *http.Response, respType MessageType) {
+	if token := bearerToken(resp.Header.Get("Authorization")); token != "" && s.Token() == "" {
+		s.mu.Lock()
+		s.token = token
+		s.mu.Unlock()
+		t.mu.Lock()
+		t.sessions[token] = s
+		t.mu.Unlock()
+	}
+
+	switch respType {
+	case MsgTO0HelloAck:
+		if body, ok := peekBody(&resp.Body); ok {
+			if nonce, err := fdo.ParseLeadingNonce(body); err == nil {
+				s.SetNonce(NonceTO0Sign, nonce)
+			}
+		}
+	case MsgTO1HelloRVAck:
+		if body, ok := peekBody(&resp.Body); ok {
+			if nonce, err := fdo.ParseLeadingNonce(body); err == nil {
+				s.SetNonce(NonceTO1Proof, nonce)
+			}
+		}
+	}
+}
+
+// finish records the completed round trip and forgets the session once the
+// protocol has ended.
+func (t *SessionTracker) finish(s *Session, resp *http.Response, respType MessageType) {
+	now := t.now()
+	s.endMessage(respType, resp.StatusCode, now)
+
+	// A session the backend issued no token for cannot continue either
+	if respType.Ends() || s.Token() == "" {
+		endSessionSpan(s, now, respType.String())
+	}
+	if respType.Ends() {
+		if token := s.Token(); token != "" {
+			t.mu.Lock()
+			delete(t.sessions, token)
+			t.mu.Unlock()
+		}
+	}
+}
+
+// bearerToken extracts the token from an Authorization header value.
+func bearerToken(header string) string {
+	const prefix = "Bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
+// peekBody reads a body and replaces it with an identical reader.
+func peekBody(body *io.ReadCloser) ([]byte, bool) {
+	if *body == nil || *body == http.NoBody {
+		return nil, false
+	}
+	b, err := io.ReadAll(*body)
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(b))
+	return b, err == nil
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/fdo"
+)
+
+func helloDeviceBody(t *testing.T, guid, nonce []byte) []byte {
+	t.Helper()
+	body, err := fdo.Encode([]any{uint64(1300), guid, nonce, "ECDH256", uint64(1), []any{int64(-7), []byte{}}})
+	if err != nil {
+		t.Fatalf("encode TO2.HelloDevice: %v", err)
+	}
+	return body
+}
+
+func TestSessionTracker_CorrelatesByBearerToken(t *testing.T) {
+	tracker := NewSessionTracker(time.Minute)
+
+	guid := bytes.Repeat([]byte{0xab}, 16)
+	nonce := bytes.Repeat([]byte{0x01}, 16)
+	body := helloDeviceBody(t, guid, nonce)
+
+	// TO2.HelloDevice carries no token yet
+	req := httptest.NewRequest("POST", "/fdo/101/msg/60", bytes.NewReader(body))
+	session := tracker.begin(req, 60)
+
+	if got := session.GUID(); got != "abababab-abab-abab-abab-abababababab" {
+		t.Errorf("unexpected GUID %s", got)
+	}
+	if !bytes.Equal(session.Nonce(NonceTO2ProveOV), nonce) {
+		t.Error("expected NonceTO2ProveOV to be recorded")
+	}
+	if restored, _ := io.ReadAll(req.Body); !bytes.Equal(restored, body) {
+		t.Error("request body was not restored")
+	}
+
+	// The backend issues the token in TO2.ProveOVHdr
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+	resp.Header.Set("Authorization", "Bearer token-1")
+	resp.Header.Set("Message-Type", "61")
+	tracker.observe(session, resp, 61)
+	tracker.finish(session, resp, 61)
+
+	if tracker.Len() != 1 {
+		t.Fatalf("expected 1 tracked session, got %d", tracker.Len())
+	}
+
+	// Later messages carrying the token resolve to the same session
+	req = httptest.NewRequest("POST", "/fdo/101/msg/70", nil)
+	req.Header.Set("Authorization", "Bearer token-1")
+	if got := tracker.begin(req, 70); got != session {
+		t.Fatal("expected TO2.Done to resolve to the HelloDevice session")
+	}
+
+	resp = &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+	tracker.observe(session, resp, 71)
+	tracker.finish(session, resp, 71)
+
+	history := session.History()
+	if len(history) != 2 {
+		t.Fatalf("expected 2 history records, got %d", len(history))
+	}
+	if history[0].RequestType != 60 || history[0].ResponseType != 61 || history[1].ResponseType != 71 {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	// TO2.Done2 ends the session
+	if tracker.Len() != 0 {
+		t.Errorf("expected session to be forgotten after TO2.Done2, got %d", tracker.Len())
+	}
+}
+
+func TestSessionTracker_Sweep(t *testing.T) {
+	now := time.Now()
+	tracker := NewSessionTracker(time.Minute)
+	tracker.now = func() time.Time { return now }
+
+	session := tracker.begin(httptest.NewRequest("POST", "/fdo/101/msg/10", nil), 10)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+	resp.Header.Set("Authorization", "Bearer token-2")
+	tracker.observe(session, resp, 11)
+	tracker.finish(session, resp, 11)
+
+	if n := tracker.Sweep(); n != 0 {
+		t.Errorf("expected no sessions swept, got %d", n)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if n := tracker.Sweep(); n != 1 {
+		t.Errorf("expected 1 session swept, got %d", n)
+	}
+	if tracker.Lookup("token-2") != nil {
+		t.Error("expected idle session to be forgotten")
+	}
+}
+
+func TestSessionTracker_Active(t *testing.T) {
+	now := time.Now()
+	tracker := NewSessionTracker(time.Hour)
+	tracker.now = func() time.Time { return now }
+
+	for _, token := range []string{"idle", "in-flight"} {
+		session := tracker.begin(httptest.NewRequest("POST", "/fdo/101/msg/60", nil), MsgTO2HelloDevice)
+		resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+		resp.Header.Set("Authorization", "Bearer "+token)
+		tracker.observe(session, resp, MsgTO2ProveOVHdr)
+		tracker.finish(session, resp, MsgTO2ProveOVHdr)
+	}
+	if n := tracker.Active(time.Minute); n != 2 {
+		t.Errorf("expected 2 active sessions, got %d", n)
+	}
+
+	// A request still waiting for its response keeps a session active
+	req := httptest.NewRequest("POST", "/fdo/101/msg/62", nil)
+	req.Header.Set("Authorization", "Bearer in-flight")
+	tracker.begin(req, MsgTO2GetOVNext)
+	now = now.Add(2 * time.Minute)
+	if n := tracker.Active(time.Minute); n != 1 {
+		t.Errorf("expected 1 active session, got %d", n)
+	}
+	if n := tracker.Len(); n != 2 {
+		t.Errorf("expected idle sessions to stay tracked, got %d", n)
+	}
+}
+
+func TestSessionTracker_Snapshot(t *testing.T) {
+	now := time.Now()
+	tracker := NewSessionTracker(time.Minute)
+	tracker.now = func() time.Time { return now }
+
+	session := tracker.begin(httptest.NewRequest("POST", "/fdo/101/msg/10", nil), MsgDIAppStart)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+	resp.Header.Set("Authorization", "Bearer token-3")
+	tracker.observe(session, resp, MsgDISetCredentials)
+	tracker.finish(session, resp, MsgDISetCredentials)
+	now = now.Add(time.Second)
+	req := httptest.NewRequest("POST", "/fdo/101/msg/12", nil)
+	req.Header.Set("Authorization", "Bearer token-3")
+	tracker.begin(req, MsgDISetHMAC)
+
+	infos := tracker.Snapshot()
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(infos))
+	}
+	info := infos[0]
+	if info.Protocol != "DI" || info.Messages != 1 || !info.InFlight || info.LastMessage != MsgDISetHMAC.String() {
+		t.Errorf("unexpected session info %+v", info)
+	}
+	if !info.LastSeen.Equal(now) {
+		t.Errorf("expected last seen %v, got %v", now, info.LastSeen)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := map[string]string{
+		"Bearer abc":  "abc",
+		"bearer abc ": "abc",
+		"Basic abc":   "",
+		"Bearer ":     "",
+		"":            "",
+	}
+	for header, expected := range tests {
+		if got := bearerToken(header); got != expected {
+			t.Errorf("bearerToken(%q) = %q, want %q", header, got, expected)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BackendState is the supervisor's view of the go-fdo backend.
+type BackendState int
+
+const (
+	// BackendStarting means the backend is being launched or probed for the first time.
+	BackendStarting BackendState = iota
+	// BackendReady means the backend answers probes and receives traffic.
+	BackendReady
+	// BackendCrashed means the process exited or the backend stopped answering.
+	BackendCrashed
+	// BackendRestarting means a crashed process is waiting out its backoff.
+	BackendRestarting
+	// BackendStopped means supervision has ended.
+	BackendStopped
+)
+
+func (s BackendState) String() string {
+	switch s {
+	case BackendStarting:
+		return "starting"
+	case BackendReady:
+		return "ready"
+	case BackendCrashed:
+		return "crashed"
+	case BackendRestarting:
+		return "restarting"
+	case BackendStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("BackendState(%d)", int(s))
+	}
+}
+
+// stableAfter is how long a process must stay up for its backoff to reset.
+const stableAfter = 2 * time.Minute
+
+// errUnhealthy reports a backend that stopped answering health probes.
+var errUnhealthy = errors.New("backend failed health checks")
+
+// Supervisor keeps the go-fdo backend available. For a launched process it
+// waits for readiness, watches for exit and failed health checks, and
+// restarts with exponential backoff. For an external backend it only tracks
+// health, since restarting is someone else's job.
+type Supervisor struct {
+	config    BackendConfig
+	target    *url.URL
+	transport http.RoundTripper
+	client    *http.Client
+
+	mu          sync.Mutex
+	state       BackendState
+	cmd         *exec.Cmd
+	restarts    int
+	lastErr     error
+	nextAttempt time.Time
+	started     bool
+	stopping    bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewSupervisor creates a supervisor for the backend described by config.
+func NewSupervisor(config BackendConfig, target *url.URL, transport http.RoundTripper) *Supervisor {
+	if config.HealthInterval <= 0 {
+		config.HealthInterval = DefaultBackendHealthInterval
+	}
+	if config.HealthFailures <= 0 {
+		config.HealthFailures = DefaultBackendHealthFailures
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultBackendMinBackoff
+	}
+	if config.StopTimeout <= 0 {
+		config.StopTimeout = DefaultBackendStopTimeout
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = max(DefaultBackendMaxBackoff, config.MinBackoff)
+	}
+	return &Supervisor{
+		config:    config,
+		target:    target,
+		transport: transport,
+		client:    &http.Client{Transport: transport, Timeout: 5 * time.Second},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// State returns the current backend state.
+func (s *Supervisor) State() BackendState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Restarts returns how many times a launched backend has been restarted.
+func (s *Supervisor) Restarts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.restarts
+}
+
+// LastError returns why the backend last went down, or nil.
+func (s *Supervisor) LastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
+
+// RetryAfter suggests how long clients should wait before retrying while
+// the backend is not ready.
+func (s *Supervisor) RetryAfter() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == BackendRestarting {
+		if d := time.Until(s.nextAttempt); d > 0 {
+			return d + time.Second
+		}
+	}
+	return 5 * time.Second
+}
+
+// Done is closed once supervision has ended.
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+// Start brings the backend up and returns once it is ready, then keeps
+// supervising it in the background until ctx is cancelled or Stop is called.
+// It fails if the first launch does not become ready within ReadyTimeout.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+
+	ready := make(chan error, 1)
+	go s.run(ctx, ready)
+	return <-ready
+}
+
+// Stop ends supervision. A launched backend is sent SIGTERM so it can finish
+// any database writes, and is killed only if it has not exited within
+// StopTimeout, in which case an error is returned.
+func (s *Supervisor) Stop() error {
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		<-s.done
+		return nil
+	}
+	s.stopping = true
+	started := s.started
+	cmd := s.cmd
+	s.mu.Unlock()
+
+	close(s.stop)
+	if !started {
+		return nil
+	}
+	if cmd != nil && cmd.Process != nil {
+		slog.Info("Stopping backend FDO server", "pid", cmd.Process.Pid)
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			slog.Error("Failed to signal backend process", "error", err)
+		}
+	}
+
+	timer := time.NewTimer(s.config.StopTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.done:
+		return nil
+	case <-timer.C:
+	}
+
+	slog.Warn("Backend did not exit after SIGTERM, killing it", "timeout", s.config.StopTimeout)
+	s.mu.Lock()
+	cmd = s.cmd
+	s.mu.Unlock()
+	if cmd != nil && cmd.Process != nil {
+		if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			slog.Error("Failed to kill backend process", "error", err)
+		}
+	}
+	<-s.done
+	return fmt.Errorf("backend killed after not exiting within %s", s.config.StopTimeout)
+}
+
+func (s *Supervisor) setState(state BackendState, err error) {
+	s.mu.Lock()
+	prev := s.state
+	s.state = state
+	if err != nil {
+		s.lastErr = err
+	}
+	s.mu.Unlock()
+	recordBackendState(state)
+
+	if prev == state {
+		return
+	}
+	attrs := []any{"from", prev.String(), "to", state.String()}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	if state == BackendCrashed {
+		slog.Error("Backend state changed", attrs...)
+	} else {
+		slog.Info("Backend state changed", attrs...)
+	}
+}
+
+func (s *Supervisor) isStopping(ctx context.Context) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping || ctx.Err() != nil
+}
+
+func (s *Supervisor) run(ctx context.Context, ready chan<- error) {
+	defer close(s.done)
+	defer func() { s.setState(BackendStopped, nil) }()
+
+	if s.config.External() {
+		s.setState(BackendStarting, nil)
+		if err := s.config.waitReady(ctx, s.target, s.transport); err != nil {
+			ready <- err
+			return
+		}
+		s.setState(BackendReady, nil)
+		ready <- nil
+		s.watchExternal(ctx)
+		return
+	}
+
+	backoff := s.config.MinBackoff
+	first := true
+	for {
+		started := time.Now()
+		err := s.runOnce(ctx, func() {
+			if first {
+				first = false
+				ready <- nil
+			}
+		})
+		if first {
+			ready <- err
+			return
+		}
+		if s.isStopping(ctx) {
+			return
+		}
+
+		s.setState(BackendCrashed, err)
+		if time.Since(started) > stableAfter {
+			backoff = s.config.MinBackoff
+		}
+
+		s.mu.Lock()
+		s.nextAttempt = time.Now().Add(backoff)
+		s.restarts++
+		s.mu.Unlock()
+		backendRestarts.With().Inc()
+		s.setState(BackendRestarting, nil)
+		slog.Info("Restarting backend", "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.config.MaxBackoff)
+	}
+}
+
+// runOnce launches one backend process and blocks until it has exited. It
+// calls onReady once the process answers probes.
+func (s *Supervisor) runOnce(ctx context.Context, onReady func()) error {
+	cmd, logCloser, err := s.config.command(ctx)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		logCloser.Close()
+		return fmt.Errorf("failed to start FDO server: %w", err)
+	}
+	slog.Info("Backend FDO server started",
+		"pid", cmd.Process.Pid,
+		"binary", cmd.Path,
+		"args", cmd.Args[1:],
+		"dir", cmd.Dir,
+		"log", s.config.LogPath)
+
+	s.mu.Lock()
+	s.cmd = cmd
+	if s.stopping {
+		// Stop ran while the process was being launched
+		cmd.Process.Kill()
+	}
+	s.mu.Unlock()
+
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		logCloser.Close()
+		s.mu.Lock()
+		s.cmd = nil
+		s.mu.Unlock()
+		exited <- err
+	}()
+
+	// Wait for readiness, giving up early if the process dies
+	readyCtx, cancel := context.WithCancel(ctx)
+	readyErr := make(chan error, 1)
+	go func() { readyErr <- s.config.waitReady(readyCtx, s.target, s.transport) }()
+
+	select {
+	case err := <-exited:
+		cancel()
+		<-readyErr
+		return exitError(err)
+	case err := <-readyErr:
+		cancel()
+		if err != nil {
+			cmd.Process.Kill()
+			<-exited
+			return err
+		}
+	}
+
+	s.setState(BackendReady, nil)
+	onReady()
+
+	return s.watchProcess(ctx, cmd, exited)
+}
+
+// watchProcess probes a ready process until it exits or fails its health
+// checks, in which case it is killed. It returns once the process is reaped.
+func (s *Supervisor) watchProcess(ctx context.Context, cmd *exec.Cmd, exited <-chan error) error {
+	ticker := time.NewTicker(s.config.HealthInterval)
+	defer ticker.Stop()
+
+	probeURL := s.config.probeURL(s.target)
+	failures := 0
+	for {
+		select {
+		case err := <-exited:
+			return exitError(err)
+		case <-ticker.C:
+			if err := probe(ctx, s.client, probeURL); err != nil {
+				failures++
+				slog.Warn("Backend health check failed", "failures", failures, "error", err)
+				if failures >= s.config.HealthFailures && !s.isStopping(ctx) {
+					cmd.Process.Kill()
+					<-exited
+					return errUnhealthy
+				}
+				continue
+			}
+			failures = 0
+		}
+	}
+}
+
+// watchExternal tracks the health of an external backend until ctx is done.
+func (s *Supervisor) watchExternal(ctx context.Context) {
+	ticker := time.NewTicker(s.config.HealthInterval)
+	defer ticker.Stop()
+
+	probeURL := s.config.probeURL(s.target)
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := probe(ctx, s.client, probeURL); err != nil {
+				failures++
+				if failures >= s.config.HealthFailures {
+					s.setState(BackendCrashed, fmt.Errorf("%w: %v", errUnhealthy, err))
+				}
+				continue
+			}
+			failures = 0
+			s.setState(BackendReady, nil)
+		}
+	}
+}
+
+func exitError(err error) error {
+	if err == nil {
+		return errors.New("backend exited with status 0")
+	}
+	return fmt.Errorf("backend exited: %w", err)
+}
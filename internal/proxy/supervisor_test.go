@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// managedConfig launches script as the backend. Probes go to server, which
+// stands in for the process's HTTP listener.
+func managedConfig(t *testing.T, script string, server *httptest.Server) BackendConfig {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "fdo-server")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	return BackendConfig{
+		BinaryPath:     bin,
+		ListenAddr:     strings.TrimPrefix(server.URL, "http://"),
+		ReadyTimeout:   5 * time.Second,
+		HealthInterval: 50 * time.Millisecond,
+		MinBackoff:     10 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackendState_String(t *testing.T) {
+	tests := []struct {
+		state    BackendState
+		expected string
+	}{
+		{BackendStarting, "starting"},
+		{BackendReady, "ready"},
+		{BackendCrashed, "crashed"},
+		{BackendRestarting, "restarting"},
+		{BackendStopped, "stopped"},
+		{BackendState(42), "BackendState(42)"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.state.String(); got != tt.expected {
+			t.Errorf("expected %s, got %s", tt.expected, got)
+		}
+	}
+}
+
+func TestSupervisor_RestartsCrashedProcess(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	config := managedConfig(t, "sleep 0.2\nexit 1", server)
+	target, _ := config.target()
+	s := NewSupervisor(config, target, http.DefaultTransport)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Stop()
+
+	waitFor(t, "a restart", func() bool { return s.Restarts() >= 1 })
+	if s.LastError() == nil {
+		t.Error("expected the crash to be recorded")
+	}
+	waitFor(t, "ready after restart", func() bool { return s.State() == BackendReady })
+}
+
+func TestSupervisor_KillsUnhealthyProcess(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	config := managedConfig(t, "exec sleep 30", server)
+	config.HealthFailures = 2
+	target, _ := config.target()
+	s := NewSupervisor(config, target, http.DefaultTransport)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Stop()
+
+	healthy.Store(false)
+	waitFor(t, "a restart", func() bool { return s.Restarts() >= 1 })
+	if err := s.LastError(); err != errUnhealthy {
+		t.Errorf("expected %v, got %v", errUnhealthy, err)
+	}
+}
+
+func TestSupervisor_StartFailsWhenProcessExits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := managedConfig(t, "exit 3", server)
+	target, _ := config.target()
+	s := NewSupervisor(config, target, http.DefaultTransport)
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("expected error but got none")
+	}
+	<-s.Done()
+	if s.State() != BackendStopped {
+		t.Errorf("expected stopped, got %s", s.State())
+	}
+}
+
+func TestSupervisor_Stop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	config := managedConfig(t, "exec sleep 30", server)
+	target, _ := config.target()
+	s := NewSupervisor(config, target, http.DefaultTransport)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Errorf("expected a clean stop after SIGTERM, got %v", err)
+	}
+	if s.State() != BackendStopped {
+		t.Errorf("expected stopped, got %s", s.State())
+	}
+	if s.Restarts() != 0 {
+		t.Errorf("expected no restarts after Stop, got %d", s.Restarts())
+	}
+	// A second Stop is a no-op
+	s.Stop()
+}
+
+func TestSupervisor_ExternalHealth(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	config := BackendConfig{URL: server.URL, HealthInterval: 20 * time.Millisecond, HealthFailures: 2}
+	target, _ := config.target()
+	s := NewSupervisor(config, target, http.DefaultTransport)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Stop()
+
+	if s.State() != BackendReady {
+		t.Fatalf("expected ready, got %s", s.State())
+	}
+	healthy.Store(false)
+	waitFor(t, "crashed", func() bool { return s.State() == BackendCrashed })
+	healthy.Store(true)
+	waitFor(t, "ready", func() bool { return s.State() == BackendReady })
+	if s.Restarts() != 0 {
+		t.Errorf("expected an external backend never to be restarted, got %d", s.Restarts())
+	}
+}
+
+func TestSupervisor_StopKillsAfterTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// The probe answers before the script runs, so it marks when SIGTERM is ignored
+	trapped := filepath.Join(t.TempDir(), "trapped")
+	config := managedConfig(t, "trap '' TERM\ntouch "+trapped+"\nwhile :; do sleep 0.05; done", server)
+	config.StopTimeout = 200 * time.Millisecond
+	target, _ := config.target()
+	s := NewSupervisor(config, target, http.DefaultTransport)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFor(t, "SIGTERM trap", func() bool {
+		_, err := os.Stat(trapped)
+		return err == nil
+	})
+
+	if err := s.Stop(); err == nil {
+		t.Error("expected error for a backend that ignores SIGTERM but got none")
+	}
+	if s.State() != BackendStopped {
+		t.Errorf("expected stopped, got %s", s.State())
+	}
+}
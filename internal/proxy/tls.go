@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Client certificate modes for ListenerTLS.ClientAuth.
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// ListenerTLS configures TLS on the device-facing listener.
+type ListenerTLS struct {
+	// CertPath and KeyPath hold the server certificate chain and key.
+	CertPath string
+	KeyPath  string
+	// MinVersion is "1.2" (the default) or "1.3".
+	MinVersion string
+	// CipherSuites is a comma-separated list of TLS 1.2 cipher suite
+	// names, as in crypto/tls; empty uses Go's defaults. TLS 1.3 suites
+	// are not configurable.
+	CipherSuites string
+	// ClientAuth is ClientAuthNone (the default), ClientAuthRequest to
+	// verify a client certificate if the device presents one, or
+	// ClientAuthRequire to refuse devices without one.
+	ClientAuth string
+	// ClientCAPath holds the CAs client certificates are verified against.
+	ClientCAPath string
+}
+
+// Config builds the server's tls.Config, loading the certificate files.
+func (c ListenerTLS) Config() (*tls.Config, error) {
+	if c.CertPath == "" || c.KeyPath == "" {
+		return nil, errors.New("TLS needs both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertPath, c.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS cert/key: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	switch c.MinVersion {
+	case "", "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported TLS minimum version %q (want 1.2 or 1.3)", c.MinVersion)
+	}
+
+	if cfg.CipherSuites, err = parseCipherSuites(c.CipherSuites); err != nil {
+		return nil, err
+	}
+
+	switch c.ClientAuth {
+	case "", ClientAuthNone:
+		if c.ClientCAPath != "" {
+			return nil, errors.New("a client CA needs client certificates to be requested or required")
+		}
+		return cfg, nil
+	case ClientAuthRequest:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %q (want %s, %s or %s)", c.ClientAuth, ClientAuthNone, ClientAuthRequest, ClientAuthRequire)
+	}
+	if c.ClientCAPath == "" {
+		return nil, fmt.Errorf("client auth %q needs a client CA", c.ClientAuth)
+	}
+	caCert, err := os.ReadFile(c.ClientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA cert: %w", err)
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if ok := cfg.ClientCAs.AppendCertsFromPEM(caCert); !ok {
+		return nil, fmt.Errorf("append client CA cert")
+	}
+	return cfg, nil
+}
+
+// parseCipherSuites maps comma-separated suite names to their IDs. Only
+// suites crypto/tls considers secure are accepted.
+func parseCipherSuites(list string) ([]uint16, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Peer identifies a device by the client certificate it presented on the
+// TLS listener, verified against the client CA.
+type Peer struct {
+	Subject     string
+	CommonName  string
+	Serial      string
+	Fingerprint string // SHA-256 of the certificate, hex encoded
+	Certificate *x509.Certificate
+}
+
+// Peer returns the verified client certificate identity of the device that
+// sent the message, or nil if it presented none or the listener is not
+// using TLS.
+func (m *Message) Peer() *Peer {
+	if m.Request == nil || m.Request.TLS == nil || len(m.Request.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := m.Request.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+	return &Peer{
+		Subject:     cert.Subject.String(),
+		CommonName:  cert.Subject.CommonName,
+		Serial:      cert.SerialNumber.Text(16),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		Certificate: cert,
+	}
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPKI issues certificates from a throwaway CA, written as PEM files.
+type testPKI struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T, name string) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pki := &testPKI{dir: t.TempDir(), cert: cert, key: key}
+	pki.write(t, name+".pem", "CERTIFICATE", der)
+	return pki
+}
+
+func (p *testPKI) write(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(p.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue writes a certificate for cn, usable for usage, and its key, returning
+// their paths.
+func (p *testPKI) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Example Devices"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.write(t, cn+".crt", "CERTIFICATE", der), p.write(t, cn+".key", "EC PRIVATE KEY", keyDER)
+}
+
+func TestListenerTLS_Config(t *testing.T) {
+	pki := newTestPKI(t, "device CA")
+	certPath, keyPath := pki.issue(t, "proxy", x509.ExtKeyUsageServerAuth)
+	caPath := filepath.Join(pki.dir, "device CA.pem")
+
+	tests := []struct {
+		name           string
+		config         ListenerTLS
+		expectedErr    string
+		expectedMin    uint16
+		expectedAuth   tls.ClientAuthType
+		expectedSuites int
+	}{
+		{
+			name:         "defaults",
+			config:       ListenerTLS{CertPath: certPath, KeyPath: keyPath},
+			expectedMin:  tls.VersionTLS12,
+			expectedAuth: tls.NoClientCert,
+		},
+		{
+			name: "TLS 1.3, cipher suites and required client certificates",
+			config: ListenerTLS{
+				CertPath:     certPath,
+				KeyPath:      keyPath,
+				MinVersion:   "1.3",
+				CipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+				ClientAuth:   ClientAuthRequire,
+				ClientCAPath: caPath,
+			},
+			expectedMin:    tls.VersionTLS13,
+			expectedAuth:   tls.RequireAndVerifyClientCert,
+			expectedSuites: 2,
+		},
+		{
+			name:         "requested client certificates",
+			config:       ListenerTLS{CertPath: certPath, KeyPath: keyPath, ClientAuth: ClientAuthRequest, ClientCAPath: caPath},
+			expectedMin:  tls.VersionTLS12,
+			expectedAuth: tls.VerifyClientCertIfGiven,
+		},
+		{
+			name:        "missing key",
+			config:      ListenerTLS{CertPath: certPath},
+			expectedErr: "both a certificate and a key",
+		},
+		{
+			name:        "unreadable certificate",
+			config:      ListenerTLS{CertPath: caPath + ".missing", KeyPath: keyPath},
+			expectedErr: "load TLS cert/key",
+		},
+		{
+			name:        "unsupported version",
+			config:      ListenerTLS{CertPath: certPath, KeyPath: keyPath, MinVersion: "1.1"},
+			expectedErr: "unsupported TLS minimum version",
+		},
+		{
+			name:        "insecure cipher suite",
+			config:      ListenerTLS{CertPath: certPath, KeyPath: keyPath, CipherSuites: "TLS_RSA_WITH_RC4_128_SHA"},
+			expectedErr: "insecure cipher suite",
+		},
+		{
+			name:        "unknown client auth",
+			config:      ListenerTLS{CertPath: certPath, KeyPath: keyPath, ClientAuth: "optional"},
+			expectedErr: "unknown client auth mode",
+		},
+		{
+			name:        "client auth without CA",
+			config:      ListenerTLS{CertPath: certPath, KeyPath: keyPath, ClientAuth: ClientAuthRequire},
+			expectedErr: "needs a client CA",
+		},
+		{
+			name:        "CA without client auth",
+			config:      ListenerTLS{CertPath: certPath, KeyPath: keyPath, ClientCAPath: caPath},
+			expectedErr: "requested or required",
+		},
+		{
+			name:        "CA file without certificates",
+			config:      ListenerTLS{CertPath: certPath, KeyPath: keyPath, ClientAuth: ClientAuthRequest, ClientCAPath: keyPath},
+			expectedErr: "append client CA cert",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.config.Config()
+			if tt.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+					t.Errorf("expected error containing %q, got %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.MinVersion != tt.expectedMin {
+				t.Errorf("expected min version %x, got %x", tt.expectedMin, cfg.MinVersion)
+			}
+			if cfg.ClientAuth != tt.expectedAuth {
+				t.Errorf("expected client auth %v, got %v", tt.expectedAuth, cfg.ClientAuth)
+			}
+			if len(cfg.CipherSuites) != tt.expectedSuites {
+				t.Errorf("expected %d cipher suites, got %d", tt.expectedSuites, len(cfg.CipherSuites))
+			}
+		})
+	}
+}
+
+func TestFDOProxy_TLSPeer(t *testing.T) {
+	devices := newTestPKI(t, "device CA")
+	serverCert, serverKey := devices.issue(t, "proxy", x509.ExtKeyUsageServerAuth)
+	deviceCert, deviceKey := devices.issue(t, "device-0001", x509.ExtKeyUsageClientAuth)
+	strangers := newTestPKI(t, "other CA")
+	strangerCert, strangerKey := strangers.issue(t, "stranger", x509.ExtKeyUsageClientAuth)
+
+	cfg, err := ListenerTLS{
+		CertPath:     serverCert,
+		KeyPath:      serverKey,
+		ClientAuth:   ClientAuthRequest,
+		ClientCAPath: filepath.Join(devices.dir, "device CA.pem"),
+	}.Config()
+	if err != nil {
+		t.Fatalf("listener TLS: %v", err)
+	}
+
+	backend := httptest.NewServer(fdoBackend(int(MsgTO2ProveOVHdr), nil, nil))
+	t.Cleanup(backend.Close)
+	config := BackendConfig{URL: backend.URL}
+
+	// Middleware sees the peer on both the request and the response
+	var requestPeer, responsePeer *Peer
+	mw := &funcMiddleware{
+		onRequest: func(ctx context.Context, msg *Message) error {
+			requestPeer = msg.Peer()
+			return nil
+		},
+		onResponse: func(ctx context.Context, msg *Message) error {
+			responsePeer = msg.Peer()
+			return nil
+		},
+	}
+	p := NewFDOProxy(config, "", nil, []Middleware{mw}, WithTLS(cfg))
+	target, _ := config.target()
+	p.backend = NewSupervisor(config, target, http.DefaultTransport)
+	if err := p.backend.Start(context.Background()); err != nil {
+		t.Fatalf("start backend: %v", err)
+	}
+	t.Cleanup(func() { p.backend.Stop() })
+
+	server := httptest.NewUnstartedServer(p.handler(target, http.DefaultTransport))
+	server.TLS = p.tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(devices.cert)
+	post := func(certPath, keyPath string) error {
+		t.Helper()
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if certPath != "" {
+			cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Sent even when its issuer is not one the proxy asks for
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Post(server.URL+"/fdo/101/msg/60", "application/cbor", nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := post(deviceCert, deviceKey); err != nil {
+		t.Fatalf("post with device certificate: %v", err)
+	}
+	for _, peer := range []*Peer{requestPeer, responsePeer} {
+		if peer == nil {
+			t.Fatal("expected a verified peer")
+		}
+		if peer.CommonName != "device-0001" {
+			t.Errorf("expected common name device-0001, got %q", peer.CommonName)
+		}
+		if !strings.Contains(peer.Subject, "O=Example Devices") {
+			t.Errorf("expected organization in subject, got %q", peer.Subject)
+		}
+		if len(peer.Fingerprint) != 64 {
+			t.Errorf("expected a SHA-256 hex fingerprint, got %q", peer.Fingerprint)
+		}
+	}
+
+	// Without a certificate the device is served, with no peer
+	if err := post("", ""); err != nil {
+		t.Fatalf("post without certificate: %v", err)
+	}
+	if requestPeer != nil || responsePeer != nil {
+		t.Errorf("expected no peer without a certificate, got %+v", requestPeer)
+	}
+
+	// A certificate from another CA fails the handshake
+	if err := post(strangerCert, strangerKey); err == nil {
+		t.Error("expected a certificate from another CA to be refused")
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/fdo-server-wrapper/internal/trace"
+)
+
+// sessionSpanKey stores the span grouping a session's round trips.
+type sessionSpanKey struct{}
+
+// sessionSpan returns the span every round trip of s is parented on,
+// starting it with the session's first message. A traceparent header on
+// that message becomes its parent. It returns nil when tracing is off.
+func sessionSpan(s *Session, r *http.Request, msgType MessageType) *trace.Span {
+	if span, ok := s.Value(sessionSpanKey{}).(*trace.Span); ok {
+		return span
+	}
+	opts := []trace.SpanOption{trace.WithAttributes("fdo.protocol", msgType.Protocol().String())}
+	if parent, ok := trace.Extract(r.Header); ok {
+		opts = append(opts, trace.WithParent(parent))
+	}
+	_, span := trace.Start(context.Background(), "FDO "+msgType.Protocol().String()+" session", opts...)
+	if span != nil {
+		s.Set(sessionSpanKey{}, span)
+	}
+	return span
+}
+
+// endSessionSpan finishes the session's span, if it has one, at end.
+func endSessionSpan(s *Session, end time.Time, reason string) {
+	span, ok := s.Value(sessionSpanKey{}).(*trace.Span)
+	if !ok {
+		return
+	}
+	span.SetAttributes("fdo.messages", len(s.History()), "fdo.session_end", reason)
+	if guid := s.GUID(); guid != "" {
+		span.SetAttributes("fdo.guid", guid)
+	}
+	span.EndAt(end)
+}
+
+// startMessageSpan starts the server span for one FDO round trip.
+func startMessageSpan(ctx context.Context, r *http.Request, session *Session, info MessageInfo) (context.Context, *trace.Span) {
+	return trace.Start(ctx, "FDO "+metricType(info.Type),
+		trace.WithKind(trace.KindServer),
+		trace.WithParent(sessionSpan(session, r, info.Type).Context()),
+		trace.WithAttributes(
+			"fdo.msg_type", metricType(info.Type),
+			"fdo.protocol_version", info.Version,
+			"http.route", r.URL.Path))
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/fdo-server-wrapper/internal/trace"
+)
+
+// recordingExporter keeps exported spans for assertions.
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []trace.SpanData
+}
+
+func (e *recordingExporter) Export(ctx context.Context, spans []trace.SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) named(name string) []trace.SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var out []trace.SpanData
+	for _, s := range e.spans {
+		if s.Name == name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func TestFDOProxy_Tracing(t *testing.T) {
+	exp := &recordingExporter{}
+	tracer := trace.NewTracer(exp)
+	trace.SetDefault(tracer)
+	t.Cleanup(func() { trace.SetDefault(nil) })
+
+	var mu sync.Mutex
+	var backendParents []string
+	backend := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			return // readiness probe
+		}
+		mu.Lock()
+		backendParents = append(backendParents, r.Header.Get(trace.TraceparentHeader))
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/fdo/101/msg/60":
+			w.Header().Set("Authorization", "Bearer session-token")
+			w.Header().Set("Message-Type", "61")
+		case "/fdo/101/msg/70":
+			w.Header().Set("Message-Type", "71")
+		}
+		w.Write([]byte{0x80})
+	}
+	server := startTestProxy(t, backend, &funcMiddleware{types: []MessageType{MsgTO2HelloDevice, MsgTO2Done}})
+
+	remote := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	send := func(msgType int, header http.Header) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/fdo/101/msg/"+strconv.Itoa(msgType), bytes.NewReader([]byte{0x80}))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+	}
+	send(60, http.Header{"Traceparent": {remote}})
+	send(70, http.Header{"Authorization": {"Bearer session-token"}})
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sessions := exp.named("FDO TO2 session")
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session span, got %d", len(sessions))
+	}
+	session := sessions[0]
+	remoteSC, _ := trace.ParseTraceparent(remote)
+	if session.Context.TraceID != remoteSC.TraceID || session.Parent != remoteSC.SpanID {
+		t.Errorf("expected session span parented on the incoming traceparent, got trace %s parent %s", session.Context.TraceID, session.Parent)
+	}
+
+	for _, name := range []string{"FDO TO2.HelloDevice", "FDO TO2.Done"} {
+		spans := exp.named(name)
+		if len(spans) != 1 {
+			t.Fatalf("expected 1 %s span, got %d", name, len(spans))
+		}
+		msg := spans[0]
+		if msg.Context.TraceID != session.Context.TraceID || msg.Parent != session.Context.SpanID {
+			t.Errorf("expected %s in the session span, got trace %s parent %s", name, msg.Context.TraceID, msg.Parent)
+		}
+		if msg.Kind != trace.KindServer {
+			t.Errorf("expected server span, got kind %d", msg.Kind)
+		}
+
+		var children []string
+		for _, s := range exp.spans {
+			if s.Parent == msg.Context.SpanID {
+				children = append(children, s.Name)
+			}
+		}
+		if len(children) != 2 {
+			t.Errorf("expected middleware and backend spans under %s, got %v", name, children)
+		}
+	}
+
+	backendSpans := append(exp.named("backend TO2.HelloDevice"), exp.named("backend TO2.Done")...)
+	if len(backendSpans) != 2 || len(backendParents) != 2 {
+		t.Fatalf("expected 2 backend spans and requests, got %d and %d", len(backendSpans), len(backendParents))
+	}
+	for i, s := range backendSpans {
+		if expected := s.Context.Traceparent(); backendParents[i] != expected {
+			t.Errorf("expected backend to receive traceparent %s, got %q", expected, backendParents[i])
+		}
+	}
+}
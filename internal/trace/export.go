@@ -0,0 +1,194 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exporter sends batches of finished spans somewhere.
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+// DefaultOTLPEndpoint is where an OpenTelemetry collector listens for
+// OTLP/HTTP traces by default.
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// scopeName identifies the proxy as the instrumentation scope.
+const scopeName = "github.com/fdo-server-wrapper"
+
+// WriterExporter writes each batch as one line of OTLP/JSON, the format an
+// OpenTelemetry collector's otlpjsonfile receiver reads.
+type WriterExporter struct {
+	service string
+	mu      sync.Mutex
+	w       io.Writer
+}
+
+// NewWriterExporter returns an exporter writing to w for service.
+func NewWriterExporter(w io.Writer, service string) *WriterExporter {
+	return &WriterExporter{w: w, service: service}
+}
+
+// Export writes spans as a single line.
+func (e *WriterExporter) Export(ctx context.Context, spans []SpanData) error {
+	b, err := encodeOTLP(e.service, spans)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("write spans: %w", err)
+	}
+	return nil
+}
+
+// OTLPExporter posts batches as OTLP/JSON to a collector's OTLP/HTTP
+// traces endpoint.
+type OTLPExporter struct {
+	service string
+	url     string
+	http    *http.Client
+}
+
+// NewOTLPExporter returns an exporter posting to url for service. A url
+// without a path gets the standard /v1/traces.
+func NewOTLPExporter(url, service string) *OTLPExporter {
+	if i := strings.Index(url, "://"); i >= 0 && !strings.Contains(url[i+3:], "/") {
+		url += "/v1/traces"
+	}
+	return &OTLPExporter{
+		service: service,
+		url:     url,
+		http:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Export posts spans in one request.
+func (e *OTLPExporter) Export(ctx context.Context, spans []SpanData) error {
+	b, err := encodeOTLP(e.service, spans)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("build OTLP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("post spans: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("post spans: collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// OTLP/JSON message shapes (opentelemetry-proto ExportTraceServiceRequest).
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              Kind           `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 1 ok, 2 error
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"` // int64 as a JSON string
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+func encodeOTLP(service string, spans []SpanData) ([]byte, error) {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		out[i] = otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Parent.IsValid() {
+			out[i].ParentSpanID = s.Parent.String()
+		}
+		if s.Error {
+			out[i].Status = otlpStatus{Code: 2, Message: s.StatusMessage}
+		}
+	}
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{{Key: "service.name", Value: service}})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: out}},
+	}}}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encode spans: %w", err)
+	}
+	return b, nil
+}
+
+func otlpAttributes(attrs []Attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch val := a.Value.(type) {
+		case bool:
+			v.BoolValue = &val
+		case int64:
+			s := strconv.FormatInt(val, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &val
+		default:
+			s := fmt.Sprint(val)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: a.Key, Value: v})
+	}
+	return kvs
+}
@@ -0,0 +1,110 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSpans() []SpanData {
+	start := time.Unix(1700000000, 0)
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	return []SpanData{{
+		Name:          "FDO TO2.Done",
+		Kind:          KindServer,
+		Context:       SpanContext{TraceID: sc.TraceID, SpanID: SpanID{1, 2, 3, 4, 5, 6, 7, 8}, Sampled: true},
+		Parent:        sc.SpanID,
+		Start:         start,
+		End:           start.Add(time.Second),
+		Attributes:    []Attribute{{Key: "fdo.guid", Value: "191e886b"}, {Key: "http.status_code", Value: int64(200)}, {Key: "retry", Value: true}},
+		Error:         true,
+		StatusMessage: "boom",
+	}}
+}
+
+func TestEncodeOTLP(t *testing.T) {
+	b, err := encodeOTLP("fdo-proxy", testSpans())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"fdo-proxy"}}]},` +
+		`"scopeSpans":[{"scope":{"name":"github.com/fdo-server-wrapper"},"spans":[{` +
+		`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736","spanId":"0102030405060708","parentSpanId":"00f067aa0ba902b7",` +
+		`"name":"FDO TO2.Done","kind":2,"startTimeUnixNano":"1700000000000000000","endTimeUnixNano":"1700000001000000000",` +
+		`"attributes":[{"key":"fdo.guid","value":{"stringValue":"191e886b"}},{"key":"http.status_code","value":{"intValue":"200"}},{"key":"retry","value":{"boolValue":true}}],` +
+		`"status":{"code":2,"message":"boom"}}]}]}]}`
+	if string(b) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b)
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exp := NewWriterExporter(&buf, "fdo-proxy")
+	for i := 0; i < 2; i++ {
+		if err := exp.Export(context.Background(), testSpans()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("expected a JSON line, got %q", line)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		path      string
+		expectErr bool
+	}{
+		{name: "accepted", status: http.StatusOK},
+		{name: "default path", status: http.StatusOK, path: "-"},
+		{name: "collector error", status: http.StatusServiceUnavailable, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPath, gotType string
+			var body []byte
+			collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath, gotType = r.URL.Path, r.Header.Get("Content-Type")
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(tt.status)
+			}))
+			defer collector.Close()
+
+			url := collector.URL + "/v1/traces"
+			if tt.path == "-" {
+				url = collector.URL
+			}
+			err := NewOTLPExporter(url, "fdo-proxy").Export(context.Background(), testSpans())
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error %v, got %v", tt.expectErr, err)
+			}
+			if gotPath != "/v1/traces" {
+				t.Errorf("expected path /v1/traces, got %q", gotPath)
+			}
+			if gotType != "application/json" {
+				t.Errorf("expected JSON content type, got %q", gotType)
+			}
+			if !bytes.Contains(body, []byte(`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`)) {
+				t.Errorf("expected span in body, got %s", body)
+			}
+		})
+	}
+}
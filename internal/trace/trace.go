@@ -0,0 +1,493 @@
+// Package trace records spans for FDO round trips, middleware and passport
+// service calls, propagates W3C trace context, and exports finished spans
+// as OTLP/JSON to a collector or a JSON-lines file.
+//
+// The proxy's packages start spans through the process-wide tracer set with
+// SetDefault. Until one is set, Start returns a nil *Span and every Span
+// method is a no-op, so instrumented code never checks whether tracing is on.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceparentHeader is the W3C trace context request header.
+const TraceparentHeader = "traceparent"
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id is not all zeros.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id is not all zeros.
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// SpanContext is what travels between processes in a traceparent header.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether both IDs are set.
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value. Versions other than
+// 00 are accepted as long as they start with the version 00 fields.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, fmt.Errorf("malformed traceparent %q", s)
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, fmt.Errorf("malformed traceparent %q", s)
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("malformed traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("traceparent trace ID: %w", err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("traceparent span ID: %w", err)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, fmt.Errorf("traceparent flags: %w", err)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("traceparent %q has a zero ID", s)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Extract returns the span context in h's traceparent header, if valid.
+func Extract(h http.Header) (SpanContext, bool) {
+	v := h.Get(TraceparentHeader)
+	if v == "" {
+		return SpanContext{}, false
+	}
+	sc, err := ParseTraceparent(v)
+	if err != nil {
+		slog.Debug("Ignoring traceparent", "error", err)
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+// Inject sets h's traceparent header to the span in ctx. It does nothing
+// when ctx carries no span.
+func Inject(ctx context.Context, h http.Header) {
+	if s := SpanFromContext(ctx); s != nil {
+		h.Set(TraceparentHeader, s.sc.Traceparent())
+	}
+}
+
+// Kind is the role of a span, numbered as in OTLP.
+type Kind int
+
+const (
+	// KindInternal is work within the proxy, such as a middleware call.
+	KindInternal Kind = iota + 1
+	// KindServer is a request the proxy answers.
+	KindServer
+	// KindClient is a request the proxy makes.
+	KindClient
+)
+
+// Attribute is a span attribute. Value is a string, bool, int64 or float64.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// SpanData is a finished span as handed to an Exporter.
+type SpanData struct {
+	Name          string
+	Kind          Kind
+	Context       SpanContext
+	Parent        SpanID
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	Error         bool
+	StatusMessage string
+}
+
+// Span is an operation being timed. All methods are safe on a nil Span.
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// Context returns the span's identity, or the zero SpanContext for nil.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttributes records key/value pairs given alternately, as with slog.
+// Values other than strings, bools and numbers are formatted with %v.
+func (s *Span) SetAttributes(kv ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = appendAttributes(s.data.Attributes, kv)
+}
+
+// SetError marks the span failed with err's message. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = true
+	s.data.StatusMessage = err.Error()
+}
+
+// End finishes the span now.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt finishes the span at t and queues it for export. Later calls are
+// ignored.
+func (s *Span) EndAt(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = t
+	data := s.data
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.tracer.enqueue(data)
+	}
+}
+
+func appendAttributes(attrs []Attribute, kv []any) []Attribute {
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		var v any
+		switch val := kv[i+1].(type) {
+		case string, bool, int64, float64:
+			v = val
+		case int:
+			v = int64(val)
+		case uint64:
+			v = int64(val)
+		case time.Duration:
+			v = val.String()
+		case fmt.Stringer:
+			v = val.String()
+		default:
+			v = fmt.Sprint(val)
+		}
+		replaced := false
+		for j := range attrs {
+			if attrs[j].Key == key {
+				attrs[j].Value, replaced = v, true
+				break
+			}
+		}
+		if !replaced {
+			attrs = append(attrs, Attribute{Key: key, Value: v})
+		}
+	}
+	return attrs
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a context carrying s as the current span.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SpanOption customizes a span started with Start.
+type SpanOption func(*spanConfig)
+
+type spanConfig struct {
+	kind   Kind
+	parent SpanContext
+	attrs  []any
+}
+
+// WithKind sets the span kind; the default is KindInternal.
+func WithKind(k Kind) SpanOption {
+	return func(c *spanConfig) { c.kind = k }
+}
+
+// WithParent parents the span on sc instead of the span in the context,
+// for example a remote parent from an incoming traceparent header.
+func WithParent(sc SpanContext) SpanOption {
+	return func(c *spanConfig) { c.parent = sc }
+}
+
+// WithAttributes sets initial attributes, given as with SetAttributes.
+func WithAttributes(kv ...any) SpanOption {
+	return func(c *spanConfig) { c.attrs = append(c.attrs, kv...) }
+}
+
+// Default tracing configuration.
+const (
+	DefaultQueueSize     = 2048
+	DefaultBatchSize     = 512
+	DefaultFlushInterval = 2 * time.Second
+)
+
+// Tracer starts spans and exports them in batches from a background
+// goroutine.
+type Tracer struct {
+	exporter Exporter
+
+	queue   chan SpanData
+	flush   chan chan struct{}
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	mu     sync.RWMutex // guards closing queue
+	closed bool
+}
+
+// NewTracer returns a tracer exporting through exp. Call Shutdown to flush
+// the spans still queued.
+func NewTracer(exp Exporter) *Tracer {
+	t := &Tracer{
+		exporter: exp,
+		queue:    make(chan SpanData, DefaultQueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start begins a span named name, a child of the span in ctx unless
+// WithParent says otherwise, and returns a context carrying it. A nil
+// Tracer returns ctx unchanged and a nil Span.
+func (t *Tracer) Start(ctx context.Context, name string, opts ...SpanOption) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	cfg := spanConfig{kind: KindInternal}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	parent := cfg.parent
+	if !parent.IsValid() {
+		parent = SpanFromContext(ctx).Context()
+	}
+
+	sc := SpanContext{SpanID: newSpanID(), Sampled: true}
+	if parent.IsValid() {
+		sc.TraceID, sc.Sampled = parent.TraceID, parent.Sampled
+	} else {
+		sc.TraceID = newTraceID()
+	}
+	s := &Span{
+		tracer: t,
+		sc:     sc,
+		data: SpanData{
+			Name:       name,
+			Kind:       cfg.kind,
+			Context:    sc,
+			Parent:     parent.SpanID,
+			Start:      time.Now(),
+			Attributes: appendAttributes(nil, cfg.attrs),
+		},
+	}
+	return ContextWithSpan(ctx, s), s
+}
+
+// Dropped returns how many spans were discarded because the export queue
+// was full.
+func (t *Tracer) Dropped() uint64 { return t.dropped.Load() }
+
+func (t *Tracer) enqueue(data SpanData) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- data:
+	default:
+		if t.dropped.Add(1) == 1 {
+			slog.Warn("Trace export queue full, dropping spans")
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(DefaultFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, DefaultBatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			slog.Warn("Failed to export spans", "spans", len(batch), "error", err)
+		}
+		cancel()
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case data, ok := <-t.queue:
+			if !ok {
+				export()
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= DefaultBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case ack := <-t.flush:
+			for drained := false; !drained; {
+				select {
+				case data := <-t.queue:
+					batch = append(batch, data)
+				default:
+					drained = true
+				}
+			}
+			export()
+			close(ack)
+		}
+	}
+}
+
+// ForceFlush exports every span queued so far.
+func (t *Tracer) ForceFlush(ctx context.Context) error {
+	t.mu.RLock()
+	closed := t.closed
+	t.mu.RUnlock()
+	if closed {
+		return nil
+	}
+	ack := make(chan struct{})
+	select {
+	case t.flush <- ack:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting spans and exports those queued, waiting until
+// ctx is done. Spans ended afterwards are discarded.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return fmt.Errorf("flush spans: %w", ctx.Err())
+	}
+	if n := t.dropped.Load(); n > 0 {
+		slog.Warn("Spans dropped because the export queue was full", "dropped", n)
+	}
+	return nil
+}
+
+var defaultTracer atomic.Pointer[Tracer]
+
+// SetDefault makes t the tracer used by Start. A nil t turns tracing off.
+func SetDefault(t *Tracer) {
+	defaultTracer.Store(t)
+}
+
+// Default returns the tracer set with SetDefault, or nil.
+func Default() *Tracer {
+	return defaultTracer.Load()
+}
+
+// Start begins a span with the default tracer; see Tracer.Start.
+func Start(ctx context.Context, name string, opts ...SpanOption) (context.Context, *Span) {
+	return Default().Start(ctx, name, opts...)
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
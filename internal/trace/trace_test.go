@@ -0,0 +1,192 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingExporter keeps exported spans for assertions.
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (e *recordingExporter) Export(ctx context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) byName(name string) (SpanData, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range e.spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return SpanData{}, false
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        string
+		expectErr     bool
+		expectSampled bool
+	}{
+		{name: "sampled", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", expectSampled: true},
+		{name: "not sampled", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{name: "future version with extra fields", header: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", expectSampled: true},
+		{name: "version 00 with extra fields", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", expectErr: true},
+		{name: "invalid version", header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", expectErr: true},
+		{name: "zero trace ID", header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", expectErr: true},
+		{name: "zero span ID", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", expectErr: true},
+		{name: "short trace ID", header: "00-4bf92f3577b34da6-00f067aa0ba902b7-01", expectErr: true},
+		{name: "not hex", header: "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", expectErr: true},
+		{name: "empty", header: "", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseTraceparent(tt.header)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error %v, got %v", tt.expectErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if sc.Sampled != tt.expectSampled {
+				t.Errorf("expected sampled %v, got %v", tt.expectSampled, sc.Sampled)
+			}
+			if got := sc.TraceID.String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Errorf("unexpected trace ID %s", got)
+			}
+		})
+	}
+}
+
+func TestTraceparent_RoundTrip(t *testing.T) {
+	exp := &recordingExporter{}
+	tracer := NewTracer(exp)
+	defer tracer.Shutdown(context.Background())
+
+	ctx, span := tracer.Start(context.Background(), "outgoing")
+	h := make(http.Header)
+	Inject(ctx, h)
+	sc, ok := Extract(h)
+	if !ok {
+		t.Fatalf("expected traceparent in %v", h)
+	}
+	if sc != span.Context() {
+		t.Errorf("expected %+v, got %+v", span.Context(), sc)
+	}
+
+	h = make(http.Header)
+	Inject(context.Background(), h)
+	if got := h.Get(TraceparentHeader); got != "" {
+		t.Errorf("expected no traceparent without a span, got %q", got)
+	}
+}
+
+func TestTracer_Spans(t *testing.T) {
+	exp := &recordingExporter{}
+	tracer := NewTracer(exp)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := tracer.Start(context.Background(), "root", WithParent(remote), WithKind(KindServer), WithAttributes("fdo.msg_type", "TO2.HelloDevice"))
+	_, child := tracer.Start(ctx, "child", WithAttributes("attempt", 1))
+	child.SetAttributes("attempt", 2, "ok", false)
+	child.SetError(context.DeadlineExceeded)
+	child.End()
+	child.End() // ignored
+	root.End()
+
+	_, unsampled := tracer.Start(context.Background(), "unsampled", WithParent(SpanContext{TraceID: remote.TraceID, SpanID: remote.SpanID}))
+	unsampled.End()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, ok := exp.byName("root")
+	if !ok {
+		t.Fatal("expected root span exported")
+	}
+	if r.Context.TraceID != remote.TraceID || r.Parent != remote.SpanID {
+		t.Errorf("expected root parented on the remote span, got trace %s parent %s", r.Context.TraceID, r.Parent)
+	}
+	if r.Kind != KindServer {
+		t.Errorf("expected server kind, got %d", r.Kind)
+	}
+
+	c, ok := exp.byName("child")
+	if !ok {
+		t.Fatal("expected child span exported")
+	}
+	if c.Context.TraceID != remote.TraceID || c.Parent != r.Context.SpanID {
+		t.Errorf("expected child of root, got trace %s parent %s", c.Context.TraceID, c.Parent)
+	}
+	if !c.Error || c.StatusMessage != context.DeadlineExceeded.Error() {
+		t.Errorf("expected error status, got %v %q", c.Error, c.StatusMessage)
+	}
+	expectedAttrs := []Attribute{{Key: "attempt", Value: int64(2)}, {Key: "ok", Value: false}}
+	if len(c.Attributes) != len(expectedAttrs) {
+		t.Fatalf("expected attributes %v, got %v", expectedAttrs, c.Attributes)
+	}
+	for i, a := range expectedAttrs {
+		if c.Attributes[i] != a {
+			t.Errorf("expected attribute %v, got %v", a, c.Attributes[i])
+		}
+	}
+
+	if _, ok := exp.byName("unsampled"); ok {
+		t.Error("expected unsampled span not to be exported")
+	}
+	exp.mu.Lock()
+	n := len(exp.spans)
+	exp.mu.Unlock()
+	if n != 2 {
+		t.Errorf("expected 2 spans exported, got %d", n)
+	}
+}
+
+func TestTracer_ForceFlush(t *testing.T) {
+	exp := &recordingExporter{}
+	tracer := NewTracer(exp)
+	defer tracer.Shutdown(context.Background())
+
+	_, span := tracer.Start(context.Background(), "flushed")
+	span.EndAt(time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tracer.ForceFlush(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := exp.byName("flushed"); !ok {
+		t.Error("expected span exported by ForceFlush")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "noop")
+	if span != nil {
+		t.Fatalf("expected nil span, got %+v", span)
+	}
+	if SpanFromContext(ctx) != nil {
+		t.Error("expected no span in context")
+	}
+	// Span methods are no-ops on nil
+	span.SetAttributes("k", "v")
+	span.SetError(context.Canceled)
+	span.End()
+	if span.Context().IsValid() {
+		t.Error("expected invalid span context")
+	}
+}